@@ -11,6 +11,30 @@ type Options struct {
 	Machine   bool // Display machine parseable output
 	BlockSize uint
 	Metadata  string
+
+	// Generation at which to view the filesystem, 0 for the latest
+	Generation uint64
+
+	// Device images as ID=PATH or PATH, in addition to the ones given as
+	// arguments
+	Devices []string
+
+	// GNU ddrescue mapfiles of the images as ID=PATH, or PATH if there is a
+	// single image
+	Mapfiles []string
+
+	// Volume in the images that holds the filesystem, either a partition
+	// number or a byte offset. Zero for the whole image.
+	Partition int
+	Offset    uint64
+
+	// File with the passphrase of LUKS containers, - for stdin. Prompt
+	// for it if empty.
+	KeyFile string
+
+	// LVM2 logical volume holding the filesystem as VG/NAME, if the
+	// volume is a physical volume
+	LV string
 }
 
 var Global Options
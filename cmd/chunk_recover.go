@@ -0,0 +1,110 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Sub-command to rebuild a lost chunk tree
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"blichmann.eu/code/btrfscue/cmd/btrfscue/app"
+	cliutil "blichmann.eu/code/btrfscue/cmd/btrfscue/app/util"
+	"blichmann.eu/code/btrfscue/pkg/btrfs"
+	"blichmann.eu/code/btrfscue/pkg/btrfs/index"
+)
+
+type chunkRecoverOptions struct {
+	dryRun bool
+}
+
+func init() {
+	options := chunkRecoverOptions{}
+	chunkRecoverCmd := &cobra.Command{
+		Use:   "chunk-recover",
+		Short: "rebuild chunk items from dev extents and block groups",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(app.Global.Metadata) == 0 {
+				cliutil.Fatalf("missing metadata option\n")
+			}
+			doChunkRecover(app.Global.Metadata, options)
+		},
+	}
+
+	fs := chunkRecoverCmd.PersistentFlags()
+	fs.BoolVarP(&options.dryRun, "dry-run", "n", false, "only show the "+
+		"rebuilt chunks, do not add them to the metadata")
+
+	rootCmd.AddCommand(chunkRecoverCmd)
+}
+
+func stripesString(m *btrfs.ChunkMapping) string {
+	stripes := make([]string, len(m.Stripes))
+	for i, s := range m.Stripes {
+		stripes[i] = fmt.Sprintf("%d:%d", s.DevID, s.Offset)
+	}
+	return strings.Join(stripes, ",")
+}
+
+// chunkRecover rebuilds chunk items, lists them and, unless dryRun is set,
+// adds the ones that are not yet known to the index. Conflicts are reported
+// as warnings. Returns the number of chunks added.
+func chunkRecover(w io.Writer, ix *index.Index, dryRun bool) (int, error) {
+	chunks, conflicts := ix.RecoverChunks()
+	for _, err := range conflicts {
+		cliutil.Warnf("%s\n", err)
+	}
+	ss := ix.SectorSize()
+	tw := tabwriter.NewWriter(w, 1, 4, 1, ' ', 0)
+	fmt.Fprintf(tw, "LOGICAL\tLENGTH\tTYPE\tGEN\tSTRIPES\tSTATUS\n")
+	numAdded := 0
+	for _, c := range chunks {
+		status := "known"
+		if !c.Known {
+			status = "new"
+			if c.Unverified {
+				status = "unverified"
+				cliutil.Warnf("chunk at %d: stripe order of %s chunk is "+
+					"unknown, assuming device order\n", c.Logical,
+					btrfs.ProfileString(c.Type))
+			}
+			if !dryRun {
+				if err := ix.InsertChunk(c.ChunkMapping, c.Generation,
+					ss); err != nil {
+					return numAdded, err
+				}
+				numAdded++
+			}
+		}
+		fmt.Fprintf(tw, "%d\t%d\t%s|%s\t%d\t%s\t%s\n", c.Logical, c.Length,
+			btrfs.BlockGroupTypeString(c.Type), btrfs.ProfileString(c.Type),
+			c.Generation, stripesString(&c.ChunkMapping), status)
+	}
+	return numAdded, tw.Flush()
+}
+
+func doChunkRecover(metadata string, options chunkRecoverOptions) {
+	var ix *index.Index
+	var err error
+	if options.dryRun {
+		ix, err = openIndexReadOnly(metadata)
+	} else {
+		ix, err = index.OpenForUpdate(metadata, indexGeneration())
+	}
+	cliutil.ReportError(err)
+	defer ix.Close()
+
+	numAdded, err := chunkRecover(os.Stdout, ix, options.dryRun)
+	cliutil.ReportError(err)
+	if !options.dryRun {
+		cliutil.ReportError(ix.Commit())
+		cliutil.Verbosef("added %d chunk items\n", numAdded)
+	}
+}
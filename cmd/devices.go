@@ -0,0 +1,263 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Opening the images of multi-device filesystems
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"blichmann.eu/code/btrfscue/cmd/btrfscue/app"
+	cliutil "blichmann.eu/code/btrfscue/cmd/btrfscue/app/util"
+	"blichmann.eu/code/btrfscue/pkg/btrfs"
+	"blichmann.eu/code/btrfscue/pkg/btrfs/index"
+	"blichmann.eu/code/btrfscue/pkg/ddrescue"
+	"blichmann.eu/code/btrfscue/pkg/uuid"
+)
+
+// deviceImage is an image of a filesystem device given on the command-line.
+type deviceImage struct {
+	devID uint64 // 0 if it needs to be determined from the image
+	path  string
+}
+
+// parseDeviceImages parses device images given as ID=PATH or PATH. Plain
+// paths may contain '=' if they do not start with a number.
+func parseDeviceImages(specs []string) ([]deviceImage, error) {
+	images := make([]deviceImage, 0, len(specs))
+	for _, s := range specs {
+		img := deviceImage{path: s}
+		if i := strings.IndexByte(s, '='); i > 0 {
+			if id, err := strconv.ParseUint(s[:i], 10, 64); err == nil {
+				if id == 0 {
+					return nil, fmt.Errorf("invalid device id in '%s'", s)
+				}
+				img = deviceImage{id, s[i+1:]}
+			}
+		}
+		if img.path == "" {
+			return nil, fmt.Errorf("missing path in device '%s'", s)
+		}
+		images = append(images, img)
+	}
+	return images, nil
+}
+
+// imageDevID determines the BTRFS device id of an image from the first of
+// its superblock copies that belongs to the filesystem fsid. The UUID in the
+// superblock's dev_item is matched against the device items in ix, if any.
+// Otherwise, the device id from the dev_item is used.
+func imageDevID(ix *index.Index, r io.ReaderAt, devSize uint64,
+	fsid uuid.UUID) (uint64, bool) {
+	for _, s := range readSuperblocks(r, devSize) {
+		if s == nil || !fsid.IsZero() && s.TreeFSID() != fsid {
+			continue
+		}
+		if ix != nil {
+			devUUID := s.DevItem().UUID()
+			for r, d := ix.DevItems(); r.HasNext(); d = r.Next() {
+				if d.UUID() == devUUID {
+					return d.DevID(), true
+				}
+			}
+		}
+		return s.DevItem().DevID(), true
+	}
+	return 0, false
+}
+
+// openedDevice is an opened device image.
+type openedDevice struct {
+	devID uint64
+	path  string
+	img   *image
+	size  uint64
+}
+
+// openDeviceImages opens the given images and determines their device ids.
+// If there is only a single image and its device id cannot be determined, it
+// gets index.AnyDevice. fsid may be zero to accept any filesystem. ix may be
+// nil.
+func openDeviceImages(ix *index.Index, fsid uuid.UUID,
+	images []deviceImage) ([]openedDevice, error) {
+	var devs []openedDevice
+	closeAll := func() {
+		for _, d := range devs {
+			d.img.Close()
+		}
+	}
+	seen := make(map[uint64]string)
+	for _, img := range images {
+		f, err := openImage(img.path)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		d := openedDevice{img.devID, img.path, f, uint64(f.Size())}
+		devs = append(devs, d)
+		if d.devID == 0 {
+			var ok bool
+			if d.devID, ok = imageDevID(ix, f, d.size, fsid); !ok {
+				if len(images) > 1 {
+					closeAll()
+					return nil, fmt.Errorf("cannot determine device id of "+
+						"%s, use --device ID=PATH", img.path)
+				}
+				d.devID = index.AnyDevice
+			}
+			devs[len(devs)-1].devID = d.devID
+		}
+		if other, ok := seen[d.devID]; ok {
+			closeAll()
+			return nil, fmt.Errorf("%s and %s both hold device %d", other,
+				img.path, d.devID)
+		}
+		seen[d.devID] = img.path
+		cliutil.Verbosef("using %s as device %s\n", img.path,
+			devIDString(d.devID))
+	}
+	return devs, nil
+}
+
+// applyMapfiles reads the ddrescue mapfiles given as ID=PATH or PATH and
+// restricts reads of the matching images to the areas that were rescued. A
+// mapfile without device id is only valid if there is a single image.
+func applyMapfiles(devs []openedDevice, specs []string) error {
+	mapfiles, err := parseDeviceImages(specs)
+	if err != nil {
+		return err
+	}
+	applied := make(map[*openedDevice]bool)
+	for _, mf := range mapfiles {
+		var d *openedDevice
+		for i := range devs {
+			if devs[i].devID == mf.devID || len(devs) == 1 &&
+				(mf.devID == 0 || devs[i].devID == index.AnyDevice) {
+				d = &devs[i]
+				break
+			}
+		}
+		if d == nil {
+			if mf.devID == 0 {
+				return fmt.Errorf("mapfile %s needs a device id, use "+
+					"--mapfile ID=PATH", mf.path)
+			}
+			return fmt.Errorf("no image for device %d of mapfile %s",
+				mf.devID, mf.path)
+		}
+		if applied[d] {
+			return fmt.Errorf("more than one mapfile for %s", d.path)
+		}
+		applied[d] = true
+		m, err := ddrescue.Open(mf.path)
+		if err != nil {
+			return err
+		}
+		if bad := m.Unreadable(d.img.offset, d.img.size); len(bad) > 0 {
+			var size uint64
+			for _, b := range bad {
+				size += b.Size
+			}
+			cliutil.Verbosef("%s: %d bytes in %d areas were not rescued\n",
+				d.path, size, len(bad))
+		}
+		if err := d.img.applyMapfile(m); err != nil {
+			return fmt.Errorf("%s: %w", d.path, err)
+		}
+	}
+	return nil
+}
+
+func devIDString(devID uint64) string {
+	if devID == index.AnyDevice {
+		return "any"
+	}
+	return fmt.Sprint(devID)
+}
+
+// openDevices opens the images given as arguments and with --device and
+// maps them by device id. The returned function closes all images. If no
+// images are given, the device map is nil.
+func openDevices(ix *index.Index, args []string) (index.Devices, func()) {
+	images, err := parseDeviceImages(append(append([]string(nil),
+		app.Global.Devices...), args...))
+	cliutil.ReportError(err)
+	opened, err := openDeviceImages(ix, ix.Metadata().FSID(), images)
+	cliutil.ReportError(err)
+	cliutil.ReportError(applyMapfiles(opened, app.Global.Mapfiles))
+	if len(opened) == 0 {
+		return nil, func() {}
+	}
+	devs := make(index.Devices, len(opened))
+	for _, d := range opened {
+		devs[d.devID] = d.img
+	}
+	return devs, func() {
+		for _, d := range opened {
+			d.img.Close()
+		}
+	}
+}
+
+// checkDevices warns about devices that chunks refer to, but for which no
+// image was given, and about chunks that cannot be read completely because
+// of that.
+func checkDevices(ix *index.Index, devs index.Devices) {
+	if devs == nil {
+		return
+	}
+	warned := make(map[uint64]bool)
+	incomplete := 0
+	for _, m := range ix.ChunkMap().Chunks() {
+		missing := make([]bool, len(m.Stripes))
+		numMissing := 0
+		for i, s := range m.Stripes {
+			if _, err := devs.Device(s.DevID); err != nil {
+				missing[i] = true
+				numMissing++
+				if !warned[s.DevID] {
+					warned[s.DevID] = true
+					cliutil.Warnf("no image for device %d\n", s.DevID)
+				}
+			}
+		}
+		if !chunkReadable(&m, missing, numMissing) {
+			incomplete++
+		}
+	}
+	if incomplete > 0 {
+		cliutil.Warnf("data in %d chunks will be missing\n", incomplete)
+	}
+}
+
+// chunkReadable returns whether all data of a chunk can be read with the
+// stripes marked in missing being unavailable.
+func chunkReadable(m *btrfs.ChunkMapping, missing []bool,
+	numMissing int) bool {
+	if p := m.ParityStripes(); p > 0 {
+		// Parity makes up for missing devices in RAID5 and RAID6 chunks
+		return numMissing <= p
+	}
+	// Groups of consecutive stripes hold copies of the same data
+	copies := 1
+	switch {
+	case m.Profile() == btrfs.BlockGroupRaid10 && m.SubStripes > 0:
+		copies = int(m.SubStripes)
+	case m.NumMirrors() > 1:
+		copies = len(m.Stripes)
+	}
+	for i := 0; i < len(missing); i += copies {
+		available := false
+		for j := i; j < i+copies && j < len(missing); j++ {
+			available = available || !missing[j]
+		}
+		if !available {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,63 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+package cmd
+
+import (
+	"reflect"
+	"testing"
+
+	"blichmann.eu/code/btrfscue/pkg/btrfs"
+)
+
+func TestParseDeviceImages(t *testing.T) {
+	images, err := parseDeviceImages([]string{"disk0.img", "2=disk1.img",
+		"a=b.img"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []deviceImage{{0, "disk0.img"}, {2, "disk1.img"},
+		{0, "a=b.img"}}
+	if !reflect.DeepEqual(images, expected) {
+		t.Errorf("expected %v, actual %v", expected, images)
+	}
+	for _, spec := range []string{"0=disk.img", "1="} {
+		if _, err := parseDeviceImages([]string{spec}); err == nil {
+			t.Errorf("%s: expected error", spec)
+		}
+	}
+}
+
+func TestChunkReadable(t *testing.T) {
+	for _, tc := range []struct {
+		profile  uint64
+		missing  []bool
+		expected bool
+	}{
+		{0, []bool{true}, false},
+		{btrfs.BlockGroupRaid0, []bool{false, true}, false},
+		{btrfs.BlockGroupRaid1, []bool{false, true}, true},
+		{btrfs.BlockGroupRaid1, []bool{true, true}, false},
+		{btrfs.BlockGroupRaid1C3, []bool{true, false, true}, true},
+		{btrfs.BlockGroupRaid10, []bool{true, false, false, true}, true},
+		{btrfs.BlockGroupRaid10, []bool{true, true, false, false}, false},
+		{btrfs.BlockGroupRaid5, []bool{false, true, false}, true},
+		{btrfs.BlockGroupRaid5, []bool{true, true, false}, false},
+		{btrfs.BlockGroupRaid6, []bool{true, true, false, false}, true},
+	} {
+		m := btrfs.ChunkMapping{Type: tc.profile, SubStripes: 2,
+			Stripes: make([]btrfs.ChunkStripe, len(tc.missing))}
+		numMissing := 0
+		for _, b := range tc.missing {
+			if b {
+				numMissing++
+			}
+		}
+		if actual := chunkReadable(&m, tc.missing,
+			numMissing); actual != tc.expected {
+			t.Errorf("%s %v: expected %t, actual %t",
+				btrfs.ProfileString(tc.profile), tc.missing, tc.expected,
+				actual)
+		}
+	}
+}
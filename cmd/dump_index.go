@@ -10,12 +10,17 @@ import (
 
 	"blichmann.eu/code/btrfscue/cmd/btrfscue/app"
 	cliutil "blichmann.eu/code/btrfscue/cmd/btrfscue/app/util"
-	"blichmann.eu/code/btrfscue/pkg/btrfs/index"
+	"blichmann.eu/code/btrfscue/pkg/btrfs"
 
 	"github.com/spf13/cobra"
 )
 
+type dumpIndexOptions struct {
+	nodes bool
+}
+
 func init() {
+	options := dumpIndexOptions{}
 	dumpIndexCmd := &cobra.Command{
 		Use:   "dump-index",
 		Short: "for debugging, dump the index in text format",
@@ -24,20 +29,27 @@ func init() {
 			if len(app.Global.Metadata) == 0 {
 				cliutil.Fatalf("missing metadata option\n")
 			}
-			doDumpIndex(app.Global.Metadata)
+			doDumpIndex(app.Global.Metadata, options)
 		},
 	}
 
+	fs := dumpIndexCmd.PersistentFlags()
+	fs.BoolVar(&options.nodes, "nodes", false,
+		"also dump internal tree nodes and their key pointers")
+
 	rootCmd.AddCommand(dumpIndexCmd)
 }
 
-func doDumpIndex(metadata string) {
-	ix, err := index.OpenReadOnly(metadata)
+func doDumpIndex(metadata string, options dumpIndexOptions) {
+	ix, err := openIndexReadOnly(metadata)
 	cliutil.ReportError(err)
 	defer ix.Close()
 
 	last := ^uint64(0)
 	for r, v := ix.FullRange(); r.HasNext(); v = r.Next() {
+		if r.Generation() > ix.Generation {
+			continue
+		}
 		if o := r.Owner(); o != last {
 			fmt.Printf("owner %d\n", o)
 			last = o
@@ -46,4 +58,21 @@ func doDumpIndex(metadata string) {
 		fmt.Printf("%s @ %d\n", k, r.Generation())
 		_ = v
 	}
+
+	if !options.nodes {
+		return
+	}
+	cliutil.ReportError(ix.ForEachNode(func(n btrfs.Node) error {
+		h := n.Header()
+		if h.Generation() > ix.Generation {
+			return nil
+		}
+		fmt.Printf("node %d @ %d owner %s level %d\n", h.ByteNr(),
+			h.Generation(), btrfs.ObjectIDString(h.Owner()), h.Level())
+		for _, p := range n.KeyPtrs() {
+			fmt.Printf("\t%s -> %d @ %d\n", p.Key(), p.BlockPtr(),
+				p.Generation())
+		}
+		return nil
+	}))
 }
@@ -0,0 +1,27 @@
+//go:build linux
+
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Turning off terminal echo for passphrase prompts
+
+package cmd
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// disableEcho turns off echo if fd is a terminal and returns a function
+// that restores the previous settings, or nil if nothing was changed.
+func disableEcho(fd int) func() {
+	t, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return nil
+	}
+	old := *t
+	t.Lflag &^= unix.ECHO
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, t); err != nil {
+		return nil
+	}
+	return func() { unix.IoctlSetTermios(fd, unix.TCSETS, &old) }
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Stub for platforms where passphrases are read with echo
+
+package cmd
+
+func disableEcho(fd int) func() { return nil }
@@ -0,0 +1,244 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Sub-command to show and extract all recorded versions of a file
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"blichmann.eu/code/btrfscue/cmd/btrfscue/app"
+	cliutil "blichmann.eu/code/btrfscue/cmd/btrfscue/app/util"
+	"blichmann.eu/code/btrfscue/pkg/btrfs"
+	"blichmann.eu/code/btrfscue/pkg/btrfs/index"
+)
+
+type historyOptions struct {
+	extract string
+}
+
+func init() {
+	options := historyOptions{}
+	historyCmd := &cobra.Command{
+		Use:   "history [DEV/IMAGE...] PATH",
+		Short: "show all versions of a file found in the metadata",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(app.Global.Metadata) == 0 {
+				cliutil.Fatalf("missing metadata option\n")
+			}
+			doHistory(args, app.Global.Metadata, options)
+		},
+	}
+
+	fs := historyCmd.PersistentFlags()
+	fs.StringVar(&options.extract, "extract", "", "extract every version "+
+		"of the file into this directory as NAME.gen<N>")
+
+	rootCmd.AddCommand(historyCmd)
+}
+
+// fileHistory holds all recorded versions of a single path.
+type fileHistory struct {
+	owner uint64
+	name  string
+
+	// Versions of the directory entries for name
+	entries []index.ItemVersion
+	// Inodes that name referred to, in order of first appearance
+	inodes []uint64
+	// Inodes that name referred to as a regular file
+	files map[uint64]bool
+}
+
+// findParent returns the owner and directory id of the directory that holds
+// the last component of a clean path.
+func findParent(ix *index.Index, p string) (owner, dirID uint64, ok bool) {
+	owner, dirID = btrfs.FSTreeObjectID, btrfs.FirstFreeObjectID
+	if dir := path.Dir(p); dir != "/" {
+		di := ix.FindDirItemForPath(owner, dir)
+		if di == nil || !(di.IsDir() || di.IsSubvolume()) {
+			return 0, 0, false
+		}
+		if di.IsSubvolume() {
+			owner = di.Location().ObjectID
+		} else {
+			dirID = di.Location().ObjectID
+		}
+	}
+	return owner, dirID, true
+}
+
+// findHistory collects all versions of the directory entries for a path.
+// Entries are recorded both by name hash and by directory index, the
+// latter helps to find entries that were deleted and recreated.
+func findHistory(ix *index.Index, p string) (*fileHistory, error) {
+	owner, dirID, ok := findParent(ix, p)
+	if !ok {
+		return nil, fmt.Errorf("cannot lookup '%s': No such directory", p)
+	}
+	h := &fileHistory{owner: owner, name: path.Base(p),
+		files: make(map[uint64]bool)}
+	seen := make(map[uint64]bool)
+	collect := func(v index.ItemVersion) error {
+		di := btrfs.DirItem(v.Item.Data())
+		if di.Name() != h.name {
+			return nil
+		}
+		h.entries = append(h.entries, v)
+		if inode := di.Location().ObjectID; !di.IsSubvolume() &&
+			!seen[inode] {
+			seen[inode] = true
+			h.inodes = append(h.inodes, inode)
+		}
+		if di.Type() == btrfs.FtRegFile {
+			h.files[di.Location().ObjectID] = true
+		}
+		return nil
+	}
+	hash := uint64(index.NameHash(h.name))
+	if err := ix.ForEachVersion(owner, index.KF(btrfs.DirItemKey, dirID,
+		hash), index.KL(btrfs.DirItemKey, dirID, hash), collect); err != nil {
+		return nil, err
+	}
+	if err := ix.ForEachVersion(owner, index.KF(btrfs.DirIndexKey, dirID),
+		index.KL(btrfs.DirIndexKey, dirID), collect); err != nil {
+		return nil, err
+	}
+	if len(h.entries) == 0 {
+		return nil, fmt.Errorf("cannot lookup '%s': No such file or "+
+			"directory", p)
+	}
+	return h, nil
+}
+
+func fileExtentString(e btrfs.FileExtentItem) (size uint64, details string) {
+	switch e.Type() {
+	case btrfs.FileExtentInline:
+		return e.RAMBytes(), "inline"
+	case btrfs.FileExtentPreAlloc:
+		return e.NumBytes(), "prealloc"
+	}
+	if e.DiskByteNr() == 0 {
+		return e.NumBytes(), "hole"
+	}
+	return e.NumBytes(), fmt.Sprintf("disk %d+%d offset %d", e.DiskByteNr(),
+		e.DiskNumBytes(), e.Offset())
+}
+
+// listHistory writes a table of all versions of the directory entries,
+// inodes and file extents of a path.
+func listHistory(w io.Writer, ix *index.Index, h *fileHistory) error {
+	tw := tabwriter.NewWriter(w, 1, 4, 1, ' ', 0)
+	fmt.Fprintf(tw, "GEN\tITEM\tSIZE\tMTIME\tDETAILS\n")
+	for _, v := range h.entries {
+		di := btrfs.DirItem(v.Item.Data())
+		fmt.Fprintf(tw, "%d\t%s\t-\t-\t%s %s -> %d\n", v.Generation,
+			btrfs.KeyTypeString(v.Key.Type), dirItemTypeString(di.Type()),
+			di.Name(), di.Location().ObjectID)
+	}
+	for _, inode := range h.inodes {
+		for _, v := range ix.History(h.owner, index.KF(btrfs.InodeItemKey,
+			inode)) {
+			ii := btrfs.InodeItem(v.Item.Data())
+			if len(ii) < btrfs.InodeItemLen {
+				continue
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%d\t%s\tinode %d %s\n", v.Generation,
+				btrfs.KeyTypeString(v.Key.Type), ii.Size(),
+				shortTime(ii.Mtime()), inode, inodeModeString(ii.Mode()))
+		}
+		if err := ix.ForEachVersion(h.owner, index.KF(btrfs.ExtentDataKey,
+			inode), index.KL(btrfs.ExtentDataKey, inode),
+			func(v index.ItemVersion) error {
+				e := btrfs.FileExtentItem(v.Item.Data())
+				size, details := fileExtentString(e)
+				fmt.Fprintf(tw, "%d\t%s\t%d\t-\tinode %d at %d, %s\n",
+					v.Generation, btrfs.KeyTypeString(v.Key.Type), size,
+					inode, v.Key.Offset, details)
+				return nil
+			}); err != nil {
+			return err
+		}
+	}
+	return tw.Flush()
+}
+
+// fileGenerations returns the generations in ascending order at which the
+// inode item or any of the file extents of an inode changed.
+func fileGenerations(ix *index.Index, owner, inode uint64) []uint64 {
+	seen := make(map[uint64]bool)
+	var gens []uint64
+	add := func(v index.ItemVersion) error {
+		if !seen[v.Generation] {
+			seen[v.Generation] = true
+			gens = append(gens, v.Generation)
+		}
+		return nil
+	}
+	ix.ForEachVersion(owner, index.KF(btrfs.InodeItemKey, inode),
+		index.KL(btrfs.InodeItemKey, inode), add)
+	ix.ForEachVersion(owner, index.KF(btrfs.ExtentDataKey, inode),
+		index.KL(btrfs.ExtentDataKey, inode), add)
+	sort.Slice(gens, func(i, j int) bool { return gens[i] < gens[j] })
+	return gens
+}
+
+// extractHistory recovers every version of a file into destDir, one file
+// per generation. Each version is restored from an index view at its
+// generation.
+func extractHistory(ix *index.Index, devs index.Devices, h *fileHistory,
+	destDir string) error {
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return err
+	}
+	defer func(gen uint64) { ix.Generation = gen }(ix.Generation)
+	for _, inode := range h.inodes {
+		if !h.files[inode] {
+			continue
+		}
+		for _, gen := range fileGenerations(ix, h.owner, inode) {
+			ix.Generation = gen
+			target := filepath.Join(destDir, fmt.Sprintf("%s.gen%d", h.name,
+				gen))
+			if err := recoverFile(ix, devs, h.owner, inode, target,
+				recoverFilesOptions{}); err != nil {
+				cliutil.Warnf("failed to extract %s: %v\n", target, err)
+			}
+		}
+	}
+	return nil
+}
+
+func doHistory(args []string, metadata string, options historyOptions) {
+	ix, err := openIndexReadOnly(metadata)
+	cliutil.ReportError(err)
+	defer ix.Close()
+
+	devs, closeDevs := openDevices(ix, args[:len(args)-1])
+	defer closeDevs()
+	if devs == nil && options.extract != "" {
+		cliutil.Warnf("no device file given, only inline file data will be " +
+			"extracted\n")
+	}
+
+	p := path.Clean("/" + args[len(args)-1])
+	if p == "/" {
+		cliutil.Fatalf("cannot show history of the root directory\n")
+	}
+	h, err := findHistory(ix, p)
+	cliutil.ReportError(err)
+	cliutil.ReportError(listHistory(os.Stdout, ix, h))
+	if options.extract != "" {
+		cliutil.ReportError(extractHistory(ix, devs, h, options.extract))
+	}
+}
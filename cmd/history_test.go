@@ -0,0 +1,122 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"blichmann.eu/code/btrfscue/pkg/btrfs"
+	"blichmann.eu/code/btrfscue/pkg/btrfs/index"
+	"blichmann.eu/code/btrfscue/pkg/uuid"
+)
+
+func TestHistory(t *testing.T) {
+	td, err := ioutil.TempDir("", "btrfscue_history_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	metadataPath := filepath.Join(td, "metadata.db")
+	fsid := uuid.UUID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	ix, err := index.Open(metadataPath, 0644, &index.Options{
+		BlockSize:  4096,
+		FSID:       fsid,
+		Generation: ^uint64(0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	insert := func(k btrfs.Key, generation uint64, data []byte) {
+		h := makeHeader(btrfs.FSTreeObjectID, generation, fsid)
+		if err := ix.InsertItem(k, h, makeItem(k, 0, uint32(len(data))),
+			data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// file.txt was deleted after generation 3 and recreated with a new
+	// inode at generation 8.
+	for _, v := range []struct {
+		inode, generation uint64
+		content           string
+	}{{257, 1, "first"}, {257, 3, "second"}, {260, 8, "third!"}} {
+		insert(btrfs.Key{ObjectID: btrfs.FirstFreeObjectID,
+			Type: btrfs.DirIndexKey, Offset: v.inode}, v.generation,
+			makeDirItem(btrfs.Key{ObjectID: v.inode,
+				Type: btrfs.InodeItemKey}, btrfs.FtRegFile, "file.txt"))
+		size := uint64(len(v.content))
+		if v.generation == 3 {
+			size += 5
+		}
+		insert(btrfs.Key{ObjectID: v.inode, Type: btrfs.InodeItemKey},
+			v.generation, makeInodeItem(size, 0100644))
+		insert(btrfs.Key{ObjectID: v.inode, Type: btrfs.ExtentDataKey},
+			v.generation, makeInlineFileExtentItem([]byte(v.content)))
+	}
+	// The file grew at generation 3
+	tailKey := btrfs.Key{ObjectID: 257, Type: btrfs.ExtentDataKey,
+		Offset: 6}
+	insert(tailKey, 3, makeInlineFileExtentItem([]byte("+tail")))
+	insert(btrfs.Key{ObjectID: btrfs.FirstFreeObjectID,
+		Type: btrfs.DirIndexKey, Offset: 258}, 2,
+		makeDirItem(btrfs.Key{ObjectID: 258, Type: btrfs.InodeItemKey},
+			btrfs.FtRegFile, "other.txt"))
+	ix.Close()
+
+	if ix, err = index.OpenReadOnly(metadataPath); err != nil {
+		t.Fatal(err)
+	}
+	defer ix.Close()
+	h, err := findHistory(ix, "/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.entries) != 3 || len(h.inodes) != 2 {
+		t.Fatalf("expected 3 entries for 2 inodes, got %d for %d",
+			len(h.entries), len(h.inodes))
+	}
+
+	var out bytes.Buffer
+	if err = listHistory(&out, ix, h); err != nil {
+		t.Fatal(err)
+	}
+	// Header, 3 directory entries, 3 inode items and 4 extents
+	if n := strings.Count(out.String(), "\n"); n != 11 {
+		t.Errorf("expected 11 lines of output, got %d:\n%s", n, out.String())
+	}
+
+	destDir := filepath.Join(td, "history")
+	if err = extractHistory(ix, nil, h, destDir); err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]string{
+		"file.txt.gen1": "first",
+		"file.txt.gen3": "second+tail",
+		"file.txt.gen8": "third!",
+	} {
+		data, err := ioutil.ReadFile(filepath.Join(destDir, name))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if string(data) != expected {
+			t.Errorf("%s: expected '%s', got '%s'", name, expected, data)
+		}
+	}
+	if ix.Generation != ^uint64(0) {
+		t.Error("expected index generation to be restored")
+	}
+	ix.Generation = 1
+	if ix.FindItem(btrfs.FSTreeObjectID, tailKey) != nil {
+		t.Error("expected no extent at offset 6 at generation 1")
+	}
+	ix.Generation = ^uint64(0)
+
+	if _, err = findHistory(ix, "/missing.txt"); err == nil {
+		t.Error("expected error for missing file")
+	}
+}
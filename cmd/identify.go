@@ -7,7 +7,10 @@ package cmd
 
 import (
 	"blichmann.eu/code/btrfscue/cmd/btrfscue/app"
+	cliutil "blichmann.eu/code/btrfscue/cmd/btrfscue/app/util"
 	"blichmann.eu/code/btrfscue/internal/identify"
+	"blichmann.eu/code/btrfscue/pkg/diskimage"
+	"blichmann.eu/code/btrfscue/pkg/partition"
 
 	"github.com/spf13/cobra"
 )
@@ -20,7 +23,7 @@ func init() {
 		Args:  cobra.ExactArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
 			options.BlockSize = app.Global.BlockSize
-			identify.IdentifyFS(args[0], options)
+			doIdentify(args[0], options)
 		},
 	}
 
@@ -36,3 +39,30 @@ func init() {
 
 	rootCmd.AddCommand(identifyCmd)
 }
+
+// doIdentify lists the partitions of a disk image, if it has any, and the
+// containers and logical volumes in the selected volume. Then it samples the
+// innermost volume for filesystem ids.
+func doIdentify(path string, options identify.IdentifyFSOptions) {
+	f, err := diskimage.Open(path)
+	cliutil.ReportError(err)
+	defer f.Close()
+	if f.Format() != diskimage.FormatRaw {
+		cliutil.Verbosef("%s: reading %s image\n", path, f.Format())
+	}
+	size := f.Size()
+
+	off, volSize, err := selectVolume(path, f, uint64(size))
+	cliutil.ReportError(err)
+	if volSize == uint64(size) {
+		if t, err := partition.Read(f, uint64(size)); err == nil {
+			cliutil.ReportError(identify.IdentifyPartitions(f, t, options))
+		} else if err != partition.ErrNoTable {
+			cliutil.Warnf("%s: %s\n", path, err)
+		}
+	}
+	img := &image{disk: f, offset: off, size: volSize, describe: &options}
+	cliutil.ReportError(img.openLayers(path))
+	cliutil.ReportError(img.stack(f))
+	identify.IdentifyFS(img.SectionReader, options)
+}
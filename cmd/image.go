@@ -0,0 +1,276 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Opening disk images and selecting the volume holding the filesystem
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"blichmann.eu/code/btrfscue/cmd/btrfscue/app"
+	cliutil "blichmann.eu/code/btrfscue/cmd/btrfscue/app/util"
+	"blichmann.eu/code/btrfscue/internal/identify"
+	"blichmann.eu/code/btrfscue/pkg/ddrescue"
+	"blichmann.eu/code/btrfscue/pkg/diskimage"
+	"blichmann.eu/code/btrfscue/pkg/luks"
+	"blichmann.eu/code/btrfscue/pkg/lvm"
+	"blichmann.eu/code/btrfscue/pkg/partition"
+)
+
+// image is an opened disk or filesystem image. Reads are restricted to the
+// volume selected with --partition or --offset. If the volume is a LUKS
+// container, reads are decrypted, and if it is an LVM2 physical volume,
+// they are mapped to the logical volume selected with --lv.
+type image struct {
+	*io.SectionReader
+	disk   diskimage.Image // Virtual disk of the image file
+	offset uint64          // Of the volume on the disk
+	size   uint64          // Of the volume
+	layers []layer         // Containers around the filesystem, outermost first
+
+	// Print the containers found and probe logical volumes with these
+	// options, for identify
+	describe *identify.IdentifyFSOptions
+}
+
+// layer returns the volume stored inside of vol.
+type layer func(vol *io.SectionReader) (*io.SectionReader, error)
+
+// openImage opens the image at path and selects the volume in it. qcow2,
+// VMDK and VHDX images are read through to their virtual disk, LUKS
+// containers are unlocked.
+func openImage(path string) (*image, error) {
+	disk, err := diskimage.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if disk.Format() != diskimage.FormatRaw {
+		cliutil.Verbosef("%s: reading %s image\n", path, disk.Format())
+	}
+	size := uint64(disk.Size())
+	off, volSize, err := selectVolume(path, disk, size)
+	if err != nil {
+		disk.Close()
+		return nil, err
+	}
+	if volSize == size {
+		checkPartitionTable(path, disk, size)
+	}
+	img := &image{disk: disk, offset: off, size: volSize}
+	if err := img.openLayers(path); err != nil {
+		disk.Close()
+		return nil, err
+	}
+	if err := img.stack(disk); err != nil {
+		disk.Close()
+		return nil, err
+	}
+	return img, nil
+}
+
+func (img *image) Close() error { return img.disk.Close() }
+
+// openLayers finds the containers around the filesystem in the volume.
+// LUKS containers are unlocked and the logical volume selected with --lv
+// is mapped, in whatever order they are nested.
+func (img *image) openLayers(path string) error {
+	vol := io.NewSectionReader(img.disk, int64(img.offset), int64(img.size))
+	lvName := app.Global.LV
+	for {
+		l, err := img.openLUKS(path, vol)
+		if err == nil && l == nil {
+			l, err = img.openLV(path, vol, lvName)
+			if l != nil {
+				lvName = ""
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if l == nil {
+			break
+		}
+		img.layers = append(img.layers, l)
+		if vol, err = l(vol); err != nil {
+			return err
+		}
+	}
+	if lvName != "" {
+		return fmt.Errorf("%s: no LVM2 physical volume with logical volume "+
+			"%s", path, lvName)
+	}
+	return nil
+}
+
+// openLUKS recovers the volume key if vol is a LUKS container.
+func (img *image) openLUKS(path string, vol *io.SectionReader) (layer,
+	error) {
+	h, err := luks.ReadHeader(vol)
+	if errors.Is(err, luks.ErrNotLUKS) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if img.describe != nil {
+		// Before prompting for the passphrase
+		fmt.Printf("LUKS%d container %s, cipher %s, key slots %s\n",
+			h.Version, h.UUID, h.Cipher,
+			strings.Trim(fmt.Sprint(h.KeySlots()), "[]"))
+	} else {
+		cliutil.Verbosef("%s: LUKS%d container %s\n", path, h.Version,
+			h.UUID)
+	}
+	key, err := unlockLUKS(path, vol, h)
+	if err != nil {
+		return nil, err
+	}
+	return func(vol *io.SectionReader) (*io.SectionReader, error) {
+		lr, err := luks.NewReader(vol, vol.Size(), h, key)
+		if err != nil {
+			return nil, err
+		}
+		return io.NewSectionReader(lr, 0, lr.Size()), nil
+	}, nil
+}
+
+// openLV maps the logical volume name, given as VG/NAME, if vol is an LVM2
+// physical volume. Without a name, the logical volumes are listed instead.
+func (img *image) openLV(path string, vol *io.SectionReader, name string) (
+	layer, error) {
+	vg, pv, err := lvm.ReadVolumeGroup(vol)
+	if errors.Is(err, lvm.ErrNotLVM) {
+		return nil, nil
+	} else if err != nil {
+		if name == "" && img.describe == nil {
+			cliutil.Verbosef("%s: %s\n", path, err)
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if name == "" {
+		if img.describe != nil {
+			return nil, identify.IdentifyLogicalVolumes(vol, vg, pv,
+				*img.describe)
+		}
+		if len(vg.LVs) > 0 {
+			cliutil.Warnf("%s is an LVM2 physical volume of volume group %s, "+
+				"use --lv %s/NAME to select the logical volume with the "+
+				"filesystem\n", path, vg.Name, vg.Name)
+		}
+		return nil, nil
+	}
+	vgName, lvName, _ := strings.Cut(name, "/")
+	if vgName != vg.Name {
+		return nil, fmt.Errorf("%s: physical volume of volume group %s, not "+
+			"%s", path, vg.Name, vgName)
+	}
+	lv := vg.LV(lvName)
+	if lv == nil {
+		var names []string
+		for _, l := range vg.LVs {
+			if l.Visible {
+				names = append(names, l.Name)
+			}
+		}
+		return nil, fmt.Errorf("%s: no logical volume %s in volume group "+
+			"%s, it has %s", path, lvName, vg.Name, strings.Join(names, ", "))
+	}
+	for _, p := range lv.PVs() {
+		if p != pv {
+			cliutil.Warnf("%s: %s is partly stored on physical volume %s "+
+				"(%s), reads of that part fail\n", path, name, p.Name,
+				p.Device)
+		}
+	}
+	cliutil.Verbosef("%s: using logical volume %s of %d bytes\n", path, name,
+		lv.Size())
+	if _, err := lvm.NewReader(lv, nil); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return func(vol *io.SectionReader) (*io.SectionReader, error) {
+		r, err := lvm.NewReader(lv, map[string]io.ReaderAt{pv.UUID: vol})
+		if err != nil {
+			return nil, err
+		}
+		return io.NewSectionReader(r, 0, r.Size()), nil
+	}, nil
+}
+
+// stack sets up reading the volume from r, which holds the whole disk.
+func (img *image) stack(r io.ReaderAt) error {
+	vol := io.NewSectionReader(r, int64(img.offset), int64(img.size))
+	for _, l := range img.layers {
+		var err error
+		if vol, err = l(vol); err != nil {
+			return err
+		}
+	}
+	img.SectionReader = vol
+	return nil
+}
+
+// applyMapfile makes reads of areas of the image that m does not list as
+// rescued fail. Mapfile positions refer to the whole disk.
+func (img *image) applyMapfile(m *ddrescue.Mapfile) error {
+	return img.stack(ddrescue.NewReaderAt(img.disk, m))
+}
+
+// selectVolume returns the offset and size of the volume selected with
+// --partition or --offset in an image of the given size. Without either,
+// this is the whole image.
+func selectVolume(path string, r io.ReaderAt, size uint64) (uint64, uint64,
+	error) {
+	part, off := app.Global.Partition, app.Global.Offset
+	switch {
+	case part > 0 && off > 0:
+		return 0, 0, fmt.Errorf("partition and offset options are " +
+			"mutually exclusive")
+	case part > 0:
+		t, err := partition.Read(r, size)
+		if err != nil {
+			return 0, 0, fmt.Errorf("%s: %w", path, err)
+		}
+		p, ok := t.Partition(part)
+		if !ok {
+			return 0, 0, fmt.Errorf("%s: no partition %d", path, part)
+		}
+		if p.Start >= size {
+			return 0, 0, fmt.Errorf("%s: %s starts beyond the end of the "+
+				"image", path, p)
+		}
+		if p.Start+p.Size > size {
+			cliutil.Warnf("%s: image ends within %s\n", path, p)
+			p.Size = size - p.Start
+		}
+		cliutil.Verbosef("%s: using %s at offset %d\n", path, p, p.Start)
+		return p.Start, p.Size, nil
+	case off > 0:
+		if off >= size {
+			return 0, 0, fmt.Errorf("%s: offset %d beyond the end of the "+
+				"image", path, off)
+		}
+		return off, size - off, nil
+	}
+	return 0, size, nil
+}
+
+// checkPartitionTable warns if a whole image is used that has a partition
+// table, but no superblock at its start.
+func checkPartitionTable(path string, r io.ReaderAt, size uint64) {
+	t, err := partition.Read(r, size)
+	if err != nil {
+		if !errors.Is(err, partition.ErrNoTable) {
+			cliutil.Verbosef("%s: %s\n", path, err)
+		}
+		return
+	}
+	if readSuperblocks(r, size)[0] == nil {
+		cliutil.Warnf("%s has a %s partition table, use --partition N or "+
+			"--offset BYTES to select the volume with the filesystem\n",
+			path, t.Scheme)
+	}
+}
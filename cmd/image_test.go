@@ -0,0 +1,51 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Tests for selecting volumes in disk images
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"blichmann.eu/code/btrfscue/cmd/btrfscue/app"
+)
+
+func TestSelectVolume(t *testing.T) {
+	const size = 1 << 20
+	disk := make([]byte, size)
+	// MBR with a single Linux partition at sector 2048
+	e := disk[446:]
+	e[4] = 0x83
+	binary.LittleEndian.PutUint32(e[8:], 1024)
+	binary.LittleEndian.PutUint32(e[12:], 512)
+	disk[510], disk[511] = 0x55, 0xaa
+	r := bytes.NewReader(disk)
+	defer func() { app.Global.Partition, app.Global.Offset = 0, 0 }()
+
+	for _, tc := range []struct {
+		partition     int
+		offset        uint64
+		start, length uint64
+		ok            bool
+	}{
+		{0, 0, 0, size, true},
+		{1, 0, 1024 * 512, 512 * 512, true},
+		{2, 0, 0, 0, false},
+		{0, 4096, 4096, size - 4096, true},
+		{0, size, 0, 0, false},
+		{1, 4096, 0, 0, false},
+	} {
+		app.Global.Partition, app.Global.Offset = tc.partition, tc.offset
+		start, length, err := selectVolume("disk", r, size)
+		if (err == nil) != tc.ok {
+			t.Errorf("partition %d, offset %d: unexpected error %v",
+				tc.partition, tc.offset, err)
+		} else if start != tc.start || length != tc.length {
+			t.Errorf("partition %d, offset %d: unexpected volume [%d, +%d)",
+				tc.partition, tc.offset, start, length)
+		}
+	}
+}
@@ -149,7 +149,7 @@ func doListFiles(args []string, metadata string, options listFilesOptions) {
 		args = append(args, "/")
 	}
 
-	ix, err := index.OpenReadOnly(app.Global.Metadata)
+	ix, err := openIndexReadOnly(metadata)
 	cliutil.ReportError(err)
 	defer ix.Close()
 
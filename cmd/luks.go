@@ -0,0 +1,105 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Unlocking LUKS containers with a key file or passphrase
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"blichmann.eu/code/btrfscue/cmd/btrfscue/app"
+	cliutil "blichmann.eu/code/btrfscue/cmd/btrfscue/app/util"
+	"blichmann.eu/code/btrfscue/pkg/luks"
+)
+
+// Number of times to prompt for the passphrase of a container
+const maxPassphraseTries = 3
+
+var (
+	// Passphrases that opened a container, tried first on the next ones
+	passphrases [][]byte
+	// Contents of the key file, read only once
+	keyFileData []byte
+
+	stdin = bufio.NewReader(os.Stdin)
+)
+
+// unlockLUKS returns the volume key of the LUKS container r. It uses the
+// key file if one was given and prompts for the passphrase otherwise.
+func unlockLUKS(path string, r io.ReaderAt, h *luks.Header) ([]byte,
+	error) {
+	if app.Global.KeyFile != "" {
+		pass, err := readKeyFile(app.Global.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		key, err := h.Unlock(r, pass)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return key, nil
+	}
+	for _, pass := range passphrases {
+		if key, err := h.Unlock(r, pass); err == nil {
+			return key, nil
+		}
+	}
+	for i := 0; i < maxPassphraseTries; i++ {
+		pass, err := readPassphrase(fmt.Sprintf("Enter passphrase for %s: ",
+			path))
+		if err != nil {
+			return nil, err
+		}
+		key, err := h.Unlock(r, pass)
+		if err == nil {
+			passphrases = append(passphrases, pass)
+			return key, nil
+		}
+		if !errors.Is(err, luks.ErrWrongPassphrase) {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		cliutil.Warnf("%s: %s\n", path, err)
+	}
+	return nil, fmt.Errorf("%s: %w", path, luks.ErrWrongPassphrase)
+}
+
+// readKeyFile returns the contents of the key file, all of which are used
+// as the passphrase.
+func readKeyFile(path string) ([]byte, error) {
+	if keyFileData != nil {
+		return keyFileData, nil
+	}
+	var err error
+	if path == "-" {
+		keyFileData, err = io.ReadAll(stdin)
+	} else {
+		keyFileData, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read key file: %w", err)
+	}
+	return keyFileData, nil
+}
+
+// readPassphrase prompts for a passphrase on stderr and reads a line from
+// stdin, without echo if it is a terminal.
+func readPassphrase(prompt string) ([]byte, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	if restore := disableEcho(int(os.Stdin.Fd())); restore != nil {
+		defer func() {
+			restore()
+			fmt.Fprintln(os.Stderr)
+		}()
+	}
+	line, err := stdin.ReadBytes('\n')
+	if err != nil && (err != io.EOF || len(line) == 0) {
+		return nil, fmt.Errorf("cannot read passphrase: %w", err)
+	}
+	return bytes.TrimSuffix(line, []byte("\n")), nil
+}
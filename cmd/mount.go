@@ -17,14 +17,13 @@ import (
 	"blichmann.eu/code/btrfscue/cmd/btrfscue/app"
 	cliutil "blichmann.eu/code/btrfscue/cmd/btrfscue/app/util"
 	"blichmann.eu/code/btrfscue/internal/rescuefs"
-	"blichmann.eu/code/btrfscue/pkg/btrfs/index"
 )
 
 func init() {
 	mountCmd := &cobra.Command{
-		Use:   "mount",
+		Use:   "mount [DEV/IMAGE...] MOUNTPOINT",
 		Short: "provide a 'rescue' filesystem backed by metadata",
-		Args:  cobra.RangeArgs(1, 2),
+		Args:  cobra.MinimumNArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
 			if len(app.Global.Metadata) == 0 {
 				cliutil.Fatalf("missing metadata option\n")
@@ -37,26 +36,20 @@ func init() {
 }
 
 func doMountRescueFS(args []string, metadata string) {
-	ix, err := index.OpenReadOnly(metadata)
+	ix, err := openIndexReadOnly(metadata)
 	cliutil.ReportError(err)
 	defer ix.Close()
 
 	mountPoint := args[len(args)-1]
-	var dev *os.File
-	defer func() {
-		if dev != nil {
-			dev.Close()
-		}
-	}()
-	if len(args) == 2 {
-		dev, err = os.Open(args[0])
-		cliutil.ReportError(err)
-	} else {
+	devs, closeDevs := openDevices(ix, args[:len(args)-1])
+	defer closeDevs()
+	if devs == nil {
 		cliutil.Warnf("no device file given, only inline file data will be " +
 			"visible\n")
 	}
+	checkDevices(ix, devs)
 
-	fs := rescuefs.New(app.Global.Metadata, ix, dev)
+	fs := rescuefs.New(app.Global.Metadata, ix, devs)
 	cliutil.ReportError(fs.Mount(mountPoint))
 	cliutil.Verbosef("mounted rescue FS on %s\n", mountPoint)
 	go fs.Serve()
@@ -6,8 +6,13 @@
 package cmd
 
 import (
+	"errors"
+	"fmt"
 	"io"
 	"os"
+	"runtime"
+	"sort"
+	"sync/atomic"
 
 	"github.com/cheggaaa/pb/v3"
 	"github.com/spf13/cobra"
@@ -15,101 +20,574 @@ import (
 	"blichmann.eu/code/btrfscue/cmd/btrfscue/app"
 	cliutil "blichmann.eu/code/btrfscue/cmd/btrfscue/app/util"
 	"blichmann.eu/code/btrfscue/pkg/btrfs"
+	"blichmann.eu/code/btrfscue/pkg/btrfs/csum"
 	"blichmann.eu/code/btrfscue/pkg/btrfs/index"
+	"blichmann.eu/code/btrfscue/pkg/ddrescue"
 	"blichmann.eu/code/btrfscue/pkg/ioutil"
 	"blichmann.eu/code/btrfscue/pkg/uuid"
 )
 
+// Ways to deal with leaves that fail checksum verification
+const (
+	badCSumFlag   = "flag"   // Index, but record the mismatch
+	badCSumReject = "reject" // Do not index
+)
+
 type scanFSOptions struct {
-	id     uuid.UUID
-	append bool
+	id      uuid.UUID
+	append  bool
+	csum    string
+	badCSum string
+	jobs    int
+	resume  bool
+	walk    bool
 }
 
 func init() {
 	options := scanFSOptions{}
 	reconCmd := &cobra.Command{
-		Use:   "recon",
+		Use:   "recon [DEV/IMAGE...]",
 		Short: "gather metadata for later use",
-		Args:  cobra.ExactArgs(1),
+		Args:  cobra.ArbitraryArgs,
 		Run: func(cmd *cobra.Command, args []string) {
 			if len(app.Global.Metadata) == 0 {
 				cliutil.Fatalf("missing metadata option\n")
 			}
-			doScanFS(args[0], app.Global.Metadata, options)
+			doScanFS(args, app.Global.Metadata, options)
 		},
 	}
 
 	fs := reconCmd.PersistentFlags()
 	fs.Var(&options.id, "id", "UUID of the filesystem (see identify)")
 	fs.BoolVar(&options.append, "append", false, "append to metadata file")
+	fs.BoolVar(&options.resume, "resume", false, "resume an interrupted "+
+		"scan of the same images")
+	fs.StringVar(&options.csum, "csum", "auto", "checksum algorithm, one of "+
+		"auto, crc32c, xxhash64, sha256, blake2b")
+	fs.StringVar(&options.badCSum, "bad-csum", badCSumFlag, "how to handle "+
+		"leaves with checksum mismatches: 'flag' to index and record them, "+
+		"'reject' to skip them")
+	fs.IntVarP(&options.jobs, "jobs", "j", runtime.NumCPU(), "number of "+
+		"parallel block readers")
+	fs.BoolVar(&options.walk, "walk", false, "walk the trees from the "+
+		"superblock roots instead of scanning the whole images. Only the "+
+		"chunks of blocks that cannot be read are scanned")
 
 	rootCmd.AddCommand(reconCmd)
 }
 
-func doScanFS(filename, metadata string, options scanFSOptions) {
-	if options.id.IsZero() {
-		cliutil.Fatalf("missing id option\n")
+// reconDevice is a device image to scan.
+type reconDevice struct {
+	devID uint64
+	r     io.ReaderAt
+	size  uint64 // Usable size, a multiple of the block size
+	start uint64 // Offset to start the linear scan at
+}
+
+// devOffset is a physical offset on a device.
+type devOffset struct {
+	devID  uint64
+	offset uint64
+}
+
+// reconScanner indexes tree blocks that belong to a filesystem.
+type reconScanner struct {
+	ix      *index.Index
+	options scanFSOptions
+
+	// Checksum algorithm plus one, 0 while unknown. Read concurrently by
+	// the block parsers of the linear scan.
+	csumType atomic.Uint32
+
+	// Device that blocks are currently read from
+	devID uint64
+	// Physical locations of blocks that were already scanned
+	scanned map[devOffset]bool
+
+	numBlocks, numBadCSum, numBadItems uint64
+	// Bytes skipped because they were not rescued, updated by the block
+	// readers
+	numUnreadable atomic.Uint64
+}
+
+func (s *reconScanner) setCSumType(t uint16) { s.csumType.Store(uint32(t) + 1) }
+
+// knownCSumType returns the checksum algorithm if it is known.
+func (s *reconScanner) knownCSumType() (uint16, bool) {
+	if v := s.csumType.Load(); v != 0 {
+		return uint16(v - 1), true
 	}
+	return 0, false
+}
 
-	f, err := os.Open(filename)
-	cliutil.ReportError(err)
-	defer f.Close()
+// isFSBlock returns whether buf holds a non-empty tree block of the
+// filesystem.
+func (s *reconScanner) isFSBlock(buf []byte) bool {
+	h := btrfs.Header(buf)
+	return h.FSID() == s.options.id && h.NrItems() != 0
+}
 
-	bs := uint64(app.Global.BlockSize)
+// blockStatus verifies the checksum of the tree block in buf. If the
+// algorithm is not known yet, the first one that verifies is locked in. If
+// none does, the block is bad regardless of the algorithm.
+func (s *reconScanner) blockStatus(buf []byte) (uint8, error) {
+	if t, ok := s.knownCSumType(); ok {
+		return verifyStatus(t, buf), nil
+	}
+	t, ok := csum.Detect(buf)
+	if !ok {
+		return csum.StatusMismatch, nil
+	}
+	s.setCSumType(t)
+	cliutil.Verbosef("detected checksum algorithm %s\n",
+		btrfs.CSumTypeString(t))
+	return csum.StatusOK, s.ix.SetCSumType(t)
+}
 
-	devSize, err := btrfs.CheckDeviceSize(f, bs)
-	cliutil.ReportError(err)
-	devSize = devSize - (devSize % bs)
+func verifyStatus(t uint16, buf []byte) uint8 {
+	if csum.Verify(t, buf) {
+		return csum.StatusOK
+	}
+	return csum.StatusMismatch
+}
+
+// scanBlock indexes the tree block in buf that was read from physical offset
+// off of the current device. It returns whether the block was indexed.
+func (s *reconScanner) scanBlock(buf []byte, off uint64) (bool, error) {
+	// Skip this header if it has the wrong FSID or is empty.
+	if !s.isFSBlock(buf) {
+		return false, nil
+	}
+	status, err := s.blockStatus(buf)
+	if err != nil {
+		return false, err
+	}
+	return s.indexBlock(buf, off, status)
+}
+
+// indexBlock inserts a tree block of the filesystem with the given checksum
+// status into the index. It returns whether the block was indexed.
+func (s *reconScanner) indexBlock(buf []byte, off uint64, status uint8) (
+	bool, error) {
+	l := btrfs.Leaf(buf)
+	h := l.Header()
+	s.numBlocks++
+
+	if status == csum.StatusMismatch {
+		s.numBadCSum++
+		cliutil.Verbosef("checksum mismatch in block %d at offset %d\n",
+			h.ByteNr(), off)
+		if s.options.badCSum == badCSumReject {
+			return false, nil
+		}
+	}
+	if !h.IsLeaf() {
+		// Internal nodes only hold key pointers to the next level
+		n := btrfs.Node(buf)
+		if err := n.CheckHeader(); err != nil {
+			cliutil.Verbosef("offset %d: %s\n", off, err)
+			if h.Level() >= btrfs.MaxLevel {
+				return false, nil
+			}
+		}
+		if err := s.ix.InsertBlock(h, s.devID, off, status); err != nil {
+			return false, err
+		}
+		return true, s.ix.InsertNode(n)
+	}
+	if err := s.ix.InsertBlock(h, s.devID, off, status); err != nil {
+		return false, err
+	}
+
+	// The free space of a leaf is between offsets
+	// [ btrfs.HeaderSize, l.Items(l.Len() - 1).Offset() ).
+	if err := l.CheckHeader(); err != nil {
+		cliutil.Verbosef("offset %d: %s\n", off, err)
+	}
+	for i := 0; i < l.Len(); i++ {
+		if err := l.CheckItem(i); err != nil {
+			s.numBadItems++
+			cliutil.Verbosef("leaf %d at offset %d: %s\n", h.ByteNr(), off,
+				err)
+			continue
+		}
+		if err := s.ix.InsertItem(l.Key(i), h, l.Item(i),
+			l.Data(i)); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// scanChunkTrees stores the superblock copies of the filesystem in the index
+// and reads the chunk trees they refer to directly. The system chunks in the
+// superblocks' sys_chunk_array map the chunk tree, so that this works even
+// before anything else is known about the filesystem layout.
+func (s *reconScanner) scanChunkTrees(devs []reconDevice, bs uint64,
+	supers []btrfs.Superblock) error {
+	var valid []btrfs.Superblock
+	for _, sb := range supers {
+		if sb == nil || sb.TreeFSID() != s.options.id {
+			continue
+		}
+		if err := s.ix.InsertSuperblock(sb); err != nil {
+			return err
+		}
+		valid = append(valid, sb)
+	}
+	// Prefer the system chunks of the latest superblock
+	sort.SliceStable(valid, func(i, j int) bool {
+		return valid[i].Generation() > valid[j].Generation()
+	})
+	cm := &btrfs.ChunkMap{}
+	var roots []uint64
+	seenRoot := make(map[uint64]bool)
+	addRoot := func(logical uint64) {
+		if logical != 0 && !seenRoot[logical] {
+			seenRoot[logical] = true
+			roots = append(roots, logical)
+		}
+	}
+	for _, sb := range valid {
+		keys, chunks := sb.SysChunks()
+		for i, c := range chunks {
+			if err := cm.AddChunk(keys[i].Offset, c); err != nil {
+				cliutil.Verbosef("superblock at %d: %s\n", sb.ByteNr(), err)
+			}
+		}
+		addRoot(sb.ChunkRoot())
+		for _, b := range sb.BackupRoots() {
+			addRoot(b.ChunkRoot())
+		}
+	}
 
 	buf := make([]byte, bs)
+	visited := make(map[uint64]bool)
+	var walk func(logical uint64) error
+	walk = func(logical uint64) error {
+		if visited[logical] {
+			return nil // Guard against loops in corrupted trees
+		}
+		visited[logical] = true
+		pr, err := cm.Physical(logical, 0)
+		if err != nil {
+			cliutil.Verbosef("chunk tree block %d: %s\n", logical, err)
+			return nil
+		}
+		d := findReconDevice(devs, pr.DevID)
+		if d == nil {
+			cliutil.Verbosef("chunk tree block %d: no image for device %d\n",
+				logical, pr.DevID)
+			return nil
+		}
+		if pr.Offset+bs > d.size {
+			cliutil.Verbosef("chunk tree block %d: physical offset %d "+
+				"beyond end of device %s\n", logical, pr.Offset,
+				devIDString(d.devID))
+			return nil
+		}
+		if err = ioutil.ReadBlockAt(d.r, buf, pr.Offset); err != nil {
+			var unreadable *ddrescue.UnreadableError
+			if errors.As(err, &unreadable) {
+				cliutil.Verbosef("chunk tree block %d: %s\n", logical, err)
+				return nil
+			}
+			return err
+		}
+		h := btrfs.Header(buf)
+		if h.ByteNr() != logical || h.Owner() != btrfs.ChunkTreeObjectID {
+			cliutil.Verbosef("no chunk tree block %d at offset %d\n",
+				logical, pr.Offset)
+			return nil
+		}
+		loc := devOffset{d.devID, pr.Offset}
+		if s.scanned[loc] {
+			return nil
+		}
+		s.scanned[loc] = true
+		s.devID = d.devID
+		indexed, err := s.scanBlock(buf, pr.Offset)
+		if err != nil || !indexed || h.IsLeaf() {
+			return err
+		}
+		// Copy the key pointers, buf is reused for the child blocks
+		var ptrs []uint64
+		for _, p := range btrfs.Node(buf).KeyPtrs() {
+			ptrs = append(ptrs, p.BlockPtr())
+		}
+		for _, ptr := range ptrs {
+			if err = walk(ptr); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, root := range roots {
+		if err := walk(root); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	ix, err := index.Open(app.Global.Metadata, 0644, &index.Options{
+// findReconDevice returns the device with the given id, or nil.
+func findReconDevice(devs []reconDevice, devID uint64) *reconDevice {
+	for i := range devs {
+		if devs[i].devID == devID {
+			return &devs[i]
+		}
+	}
+	if len(devs) == 1 && devs[0].devID == index.AnyDevice {
+		return &devs[0]
+	}
+	return nil
+}
+
+// scanParams returns the scan parameters that need to match when adding to
+// or resuming a scan. Block size and filesystem id are checked when opening
+// the index.
+func scanParams(options scanFSOptions) string {
+	return "bad-csum=" + options.badCSum
+}
+
+// resumeDevices sets the offsets at which to continue scanning the devices
+// from the progress of an interrupted scan. The devices need to be the same.
+func resumeDevices(devs []reconDevice, prev []index.ScanDevice) error {
+	if len(devs) != len(prev) {
+		return fmt.Errorf("interrupted scan was of %d devices, not %d",
+			len(prev), len(devs))
+	}
+	for i := range devs {
+		d := &devs[i]
+		found := false
+		for _, p := range prev {
+			if p.DevID != d.devID {
+				continue
+			}
+			if p.Size != d.size {
+				return fmt.Errorf("device %d has size %d, expected %d",
+					d.devID, d.size, p.Size)
+			}
+			d.start, found = p.Offset, true
+		}
+		if !found {
+			return fmt.Errorf("device %d was not part of the interrupted "+
+				"scan", d.devID)
+		}
+	}
+	return nil
+}
+
+// openScanIndex opens the metadata index to scan into. Existing metadata is
+// only added to with --append or --resume. For the latter, the block size
+// and filesystem id are taken from the metadata.
+func openScanIndex(metadata string, options *scanFSOptions) (*index.Index,
+	uint64, error) {
+	if options.resume {
+		ix, err := index.OpenForUpdate(metadata, ^uint64(0))
+		if err != nil {
+			return nil, 0, err
+		}
+		m := ix.Metadata()
+		if !options.id.IsZero() && options.id != m.FSID() {
+			ix.Close()
+			return nil, 0, fmt.Errorf("filesystem id mismatch, metadata is "+
+				"for %s", m.FSID())
+		}
+		options.id = m.FSID()
+		return ix, uint64(m.BlockSize()), nil
+	}
+	if fi, err := os.Stat(metadata); err == nil && fi.Size() > 0 &&
+		!options.append {
+		return nil, 0, fmt.Errorf("metadata file %s exists, use --append or "+
+			"--resume", metadata)
+	}
+	bs := uint64(app.Global.BlockSize)
+	ix, err := index.Open(metadata, 0644, &index.Options{
 		BlockSize:  uint(bs),
 		FSID:       options.id,
 		Generation: ^uint64(0),
 	})
+	return ix, bs, err
+}
+
+func doScanFS(args []string, metadata string, options scanFSOptions) {
+	if options.id.IsZero() && !options.resume {
+		cliutil.Fatalf("missing id option\n")
+	}
+	if options.append && options.resume {
+		cliutil.Fatalf("append and resume options are mutually exclusive\n")
+	}
+	if options.walk && options.resume {
+		cliutil.Fatalf("walk and resume options are mutually exclusive\n")
+	}
+	if options.badCSum != badCSumFlag && options.badCSum != badCSumReject {
+		cliutil.Fatalf("invalid bad-csum option: %s\n", options.badCSum)
+	}
+	if options.jobs < 1 {
+		cliutil.Fatalf("invalid jobs option: %d\n", options.jobs)
+	}
+	images, err := parseDeviceImages(append(append([]string(nil),
+		app.Global.Devices...), args...))
+	cliutil.ReportError(err)
+	if len(images) == 0 {
+		cliutil.Fatalf("missing device or image\n")
+	}
+
+	ix, bs, err := openScanIndex(metadata, &options)
 	cliutil.ReportError(err)
 	defer func() {
 		cliutil.ReportError(ix.Commit())
 		ix.Close()
 	}()
 
-	bar := pb.New64(int64(devSize)) //.SetUnits(pb.U_BYTES)
+	opened, err := openDeviceImages(ix, options.id, images)
+	cliutil.ReportError(err)
+	defer func() {
+		for _, d := range opened {
+			d.img.Close()
+		}
+	}()
+	cliutil.ReportError(applyMapfiles(opened, app.Global.Mapfiles))
+	var devs []reconDevice
+	var supers []btrfs.Superblock
+	for _, d := range opened {
+		devSize, err := btrfs.CheckDeviceSize(d.img, bs)
+		cliutil.ReportError(err)
+		devSize = devSize - (devSize % bs)
+		devID := d.devID
+		if devID == index.AnyDevice {
+			// A single device of unknown id, most likely the first one
+			devID = 1
+		}
+		// Start right after the first superblock
+		devs = append(devs, reconDevice{devID, d.img, devSize,
+			btrfs.SuperInfoOffset + bs})
+		supers = append(supers, readSuperblocks(d.img, devSize)...)
+	}
+
+	params := scanParams(options)
+	prevParams, prevDevs, scanned, err := ix.ScanState()
+	cliutil.ReportError(err)
+	if scanned && prevParams != params {
+		cliutil.Fatalf("scan parameter mismatch, metadata was gathered "+
+			"with %s\n", prevParams)
+	}
+	if options.resume {
+		if !scanned {
+			cliutil.Fatalf("no scan to resume in %s\n", metadata)
+		}
+		cliutil.ReportError(resumeDevices(devs, prevDevs))
+	}
+
+	s := &reconScanner{
+		ix:      ix,
+		options: options,
+		scanned: make(map[devOffset]bool),
+	}
+	csumType, csumKnown := scanCSumType(supers, options)
+	if prev, ok := ix.CSumType(); ok {
+		if csumKnown && csumType != prev {
+			cliutil.Fatalf("checksum algorithm mismatch, metadata was "+
+				"gathered using %s\n", btrfs.CSumTypeString(prev))
+		}
+		csumType, csumKnown = prev, true
+	}
+	if csumKnown {
+		s.setCSumType(csumType)
+		cliutil.ReportError(ix.SetCSumType(csumType))
+	}
+	cliutil.ReportError(s.scanChunkTrees(devs, bs, supers))
+
+	state := make([]index.ScanDevice, len(devs))
+	for i, d := range devs {
+		state[i] = index.ScanDevice{DevID: d.devID, Size: d.size,
+			Offset: d.start}
+	}
+	checkpoint := func(progress []uint64) error {
+		for i := range state {
+			state[i].Offset = progress[i]
+		}
+		return ix.SetScanState(params, state)
+	}
+	cliutil.ReportError(ix.SetScanState(params, state))
+
+	// A walk leaves the scan state at the start, so that a later --resume
+	// scans the devices completely
+	scan := devs
+	if options.walk {
+		scan, err = s.walkTrees(devs, bs, supers)
+		cliutil.ReportError(err)
+		checkpoint = nil
+	}
+	var total, start uint64
+	for _, d := range scan {
+		total += d.size
+		start += d.start
+	}
+	if options.walk {
+		// The progress is of the regions left to scan
+		total, start = total-start, 0
+		cliutil.Verbosef("scanning %d bytes in %d regions\n", total,
+			len(scan))
+	}
+
+	bar := pb.New64(int64(total)) //.SetUnits(pb.U_BYTES)
 	bar.SetMaxWidth(120)
+	bar.SetCurrent(int64(start))
 	if app.Global.Progress {
 		bar.Start()
 	}
 	defer bar.Finish()
 
-	// Start right after the first superblock
-	for off := uint64(btrfs.SuperInfoOffset) + bs; off < devSize; off += bs {
-		if err = ioutil.ReadBlockAt(f, buf, off); err == io.EOF {
-			break
-		} else if err != nil {
-			cliutil.ReportError(err)
-		}
-		bar.SetCurrent(int64(off))
-		l := btrfs.Leaf(buf)
-		h := l.Header()
+	cliutil.ReportError(s.scanDevices(scan, bs, options.jobs, bar,
+		checkpoint))
+	bar.SetCurrent(int64(total))
 
-		// Skip this header if it has the wrong FSID or is empty.
-		if h.FSID() != options.id || h.NrItems() == 0 {
-			continue
-		}
-		// Also skip all non-leaves (= nodes)
-		if !h.IsLeaf() {
-			//cliutil.Warnf("non-leaf %d at offset %d, level %d\n", h.ByteNr(),
-			//	off, h.Level())
-			continue
-		}
-		// The free space of a leaf is between offsets
-		// [ btrfs.HeaderSize, l.Items(l.Len() - 1).Offset() ).
-		for i := 0; i < l.Len(); i++ {
-			cliutil.ReportError(ix.InsertItem(l.Key(i), h, l.Item(i),
-				l.Data(i)))
+	bar.Finish()
+
+	// Last resort mapping in case chunk and device trees are lost
+	inferred := ix.InferChunks(bs, index.DefaultMaxInferGap)
+	cliutil.ReportError(ix.SetInferredChunks(inferred))
+	for _, m := range inferred {
+		cliutil.Verbosef("inferred %s chunk [%d, %d) at physical %d\n",
+			btrfs.ProfileString(m.Type), m.Logical, m.End(),
+			m.Stripes[0].Offset)
+	}
+	if s.numBadCSum > 0 {
+		action := "flagged"
+		if options.badCSum == badCSumReject {
+			action = "rejected"
 		}
+		cliutil.Warnf("%d of %d tree blocks %s due to checksum mismatch\n",
+			s.numBadCSum, s.numBlocks, action)
+	}
+	if s.numBadItems > 0 {
+		cliutil.Warnf("skipped %d invalid items\n", s.numBadItems)
 	}
-	bar.SetCurrent(int64(devSize))
+	if n := s.numUnreadable.Load(); n > 0 {
+		cliutil.Warnf("skipped %d bytes that were not rescued\n", n)
+	}
+}
 
-	bar.Finish()
+// scanCSumType determines the checksum algorithm to use for verifying tree
+// blocks. It is taken from the command-line or from the first superblock copy
+// that belongs to the filesystem. If neither is available, it needs to be
+// auto-detected from the tree blocks.
+func scanCSumType(supers []btrfs.Superblock, options scanFSOptions) (
+	uint16, bool) {
+	if options.csum != "auto" {
+		t, err := csum.ParseType(options.csum)
+		cliutil.ReportError(err)
+		return t, true
+	}
+	for _, s := range supers {
+		if s != nil && s.TreeFSID() == options.id && csum.Verify(s.CSumType(),
+			s) {
+			cliutil.Verbosef("using checksum algorithm %s from superblock\n",
+				btrfs.CSumTypeString(s.CSumType()))
+			return s.CSumType(), true
+		}
+	}
+	return 0, false
 }
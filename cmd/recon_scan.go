@@ -0,0 +1,201 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Parallel linear scan of device images for tree blocks
+
+package cmd
+
+import (
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/cheggaaa/pb/v3"
+
+	"blichmann.eu/code/btrfscue/pkg/ddrescue"
+	"blichmann.eu/code/btrfscue/pkg/ioutil"
+)
+
+// Number of blocks that a block reader reads at once
+const scanSegmentBlocks = 256
+
+// scanSegment is a range of blocks on a device that is read at once.
+type scanSegment struct {
+	dev       int // Index into the scanned devices
+	off, size uint64
+}
+
+// scannedBlock is a tree block of the filesystem found by a block reader.
+type scannedBlock struct {
+	devID, off uint64
+	buf        []byte
+	status     uint8
+	verified   bool // Whether status holds the checksum status
+	err        error
+
+	// If set, this is not a block, but marks that all blocks of the segment
+	// have been sent.
+	done *scanSegment
+}
+
+// scanDevices linearly scans the devices for tree blocks of the filesystem,
+// starting at their start offsets. jobs block readers read and parse
+// segments of the devices concurrently and feed the blocks they find to the
+// calling goroutine, which is the only one writing to the index. Blocks are
+// indexed in no particular order. Whenever the offsets up to which all
+// blocks of the devices have been indexed advance, they are passed to
+// checkpoint, if set.
+func (s *reconScanner) scanDevices(devs []reconDevice, bs uint64, jobs int,
+	bar *pb.ProgressBar, checkpoint func(progress []uint64) error) error {
+	segments := make(chan scanSegment, jobs)
+	blocks := make(chan scannedBlock, jobs*16)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(segments)
+		segSize := bs * scanSegmentBlocks
+		for i, d := range devs {
+			for off := d.start; off < d.size; off += segSize {
+				seg := scanSegment{i, off, segSize}
+				if off+seg.size > d.size {
+					seg.size = d.size - off
+				}
+				select {
+				case segments <- seg:
+				case <-done:
+					return
+				}
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.readSegments(devs, segments, blocks, done, bs, bar)
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(blocks)
+	}()
+
+	// Segments that were completely indexed, but not yet contiguously from
+	// the offsets in progress
+	progress := make([]uint64, len(devs))
+	pending := make([]map[uint64]uint64, len(devs))
+	for i, d := range devs {
+		progress[i] = d.start
+		pending[i] = make(map[uint64]uint64)
+	}
+	var err error
+	for b := range blocks {
+		if err != nil {
+			continue // Drain until all readers have stopped
+		}
+		if seg := b.done; seg != nil {
+			pending[seg.dev][seg.off] = seg.size
+			advanced := false
+			for {
+				size, ok := pending[seg.dev][progress[seg.dev]]
+				if !ok {
+					break
+				}
+				delete(pending[seg.dev], progress[seg.dev])
+				progress[seg.dev] += size
+				advanced = true
+			}
+			if advanced && checkpoint != nil {
+				if err = checkpoint(progress); err != nil {
+					close(done)
+				}
+			}
+			continue
+		}
+		if err = b.err; err == nil {
+			if !b.verified {
+				b.status, err = s.blockStatus(b.buf)
+			}
+			if err == nil {
+				s.devID = b.devID
+				_, err = s.indexBlock(b.buf, b.off, b.status)
+			}
+		}
+		if err != nil {
+			close(done)
+		}
+	}
+	return err
+}
+
+// readSegments reads the segments it receives and sends the tree blocks of
+// the filesystem in them to blocks. Checksums are verified here if the
+// algorithm is known, as that is where most of the CPU time goes.
+func (s *reconScanner) readSegments(devs []reconDevice,
+	segments <-chan scanSegment, blocks chan<- scannedBlock,
+	done <-chan struct{}, bs uint64, bar *pb.ProgressBar) {
+	send := func(b scannedBlock) bool {
+		select {
+		case blocks <- b:
+			return true
+		case <-done:
+			return false
+		}
+	}
+	var buf []byte
+	for seg := range segments {
+		dev := &devs[seg.dev]
+		if uint64(cap(buf)) < seg.size {
+			buf = make([]byte, seg.size)
+		}
+		buf = buf[:seg.size]
+		if err := s.readSegment(dev.r, buf, seg.off, bs); err != nil {
+			send(scannedBlock{err: err})
+			return
+		}
+		for o := uint64(0); o+bs <= seg.size; o += bs {
+			off := seg.off + o
+			block := buf[o : o+bs]
+			if s.scanned[devOffset{dev.devID, off}] || !s.isFSBlock(block) {
+				continue // Already read directly or not interesting
+			}
+			b := scannedBlock{devID: dev.devID, off: off,
+				buf: append([]byte(nil), block...)}
+			if t, ok := s.knownCSumType(); ok {
+				b.status, b.verified = verifyStatus(t, block), true
+			}
+			if !send(b) {
+				return
+			}
+		}
+		bar.Add64(int64(seg.size))
+		if !send(scannedBlock{done: &seg}) {
+			return
+		}
+	}
+}
+
+// readSegment reads buf from r at off. If parts of it were not rescued, the
+// blocks are read one by one and the unreadable ones are zeroed, which never
+// makes them look like filesystem blocks.
+func (s *reconScanner) readSegment(r io.ReaderAt, buf []byte, off,
+	bs uint64) error {
+	err := ioutil.ReadBlockAt(r, buf, off)
+	var unreadable *ddrescue.UnreadableError
+	if !errors.As(err, &unreadable) {
+		return err
+	}
+	for o := uint64(0); o+bs <= uint64(len(buf)); o += bs {
+		block := buf[o : o+bs]
+		err := ioutil.ReadBlockAt(r, block, off+o)
+		if errors.As(err, &unreadable) {
+			clear(block)
+			s.numUnreadable.Add(bs)
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,397 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cheggaaa/pb/v3"
+
+	"blichmann.eu/code/btrfscue/pkg/btrfs"
+	"blichmann.eu/code/btrfscue/pkg/btrfs/csum"
+	"blichmann.eu/code/btrfscue/pkg/btrfs/index"
+	"blichmann.eu/code/btrfscue/pkg/ddrescue"
+	"blichmann.eu/code/btrfscue/pkg/uuid"
+)
+
+// makeSuperblock returns a superblock whose sys_chunk_array holds a single
+// chunk at the given logical address.
+func makeSuperblock(fsid uuid.UUID, bytenr, generation, chunkRoot,
+	sysLogical uint64, sysChunk []byte) btrfs.Superblock {
+	s := make([]byte, btrfs.SuperInfoSize)
+	copy(s[0x20:], fsid[:])
+	binary.LittleEndian.PutUint64(s[0x30:], bytenr)
+	binary.LittleEndian.PutUint64(s[0x40:], btrfs.Magic)
+	binary.LittleEndian.PutUint64(s[0x48:], generation)
+	binary.LittleEndian.PutUint64(s[0x58:], chunkRoot)
+	a := s[0x32b:]
+	binary.LittleEndian.PutUint64(a[0:], btrfs.FirstChunkTreeObjectID)
+	a[8] = btrfs.ChunkItemKey
+	binary.LittleEndian.PutUint64(a[9:], sysLogical)
+	copy(a[btrfs.KeyLen:], sysChunk)
+	binary.LittleEndian.PutUint32(s[0xa0:],
+		uint32(btrfs.KeyLen+len(sysChunk)))
+	return btrfs.Superblock(s)
+}
+
+// makeLeafBlock returns a tree block of the given size holding a leaf with
+// the given keys and item data.
+func makeLeafBlock(size int, bytenr uint64, h btrfs.Header, keys []btrfs.Key,
+	data [][]byte) []byte {
+	b := make([]byte, size)
+	copy(b, h)
+	binary.LittleEndian.PutUint64(b[48:], bytenr)
+	binary.LittleEndian.PutUint32(b[96:], uint32(len(keys)))
+	end := size - btrfs.HeaderLen
+	for i, k := range keys {
+		end -= len(data[i])
+		copy(b[btrfs.HeaderLen+end:], data[i])
+		copy(b[btrfs.HeaderLen+i*btrfs.ItemLen:], makeItem(k, uint32(end),
+			uint32(len(data[i]))))
+	}
+	return b
+}
+
+func TestScanChunkTrees(t *testing.T) {
+	td, err := ioutil.TempDir("", "btrfscue_recon_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	const bs = 4096
+	fsid := uuid.UUID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+
+	// The system chunk maps logical 1M to physical 128K on device 2. The
+	// chunk tree leaf in it maps a data chunk at 8M.
+	const sysLogical, sysPhysical = 1 << 20, 128 << 10
+	const chunkRoot = sysLogical + bs
+	img := make([]byte, 1<<20)
+	img2 := make([]byte, 1<<20)
+	super := makeSuperblock(fsid, btrfs.SuperInfoOffset, 7, chunkRoot,
+		sysLogical, makeChunk(1<<16, 2, sysPhysical))
+	copy(img[btrfs.SuperInfoOffset:], super)
+	dataKey := btrfs.Key{ObjectID: btrfs.FirstChunkTreeObjectID,
+		Type: btrfs.ChunkItemKey, Offset: 8 << 20}
+	leaf := makeLeafBlock(bs, chunkRoot, makeHeader(btrfs.ChunkTreeObjectID,
+		7, fsid), []btrfs.Key{dataKey}, [][]byte{makeChunk(1<<20, 1,
+		512<<10)})
+	copy(img2[sysPhysical+bs:], leaf)
+
+	ix, err := index.Open(filepath.Join(td, "metadata.db"), 0644,
+		&index.Options{BlockSize: bs, FSID: fsid, Generation: ^uint64(0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ix.Close()
+	s := &reconScanner{
+		ix:      ix,
+		options: scanFSOptions{id: fsid, badCSum: badCSumFlag},
+		scanned: make(map[devOffset]bool),
+	}
+	r := bytes.NewReader(img)
+	devs := []reconDevice{
+		{1, r, uint64(len(img)), 0},
+		{2, bytes.NewReader(img2), uint64(len(img2)), 0},
+	}
+	if err := s.scanChunkTrees(devs, bs, readSuperblocks(r,
+		uint64(len(img)))); err != nil {
+		t.Fatal(err)
+	}
+	if !s.scanned[devOffset{2, sysPhysical + bs}] {
+		t.Errorf("expected chunk tree leaf at %d to be scanned",
+			sysPhysical+bs)
+	}
+	if err := ix.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	numSupers := 0
+	ix.ForEachSuperblock(func(sb btrfs.Superblock) error {
+		numSupers++
+		if sb.Generation() != 7 {
+			t.Errorf("expected superblock generation 7, actual %d",
+				sb.Generation())
+		}
+		return nil
+	})
+	if numSupers != 1 {
+		t.Errorf("expected 1 stored superblock, actual %d", numSupers)
+	}
+	if b := ix.FindBlock(chunkRoot, 7); b == nil ||
+		b.Physical() != sysPhysical+bs || b.DevID() != 2 {
+		t.Errorf("expected chunk tree block at physical %d on device 2",
+			sysPhysical+bs)
+	}
+	for _, c := range []struct{ logical, physical uint64 }{
+		{sysLogical + 42, sysPhysical + 42}, // From the superblock
+		{8<<20 + 42, 512<<10 + 42},          // From the chunk tree
+	} {
+		pr, err := ix.Physical(c.logical)
+		if err != nil {
+			t.Errorf("logical %d: %s", c.logical, err)
+		} else if pr.Offset != c.physical {
+			t.Errorf("logical %d: expected physical %d, actual %d",
+				c.logical, c.physical, pr.Offset)
+		}
+	}
+}
+
+func TestScanDevices(t *testing.T) {
+	td, err := ioutil.TempDir("", "btrfscue_recon_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	const bs = 4096
+	fsid := uuid.UUID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	ix, err := index.Open(filepath.Join(td, "metadata.db"), 0644,
+		&index.Options{BlockSize: bs, FSID: fsid, Generation: ^uint64(0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ix.Close()
+
+	// Leaves at every 5th block of two devices, every other one with a
+	// valid checksum. Blocks are identified by their logical address.
+	images := [][]byte{make([]byte, 4<<20), make([]byte, 3<<20+bs)}
+	type location struct{ devID, physical uint64 }
+	expected := make(map[uint64]location)
+	numBad := 0
+	for i, img := range images {
+		size := uint64(len(img))
+		for off := uint64(btrfs.SuperInfoOffset) + bs; off < size; off +=
+			5 * bs {
+			logical := uint64(len(expected)+1) * bs
+			k := btrfs.Key{ObjectID: logical, Type: btrfs.InodeItemKey}
+			leaf := makeLeafBlock(bs, logical, makeHeader(btrfs.FSTreeObjectID,
+				1, fsid), []btrfs.Key{k}, [][]byte{makeInodeItem(0, 0)})
+			if len(expected)%2 == 0 {
+				c, _ := csum.Sum(btrfs.CSumTypeCRC32, leaf[btrfs.CSumSize:])
+				copy(leaf, c[:])
+			} else {
+				numBad++
+			}
+			copy(img[off:], leaf)
+			expected[logical] = location{uint64(i + 1), off}
+		}
+	}
+	start := uint64(btrfs.SuperInfoOffset + bs)
+	devs := []reconDevice{
+		{1, bytes.NewReader(images[0]), uint64(len(images[0])), start},
+		{2, bytes.NewReader(images[1]), uint64(len(images[1])), start},
+	}
+	s := &reconScanner{
+		ix:      ix,
+		options: scanFSOptions{id: fsid, badCSum: badCSumFlag},
+		scanned: make(map[devOffset]bool),
+	}
+	s.setCSumType(btrfs.CSumTypeCRC32)
+	progress := []uint64{start, start}
+	if err := s.scanDevices(devs, bs, 4, pb.New(0), func(p []uint64) error {
+		for i, off := range p {
+			if off < progress[i] {
+				t.Errorf("device %d: progress went back from %d to %d", i,
+					progress[i], off)
+			}
+		}
+		copy(progress, p)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for i, d := range devs {
+		if progress[i] != d.size {
+			t.Errorf("device %d: expected progress %d, actual %d", i, d.size,
+				progress[i])
+		}
+	}
+	if err := ix.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if s.numBlocks != uint64(len(expected)) || s.numBadCSum != uint64(numBad) {
+		t.Errorf("expected %d blocks, %d bad, actual %d, %d", len(expected),
+			numBad, s.numBlocks, s.numBadCSum)
+	}
+	for logical, loc := range expected {
+		b := ix.FindBlock(logical, 1)
+		if b == nil || b.DevID() != loc.devID || b.Physical() != loc.physical {
+			t.Errorf("block %d: expected at %d:%d, actual %v", logical,
+				loc.devID, loc.physical, b)
+		}
+	}
+}
+
+func TestResumeDevices(t *testing.T) {
+	devs := []reconDevice{{devID: 2, size: 8 << 20}, {devID: 1,
+		size: 4 << 20}}
+	prev := []index.ScanDevice{{DevID: 1, Size: 4 << 20, Offset: 1 << 20},
+		{DevID: 2, Size: 8 << 20, Offset: 2 << 20}}
+	if err := resumeDevices(devs, prev); err != nil {
+		t.Fatal(err)
+	}
+	if devs[0].start != 2<<20 || devs[1].start != 1<<20 {
+		t.Errorf("unexpected start offsets %d and %d", devs[0].start,
+			devs[1].start)
+	}
+	for _, p := range [][]index.ScanDevice{
+		prev[:1],
+		{{DevID: 1, Size: 4 << 20}, {DevID: 2, Size: 4 << 20}},
+		{{DevID: 1, Size: 4 << 20}, {DevID: 3, Size: 8 << 20}},
+	} {
+		if err := resumeDevices(devs, p); err == nil {
+			t.Errorf("%v: expected error", p)
+		}
+	}
+}
+
+func TestReadSegmentUnreadable(t *testing.T) {
+	const bs = 4096
+	m, err := ddrescue.Parse(strings.NewReader(
+		"0 +\n0 5000 +\n5000 100 -\n5100 7188 +\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := ddrescue.NewReaderAt(bytes.NewReader(
+		bytes.Repeat([]byte{0xab}, 3*bs)), m)
+	s := &reconScanner{}
+	buf := make([]byte, 3*bs)
+	if err := s.readSegment(r, buf, 0, bs); err != nil {
+		t.Fatal(err)
+	}
+	for i, b := range buf {
+		if unreadable := i >= bs && i < 2*bs; unreadable != (b == 0) {
+			t.Fatalf("unexpected byte %#x at %d", b, i)
+		}
+	}
+	if n := s.numUnreadable.Load(); n != bs {
+		t.Errorf("%d vs %d unreadable bytes", bs, n)
+	}
+}
+
+// makeNodeBlock returns a tree block of the given size holding an internal
+// node at level 1 that points to the blocks at ptrs.
+func makeNodeBlock(size int, bytenr uint64, h btrfs.Header, keys []btrfs.Key,
+	ptrs []uint64) []byte {
+	b := make([]byte, size)
+	copy(b, h)
+	binary.LittleEndian.PutUint64(b[48:], bytenr)
+	binary.LittleEndian.PutUint32(b[96:], uint32(len(keys)))
+	b[100] = 1
+	for i, k := range keys {
+		p := b[btrfs.HeaderLen+i*btrfs.KeyPtrLen:]
+		binary.LittleEndian.PutUint64(p, k.ObjectID)
+		p[8] = k.Type
+		binary.LittleEndian.PutUint64(p[9:], k.Offset)
+		binary.LittleEndian.PutUint64(p[btrfs.KeyLen:], ptrs[i])
+		binary.LittleEndian.PutUint64(p[btrfs.KeyLen+8:], h.Generation())
+	}
+	return b
+}
+
+func TestWalkTrees(t *testing.T) {
+	td, err := ioutil.TempDir("", "btrfscue_recon_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	const bs = 4096
+	fsid := uuid.UUID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	img := make([]byte, 4<<20)
+	write := func(physical uint64, block []byte) {
+		c, _ := csum.Sum(btrfs.CSumTypeCRC32, block[btrfs.CSumSize:])
+		copy(block, c[:])
+		copy(img[physical:], block)
+	}
+
+	// The chunk tree maps the metadata chunk at logical 8M to physical 1M
+	const sysLogical, sysPhysical = 1 << 20, 128 << 10
+	const metaLogical, metaPhysical = 8 << 20, 1 << 20
+	write(sysPhysical, makeLeafBlock(bs, sysLogical, makeHeader(
+		btrfs.ChunkTreeObjectID, 7, fsid), []btrfs.Key{{
+		ObjectID: btrfs.FirstChunkTreeObjectID, Type: btrfs.ChunkItemKey,
+		Offset: metaLogical}}, [][]byte{makeChunk(1<<20, 1, metaPhysical)}))
+
+	// The root tree leads to an FS tree node with two leaves, of which the
+	// second one is missing. A backup root points to an overwritten block.
+	const rootTree, fsNode, fsLeaf, lostLeaf, staleRoot = metaLogical,
+		metaLogical + bs, metaLogical + 2*bs, metaLogical + 3*bs,
+		metaLogical + 4*bs
+	rootItem := make([]byte, btrfs.RootItemLen)
+	binary.LittleEndian.PutUint64(rootItem[btrfs.InodeItemLen+16:], fsNode)
+	write(metaPhysical, makeLeafBlock(bs, rootTree, makeHeader(
+		btrfs.RootTreeObjectID, 7, fsid), []btrfs.Key{{
+		ObjectID: btrfs.FSTreeObjectID, Type: btrfs.RootItemKey}},
+		[][]byte{rootItem}))
+	write(metaPhysical+bs, makeNodeBlock(bs, fsNode, makeHeader(
+		btrfs.FSTreeObjectID, 7, fsid), []btrfs.Key{
+		{ObjectID: 256, Type: btrfs.InodeItemKey},
+		{ObjectID: 300, Type: btrfs.InodeItemKey},
+	}, []uint64{fsLeaf, lostLeaf}))
+	write(metaPhysical+2*bs, makeLeafBlock(bs, fsLeaf, makeHeader(
+		btrfs.FSTreeObjectID, 7, fsid), []btrfs.Key{{ObjectID: 256,
+		Type: btrfs.InodeItemKey}}, [][]byte{makeInodeItem(0, 0)}))
+
+	super := makeSuperblock(fsid, btrfs.SuperInfoOffset, 7, sysLogical,
+		sysLogical, makeChunk(1<<16, 1, sysPhysical))
+	binary.LittleEndian.PutUint64(super[0x50:], rootTree)
+	binary.LittleEndian.PutUint64(super[0xb2b:], staleRoot)
+	if super.Root() != rootTree ||
+		super.BackupRoot(0).TreeRoot() != staleRoot {
+		t.Fatal("unexpected superblock layout")
+	}
+
+	ix, err := index.Open(filepath.Join(td, "metadata.db"), 0644,
+		&index.Options{BlockSize: bs, FSID: fsid, Generation: ^uint64(0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ix.Close()
+	s := &reconScanner{
+		ix:      ix,
+		options: scanFSOptions{id: fsid, badCSum: badCSumFlag},
+		scanned: make(map[devOffset]bool),
+	}
+	s.setCSumType(btrfs.CSumTypeCRC32)
+	r := bytes.NewReader(img)
+	devs := []reconDevice{{1, r, uint64(len(img)), 0}}
+	supers := []btrfs.Superblock{super}
+	if err := s.scanChunkTrees(devs, bs, supers); err != nil {
+		t.Fatal(err)
+	}
+	// As if indexing had committed
+	if err := ix.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	regions, err := s.walkTrees(devs, bs, supers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ix.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	for _, logical := range []uint64{rootTree, fsNode, fsLeaf} {
+		if b := ix.FindBlock(logical, 7); b == nil ||
+			b.Physical() != logical-metaLogical+metaPhysical {
+			t.Errorf("expected block %d to be indexed", logical)
+		}
+	}
+	if s.numBadCSum != 0 {
+		t.Errorf("expected no checksum mismatches, actual %d", s.numBadCSum)
+	}
+	// Only the metadata chunk of the missing leaf needs a linear scan
+	if len(regions) != 1 || regions[0].devID != 1 ||
+		regions[0].start != metaPhysical ||
+		regions[0].size != metaPhysical+1<<20 {
+		t.Errorf("unexpected regions %+v", regions)
+	}
+}
@@ -0,0 +1,241 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Walking the trees from the superblock roots instead of a linear scan
+
+package cmd
+
+import (
+	"errors"
+	"sort"
+
+	cliutil "blichmann.eu/code/btrfscue/cmd/btrfscue/app/util"
+	"blichmann.eu/code/btrfscue/pkg/btrfs"
+	"blichmann.eu/code/btrfscue/pkg/btrfs/csum"
+	"blichmann.eu/code/btrfscue/pkg/ddrescue"
+	"blichmann.eu/code/btrfscue/pkg/ioutil"
+)
+
+// treeWalker indexes the tree blocks reachable from a set of roots.
+type treeWalker struct {
+	s    *reconScanner
+	cm   *btrfs.ChunkMap
+	devs []reconDevice
+	bs   uint64
+
+	visited map[uint64]bool
+	// Logical addresses of blocks that could not be read or did not verify
+	failed []uint64
+}
+
+// walkTrees indexes the tree blocks reachable from the roots in the
+// superblock copies of the filesystem and in their backup roots. Blocks are
+// located with the chunk map of the index, so the chunk trees need to be
+// scanned first. The leaves of the root trees lead to the roots of all
+// other trees. It returns the regions of the devices that still need a
+// linear scan: the device extents of the chunks holding blocks of the
+// latest trees that could not be read or did not verify, or the whole
+// devices if no tree could be walked at all. Older trees are walked as far
+// as they go, their blocks are often overwritten already.
+func (s *reconScanner) walkTrees(devs []reconDevice, bs uint64,
+	supers []btrfs.Superblock) ([]reconDevice, error) {
+	// Indexing may have committed, the chunk map needs a transaction
+	if err := s.ix.Begin(); err != nil {
+		return nil, err
+	}
+	w := &treeWalker{
+		s:       s,
+		cm:      s.ix.ChunkMap(),
+		devs:    devs,
+		bs:      bs,
+		visited: make(map[uint64]bool),
+	}
+	var latest btrfs.Superblock
+	var older []uint64
+	for _, sb := range supers {
+		if sb == nil || sb.TreeFSID() != s.options.id {
+			continue
+		}
+		if latest == nil || sb.Generation() > latest.Generation() {
+			latest = sb
+		}
+		older = append(older, sb.Root(), sb.LogRoot())
+		for _, b := range sb.BackupRoots() {
+			older = append(older, b.TreeRoot(), b.ExtentRoot(), b.FSRoot(),
+				b.DevRoot(), b.CSumRoot())
+		}
+	}
+	numBlocks := s.numBlocks
+	if latest != nil {
+		for _, root := range []uint64{latest.Root(), latest.LogRoot()} {
+			if err := w.walk(root, true); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, root := range older {
+		if err := w.walk(root, false); err != nil {
+			return nil, err
+		}
+	}
+	cliutil.Verbosef("walked %d tree blocks, %d of the latest trees failed\n",
+		s.numBlocks-numBlocks, len(w.failed))
+	if s.numBlocks == numBlocks {
+		cliutil.Verbosef("no trees found, scanning the whole devices\n")
+		return devs, nil
+	}
+	return w.fallbackRegions(), nil
+}
+
+// walk indexes the tree block at the logical address and the blocks it
+// points to. If required is set, blocks that fail are recorded.
+func (w *treeWalker) walk(logical uint64, required bool) error {
+	if logical == 0 || w.visited[logical] {
+		return nil // Also guards against loops in corrupted trees
+	}
+	w.visited[logical] = true
+	buf, d, off, status, err := w.readBlock(logical)
+	if err != nil {
+		return err
+	}
+	if required && (buf == nil || status == csum.StatusMismatch) {
+		w.failed = append(w.failed, logical)
+	}
+	if buf == nil {
+		return nil
+	}
+	s := w.s
+	loc := devOffset{d.devID, off}
+	if s.scanned[loc] {
+		return nil
+	}
+	s.scanned[loc] = true
+	s.devID = d.devID
+	indexed, err := s.indexBlock(buf, off, status)
+	if err != nil || !indexed {
+		return err
+	}
+
+	var ptrs []uint64
+	if h := btrfs.Header(buf); !h.IsLeaf() {
+		for _, p := range btrfs.Node(buf).KeyPtrs() {
+			ptrs = append(ptrs, p.BlockPtr())
+		}
+	} else {
+		// Root items lead to the other trees
+		l := btrfs.Leaf(buf)
+		for i := 0; i < l.Len(); i++ {
+			if l.CheckItem(i) != nil || l.Key(i).Type != btrfs.RootItemKey ||
+				len(l.Data(i)) < btrfs.RootItemLen {
+				continue
+			}
+			ptrs = append(ptrs, btrfs.RootItem(l.Data(i)).ByteNr())
+		}
+	}
+	for _, ptr := range ptrs {
+		if err := w.walk(ptr, required); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readBlock reads the tree block at the logical address from the first
+// mirror that holds it with a valid checksum. If no mirror does, the first
+// one that holds the block is returned with a mismatch status. buf is nil
+// if no mirror holds the block.
+func (w *treeWalker) readBlock(logical uint64) (buf []byte, d *reconDevice,
+	off uint64, status uint8, err error) {
+	m, err := w.cm.Lookup(logical)
+	if err != nil {
+		cliutil.Verbosef("tree block %d: %s\n", logical, err)
+		return nil, nil, 0, 0, nil
+	}
+	block := make([]byte, w.bs)
+	for mirror := 0; mirror < m.NumMirrors(); mirror++ {
+		pr, err := m.Physical(logical, mirror)
+		if err != nil {
+			cliutil.Verbosef("tree block %d: %s\n", logical, err)
+			continue
+		}
+		md := findReconDevice(w.devs, pr.DevID)
+		if md == nil || pr.Offset+w.bs > md.size {
+			cliutil.Verbosef("tree block %d: no image holds physical "+
+				"offset %d of device %d\n", logical, pr.Offset, pr.DevID)
+			continue
+		}
+		if err := ioutil.ReadBlockAt(md.r, block, pr.Offset); err != nil {
+			var unreadable *ddrescue.UnreadableError
+			if errors.As(err, &unreadable) {
+				cliutil.Verbosef("tree block %d: %s\n", logical, err)
+				continue
+			}
+			return nil, nil, 0, 0, err
+		}
+		if btrfs.Header(block).ByteNr() != logical ||
+			!w.s.isFSBlock(block) {
+			cliutil.Verbosef("no tree block %d at offset %d of device %d\n",
+				logical, pr.Offset, pr.DevID)
+			continue
+		}
+		st, err := w.s.blockStatus(block)
+		if err != nil {
+			return nil, nil, 0, 0, err
+		}
+		if buf == nil || st == csum.StatusOK {
+			buf, d, off, status = append([]byte(nil), block...), md,
+				pr.Offset, st
+		}
+		if st == csum.StatusOK {
+			break
+		}
+	}
+	return buf, d, off, status, nil
+}
+
+// fallbackRegions returns the device extents of the chunks holding failed
+// blocks, merged where they overlap. If a block is not in a known chunk,
+// the whole devices are returned.
+func (w *treeWalker) fallbackRegions() []reconDevice {
+	var regions []reconDevice
+	seen := make(map[uint64]bool)
+	for _, logical := range w.failed {
+		m, err := w.cm.Lookup(logical)
+		if err != nil {
+			cliutil.Verbosef("tree block %d is not in a known chunk, "+
+				"scanning the whole devices\n", logical)
+			return w.devs
+		}
+		if seen[m.Logical] {
+			continue
+		}
+		seen[m.Logical] = true
+		for _, st := range m.Stripes {
+			d := findReconDevice(w.devs, st.DevID)
+			if d == nil {
+				continue
+			}
+			start := st.Offset - st.Offset%w.bs
+			end := st.Offset + m.DevExtentLength()
+			end = min(d.size, (end+w.bs-1)/w.bs*w.bs)
+			if start < end {
+				regions = append(regions, reconDevice{d.devID, d.r, end,
+					start})
+			}
+		}
+	}
+	sort.Slice(regions, func(i, j int) bool {
+		a, b := regions[i], regions[j]
+		return a.devID < b.devID || a.devID == b.devID && a.start < b.start
+	})
+	var merged []reconDevice
+	for _, r := range regions {
+		if n := len(merged); n > 0 && merged[n-1].devID == r.devID &&
+			r.start <= merged[n-1].size {
+			merged[n-1].size = max(merged[n-1].size, r.size)
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
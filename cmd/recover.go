@@ -6,6 +6,7 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -17,7 +18,9 @@ import (
 	"blichmann.eu/code/btrfscue/cmd/btrfscue/app"
 	cliutil "blichmann.eu/code/btrfscue/cmd/btrfscue/app/util"
 	"blichmann.eu/code/btrfscue/pkg/btrfs"
+	"blichmann.eu/code/btrfscue/pkg/btrfs/compression"
 	"blichmann.eu/code/btrfscue/pkg/btrfs/index"
+	"blichmann.eu/code/btrfscue/pkg/ddrescue"
 )
 
 type recoverFilesOptions struct {
@@ -27,14 +30,18 @@ type recoverFilesOptions struct {
 func init() {
 	options := recoverFilesOptions{}
 	recoverCmd := &cobra.Command{
-		Use:   "recover DEV/IMAGE DESTDIR",
+		Use:   "recover [DEV/IMAGE...] DESTDIR",
 		Short: "try to restore files from a damaged filesystem",
-		Args:  cobra.ExactArgs(2),
+		Args:  cobra.MinimumNArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
 			if len(app.Global.Metadata) == 0 {
 				cliutil.Fatalf("missing metadata option\n")
 			}
-			doRecoverFiles(args[0], args[1], app.Global.Metadata, options)
+			if len(args) == 1 && len(app.Global.Devices) == 0 {
+				cliutil.Fatalf("missing device or image\n")
+			}
+			doRecoverFiles(args[:len(args)-1], args[len(args)-1],
+				app.Global.Metadata, options)
 		},
 	}
 
@@ -45,14 +52,14 @@ func init() {
 	rootCmd.AddCommand(recoverCmd)
 }
 
-func doRecoverFiles(imagePath, destDir, metadata string, options recoverFilesOptions) {
-	ix, err := index.OpenReadOnly(metadata)
+func doRecoverFiles(images []string, destDir, metadata string, options recoverFilesOptions) {
+	ix, err := openIndexReadOnly(metadata)
 	cliutil.ReportError(err)
 	defer ix.Close()
 
-	f, err := os.Open(imagePath)
-	cliutil.ReportError(err)
-	defer f.Close()
+	devs, closeDevs := openDevices(ix, images)
+	defer closeDevs()
+	checkDevices(ix, devs)
 
 	if err := os.MkdirAll(destDir, 0755); err != nil {
 		cliutil.Fatalf("failed to create destination directory: %v\n", err)
@@ -65,7 +72,7 @@ func doRecoverFiles(imagePath, destDir, metadata string, options recoverFilesOpt
 	dirID := uint64(btrfs.FirstFreeObjectID)
 
 	cliutil.Verbosef("Recovering root directory tree from subvolume %d...\n", owner)
-	if err := recoverDir(ix, f, owner, dirID, destDir, options, visited); err != nil {
+	if err := recoverDir(ix, devs, owner, dirID, destDir, options, visited); err != nil {
 		cliutil.Warnf("failed to recover root directory: %v\n", err)
 	}
 
@@ -77,14 +84,14 @@ func doRecoverFiles(imagePath, destDir, metadata string, options recoverFilesOpt
 			subvolName := fmt.Sprintf("subvol_%d", subOwner)
 			subvolDest := filepath.Join(destDir, subvolName)
 			cliutil.Verbosef("Recovering unreferenced subvolume %d to %s...\n", subOwner, subvolDest)
-			if err := recoverDir(ix, f, subOwner, btrfs.FirstFreeObjectID, subvolDest, options, visited); err != nil {
+			if err := recoverDir(ix, devs, subOwner, btrfs.FirstFreeObjectID, subvolDest, options, visited); err != nil {
 				cliutil.Warnf("failed to recover subvolume %d: %v\n", subOwner, err)
 			}
 		}
 	}
 }
 
-func recoverDir(ix *index.Index, devFile *os.File, owner, dirID uint64, currentDest string, options recoverFilesOptions, visited map[[2]uint64]bool) error {
+func recoverDir(ix *index.Index, devs index.Devices, owner, dirID uint64, currentDest string, options recoverFilesOptions, visited map[[2]uint64]bool) error {
 	key := [2]uint64{owner, dirID}
 	if visited[key] {
 		return nil
@@ -115,15 +122,15 @@ func recoverDir(ix *index.Index, devFile *os.File, owner, dirID uint64, currentD
 				subOwner = di.Location().ObjectID
 				subDirID = btrfs.FirstFreeObjectID
 			}
-			if err := recoverDir(ix, devFile, subOwner, subDirID, targetPath, options, visited); err != nil {
+			if err := recoverDir(ix, devs, subOwner, subDirID, targetPath, options, visited); err != nil {
 				cliutil.Warnf("failed to recover directory %s: %v\n", targetPath, err)
 			}
 		} else if di.Type() == btrfs.FtRegFile {
-			if err := recoverFile(ix, devFile, owner, di.Location().ObjectID, targetPath, options); err != nil {
+			if err := recoverFile(ix, devs, owner, di.Location().ObjectID, targetPath, options); err != nil {
 				cliutil.Warnf("failed to recover file %s: %v\n", targetPath, err)
 			}
 		} else if di.Type() == btrfs.FtSymlink {
-			if err := recoverSymlink(ix, devFile, owner, di.Location().ObjectID, targetPath, options); err != nil {
+			if err := recoverSymlink(ix, devs, owner, di.Location().ObjectID, targetPath, options); err != nil {
 				cliutil.Warnf("failed to recover symlink %s: %v\n", targetPath, err)
 			}
 		} else {
@@ -133,7 +140,7 @@ func recoverDir(ix *index.Index, devFile *os.File, owner, dirID uint64, currentD
 	return nil
 }
 
-func recoverFile(ix *index.Index, devFile *os.File, owner, inode uint64, targetPath string, options recoverFilesOptions) error {
+func recoverFile(ix *index.Index, devs index.Devices, owner, inode uint64, targetPath string, options recoverFilesOptions) error {
 	if _, err := os.Stat(targetPath); err == nil && !options.clobber {
 		cliutil.Verbosef("file %s already exists, skipping (--clobber not specified)\n", targetPath)
 		return nil
@@ -161,18 +168,35 @@ func recoverFile(ix *index.Index, devFile *os.File, owner, inode uint64, targetP
 		return nil
 	}
 
+	// Ranges of the file that could not be read from the images
+	var missing []byteRange
 	for ; r.HasNext(); e = r.Next() {
 		fileOffset := r.Key().Offset
 
-		if e.IsInline() {
-			inlineData := []byte(e.Data())
-			limit := len(inlineData)
+		if e.IsInline() || (e.Compression() != btrfs.CompressNone &&
+			e.DiskByteNr() != 0) {
+			// Inline and compressed extents are small enough to be
+			// decompressed in memory.
+			data, err := compression.ReadExtent(ix.NewLogicalReader(devs),
+				e, compression.DefaultSectorSize)
+			if err != nil {
+				cliutil.Warnf("%s: extent at %d: %v\n", targetPath,
+					fileOffset, err)
+				var unreadable *ddrescue.UnreadableError
+				if errors.As(err, &unreadable) {
+					// Compressed data is only usable as a whole
+					missing = addByteRange(missing, fileOffset,
+						fileOffset+e.NumBytes())
+					data = nil
+				}
+			}
+			limit := len(data)
 			if ii != nil && int64(fileOffset)+int64(limit) > int64(fileSize) {
-				limit = int(fileSize - fileOffset)
+				limit = int(int64(fileSize) - int64(fileOffset))
 			}
 			if limit > 0 {
-				if _, err := f.WriteAt(inlineData[:limit], int64(fileOffset)); err != nil {
-					return fmt.Errorf("write inline data failed: %w", err)
+				if _, err := f.WriteAt(data[:limit], int64(fileOffset)); err != nil {
+					return fmt.Errorf("write extent data failed: %w", err)
 				}
 			}
 		} else {
@@ -183,8 +207,8 @@ func recoverFile(ix *index.Index, devFile *os.File, owner, inode uint64, targetP
 					return fmt.Errorf("write zeros failed: %w", err)
 				}
 			} else {
-				_, physOffset := ix.Physical(e.DiskByteNr())
-				srcOffset := physOffset + e.Offset()
+				lr := ix.NewLogicalReader(devs)
+				srcOffset := e.DiskByteNr() + e.Offset()
 
 				const chunkSize = 1024 * 1024
 				buf := make([]byte, chunkSize)
@@ -196,7 +220,21 @@ func recoverFile(ix *index.Index, devFile *os.File, owner, inode uint64, targetP
 						toCopy = chunkSize
 					}
 
-					n, err := devFile.ReadAt(buf[:toCopy], int64(srcOffset+bytesCopied))
+					n, err := lr.ReadAt(buf[:toCopy], int64(srcOffset+bytesCopied))
+					var unreadable *ddrescue.UnreadableError
+					if errors.As(err, &unreadable) {
+						// Keep the readable data around the gaps
+						var bad []byteRange
+						var m int
+						m, bad, err = readAround(lr, buf[n:toCopy],
+							srcOffset+bytesCopied+uint64(n))
+						start := fileOffset + bytesCopied + uint64(n)
+						for _, b := range bad {
+							missing = addByteRange(missing, start+b.start,
+								start+b.end)
+						}
+						n += m
+					}
 					if n > 0 {
 						if _, wErr := f.WriteAt(buf[:n], int64(fileOffset+bytesCopied)); wErr != nil {
 							return fmt.Errorf("write file data failed: %w", wErr)
@@ -204,6 +242,13 @@ func recoverFile(ix *index.Index, devFile *os.File, owner, inode uint64, targetP
 						bytesCopied += uint64(n)
 					}
 					if err != nil {
+						var unmapped *btrfs.UnmappedError
+						if errors.As(err, &unmapped) {
+							// Leave a hole, but keep recovering other extents
+							cliutil.Warnf("%s: extent at %d: %v\n", targetPath,
+								fileOffset, err)
+							break
+						}
 						if err == io.EOF && bytesCopied < numBytes {
 							return fmt.Errorf("unexpected EOF reading device/image: %w", err)
 						}
@@ -218,11 +263,88 @@ func recoverFile(ix *index.Index, devFile *os.File, owner, inode uint64, targetP
 		if err := f.Truncate(int64(fileSize)); err != nil {
 			return fmt.Errorf("truncate failed: %w", err)
 		}
+		missing = clipByteRanges(missing, fileSize)
 	}
-	return nil
+	return markIncomplete(targetPath, missing)
+}
+
+// Granularity at which unreadable parts of extents are determined, the
+// sector size that ddrescue uses by default
+const recoverProbeSize = 512
+
+// byteRange is the range [start, end) of a file.
+type byteRange struct {
+	start, end uint64
+}
+
+// addByteRange adds [start, end) to the sorted ranges, merging it with
+// adjacent ones.
+func addByteRange(ranges []byteRange, start, end uint64) []byteRange {
+	if n := len(ranges); n > 0 && ranges[n-1].end == start {
+		ranges[n-1].end = end
+		return ranges
+	}
+	return append(ranges, byteRange{start, end})
+}
+
+// clipByteRanges drops the parts of the ranges beyond size.
+func clipByteRanges(ranges []byteRange, size uint64) []byteRange {
+	clipped := ranges[:0]
+	for _, r := range ranges {
+		if r.start >= size {
+			continue
+		}
+		r.end = min(r.end, size)
+		clipped = append(clipped, r)
+	}
+	return clipped
+}
+
+// readAround reads p from r at off in pieces of recoverProbeSize bytes,
+// zeroing the ones that were not rescued. It returns the number of bytes
+// processed and the unreadable ranges relative to off. Other errors stop the
+// read.
+func readAround(r io.ReaderAt, p []byte, off uint64) (int, []byteRange,
+	error) {
+	var bad []byteRange
+	for o := 0; o < len(p); o += recoverProbeSize {
+		piece := p[o:min(o+recoverProbeSize, len(p))]
+		n, err := r.ReadAt(piece, int64(off)+int64(o))
+		var unreadable *ddrescue.UnreadableError
+		if errors.As(err, &unreadable) {
+			clear(piece[n:])
+			bad = addByteRange(bad, uint64(o+n), uint64(o+len(piece)))
+		} else if err != nil {
+			return o + n, bad, err
+		}
+	}
+	return len(p), bad, nil
+}
+
+// markIncomplete warns about the ranges of a recovered file that could not
+// be read and lists them in a file next to it, named like it with an
+// ".incomplete" suffix. A stale list from an earlier run is removed.
+func markIncomplete(targetPath string, missing []byteRange) error {
+	listPath := targetPath + ".incomplete"
+	if len(missing) == 0 {
+		if err := os.Remove(listPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	var b strings.Builder
+	var size uint64
+	b.WriteString("# Byte ranges [start, end) that could not be read\n")
+	for _, r := range missing {
+		fmt.Fprintf(&b, "%d %d\n", r.start, r.end)
+		size += r.end - r.start
+	}
+	cliutil.Warnf("%s: incomplete, %d bytes in %d ranges could not be "+
+		"read, see %s\n", targetPath, size, len(missing), listPath)
+	return os.WriteFile(listPath, []byte(b.String()), 0644)
 }
 
-func recoverSymlink(ix *index.Index, devFile *os.File, owner, inode uint64, targetPath string, options recoverFilesOptions) error {
+func recoverSymlink(ix *index.Index, devs index.Devices, owner, inode uint64, targetPath string, options recoverFilesOptions) error {
 	if _, err := os.Lstat(targetPath); err == nil {
 		if !options.clobber {
 			cliutil.Verbosef("symlink %s already exists, skipping (--clobber not specified)\n", targetPath)
@@ -240,11 +362,10 @@ func recoverSymlink(ix *index.Index, devFile *os.File, owner, inode uint64, targ
 	if e.IsInline() {
 		target = e.Data()
 	} else {
-		if e.DiskByteNr() > 0 && devFile != nil {
-			_, physOffset := ix.Physical(e.DiskByteNr())
-			srcOffset := physOffset + e.Offset()
+		if e.DiskByteNr() > 0 && devs != nil {
+			srcOffset := e.DiskByteNr() + e.Offset()
 			buf := make([]byte, e.NumBytes())
-			if _, err := devFile.ReadAt(buf, int64(srcOffset)); err == nil {
+			if _, err := ix.NewLogicalReader(devs).ReadAt(buf, int64(srcOffset)); err == nil {
 				target = string(buf)
 			} else {
 				return fmt.Errorf("failed to read symlink target: %w", err)
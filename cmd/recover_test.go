@@ -4,12 +4,18 @@
 package cmd
 
 import (
+	"bytes"
+	"compress/zlib"
 	"encoding/binary"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
 
+	"github.com/klauspost/compress/zstd"
+
+	"blichmann.eu/code/btrfscue/cmd/btrfscue/app"
 	"blichmann.eu/code/btrfscue/pkg/btrfs"
 	"blichmann.eu/code/btrfscue/pkg/btrfs/index"
 	"blichmann.eu/code/btrfscue/pkg/uuid"
@@ -168,7 +174,7 @@ func TestRecoverCommand(t *testing.T) {
 	}
 
 	options := recoverFilesOptions{clobber: true}
-	doRecoverFiles(imagePath, destDir, metadataPath, options)
+	doRecoverFiles([]string{imagePath}, destDir, metadataPath, options)
 
 	recoveredFile := filepath.Join(destDir, "test.txt")
 	if data, err := ioutil.ReadFile(recoveredFile); err != nil {
@@ -184,3 +190,244 @@ func TestRecoverCommand(t *testing.T) {
 		t.Errorf("expected 'hello', got '%s'", string(data))
 	}
 }
+
+func TestRecoverAtGeneration(t *testing.T) {
+	td, err := ioutil.TempDir("", "btrfscue_recover_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	metadataPath := filepath.Join(td, "metadata.db")
+	imagePath := filepath.Join(td, "disk.img")
+	if err := ioutil.WriteFile(imagePath, make([]byte, 4096), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fsid := uuid.UUID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	ix, err := index.Open(metadataPath, 0644, &index.Options{
+		BlockSize:  4096,
+		FSID:       fsid,
+		Generation: ^uint64(0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	insert := func(k btrfs.Key, generation uint64, data []byte) {
+		h := makeHeader(btrfs.FSTreeObjectID, generation, fsid)
+		if err := ix.InsertItem(k, h, makeItem(k, 0, uint32(len(data))),
+			data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	inode := uint64(257)
+	insert(btrfs.Key{ObjectID: btrfs.FirstFreeObjectID,
+		Type: btrfs.DirItemKey, Offset: uint64(index.NameHash("file.txt"))}, 1,
+		makeDirItem(btrfs.Key{ObjectID: inode, Type: btrfs.InodeItemKey},
+			btrfs.FtRegFile, "file.txt"))
+	for gen, content := range map[uint64]string{1: "before", 5: "after!!"} {
+		insert(btrfs.Key{ObjectID: inode, Type: btrfs.InodeItemKey}, gen,
+			makeInodeItem(uint64(len(content)), 0644))
+		insert(btrfs.Key{ObjectID: inode, Type: btrfs.ExtentDataKey}, gen,
+			makeInlineFileExtentItem([]byte(content)))
+	}
+	ix.Close()
+
+	defer func() { app.Global.Generation = 0 }()
+	for _, tc := range []struct {
+		generation uint64
+		expected   string
+	}{{0, "after!!"}, {1, "before"}, {4, "before"}, {5, "after!!"}} {
+		app.Global.Generation = tc.generation
+		destDir := filepath.Join(td, fmt.Sprintf("gen%d", tc.generation))
+		doRecoverFiles([]string{imagePath}, destDir, metadataPath,
+			recoverFilesOptions{})
+		data, err := ioutil.ReadFile(filepath.Join(destDir, "file.txt"))
+		if err != nil {
+			t.Fatalf("generation %d: %v", tc.generation, err)
+		} else if string(data) != tc.expected {
+			t.Errorf("generation %d: expected '%s', got '%s'", tc.generation,
+				tc.expected, string(data))
+		}
+	}
+}
+
+func TestRecoverCompressed(t *testing.T) {
+	td, err := ioutil.TempDir("", "btrfscue_recover_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	metadataPath := filepath.Join(td, "metadata.db")
+	imagePath := filepath.Join(td, "disk.img")
+	destDir := filepath.Join(td, "recovered")
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), 1024)
+	e, _ := zstd.NewWriter(nil)
+	compressed := e.EncodeAll(content, nil)
+	e.Close()
+	image := make([]byte, 20000)
+	copy(image[10000:], compressed)
+	if err := ioutil.WriteFile(imagePath, image, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var inline bytes.Buffer
+	zw := zlib.NewWriter(&inline)
+	zw.Write([]byte("inline and compressed"))
+	zw.Close()
+
+	fsid := uuid.UUID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	ix, err := index.Open(metadataPath, 0644, &index.Options{
+		BlockSize:  4096,
+		FSID:       fsid,
+		Generation: ^uint64(0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	insert := func(owner uint64, k btrfs.Key, data []byte) {
+		h := makeHeader(owner, 1, fsid)
+		if err := ix.InsertItem(k, h, makeItem(k, 0, uint32(len(data))),
+			data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	insert(btrfs.ChunkTreeObjectID, btrfs.Key{
+		ObjectID: btrfs.FirstFreeObjectID, Type: btrfs.ChunkItemKey,
+		Offset: 1000000}, makeChunk(1<<20, 1, 0))
+	for i, name := range []string{"zstd.txt", "zlib.txt"} {
+		inode := uint64(257 + i)
+		insert(btrfs.FSTreeObjectID, btrfs.Key{
+			ObjectID: btrfs.FirstFreeObjectID, Type: btrfs.DirItemKey,
+			Offset: uint64(index.NameHash(name))},
+			makeDirItem(btrfs.Key{ObjectID: inode, Type: btrfs.InodeItemKey},
+				btrfs.FtRegFile, name))
+	}
+
+	// Refers to 100 bytes at offset 50 of the decompressed extent
+	insert(btrfs.FSTreeObjectID, btrfs.Key{ObjectID: 257,
+		Type: btrfs.InodeItemKey}, makeInodeItem(100, 0644))
+	fe := makeRegFileExtentItem(1010000, 4096, 50, 100)
+	binary.LittleEndian.PutUint64(fe[8:], uint64(len(content)))
+	fe[16] = btrfs.CompressZstd
+	insert(btrfs.FSTreeObjectID, btrfs.Key{ObjectID: 257,
+		Type: btrfs.ExtentDataKey}, fe)
+
+	insert(btrfs.FSTreeObjectID, btrfs.Key{ObjectID: 258,
+		Type: btrfs.InodeItemKey}, makeInodeItem(21, 0644))
+	fe = makeInlineFileExtentItem(inline.Bytes())
+	binary.LittleEndian.PutUint64(fe[8:], 21)
+	fe[16] = btrfs.CompressZlib
+	insert(btrfs.FSTreeObjectID, btrfs.Key{ObjectID: 258,
+		Type: btrfs.ExtentDataKey}, fe)
+	ix.Close()
+
+	doRecoverFiles([]string{imagePath}, destDir, metadataPath, recoverFilesOptions{})
+	for name, expected := range map[string]string{
+		"zstd.txt": string(content[50:150]),
+		"zlib.txt": "inline and compressed",
+	} {
+		data, err := ioutil.ReadFile(filepath.Join(destDir, name))
+		if err != nil {
+			t.Fatalf("failed to read recovered file: %v", err)
+		} else if string(data) != expected {
+			t.Errorf("%s: expected '%s', got '%s'", name, expected, data)
+		}
+	}
+}
+
+func TestRecoverMapfile(t *testing.T) {
+	td, err := ioutil.TempDir("", "btrfscue_recover_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	metadataPath := filepath.Join(td, "metadata.db")
+	imagePath := filepath.Join(td, "disk.img")
+	mapfilePath := filepath.Join(td, "disk.map")
+	destDir := filepath.Join(td, "recovered")
+
+	fsid := uuid.UUID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	ix, err := index.Open(metadataPath, 0644, &index.Options{
+		BlockSize:  4096,
+		FSID:       fsid,
+		Generation: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const fileSize = 3000
+	insert := func(owner uint64, k btrfs.Key, data []byte) {
+		h := makeHeader(owner, 1, fsid)
+		item := makeItem(k, 0, uint32(len(data)))
+		if err := ix.InsertItem(k, h, item, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	insert(btrfs.ChunkTreeObjectID, btrfs.Key{
+		ObjectID: btrfs.FirstFreeObjectID, Type: btrfs.ChunkItemKey,
+		Offset: 1000000}, makeChunk(4096, 1, 8192))
+	insert(btrfs.FSTreeObjectID, btrfs.Key{
+		ObjectID: btrfs.FirstFreeObjectID, Type: btrfs.DirItemKey,
+		Offset: uint64(index.NameHash("file"))},
+		makeDirItem(btrfs.Key{ObjectID: 257, Type: btrfs.InodeItemKey},
+			btrfs.FtRegFile, "file"))
+	insert(btrfs.FSTreeObjectID, btrfs.Key{ObjectID: 257,
+		Type: btrfs.InodeItemKey}, makeInodeItem(fileSize, 0644))
+	insert(btrfs.FSTreeObjectID, btrfs.Key{ObjectID: 257,
+		Type: btrfs.ExtentDataKey},
+		makeRegFileExtentItem(1000000, 4096, 0, 4096))
+	if err := ix.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	ix.Close()
+
+	image := make([]byte, 16384)
+	for i := range image {
+		image[i] = 0xab
+	}
+	if err := ioutil.WriteFile(imagePath, image, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// File bytes [512, 1536) and [2560, 3000) were not rescued
+	mapfile := "0 +\n" +
+		"0 8704 +\n" +
+		"8704 1024 -\n" +
+		"9728 1024 +\n" +
+		"10752 512 *\n"
+	if err := ioutil.WriteFile(mapfilePath, []byte(mapfile),
+		0644); err != nil {
+		t.Fatal(err)
+	}
+
+	app.Global.Mapfiles = []string{mapfilePath}
+	defer func() { app.Global.Mapfiles = nil }()
+	doRecoverFiles([]string{imagePath}, destDir, metadataPath,
+		recoverFilesOptions{})
+
+	expected := make([]byte, fileSize)
+	for i := range expected {
+		if i < 512 || i >= 1536 && i < 2560 {
+			expected[i] = 0xab
+		}
+	}
+	data, err := ioutil.ReadFile(filepath.Join(destDir, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, expected) {
+		t.Errorf("unexpected file content")
+	}
+	list, err := ioutil.ReadFile(filepath.Join(destDir, "file.incomplete"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const expectedList = "# Byte ranges [start, end) that could not be " +
+		"read\n512 1536\n2560 3000\n"
+	if string(list) != expectedList {
+		t.Errorf("%q vs %q", expectedList, list)
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"blichmann.eu/code/btrfscue/cmd/btrfscue/app"
 	cliutil "blichmann.eu/code/btrfscue/cmd/btrfscue/app/util"
 	"blichmann.eu/code/btrfscue/pkg/btrfs"
+	"blichmann.eu/code/btrfscue/pkg/btrfs/index"
 )
 
 // rootCmd represents the base command when called without any subcommands
@@ -48,6 +49,36 @@ For bug reporting instructions, please see:
 		"filesystem block size")
 	fs.StringVar(&global.Metadata, "metadata", os.Getenv("BTRFSCUE_METADATA"),
 		"metadata database to use")
+	fs.Uint64Var(&global.Generation, "generation", 0, "show the filesystem "+
+		"as it was at this transaction generation, 0 for the latest")
+	fs.StringArrayVar(&global.Devices, "device", nil, "image of a "+
+		"filesystem device as ID=PATH, or PATH to match by device UUID. "+
+		"Repeat for multi-device filesystems")
+	fs.StringArrayVar(&global.Mapfiles, "mapfile", nil, "GNU ddrescue "+
+		"mapfile of an image as ID=PATH, or PATH for a single image. Areas "+
+		"that were not rescued are treated as unreadable")
+	fs.IntVar(&global.Partition, "partition", 0, "use partition N of "+
+		"disk images with a GPT or MBR partition table")
+	fs.Uint64Var(&global.Offset, "offset", 0, "byte offset of the "+
+		"filesystem in the images")
+	fs.StringVar(&global.KeyFile, "key-file", "", "read the passphrase of "+
+		"LUKS containers from this file, - for stdin, instead of prompting")
+	fs.StringVar(&global.LV, "lv", "", "use the LVM2 logical volume "+
+		"VG/NAME of images that are physical volumes")
+}
+
+// indexGeneration returns the generation selected on the command-line.
+func indexGeneration() uint64 {
+	if gen := app.Global.Generation; gen != 0 {
+		return gen
+	}
+	return ^uint64(0)
+}
+
+// openIndexReadOnly opens the metadata index at the generation selected on
+// the command-line.
+func openIndexReadOnly(metadata string) (*index.Index, error) {
+	return index.OpenReadOnlyAt(metadata, indexGeneration())
 }
 
 // Execute adds all child commands to the root command and sets flags
@@ -0,0 +1,254 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Sub-command to decode and compare superblock copies
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"blichmann.eu/code/btrfscue/cmd/btrfscue/app"
+	cliutil "blichmann.eu/code/btrfscue/cmd/btrfscue/app/util"
+	"blichmann.eu/code/btrfscue/pkg/btrfs"
+	"blichmann.eu/code/btrfscue/pkg/btrfs/csum"
+	"blichmann.eu/code/btrfscue/pkg/ioutil"
+)
+
+func init() {
+	superCmd := &cobra.Command{
+		Use:   "super DEV/IMAGE",
+		Short: "decode all superblock copies and show where they differ",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			doDumpSuper(os.Stdout, args[0])
+		},
+	}
+
+	rootCmd.AddCommand(superCmd)
+}
+
+type superField struct {
+	name  string
+	value func(s btrfs.Superblock) string
+}
+
+func superFields() []superField {
+	u64 := func(name string, fn func(s btrfs.Superblock) uint64) superField {
+		return superField{name, func(s btrfs.Superblock) string {
+			return fmt.Sprint(fn(s))
+		}}
+	}
+	u32 := func(name string, fn func(s btrfs.Superblock) uint32) superField {
+		return superField{name, func(s btrfs.Superblock) string {
+			return fmt.Sprint(fn(s))
+		}}
+	}
+	u8 := func(name string, fn func(s btrfs.Superblock) uint8) superField {
+		return superField{name, func(s btrfs.Superblock) string {
+			return fmt.Sprint(fn(s))
+		}}
+	}
+	fields := []superField{
+		{"csum", func(s btrfs.Superblock) string {
+			t := s.CSumType()
+			c := s.CSum()
+			if l := csum.Size(t); l > 0 {
+				status := "ok"
+				if !csum.Verify(t, s) {
+					status = "BAD"
+				}
+				return fmt.Sprintf("%x (%s)", c[:l], status)
+			}
+			return fmt.Sprintf("%x (unknown)", c[:])
+		}},
+		{"fsid", func(s btrfs.Superblock) string { return s.FSID().String() }},
+		{"metadata_uuid", func(s btrfs.Superblock) string {
+			return s.MetadataUUID().String()
+		}},
+		u64("bytenr", btrfs.Superblock.ByteNr),
+		{"flags", func(s btrfs.Superblock) string {
+			return btrfs.SuperFlagsString(s.Flags())
+		}},
+		u64("generation", btrfs.Superblock.Generation),
+		u64("root", btrfs.Superblock.Root),
+		u8("root_level", btrfs.Superblock.RootLevel),
+		u64("chunk_root", btrfs.Superblock.ChunkRoot),
+		u8("chunk_root_level", btrfs.Superblock.ChunkRootLevel),
+		u64("chunk_root_generation", btrfs.Superblock.ChunkRootGeneration),
+		u64("log_root", btrfs.Superblock.LogRoot),
+		u8("log_root_level", btrfs.Superblock.LogRootLevel),
+		u64("total_bytes", btrfs.Superblock.TotalBytes),
+		u64("bytes_used", btrfs.Superblock.BytesUsed),
+		u64("root_dir_objectid", btrfs.Superblock.RootDirObjectID),
+		u64("num_devices", btrfs.Superblock.NumDevices),
+		u32("sectorsize", btrfs.Superblock.SectorSize),
+		u32("nodesize", btrfs.Superblock.NodeSize),
+		u32("stripesize", btrfs.Superblock.StripeSize),
+		u64("compat_flags", btrfs.Superblock.CompatFlags),
+		{"compat_ro_flags", func(s btrfs.Superblock) string {
+			return btrfs.CompatROFlagsString(s.CompatROFlags())
+		}},
+		{"incompat_flags", func(s btrfs.Superblock) string {
+			return btrfs.IncompatFlagsString(s.IncompatFlags())
+		}},
+		{"csum_type", func(s btrfs.Superblock) string {
+			return btrfs.CSumTypeString(s.CSumType())
+		}},
+		{"label", func(s btrfs.Superblock) string {
+			return fmt.Sprintf("%q", s.Label())
+		}},
+		u64("cache_generation", btrfs.Superblock.CacheGeneration),
+		u64("uuid_tree_generation", btrfs.Superblock.UUIDTreeGeneration),
+		u64("block_group_root", btrfs.Superblock.BlockGroupRoot),
+		u64("block_group_root_generation",
+			btrfs.Superblock.BlockGroupRootGeneration),
+		{"dev_item.devid", func(s btrfs.Superblock) string {
+			return fmt.Sprint(s.DevItem().DevID())
+		}},
+		{"dev_item.uuid", func(s btrfs.Superblock) string {
+			return s.DevItem().UUID().String()
+		}},
+		{"dev_item.fsid", func(s btrfs.Superblock) string {
+			return s.DevItem().FSID().String()
+		}},
+		{"dev_item.total_bytes", func(s btrfs.Superblock) string {
+			return fmt.Sprint(s.DevItem().TotalBytes())
+		}},
+		{"dev_item.bytes_used", func(s btrfs.Superblock) string {
+			return fmt.Sprint(s.DevItem().BytesUsed())
+		}},
+		{"dev_item.generation", func(s btrfs.Superblock) string {
+			return fmt.Sprint(s.DevItem().Generation())
+		}},
+		u32("sys_chunk_array_size", btrfs.Superblock.SysChunkArraySize),
+		{"sys_chunk_array", func(s btrfs.Superblock) string {
+			keys, chunks := s.SysChunks()
+			var parts []string
+			for i, c := range chunks {
+				var stripes []string
+				for j := uint16(0); j < c.NumStripes(); j++ {
+					st := c.Stripe(j)
+					stripes = append(stripes, fmt.Sprintf("%d:%d", st.DevID(),
+						st.Offset()))
+				}
+				parts = append(parts, fmt.Sprintf("%d+%d=>%s", keys[i].Offset,
+					c.Length(), strings.Join(stripes, ",")))
+			}
+			return strings.Join(parts, " ")
+		}},
+	}
+	for i := 0; i < btrfs.NumBackupRoots; i++ {
+		i := i
+		backup := func(name string, fn func(r btrfs.RootBackup) uint64,
+			level func(r btrfs.RootBackup) uint8) superField {
+			return superField{fmt.Sprintf("backup[%d].%s", i, name),
+				func(s btrfs.Superblock) string {
+					r := s.BackupRoot(i)
+					if level == nil {
+						return fmt.Sprint(fn(r))
+					}
+					return fmt.Sprintf("%d (level %d)", fn(r), level(r))
+				}}
+		}
+		fields = append(fields,
+			backup("tree_root", btrfs.RootBackup.TreeRoot,
+				btrfs.RootBackup.TreeRootLevel),
+			backup("tree_root_gen", btrfs.RootBackup.TreeRootGen, nil),
+			backup("chunk_root", btrfs.RootBackup.ChunkRoot,
+				btrfs.RootBackup.ChunkRootLevel),
+			backup("chunk_root_gen", btrfs.RootBackup.ChunkRootGen, nil),
+			backup("extent_root", btrfs.RootBackup.ExtentRoot,
+				btrfs.RootBackup.ExtentRootLevel),
+			backup("extent_root_gen", btrfs.RootBackup.ExtentRootGen, nil),
+			backup("fs_root", btrfs.RootBackup.FSRoot,
+				btrfs.RootBackup.FSRootLevel),
+			backup("fs_root_gen", btrfs.RootBackup.FSRootGen, nil),
+			backup("dev_root", btrfs.RootBackup.DevRoot,
+				btrfs.RootBackup.DevRootLevel),
+			backup("dev_root_gen", btrfs.RootBackup.DevRootGen, nil),
+			backup("csum_root", btrfs.RootBackup.CSumRoot,
+				btrfs.RootBackup.CSumRootLevel),
+			backup("csum_root_gen", btrfs.RootBackup.CSumRootGen, nil),
+			backup("total_bytes", btrfs.RootBackup.TotalBytes, nil),
+			backup("bytes_used", btrfs.RootBackup.BytesUsed, nil),
+			backup("num_devices", btrfs.RootBackup.NumDevices, nil),
+		)
+	}
+	return fields
+}
+
+// readSuperblocks reads all superblock copies that fit on the device. Copies
+// that cannot be read or that have an invalid magic are returned as nil.
+func readSuperblocks(r io.ReaderAt, devSize uint64) []btrfs.Superblock {
+	supers := make([]btrfs.Superblock, len(btrfs.SuperInfoOffsets))
+	for i, o := range btrfs.SuperInfoOffsets {
+		if o+btrfs.SuperInfoSize > devSize {
+			break
+		}
+		s := make(btrfs.Superblock, btrfs.SuperInfoSize)
+		if err := ioutil.ReadBlockAt(r, s, o); err != nil {
+			cliutil.Warnf("cannot read superblock at %d: %s\n", o, err)
+			continue
+		}
+		if s.IsValid() {
+			supers[i] = s
+		}
+	}
+	return supers
+}
+
+func doDumpSuper(w io.Writer, filename string) {
+	img, err := openImage(filename)
+	cliutil.ReportError(err)
+	defer img.Close()
+
+	var supers []btrfs.Superblock
+	var offsets []uint64
+	for i, s := range readSuperblocks(img, uint64(img.Size())) {
+		if s == nil {
+			cliutil.Verbosef("no valid superblock at %d\n",
+				btrfs.SuperInfoOffsets[i])
+			continue
+		}
+		supers = append(supers, s)
+		offsets = append(offsets, btrfs.SuperInfoOffsets[i])
+	}
+	if len(supers) == 0 {
+		cliutil.Fatalf("no valid superblock found\n")
+	}
+
+	var c byte = ' '
+	if app.Global.Machine {
+		c = '\t'
+	}
+	tw := tabwriter.NewWriter(w, 1, 4, 1, c, 0)
+	if !app.Global.Machine {
+		fmt.Fprint(tw, "\tfield")
+		for _, o := range offsets {
+			fmt.Fprintf(tw, "\tcopy @%d", o)
+		}
+		fmt.Fprintln(tw)
+	}
+	for _, f := range superFields() {
+		// Mark fields that differ between copies. The bytenr and checksum
+		// fields are expected to differ, so they are never highlighted.
+		values := make([]string, len(supers))
+		differ := false
+		for i, s := range supers {
+			values[i] = f.value(s)
+			differ = differ || values[i] != values[0]
+		}
+		if differ && f.name != "bytenr" && f.name != "csum" {
+			fmt.Fprint(tw, "*")
+		}
+		fmt.Fprintf(tw, "\t%s\t%s\n", f.name, strings.Join(values, "\t"))
+	}
+	tw.Flush()
+}
@@ -0,0 +1,191 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Sub-command to upgrade legacy metadata indices
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+	"go.etcd.io/bbolt"
+
+	"blichmann.eu/code/btrfscue/cmd/btrfscue/app"
+	cliutil "blichmann.eu/code/btrfscue/cmd/btrfscue/app/util"
+	"blichmann.eu/code/btrfscue/pkg/btrfs/index"
+)
+
+// Name of the bucket holding the index items, see index.Open
+var indexBucketName = []byte("index")
+
+type upgradeIndexOptions struct {
+	output string
+}
+
+func init() {
+	options := upgradeIndexOptions{}
+	upgradeIndexCmd := &cobra.Command{
+		Use:   "upgrade-index",
+		Short: "upgrade metadata written by older versions",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(app.Global.Metadata) == 0 {
+				cliutil.Fatalf("missing metadata option\n")
+			}
+			doUpgradeIndex(app.Global.Metadata, options)
+		},
+	}
+
+	fs := upgradeIndexCmd.PersistentFlags()
+	fs.StringVarP(&options.output, "output", "o", "", "write the upgraded "+
+		"metadata to a new file instead of upgrading in place")
+
+	rootCmd.AddCommand(upgradeIndexCmd)
+}
+
+func doUpgradeIndex(metadata string, options upgradeIndexOptions) {
+	numItems, err := upgradeIndex(metadata, options.output)
+	cliutil.ReportError(err)
+	cliutil.Verbosef("upgraded %d items to metadata version v%d\n", numItems,
+		index.MetadataVersion)
+}
+
+// upgradeIndex migrates the metadata at src to the current index version.
+// If dst is non-empty, src is left untouched and the result is written to
+// the new file dst. Returns the number of items migrated.
+func upgradeIndex(src, dst string) (int, error) {
+	version, err := indexVersion(src)
+	if err != nil {
+		return 0, err
+	}
+	if version == index.MetadataVersion {
+		return 0, fmt.Errorf("metadata is already at version v%d",
+			index.MetadataVersion)
+	}
+	if version != index.MetadataVersionUpgradable {
+		return 0, fmt.Errorf("cannot upgrade metadata version v%d", version)
+	}
+
+	path := src
+	if dst != "" {
+		if err = copyFile(src, dst); err != nil {
+			return 0, err
+		}
+		path = dst
+	}
+	ix, err := index.Open(path, 0644, &index.Options{
+		AllowOldVersion: true,
+		Generation:      ^uint64(0),
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer ix.Close()
+
+	numItems := 0
+	err = ix.RawTx(func(db *bbolt.DB, tx *bbolt.Tx,
+		bucket *bbolt.Bucket) error {
+		m := append([]byte(nil), bucket.Get(index.MetadataKey)...)
+		if len(m) < 8 {
+			return fmt.Errorf("invalid index metadata")
+		}
+
+		// Migrate into a new bucket, so the original items can be counted
+		// against the migrated ones before replacing them. All of this
+		// happens in a single transaction, an interrupted upgrade leaves
+		// the metadata unchanged.
+		upgradeName := []byte("index-upgrade")
+		upgraded, err := tx.CreateBucket(upgradeName)
+		if err != nil {
+			return err
+		}
+		if err = bucket.ForEach(func(k, v []byte) error {
+			if bytes.Equal(k, index.MetadataKey) {
+				return nil
+			}
+			numItems++
+			return upgraded.Put(index.NewIndexKeyFromV1(k), v)
+		}); err != nil {
+			return err
+		}
+		if n := countKeys(upgraded); n != numItems {
+			return fmt.Errorf("item count mismatch after upgrade, expected "+
+				"%d got: %d", numItems, n)
+		}
+
+		if err = tx.DeleteBucket(indexBucketName); err != nil {
+			return err
+		}
+		if bucket, err = tx.CreateBucket(indexBucketName); err != nil {
+			return err
+		}
+		// The version is the first field of the index metadata
+		binary.LittleEndian.PutUint64(m, index.MetadataVersion)
+		if err = bucket.Put(index.MetadataKey, m); err != nil {
+			return err
+		}
+		if err = upgraded.ForEach(func(k, v []byte) error {
+			return bucket.Put(k, v)
+		}); err != nil {
+			return err
+		}
+		if n := countKeys(bucket) - 1; n != numItems {
+			return fmt.Errorf("item count mismatch after upgrade, expected "+
+				"%d got: %d", numItems, n)
+		}
+		return tx.DeleteBucket(upgradeName)
+	})
+	return numItems, err
+}
+
+// countKeys returns the number of keys in a bucket.
+func countKeys(b *bbolt.Bucket) int {
+	n := 0
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		n++
+	}
+	return n
+}
+
+// indexVersion returns the metadata version of an existing index without
+// modifying it.
+func indexVersion(path string) (uint64, error) {
+	if _, err := os.Stat(path); err != nil {
+		return 0, err
+	}
+	ix, err := index.Open(path, 0644, &index.Options{
+		ReadOnly:        true,
+		AllowOldVersion: true,
+		Generation:      ^uint64(0),
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer ix.Close()
+	return ix.Metadata().Version(), nil
+}
+
+// copyFile copies src to the new file dst. It fails if dst already exists.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
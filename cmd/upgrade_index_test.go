@@ -0,0 +1,122 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+package cmd
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.etcd.io/bbolt"
+
+	"blichmann.eu/code/btrfscue/pkg/btrfs"
+	"blichmann.eu/code/btrfscue/pkg/btrfs/index"
+	"blichmann.eu/code/btrfscue/pkg/uuid"
+)
+
+func makeKeyV1(owner uint64, k btrfs.Key, generation uint64) []byte {
+	ik := make([]byte, 33)
+	binary.BigEndian.PutUint64(ik[0:], owner)
+	ik[8] = k.Type
+	binary.BigEndian.PutUint64(ik[9:], k.ObjectID)
+	binary.BigEndian.PutUint64(ik[17:], k.Offset)
+	binary.BigEndian.PutUint64(ik[25:], generation)
+	return ik
+}
+
+// writeV1Index writes a metadata database the way btrfscue did up to
+// metadata version 20161109.
+func writeV1Index(t *testing.T, path string, fsid uuid.UUID) {
+	db, err := bbolt.Open(path, 0644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("index"))
+		if err != nil {
+			return err
+		}
+		m := make([]byte, 36)
+		binary.LittleEndian.PutUint64(m[0:], index.MetadataVersionUpgradable)
+		binary.LittleEndian.PutUint32(m[8:], 4096)
+		copy(m[12:], fsid[:])
+		binary.LittleEndian.PutUint64(m[28:], ^uint64(0))
+		if err = b.Put(index.MetadataKey, m); err != nil {
+			return err
+		}
+		for gen := uint64(1); gen <= 3; gen++ {
+			data := makeInodeItem(gen*100, 0100644)
+			item := append(makeItem(btrfs.Key{ObjectID: 257,
+				Type: btrfs.InodeItemKey}, 0, uint32(len(data))), data...)
+			if err = b.Put(makeKeyV1(btrfs.FSTreeObjectID, btrfs.Key{
+				ObjectID: 257, Type: btrfs.InodeItemKey}, gen),
+				item); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpgradeIndex(t *testing.T) {
+	td, err := ioutil.TempDir("", "upgrade_index_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+	fsid, _ := uuid.New("01234567-89ab-cdef-0123-456789abcdef")
+
+	src := filepath.Join(td, "v1")
+	writeV1Index(t, src, fsid)
+	if _, err = index.OpenReadOnly(src); err == nil {
+		t.Fatal("expected V1 metadata to be rejected")
+	}
+
+	check := func(path string) {
+		ix, err := index.OpenReadOnly(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ix.Close()
+		if v := ix.Metadata().Version(); v != index.MetadataVersion {
+			t.Errorf("expected version v%d, got: v%d", index.MetadataVersion,
+				v)
+		}
+		if ix.Metadata().FSID() != fsid {
+			t.Errorf("filesystem id not preserved")
+		}
+		ii := ix.FindInodeItem(btrfs.FSTreeObjectID, 257)
+		if ii == nil || ii.Size() != 300 {
+			t.Errorf("expected latest inode item with size 300")
+		}
+	}
+
+	// Into a new file, leaving the original alone
+	dst := filepath.Join(td, "v2")
+	if n, err := upgradeIndex(src, dst); err != nil || n != 3 {
+		t.Fatalf("expected 3 items upgraded, got: %d, %v", n, err)
+	}
+	check(dst)
+	if v, err := indexVersion(src); err != nil ||
+		v != index.MetadataVersionUpgradable {
+		t.Errorf("expected source to be unchanged, got: v%d, %v", v, err)
+	}
+	if _, err = upgradeIndex(src, dst); err == nil {
+		t.Error("expected error for existing output file")
+	}
+
+	// In place
+	if n, err := upgradeIndex(src, ""); err != nil || n != 3 {
+		t.Fatalf("expected 3 items upgraded, got: %d, %v", n, err)
+	}
+	check(src)
+	if _, err = upgradeIndex(src, ""); err == nil {
+		t.Error("expected error for already upgraded metadata")
+	}
+}
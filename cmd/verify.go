@@ -0,0 +1,68 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Sub-command to verify the digests stored in evidence files
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"blichmann.eu/code/btrfscue/cmd/btrfscue/app"
+	cliutil "blichmann.eu/code/btrfscue/cmd/btrfscue/app/util"
+	"blichmann.eu/code/btrfscue/pkg/diskimage"
+)
+
+func init() {
+	verifyCmd := &cobra.Command{
+		Use:   "verify IMAGE",
+		Short: "check E01, Ex01 and AFF4 images against stored digests",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if !doVerify(os.Stdout, args[0]) {
+				os.Exit(1)
+			}
+		},
+	}
+
+	rootCmd.AddCommand(verifyCmd)
+}
+
+// doVerify reads the whole image at path and compares it with the digests
+// stored in it. It reports whether all of them match.
+func doVerify(w io.Writer, path string) bool {
+	img, err := diskimage.Open(path)
+	cliutil.ReportError(err)
+	defer img.Close()
+
+	cliutil.Verbosef("reading %d bytes of %s image\n", img.Size(),
+		img.Format())
+	vs, err := diskimage.Verify(img)
+	cliutil.ReportError(err)
+	if len(vs) == 0 {
+		cliutil.Fatalf("%s: %s image has no stored digests\n", path,
+			img.Format())
+	}
+
+	var c byte = ' '
+	if app.Global.Machine {
+		c = '\t'
+	}
+	tw := tabwriter.NewWriter(w, 1, 4, 1, c, 0)
+	ok := true
+	for _, v := range vs {
+		status := "OK"
+		if !v.OK() {
+			status = fmt.Sprintf("MISMATCH, computed %x", v.Computed)
+			ok = false
+		}
+		fmt.Fprintf(tw, "%s\t%x\t%s\n", v.Algorithm, v.Sum, status)
+	}
+	tw.Flush()
+	return ok
+}
@@ -1,12 +1,16 @@
 module blichmann.eu/code/btrfscue
 
-go 1.18
+go 1.22
 
 require (
+	github.com/cespare/xxhash/v2 v2.2.0
 	github.com/cheggaaa/pb/v3 v3.1.0
 	github.com/hanwen/go-fuse/v2 v2.1.0
+	github.com/klauspost/compress v1.18.0
 	github.com/spf13/cobra v1.5.0
 	go.etcd.io/bbolt v1.3.6
+	golang.org/x/crypto v0.23.0
+	golang.org/x/sys v0.20.0
 )
 
 require (
@@ -18,5 +22,4 @@ require (
 	github.com/mattn/go-runewidth v0.0.13 // indirect
 	github.com/rivo/uniseg v0.3.4 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
-	golang.org/x/sys v0.0.0-20220829200755-d48e67d00261 // indirect
 )
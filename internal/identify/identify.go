@@ -7,6 +7,7 @@ package identify
 
 import (
 	"fmt"
+	"io"
 	"math/rand"
 	"os"
 	"sort"
@@ -68,11 +69,8 @@ type IdentifyFSOptions struct {
 	MinOccurrence  uint
 }
 
-func IdentifyFS(filename string, options IdentifyFSOptions) {
-	dev, err := os.Open(filename)
-	cliutil.ReportError(err)
-	defer dev.Close()
-
+// IdentifyFS samples the blocks of dev for the ids of BTRFS filesystems.
+func IdentifyFS(dev *io.SectionReader, options IdentifyFSOptions) {
 	bs := uint64(options.BlockSize)
 
 	// Get total file/device size
@@ -0,0 +1,71 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Look for BTRFS filesystems in the logical volumes of an LVM2 physical
+// volume
+
+package identify
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"blichmann.eu/code/btrfscue/cmd/btrfscue/app"
+	"blichmann.eu/code/btrfscue/pkg/lvm"
+)
+
+// IdentifyLogicalVolumes lists the visible logical volumes of a volume
+// group along with the BTRFS superblocks and tree blocks found in them. dev
+// holds the physical volume pv. Logical volumes that are partly stored on
+// other physical volumes or that cannot be read are not probed.
+func IdentifyLogicalVolumes(dev io.ReaderAt, vg *lvm.VolumeGroup,
+	pv *lvm.PhysicalVolume, options IdentifyFSOptions) error {
+	var c byte = ' '
+	if app.Global.Machine {
+		c = '\t'
+	}
+	w := tabwriter.NewWriter(os.Stdout, 1, 4, 1, c, 0)
+	if !app.Global.Machine {
+		fmt.Fprintf(w, "LVM2 volume group %s, physical volume %s:\n",
+			vg.Name, pv.Name)
+		fmt.Fprintln(w, "logical volume\tsize\tsegments\tpvs\tsuperblocks\t"+
+			"tree blocks\tfsid\tcontainer")
+	}
+	devices := map[string]io.ReaderAt{pv.UUID: dev}
+	for _, lv := range vg.LVs {
+		if !lv.Visible {
+			continue
+		}
+		var pvs []string
+		for _, p := range lv.PVs() {
+			pvs = append(pvs, p.Name)
+		}
+		superblocks, treeBlocks, fsid, container := "-", "-", "-", "-"
+		if r, err := lvm.NewReader(lv, devices); err == nil &&
+			len(pvs) == 1 && pvs[0] == pv.Name {
+			info, err := ProbeVolume(io.NewSectionReader(r, 0, r.Size()),
+				uint64(options.BlockSize), uint64(options.MinBlocks))
+			if err != nil {
+				return fmt.Errorf("%s/%s: %w", vg.Name, lv.Name, err)
+			}
+			superblocks = fmt.Sprint(info.Superblocks)
+			treeBlocks = fmt.Sprint(info.TreeBlocks)
+			if info.Superblocks > 0 || info.TreeBlocks > 0 {
+				fsid = info.FSID.String()
+			}
+			if info.Container != "" {
+				container = info.Container
+			}
+		}
+		if len(pvs) == 0 {
+			pvs = []string{"-"}
+		}
+		fmt.Fprintf(w, "%s/%s\t%d\t%s\t%s\t%s\t%s\t%s\t%s\n", vg.Name,
+			lv.Name, lv.Size(), strings.Join(lv.SegmentTypes(), ","),
+			strings.Join(pvs, ","), superblocks, treeBlocks, fsid, container)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,141 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Look for BTRFS filesystems in the partitions of a disk image
+
+package identify
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"blichmann.eu/code/btrfscue/cmd/btrfscue/app"
+	"blichmann.eu/code/btrfscue/pkg/btrfs"
+	"blichmann.eu/code/btrfscue/pkg/ioutil"
+	"blichmann.eu/code/btrfscue/pkg/luks"
+	"blichmann.eu/code/btrfscue/pkg/lvm"
+	"blichmann.eu/code/btrfscue/pkg/partition"
+	"blichmann.eu/code/btrfscue/pkg/uuid"
+)
+
+// VolumeInfo describes the BTRFS structures found in a volume.
+type VolumeInfo struct {
+	Superblocks int       // Number of valid superblock copies
+	FSID        uuid.UUID // Of the superblocks or the sampled tree blocks
+	TreeBlocks  uint      // Number of sampled tree blocks of FSID
+	Container   string    // Like LUKS2 if the volume is encrypted
+}
+
+// PartitionInfo describes the BTRFS structures found in a partition.
+type PartitionInfo struct {
+	partition.Partition
+	VolumeInfo
+}
+
+// ProbePartition probes a partition of dev with ProbeVolume.
+func ProbePartition(dev io.ReaderAt, p partition.Partition, bs,
+	numSamples uint64) (PartitionInfo, error) {
+	r := io.NewSectionReader(dev, int64(p.Start), int64(p.Size))
+	info, err := ProbeVolume(r, bs, numSamples)
+	return PartitionInfo{p, info}, err
+}
+
+// ProbeVolume reads the superblock copies of a volume and samples up to
+// numSamples of its blocks for tree blocks: the first ones after the
+// primary superblock, where the initial metadata chunk usually is, and the
+// rest evenly spaced.
+func ProbeVolume(r *io.SectionReader, bs, numSamples uint64) (VolumeInfo,
+	error) {
+	info := VolumeInfo{}
+	size := uint64(r.Size())
+	// Encrypted data and physical volumes are not worth sampling
+	if h, err := luks.ReadHeader(r); err == nil {
+		info.Container = fmt.Sprintf("LUKS%d", h.Version)
+		return info, nil
+	}
+	if _, _, err := lvm.ReadVolumeGroup(r); err == nil {
+		info.Container = "LVM2"
+		return info, nil
+	}
+	for _, o := range btrfs.SuperInfoOffsets {
+		if o+btrfs.SuperInfoSize > size {
+			break
+		}
+		s := make(btrfs.Superblock, btrfs.SuperInfoSize)
+		if err := ioutil.ReadBlockAt(r, s, o); err != nil {
+			return info, err
+		}
+		if s.IsValid() {
+			info.Superblocks++
+			info.FSID = s.FSID()
+		}
+	}
+
+	numBlocks := size / bs
+	samples := make(map[uint64]bool)
+	first := (btrfs.SuperInfoOffset + btrfs.SuperInfoSize + bs - 1) / bs
+	for b := first; b < numBlocks && b < first+numSamples/2; b++ {
+		samples[b] = true
+	}
+	if rest := numSamples - uint64(len(samples)); rest > 0 && numBlocks > 0 {
+		step := max(numBlocks/rest, 1)
+		for b := uint64(0); b < numBlocks; b += step {
+			samples[b] = true
+		}
+	}
+	buf := make([]byte, bs)
+	coll := FSIDCollecter{}
+	for b := range samples {
+		if err := ioutil.ReadBlockAt(r, buf, b*bs); err != nil {
+			return info, err
+		}
+		coll.CollectBlock(buf)
+	}
+	entries := coll.Entries(1)
+	for _, e := range entries {
+		if info.Superblocks == 0 || e.FSID == info.FSID {
+			info.FSID, info.TreeBlocks = e.FSID, e.Count
+			break
+		}
+	}
+	return info, nil
+}
+
+// IdentifyPartitions lists the partitions of a disk image along with the
+// BTRFS superblocks and tree blocks found in them.
+func IdentifyPartitions(dev io.ReaderAt, t *partition.Table,
+	options IdentifyFSOptions) error {
+	var c byte = ' '
+	if app.Global.Machine {
+		c = '\t'
+	}
+	w := tabwriter.NewWriter(os.Stdout, 1, 4, 1, c, 0)
+	if !app.Global.Machine {
+		fmt.Fprintf(w, "%s partition table:\n", t.Scheme)
+		fmt.Fprintln(w, "partition\tstart\tsize\ttype\tname\tsuperblocks\t"+
+			"tree blocks\tfsid\tcontainer")
+	}
+	for _, p := range t.Partitions {
+		info, err := ProbePartition(dev, p, uint64(options.BlockSize),
+			uint64(options.MinBlocks))
+		if err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+		name, fsid, container := p.Name, "-", info.Container
+		if name == "" {
+			name = "-"
+		}
+		if container == "" {
+			container = "-"
+		}
+		if info.Superblocks > 0 || info.TreeBlocks > 0 {
+			fsid = info.FSID.String()
+		}
+		fmt.Fprintf(w, "%d\t%d\t%d\t%s\t%s\t%d\t%d\t%s\t%s\n", p.Number,
+			p.Start, p.Size, p.Type, name, info.Superblocks, info.TreeBlocks,
+			fsid, container)
+	}
+	return w.Flush()
+}
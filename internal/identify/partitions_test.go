@@ -0,0 +1,45 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Tests for looking for filesystems in partitions
+
+package identify
+
+import (
+	"bytes"
+	"testing"
+
+	"blichmann.eu/code/btrfscue/pkg/partition"
+	"blichmann.eu/code/btrfscue/pkg/uuid"
+)
+
+func TestProbePartition(t *testing.T) {
+	const (
+		bs    = 4096
+		start = 1 << 20
+	)
+	fsid := uuid.UUID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	disk := make([]byte, 3<<20)
+	// Leaves right after the primary superblock of the partition
+	for b := 17; b < 21; b++ {
+		copy(disk[start+b*bs+32:], fsid[:])
+	}
+	p := partition.Partition{Number: 1, Start: start, Size: 2 << 20}
+	info, err := ProbePartition(bytes.NewReader(disk), p, bs, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Superblocks != 0 || info.FSID != fsid || info.TreeBlocks != 4 {
+		t.Errorf("unexpected %+v", info)
+	}
+
+	// Nothing in the other partition
+	p = partition.Partition{Number: 2, Start: 0, Size: 1 << 20}
+	if info, err = ProbePartition(bytes.NewReader(disk), p, bs,
+		100); err != nil {
+		t.Fatal(err)
+	}
+	if info.Superblocks != 0 || info.TreeBlocks != 0 {
+		t.Errorf("unexpected %+v", info)
+	}
+}
@@ -9,8 +9,11 @@ package rescuefs
 
 import (
 	"io"
+	"sync"
 
 	cliutil "blichmann.eu/code/btrfscue/cmd/btrfscue/app/util"
+	"blichmann.eu/code/btrfscue/pkg/btrfs"
+	"blichmann.eu/code/btrfscue/pkg/btrfs/compression"
 	"github.com/hanwen/go-fuse/v2/fuse"
 	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
 )
@@ -18,9 +21,11 @@ import (
 type extentMapEntry struct {
 	fileOffset uint64
 	length     uint64
-	physOffset uint64
+	logical    uint64 // Logical address of the data at fileOffset
 	diskByteNr uint64
-	devID      uint64
+
+	// Compressed extents need to be read and decompressed as a whole
+	compressed btrfs.FileExtentItem
 }
 
 type extentFile struct {
@@ -29,6 +34,11 @@ type extentFile struct {
 	owner     uint64
 	inode     uint64
 	extentMap []extentMapEntry
+
+	// Decompressed data of the most recently read compressed extent
+	cacheMu    sync.Mutex
+	cacheIndex int
+	cacheData  []byte
 }
 
 func newExtentFile(fs *rescueFS, owner, id uint64) nodefs.File {
@@ -37,29 +47,44 @@ func newExtentFile(fs *rescueFS, owner, id uint64) nodefs.File {
 		return nil
 	}
 	f := &extentFile{
-		File:      nodefs.NewReadOnlyFile(nodefs.NewDefaultFile()),
-		fs:        fs,
-		owner:     owner,
-		inode:     id,
-		extentMap: make([]extentMapEntry, 0, 1),
+		File:       nodefs.NewReadOnlyFile(nodefs.NewDefaultFile()),
+		fs:         fs,
+		owner:      owner,
+		inode:      id,
+		extentMap:  make([]extentMapEntry, 0, 1),
+		cacheIndex: -1,
 	}
 	for ; r.HasNext(); e = r.Next() {
-		var phys uint64
-		var dev uint64
-		if e.DiskByteNr() > 0 {
-			dev, phys = fs.ix.Physical(e.DiskByteNr())
-		}
-		f.extentMap = append(f.extentMap, extentMapEntry{
+		entry := extentMapEntry{
 			fileOffset: r.Key().Offset,
 			length:     e.NumBytes(),
-			physOffset: phys + e.Offset(),
+			logical:    e.DiskByteNr() + e.Offset(),
 			diskByteNr: e.DiskByteNr(),
-			devID:      dev,
-		})
+		}
+		if e.Compression() != btrfs.CompressNone && e.DiskByteNr() > 0 {
+			entry.compressed = append(btrfs.FileExtentItem(nil), e...)
+		}
+		f.extentMap = append(f.extentMap, entry)
 	}
 	return f
 }
 
+// decompressed returns the decompressed data of the ith extent.
+func (f *extentFile) decompressed(i int) ([]byte, error) {
+	f.cacheMu.Lock()
+	defer f.cacheMu.Unlock()
+	if f.cacheIndex == i {
+		return f.cacheData, nil
+	}
+	data, err := compression.ReadExtent(f.fs.ix.NewLogicalReader(f.fs.devs),
+		f.extentMap[i].compressed, compression.DefaultSectorSize)
+	if err != nil {
+		return nil, err
+	}
+	f.cacheIndex, f.cacheData = i, data
+	return data, nil
+}
+
 func (f *extentFile) String() string {
 	return "extentFile"
 }
@@ -100,7 +125,7 @@ func (f *extentFile) Read(buf []byte, off int64) (res fuse.ReadResult, code fuse
 	bytesRead := 0
 	bufLen := len(buf)
 
-	for _, entry := range f.extentMap {
+	for i, entry := range f.extentMap {
 		if off >= int64(entry.fileOffset+entry.length) {
 			continue
 		}
@@ -134,17 +159,32 @@ func (f *extentFile) Read(buf []byte, off int64) (res fuse.ReadResult, code fuse
 			for i := int64(0); i < chunkSize; i++ {
 				buf[destOffset+i] = 0
 			}
+		} else if entry.compressed != nil && f.fs.devs != nil {
+			data, err := f.decompressed(i)
+			if err != nil {
+				cliutil.Warnf("extent at logical %d: %v\n", entry.diskByteNr,
+					err)
+				return nil, fuse.EIO
+			}
+			// Zero-fill if the extent decompressed to less than expected
+			src := btrfs.SliceClamp(data, int(readStart-extentStart),
+				int(readEnd-extentStart))
+			n := copy(buf[destOffset:destOffset+chunkSize], src)
+			for j := int64(n); j < chunkSize; j++ {
+				buf[destOffset+j] = 0
+			}
 		} else {
 			// Read from physical device
-			physReadOffset := int64(entry.physOffset) + (readStart - extentStart)
-			if f.fs.dev == nil {
+			logicalReadOffset := int64(entry.logical) + (readStart - extentStart)
+			if f.fs.devs == nil {
 				// No device file provided: return zeroes
 				for i := int64(0); i < chunkSize; i++ {
 					buf[destOffset+i] = 0
 				}
 			} else {
-				if _, err := f.fs.dev.ReadAt(buf[destOffset:destOffset+chunkSize], physReadOffset); err != nil && err != io.EOF {
-					cliutil.Warnf("read error at physical offset %d: %v\n", physReadOffset, err)
+				lr := f.fs.ix.NewLogicalReader(f.fs.devs)
+				if _, err := lr.ReadAt(buf[destOffset:destOffset+chunkSize], logicalReadOffset); err != nil && err != io.EOF {
+					cliutil.Warnf("read error at logical offset %d: %v\n", logicalReadOffset, err)
 					return nil, fuse.EIO
 				}
 			}
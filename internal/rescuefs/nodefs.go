@@ -18,6 +18,7 @@ import (
 	"fmt" //DBG!!!
 
 	"blichmann.eu/code/btrfscue/pkg/btrfs"
+	"blichmann.eu/code/btrfscue/pkg/btrfs/compression"
 	"blichmann.eu/code/btrfscue/pkg/btrfs/index"
 )
 
@@ -181,8 +182,12 @@ func (n *rescueNode) Open(flags uint32, context *fuse.Context) (
 		return nil, fuse.ENOENT
 	}
 	if e.IsInline() {
-		return nodefs.NewReadOnlyFile(nodefs.NewDataFile(
-			[]byte(e.Data()))), fuse.OK
+		data, err := compression.ReadExtent(nil, e,
+			compression.DefaultSectorSize)
+		if err != nil {
+			return nil, fuse.EIO
+		}
+		return nodefs.NewReadOnlyFile(nodefs.NewDataFile(data)), fuse.OK
 	}
 
 	if f := newExtentFile(n.fs, n.owner, n.ixInode); f != nil {
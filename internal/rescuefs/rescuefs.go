@@ -8,8 +8,6 @@
 package rescuefs
 
 import (
-	"io"
-
 	"github.com/hanwen/go-fuse/v2/fuse"
 	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
 
@@ -20,14 +18,16 @@ type rescueFS struct {
 	metadata string
 	ix       *index.Index
 
-	dev io.ReaderAt
+	devs index.Devices
 
 	root   *basicNode
 	server *fuse.Server
 }
 
-func New(metadata string, ix *index.Index, dev io.ReaderAt) rescueFS {
-	r := rescueFS{metadata: metadata, ix: ix, dev: dev}
+func New(metadata string, ix *index.Index, devs index.Devices) rescueFS {
+	r := rescueFS{metadata: metadata, ix: ix, devs: devs}
+	// Build the chunk map before serving concurrent requests
+	ix.ChunkMap()
 	r.root = r.newNode()
 	return r
 }
@@ -9,14 +9,13 @@ package rescuefs
 
 import (
 	"errors"
-	"io"
 
-	"blichmann.eu/code/btrfscue/pkg/btrfs"
+	"blichmann.eu/code/btrfscue/pkg/btrfs/index"
 )
 
 type rescueFS struct{}
 
-func New(metadata string, ix *btrfs.Index, reader io.ReaderAt) rescueFS {
+func New(metadata string, ix *index.Index, devs index.Devices) rescueFS {
 	// Do nothing
 	return rescueFS{}
 }
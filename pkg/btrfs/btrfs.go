@@ -21,6 +21,11 @@ const (
 	// DefaultBlockSize is the default block size for BTRFS. It is the size
 	// of four pages on x86 (16384 bytes).
 	DefaultBlockSize = 4 * X86RegularPageSize
+
+	// StripeLen is the size of a contiguous stripe on each device of a
+	// striped chunk. It has been fixed at 64 KiB since the very first
+	// on-disk format.
+	StripeLen = 64 << 10
 )
 
 // Offsets of all superblock copies
@@ -66,6 +71,10 @@ const (
 	// Tracks free space in block groups
 	FreeSpaceTreeObjectID = 10
 
+	// Holds the block group items if the block group tree feature is enabled,
+	// otherwise they live in the extent tree
+	BlockGroupTreeObjectID = 11
+
 	// Device stats in the device tree
 	DevStatsObjectID = 0
 
@@ -446,7 +455,7 @@ func (c Chunk) SubStripes() uint16 { return SliceUint16LE(c[chunkSubStripes:]) }
 
 // Stripe returns the ith stripe of this chunk.
 func (c Chunk) Stripe(i uint16) Stripe {
-	return Stripe(c[chunkStripes+i*stripeEnd:])
+	return Stripe(c[chunkStripes+int(i)*stripeEnd:])
 }
 
 type InodeItem []byte
@@ -517,7 +526,7 @@ func (i InodeRefItem) Name() string {
 	if l > 255 {
 		l = 255
 	}
-	return string(i[inodeRefItemName : inodeRefItemName+l])
+	return string(SliceClamp(i, inodeRefItemName, inodeRefItemName+l))
 }
 
 // Directory item type
@@ -557,12 +566,12 @@ func (d DirItem) Name() string {
 	if l > 255 {
 		l = 255
 	}
-	return string(d[dirItemName : dirItemName+l])
+	return string(SliceClamp(d, dirItemName, dirItemName+l))
 }
 
 func (d DirItem) Data() string {
-	o := dirItemName + d.NameLen()
-	return string(d[o : o+d.DataLen()])
+	o := dirItemName + int(d.NameLen())
+	return string(SliceClamp(d, o, o+int(d.DataLen())))
 }
 
 func (d DirItem) IsDir() bool       { return d.Type() == FtDir }
@@ -578,8 +587,16 @@ const (
 	BlockGroupRaid10
 	BlockGroupRaid5
 	BlockGroupRaid6
-	// TODO(cblichmann): More constants and the block group masks
+	BlockGroupRaid1C3
+	BlockGroupRaid1C4
+	// TODO(cblichmann): More constants
 	// BlockGroupReserved = AVAIL_ALLOC_BIT_SINGLE | SPACE_INFO_GLOBAL_RSV
+
+	BlockGroupTypeMask = BlockGroupData | BlockGroupSystem |
+		BlockGroupMetadata
+	BlockGroupProfileMask = BlockGroupRaid0 | BlockGroupRaid1 |
+		BlockGroupDup | BlockGroupRaid10 | BlockGroupRaid5 |
+		BlockGroupRaid6 | BlockGroupRaid1C3 | BlockGroupRaid1C4
 )
 
 type BlockGroupItem []byte
@@ -603,6 +620,14 @@ const (
 	FileExtentPreAlloc
 )
 
+// File extent compression
+const (
+	CompressNone = iota
+	CompressZlib
+	CompressLZO
+	CompressZstd
+)
+
 type FileExtentItem []byte
 
 // FileExtentItem offsets for parsing from byte slice
@@ -662,13 +687,20 @@ func (i FileExtentItem) NumBytes() uint64 { return SliceUint64LE(i[fileExtentIte
 
 func (i FileExtentItem) IsInline() bool { return i.Type() == FileExtentInline }
 
+// InlineData returns the inline data as stored, which is compressed if
+// Compression() != CompressNone. Only valid if Type == FileExtentInline.
+func (i FileExtentItem) InlineData() []byte {
+	return SliceClamp(i, fileExtentItemDiskByteNr, len(i))
+}
+
 // The data returned is only valid if Type == FileExtentInline:
 func (i FileExtentItem) Data() string {
 	l := int(i.RAMBytes())
 	if l > DefaultBlockSize {
 		l = DefaultBlockSize
 	}
-	return string(i[fileExtentItemDiskByteNr : fileExtentItemDiskByteNr+l])
+	return string(SliceClamp(i, fileExtentItemDiskByteNr,
+		fileExtentItemDiskByteNr+l))
 }
 
 type CSumItem []byte
@@ -794,7 +826,7 @@ func (r RootRef) Name() string {
 	if l > 255 {
 		l = 255
 	}
-	return string(r[rootRefName : rootRefName+l])
+	return string(SliceClamp(r, rootRefName, rootRefName+l))
 }
 
 // Extent item flags
@@ -0,0 +1,344 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Mapping of logical to physical addresses
+
+package btrfs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"blichmann.eu/code/btrfscue/pkg/uuid"
+)
+
+// UnmappedError is returned for logical addresses that lie outside of all
+// known chunks.
+type UnmappedError struct {
+	Logical uint64
+}
+
+func (e *UnmappedError) Error() string {
+	return fmt.Sprintf("logical address %d is not mapped by any chunk",
+		e.Logical)
+}
+
+// ChunkStripe is the location of a chunk stripe on a device.
+type ChunkStripe struct {
+	DevID   uint64
+	Offset  uint64
+	DevUUID uuid.UUID
+}
+
+// ChunkMapping maps a range of the logical address space to its stripes.
+type ChunkMapping struct {
+	Logical    uint64
+	Length     uint64
+	StripeLen  uint64
+	Type       uint64 // Block group flags
+	SubStripes uint16
+	Stripes    []ChunkStripe
+}
+
+// NewChunkMapping decodes the chunk item at the given logical address.
+func NewChunkMapping(logical uint64, c Chunk) (ChunkMapping, error) {
+	if len(c) < chunkStripes {
+		return ChunkMapping{}, fmt.Errorf("chunk at %d too short", logical)
+	}
+	n := c.NumStripes()
+	if n == 0 || len(c) < chunkStripes+int(n)*stripeEnd {
+		return ChunkMapping{}, fmt.Errorf("chunk at %d has invalid number "+
+			"of stripes %d", logical, n)
+	}
+	if c.Length() == 0 || logical+c.Length() < logical {
+		return ChunkMapping{}, fmt.Errorf("chunk at %d has invalid length "+
+			"%d", logical, c.Length())
+	}
+	m := ChunkMapping{
+		Logical:    logical,
+		Length:     c.Length(),
+		StripeLen:  c.StripeLen(),
+		Type:       c.Type(),
+		SubStripes: c.SubStripes(),
+		Stripes:    make([]ChunkStripe, n),
+	}
+	for i := range m.Stripes {
+		s := c.Stripe(uint16(i))
+		m.Stripes[i] = ChunkStripe{s.DevID(), s.Offset(), s.DevUUID()}
+	}
+	return m, nil
+}
+
+// End returns the first logical address after the chunk.
+func (m *ChunkMapping) End() uint64 { return m.Logical + m.Length }
+
+// Contains returns whether the logical address lies within the chunk.
+func (m *ChunkMapping) Contains(logical uint64) bool {
+	return logical >= m.Logical && logical < m.End()
+}
+
+// Profile returns the replication profile of the chunk, one of the
+// BlockGroupRaid* flags, BlockGroupDup or 0 for single.
+func (m *ChunkMapping) Profile() uint64 {
+	return m.Type & BlockGroupProfileMask
+}
+
+// NumMirrors returns the number of complete copies of the data in the
+// chunk.
+func (m *ChunkMapping) NumMirrors() int {
+	switch m.Profile() {
+	case BlockGroupDup, BlockGroupRaid1, BlockGroupRaid10:
+		return 2
+	case BlockGroupRaid1C3:
+		return 3
+	case BlockGroupRaid1C4:
+		return 4
+	}
+	return 1
+}
+
+// DataStripes returns the number of stripes of the chunk that hold distinct
+// data, i.e. not counting mirrors and parity.
+func (m *ChunkMapping) DataStripes() int {
+	n := len(m.Stripes)
+	switch m.Profile() {
+	case BlockGroupDup, BlockGroupRaid1, BlockGroupRaid1C3,
+		BlockGroupRaid1C4:
+		return 1
+	case BlockGroupRaid10:
+		if m.SubStripes == 0 {
+			return 0
+		}
+		return n / int(m.SubStripes)
+	case BlockGroupRaid5:
+		return n - 1
+	case BlockGroupRaid6:
+		return n - 2
+	}
+	return n
+}
+
+// ParityStripes returns the number of parity stripes per stripe row of
+// RAID5 and RAID6 chunks, 0 for all other profiles.
+func (m *ChunkMapping) ParityStripes() int {
+	switch m.Profile() {
+	case BlockGroupRaid5:
+		return 1
+	case BlockGroupRaid6:
+		return 2
+	}
+	return 0
+}
+
+// DevExtentLength returns the number of bytes that each stripe of the chunk
+// occupies on its device. This is the length of the corresponding dev
+// extents.
+func (m *ChunkMapping) DevExtentLength() uint64 {
+	if n := m.DataStripes(); n > 0 {
+		return m.Length / uint64(n)
+	}
+	return 0
+}
+
+// Chunk encodes the mapping as a chunk item.
+func (m *ChunkMapping) Chunk(sectorSize uint32) Chunk {
+	c := make(Chunk, chunkStripes+len(m.Stripes)*stripeEnd)
+	binary.LittleEndian.PutUint64(c[chunkLength:], m.Length)
+	binary.LittleEndian.PutUint64(c[chunkOwner:], ExtentTreeObjectID)
+	binary.LittleEndian.PutUint64(c[chunkStripeLen:], m.StripeLen)
+	binary.LittleEndian.PutUint64(c[chunkType:], m.Type)
+	binary.LittleEndian.PutUint32(c[chunkIOAlign:], uint32(m.StripeLen))
+	binary.LittleEndian.PutUint32(c[chunkIOWidth:], uint32(m.StripeLen))
+	binary.LittleEndian.PutUint32(c[chunkSectorSize:], sectorSize)
+	binary.LittleEndian.PutUint16(c[chunkNumStripes:], uint16(len(m.Stripes)))
+	binary.LittleEndian.PutUint16(c[chunkSubStripes:], m.SubStripes)
+	for i, s := range m.Stripes {
+		o := chunkStripes + i*stripeEnd
+		binary.LittleEndian.PutUint64(c[o+stripeDevID:], s.DevID)
+		binary.LittleEndian.PutUint64(c[o+stripeOffset:], s.Offset)
+		copy(c[o+stripeDevUUID:], s.DevUUID[:])
+	}
+	return c
+}
+
+// PhysicalRange is a range of bytes on a single device.
+type PhysicalRange struct {
+	DevID  uint64
+	Offset uint64
+	Length uint64 // Number of bytes that are contiguous on the device
+}
+
+// Physical maps a logical address within the chunk to its location on the
+// device holding the given mirror.
+func (m *ChunkMapping) Physical(logical uint64, mirror int) (PhysicalRange,
+	error) {
+	if !m.Contains(logical) {
+		return PhysicalRange{}, &UnmappedError{logical}
+	}
+	if mirror < 0 || mirror >= m.NumMirrors() {
+		return PhysicalRange{}, fmt.Errorf("chunk at %d has no mirror %d",
+			m.Logical, mirror)
+	}
+	off := logical - m.Logical
+	switch m.Profile() {
+	case 0, BlockGroupDup, BlockGroupRaid1, BlockGroupRaid1C3,
+		BlockGroupRaid1C4:
+		if mirror >= len(m.Stripes) {
+			return PhysicalRange{}, fmt.Errorf("chunk at %d has only %d "+
+				"stripes", m.Logical, len(m.Stripes))
+		}
+		s := m.Stripes[mirror]
+		return PhysicalRange{s.DevID, s.Offset + off, m.Length - off}, nil
+	case BlockGroupRaid0, BlockGroupRaid10:
+		return m.stripedPhysical(off, mirror)
+	case BlockGroupRaid5, BlockGroupRaid6:
+		row, index, err := m.StripeRow(logical)
+		if err != nil {
+			return PhysicalRange{}, err
+		}
+		return row[index], nil
+	}
+	return PhysicalRange{}, fmt.Errorf("chunk at %d: unsupported profile %s",
+		m.Logical, ProfileString(m.Type))
+}
+
+// stripedPhysical maps an offset within a RAID0 or RAID10 chunk. Data is
+// distributed round-robin across the data stripes in units of StripeLen.
+// For RAID10, each data stripe consists of SubStripes consecutive stripes
+// holding mirrored copies.
+func (m *ChunkMapping) stripedPhysical(off uint64, mirror int) (
+	PhysicalRange, error) {
+	subStripes := 1
+	if m.Profile() == BlockGroupRaid10 {
+		subStripes = int(m.SubStripes)
+	}
+	n := len(m.Stripes)
+	if m.StripeLen == 0 || subStripes == 0 || n == 0 || n%subStripes != 0 {
+		return PhysicalRange{}, fmt.Errorf("chunk at %d has invalid stripe "+
+			"geometry (%d stripes, %d sub-stripes, stripe length %d)",
+			m.Logical, n, m.SubStripes, m.StripeLen)
+	}
+	if mirror >= subStripes {
+		return PhysicalRange{}, fmt.Errorf("chunk at %d has no mirror %d",
+			m.Logical, mirror)
+	}
+	dataStripes := uint64(n / subStripes)
+	stripeNr := off / m.StripeLen
+	stripeOff := off % m.StripeLen
+	index := int(stripeNr%dataStripes)*subStripes + mirror
+	row := stripeNr / dataStripes
+
+	s := m.Stripes[index]
+	length := m.StripeLen - stripeOff
+	if rest := m.Length - off; length > rest {
+		length = rest
+	}
+	return PhysicalRange{s.DevID, s.Offset + row*m.StripeLen + stripeOff,
+		length}, nil
+}
+
+// ChunkMap maps logical addresses to physical ones. Its chunks never
+// overlap.
+type ChunkMap struct {
+	chunks []ChunkMapping // Sorted by logical address
+}
+
+// Add adds a chunk to the map. It is an error if the chunk overlaps with
+// one that was added before, unless both are identical.
+func (cm *ChunkMap) Add(m ChunkMapping) error {
+	i := sort.Search(len(cm.chunks), func(i int) bool {
+		return cm.chunks[i].End() > m.Logical
+	})
+	if i < len(cm.chunks) && cm.chunks[i].Logical < m.End() {
+		c := &cm.chunks[i]
+		if c.Logical == m.Logical && c.Length == m.Length &&
+			c.Type == m.Type {
+			return nil
+		}
+		return fmt.Errorf("chunk [%d, %d) overlaps chunk [%d, %d)",
+			m.Logical, m.End(), c.Logical, c.End())
+	}
+	cm.chunks = append(cm.chunks, ChunkMapping{})
+	copy(cm.chunks[i+1:], cm.chunks[i:])
+	cm.chunks[i] = m
+	return nil
+}
+
+// AddChunk decodes and adds a chunk item at the given logical address.
+func (cm *ChunkMap) AddChunk(logical uint64, c Chunk) error {
+	m, err := NewChunkMapping(logical, c)
+	if err != nil {
+		return err
+	}
+	return cm.Add(m)
+}
+
+// Len returns the number of chunks in the map.
+func (cm *ChunkMap) Len() int { return len(cm.chunks) }
+
+// Chunks returns all chunks in order of their logical address.
+func (cm *ChunkMap) Chunks() []ChunkMapping { return cm.chunks }
+
+// Lookup returns the chunk containing the logical address or an
+// *UnmappedError.
+func (cm *ChunkMap) Lookup(logical uint64) (*ChunkMapping, error) {
+	i := sort.Search(len(cm.chunks), func(i int) bool {
+		return cm.chunks[i].End() > logical
+	})
+	if i == len(cm.chunks) || !cm.chunks[i].Contains(logical) {
+		return nil, &UnmappedError{logical}
+	}
+	return &cm.chunks[i], nil
+}
+
+// Physical maps a logical address to its location on the device holding the
+// given mirror. Mirror 0 always exists for mapped addresses.
+func (cm *ChunkMap) Physical(logical uint64, mirror int) (PhysicalRange,
+	error) {
+	m, err := cm.Lookup(logical)
+	if err != nil {
+		return PhysicalRange{}, err
+	}
+	return m.Physical(logical, mirror)
+}
+
+// StripeRow returns the locations of all blocks in the RAID5 or RAID6 stripe
+// row that holds the logical address, at the same offset within their
+// stripes: first the data stripes in logical order, then P and, for RAID6, Q.
+// index is the position of the data stripe holding the address. As in Linux
+// MD, parity rotates across the devices from one row to the next.
+func (m *ChunkMapping) StripeRow(logical uint64) (row []PhysicalRange,
+	index int, err error) {
+	if !m.Contains(logical) {
+		return nil, 0, &UnmappedError{logical}
+	}
+	parity := m.ParityStripes()
+	if parity == 0 {
+		return nil, 0, fmt.Errorf("chunk at %d is not RAID5 or RAID6",
+			m.Logical)
+	}
+	n := len(m.Stripes)
+	dataStripes := n - parity
+	if m.StripeLen == 0 || dataStripes < 1 {
+		return nil, 0, fmt.Errorf("chunk at %d has invalid stripe geometry "+
+			"(%d stripes, stripe length %d)", m.Logical, n, m.StripeLen)
+	}
+	off := logical - m.Logical
+	stripeNr := off / m.StripeLen
+	stripeOff := off % m.StripeLen
+	index = int(stripeNr % uint64(dataStripes))
+	rowNr := stripeNr / uint64(dataStripes)
+
+	length := m.StripeLen - stripeOff
+	if rest := m.Length - off; length > rest {
+		length = rest
+	}
+	row = make([]PhysicalRange, n)
+	for i := range row {
+		s := m.Stripes[(rowNr+uint64(i))%uint64(n)]
+		row[i] = PhysicalRange{s.DevID, s.Offset + rowNr*m.StripeLen +
+			stripeOff, length}
+	}
+	return row, index, nil
+}
@@ -0,0 +1,183 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Tests for the logical to physical mapping
+
+package btrfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+type testStripe struct{ devID, offset uint64 }
+
+func makeChunk(length, flags uint64, stripes ...testStripe) Chunk {
+	c := make(Chunk, chunkStripes+len(stripes)*stripeEnd)
+	binary.LittleEndian.PutUint64(c[chunkLength:], length)
+	binary.LittleEndian.PutUint64(c[chunkStripeLen:], 64*1024)
+	binary.LittleEndian.PutUint64(c[chunkType:], flags)
+	binary.LittleEndian.PutUint16(c[chunkNumStripes:], uint16(len(stripes)))
+	for i, s := range stripes {
+		o := chunkStripes + i*stripeEnd
+		binary.LittleEndian.PutUint64(c[o+stripeDevID:], s.devID)
+		binary.LittleEndian.PutUint64(c[o+stripeOffset:], s.offset)
+	}
+	return c
+}
+
+func TestChunkMap(t *testing.T) {
+	cm := ChunkMap{}
+	for _, c := range []struct {
+		logical uint64
+		chunk   Chunk
+	}{
+		{1 << 30, makeChunk(1<<20, BlockGroupData, testStripe{1, 1 << 22})},
+		{1 << 20, makeChunk(1<<20, BlockGroupMetadata|BlockGroupDup,
+			testStripe{1, 1 << 24}, testStripe{1, 1 << 25})},
+	} {
+		if err := cm.AddChunk(c.logical, c.chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cm.AddChunk(1<<30+4096, makeChunk(1<<20, BlockGroupData,
+		testStripe{1, 0})); err == nil {
+		t.Error("expected error for overlapping chunk")
+	}
+	if err := cm.AddChunk(1<<30, makeChunk(1<<20, BlockGroupData,
+		testStripe{1, 1 << 22})); err != nil {
+		t.Errorf("expected identical chunk to be accepted, got: %s", err)
+	}
+	if err := cm.AddChunk(0, makeChunk(4096, BlockGroupData)); err == nil {
+		t.Error("expected error for chunk without stripes")
+	}
+	if cm.Len() != 2 || cm.Chunks()[0].Logical != 1<<20 {
+		t.Fatalf("expected 2 chunks in logical order, got %d", cm.Len())
+	}
+
+	for _, tc := range []struct {
+		logical  uint64
+		mirror   int
+		expected PhysicalRange
+	}{
+		{1 << 30, 0, PhysicalRange{1, 1 << 22, 1 << 20}},
+		{1<<30 + 100, 0, PhysicalRange{1, 1<<22 + 100, 1<<20 - 100}},
+		{1<<20 + 4096, 1, PhysicalRange{1, 1<<25 + 4096, 1<<20 - 4096}},
+	} {
+		pr, err := cm.Physical(tc.logical, tc.mirror)
+		if err != nil {
+			t.Errorf("%d/%d: %s", tc.logical, tc.mirror, err)
+		} else if pr != tc.expected {
+			t.Errorf("%d/%d: expected %v, got: %v", tc.logical, tc.mirror,
+				tc.expected, pr)
+		}
+	}
+
+	var unmapped *UnmappedError
+	for _, logical := range []uint64{0, 1<<20 - 1, 1 << 21, 1<<30 + 1<<20} {
+		if _, err := cm.Physical(logical, 0); !errors.As(err, &unmapped) {
+			t.Errorf("%d: expected unmapped error, got: %v", logical, err)
+		}
+	}
+	if _, err := cm.Physical(1<<30, 1); err == nil {
+		t.Error("expected error for non-existing mirror")
+	}
+	if m, _ := cm.Lookup(1 << 20); m == nil || m.NumMirrors() != 2 ||
+		ProfileString(m.Type) != "dup" {
+		t.Error("expected dup chunk with two mirrors")
+	}
+}
+
+func TestChunkMapStriped(t *testing.T) {
+	const sl = 64 << 10
+	raid0 := ChunkMapping{Logical: 1 << 30, Length: 6 * sl, StripeLen: sl,
+		Type: BlockGroupData | BlockGroupRaid0, Stripes: []ChunkStripe{
+			{DevID: 1, Offset: 1 << 20}, {DevID: 2, Offset: 2 << 20},
+			{DevID: 3, Offset: 3 << 20}}}
+	raid10 := ChunkMapping{Logical: 2 << 30, Length: 4 * sl, StripeLen: sl,
+		Type: BlockGroupData | BlockGroupRaid10, SubStripes: 2,
+		Stripes: []ChunkStripe{{DevID: 1, Offset: 1 << 20},
+			{DevID: 2, Offset: 2 << 20}, {DevID: 3, Offset: 3 << 20},
+			{DevID: 4, Offset: 4 << 20}}}
+	for _, tc := range []struct {
+		m        *ChunkMapping
+		off      uint64
+		mirror   int
+		expected PhysicalRange
+	}{
+		{&raid0, 0, 0, PhysicalRange{1, 1 << 20, sl}},
+		{&raid0, 100, 0, PhysicalRange{1, 1<<20 + 100, sl - 100}},
+		{&raid0, sl + 4096, 0, PhysicalRange{2, 2<<20 + 4096, sl - 4096}},
+		{&raid0, 2 * sl, 0, PhysicalRange{3, 3 << 20, sl}},
+		{&raid0, 3*sl + 1, 0, PhysicalRange{1, 1<<20 + sl + 1, sl - 1}},
+		{&raid0, 5 * sl, 0, PhysicalRange{3, 3<<20 + sl, sl}},
+		{&raid10, 0, 0, PhysicalRange{1, 1 << 20, sl}},
+		{&raid10, 0, 1, PhysicalRange{2, 2 << 20, sl}},
+		{&raid10, sl + 8, 0, PhysicalRange{3, 3<<20 + 8, sl - 8}},
+		{&raid10, sl + 8, 1, PhysicalRange{4, 4<<20 + 8, sl - 8}},
+		{&raid10, 2 * sl, 1, PhysicalRange{2, 2<<20 + sl, sl}},
+		{&raid10, 3 * sl, 0, PhysicalRange{3, 3<<20 + sl, sl}},
+	} {
+		pr, err := tc.m.Physical(tc.m.Logical+tc.off, tc.mirror)
+		if err != nil {
+			t.Errorf("%s %d/%d: %s", ProfileString(tc.m.Type), tc.off,
+				tc.mirror, err)
+		} else if pr != tc.expected {
+			t.Errorf("%s %d/%d: expected %v, got: %v",
+				ProfileString(tc.m.Type), tc.off, tc.mirror, tc.expected, pr)
+		}
+	}
+	if _, err := raid0.Physical(raid0.Logical, 1); err == nil {
+		t.Error("expected error for non-existing raid0 mirror")
+	}
+	bad := raid10
+	bad.SubStripes = 3
+	if _, err := bad.Physical(bad.Logical, 0); err == nil {
+		t.Error("expected error for invalid raid10 geometry")
+	}
+}
+
+func TestChunkMapRAID56(t *testing.T) {
+	const sl = 64 << 10
+	raid6 := ChunkMapping{Logical: 1 << 30, Length: 4 * sl, StripeLen: sl,
+		Type: BlockGroupData | BlockGroupRaid6, Stripes: []ChunkStripe{
+			{DevID: 1, Offset: 1 << 20}, {DevID: 2, Offset: 2 << 20},
+			{DevID: 3, Offset: 3 << 20}, {DevID: 4, Offset: 4 << 20}}}
+	for _, tc := range []struct {
+		off   uint64
+		index int
+		devs  []uint64 // Data stripes, P and Q
+		phys  uint64   // Offset on the device
+	}{
+		{0, 0, []uint64{1, 2, 3, 4}, 0},
+		{sl + 42, 1, []uint64{1, 2, 3, 4}, 42},
+		{2*sl + 42, 0, []uint64{2, 3, 4, 1}, sl + 42},
+		{3 * sl, 1, []uint64{2, 3, 4, 1}, sl},
+	} {
+		row, index, err := raid6.StripeRow(raid6.Logical + tc.off)
+		if err != nil {
+			t.Errorf("%d: %s", tc.off, err)
+			continue
+		}
+		if index != tc.index {
+			t.Errorf("%d: expected data stripe %d, got: %d", tc.off,
+				tc.index, index)
+		}
+		for i, pr := range row {
+			s := raid6.Stripes[pr.DevID-1]
+			if pr.DevID != tc.devs[i] || pr.Offset != s.Offset+tc.phys ||
+				pr.Length != sl-tc.off%sl {
+				t.Errorf("%d: unexpected stripe %d: %v", tc.off, i, pr)
+			}
+		}
+		pr, err := raid6.Physical(raid6.Logical+tc.off, 0)
+		if err != nil || pr != row[index] {
+			t.Errorf("%d: expected %v, got: %v (%v)", tc.off, row[index], pr,
+				err)
+		}
+	}
+	if raid6.DataStripes() != 2 || raid6.ParityStripes() != 2 {
+		t.Error("expected two data and two parity stripes")
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Decompression of BTRFS file extents
+
+package compression
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+
+	"blichmann.eu/code/btrfscue/pkg/btrfs"
+)
+
+// DefaultSectorSize is the sector size used for LZO framing if the actual
+// one is unknown.
+const DefaultSectorSize = btrfs.X86RegularPageSize
+
+// MaxCompressedSize is the maximum size of a compressed extent, both on
+// disk and in memory.
+const MaxCompressedSize = 128 * 1024
+
+// Size of the LZO length headers
+const lzoLenSize = 4
+
+// ReadExtent returns the file data that an inline or a compressed regular
+// file extent refers to. For regular extents, the on-disk extent is read in
+// full from r at its logical address. The result is limited to the range
+// [Offset(), Offset()+NumBytes()) of the decompressed data.
+func ReadExtent(r io.ReaderAt, e btrfs.FileExtentItem, sectorSize uint32) (
+	[]byte, error) {
+	if e.IsInline() {
+		if e.Compression() == btrfs.CompressNone {
+			return []byte(e.Data()), nil
+		}
+		if e.RAMBytes() > MaxCompressedSize {
+			return nil, fmt.Errorf("inline extent too large: %d bytes",
+				e.RAMBytes())
+		}
+		return Decompress(e.Compression(), e.InlineData(), e.RAMBytes(),
+			sectorSize)
+	}
+	if e.DiskByteNr() == 0 {
+		// Hole
+		return make([]byte, e.NumBytes()), nil
+	}
+	if e.Compression() == btrfs.CompressNone {
+		data := make([]byte, e.NumBytes())
+		n, err := r.ReadAt(data, int64(e.DiskByteNr()+e.Offset()))
+		if err == io.EOF && n == len(data) {
+			err = nil
+		}
+		return data[:n], err
+	}
+
+	if e.DiskNumBytes() > MaxCompressedSize || e.RAMBytes() >
+		MaxCompressedSize {
+		return nil, fmt.Errorf("compressed extent too large: %d bytes on "+
+			"disk, %d in memory", e.DiskNumBytes(), e.RAMBytes())
+	}
+	buf := make([]byte, e.DiskNumBytes())
+	n, err := r.ReadAt(buf, int64(e.DiskByteNr()))
+	if err != nil && !(err == io.EOF && n > 0) {
+		return nil, err
+	}
+	data, err := Decompress(e.Compression(), buf[:n], e.RAMBytes(),
+		sectorSize)
+	start, end := e.Offset(), e.Offset()+e.NumBytes()
+	if end > uint64(len(data)) {
+		end = uint64(len(data))
+	}
+	if start > end {
+		start = end
+	}
+	return data[start:end], err
+}
+
+// Decompress decompresses the data of a compressed extent, as stored on
+// disk or inline, into a buffer of ramBytes bytes. Trailing data, like the
+// zero padding up to the next sector boundary, is ignored. sectorSize is
+// the filesystem sector size, which LZO uses for framing its segments.
+// If decompression fails, the data decompressed so far is returned along
+// with the error.
+func Decompress(t uint8, data []byte, ramBytes uint64, sectorSize uint32) (
+	[]byte, error) {
+	switch t {
+	case btrfs.CompressNone:
+		return data, nil
+	case btrfs.CompressZlib:
+		r, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return readFull(r, ramBytes)
+	case btrfs.CompressLZO:
+		return decompressLZO(data, ramBytes, sectorSize)
+	case btrfs.CompressZstd:
+		// Consecutive frames are decoded as a single stream
+		d, err := zstd.NewReader(bytes.NewReader(data),
+			zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		defer d.Close()
+		return readFull(d, ramBytes)
+	}
+	return nil, fmt.Errorf("unsupported compression type %s",
+		btrfs.CompressionString(t))
+}
+
+// readFull reads up to n bytes from r. It is not an error if r is
+// exhausted before that, as the last extent of a file may decompress to
+// fewer bytes than its size in memory.
+func readFull(r io.Reader, n uint64) ([]byte, error) {
+	buf := make([]byte, n)
+	read, err := io.ReadFull(r, buf)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		err = nil
+	}
+	return buf[:read], err
+}
+
+// decompressLZO decompresses an LZO compressed extent. The extent starts
+// with the total length of the compressed data, followed by segments, each
+// prefixed with its length. Each segment decompresses to at most one sector.
+// Segment headers never straddle a sector boundary, they are moved to the
+// next sector instead and the remainder is zero-padded.
+func decompressLZO(data []byte, ramBytes uint64, sectorSize uint32) (
+	[]byte, error) {
+	if sectorSize == 0 {
+		sectorSize = DefaultSectorSize
+	}
+	if len(data) < lzoLenSize {
+		return nil, fmt.Errorf("lzo: extent too short")
+	}
+	total := int(binary.LittleEndian.Uint32(data))
+	if total > len(data) || total < lzoLenSize {
+		return nil, fmt.Errorf("lzo: invalid total length %d", total)
+	}
+	out := make([]byte, 0, ramBytes)
+	ss := int(sectorSize)
+	for off := lzoLenSize; off < total && uint64(len(out)) < ramBytes; {
+		if rem := ss - off%ss; rem < lzoLenSize {
+			off += rem
+			continue
+		}
+		if off+lzoLenSize > total {
+			break
+		}
+		segLen := int(binary.LittleEndian.Uint32(data[off:]))
+		off += lzoLenSize
+		if segLen == 0 || off+segLen > total {
+			return out, fmt.Errorf("lzo: invalid segment length %d at %d",
+				segLen, off-lzoLenSize)
+		}
+		maxOut := int(ramBytes) - len(out)
+		if maxOut > ss {
+			maxOut = ss
+		}
+		var err error
+		if out, err = lzo1xDecompress(out, data[off:off+segLen],
+			maxOut); err != nil {
+			return out, err
+		}
+		off += segLen
+	}
+	return out, nil
+}
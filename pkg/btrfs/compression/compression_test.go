@@ -0,0 +1,111 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Tests for extent decompression
+
+package compression
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+
+	"blichmann.eu/code/btrfscue/pkg/btrfs"
+)
+
+// Hand-assembled LZO1X block: a literal run, an overlapping M3 match
+// followed by one literal and the end of stream marker.
+var lzoHello = []byte{17 + 6, 'h', 'e', 'l', 'l', 'o', ' ', 32 + 9, 5<<2 | 1,
+	0, '!', 17, 0, 0}
+
+func TestLZO1X(t *testing.T) {
+	out, err := lzo1xDecompress(nil, lzoHello, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "hello hello hello!" {
+		t.Errorf("unexpected output: %q", out)
+	}
+
+	// Long literal run, length encoded with a zero byte
+	lit := bytes.Repeat([]byte("x"), 3+15+255+1)
+	in := append([]byte{0, 0, 1}, lit...)
+	in = append(in, 17, 0, 0)
+	if out, err = lzo1xDecompress(nil, in, len(lit)); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(out, lit) {
+		t.Errorf("unexpected output of length %d", len(out))
+	}
+
+	if _, err = lzo1xDecompress(nil, lzoHello[:8], 100); err == nil {
+		t.Error("expected error for truncated input")
+	}
+	if _, err = lzo1xDecompress(nil, lzoHello, 10); err == nil {
+		t.Error("expected error for output overrun")
+	}
+	if _, err = lzo1xDecompress(nil, []byte{32 + 9, 0xFF, 0}, 100); err == nil {
+		t.Error("expected error for look-behind overrun")
+	}
+}
+
+func TestDecompressLZO(t *testing.T) {
+	const sectorSize = 32
+	seg1 := append([]byte{17 + 18}, "ABCDEFGHIJKLMNOPQR"...)
+	seg1 = append(seg1, 17, 0, 0)
+	data := make([]byte, 64)
+	o := 4
+	binary.LittleEndian.PutUint32(data[o:], uint32(len(seg1)))
+	o += 4 + copy(data[o+4:], seg1)
+	// Only two bytes left in the first sector, the header moves to the next
+	o = sectorSize
+	binary.LittleEndian.PutUint32(data[o:], uint32(len(lzoHello)))
+	o += 4 + copy(data[o+4:], lzoHello)
+	binary.LittleEndian.PutUint32(data, uint32(o))
+
+	out, err := Decompress(btrfs.CompressLZO, data, 36, sectorSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "ABCDEFGHIJKLMNOPQRhello hello hello!" {
+		t.Errorf("unexpected output: %q", out)
+	}
+}
+
+func TestDecompress(t *testing.T) {
+	expected := bytes.Repeat([]byte("btrfscue "), 1000)
+	padding := make([]byte, 100)
+
+	var zb bytes.Buffer
+	zw := zlib.NewWriter(&zb)
+	zw.Write(expected)
+	zw.Close()
+
+	// Two frames, as written when compressing in several steps
+	e, _ := zstd.NewWriter(nil)
+	zs := e.EncodeAll(expected[:4000], nil)
+	zs = e.EncodeAll(expected[4000:], zs)
+	e.Close()
+
+	for _, tc := range []struct {
+		t    uint8
+		data []byte
+	}{
+		{btrfs.CompressZlib, append(zb.Bytes(), padding...)},
+		{btrfs.CompressZstd, append(zs, padding...)},
+	} {
+		out, err := Decompress(tc.t, tc.data, uint64(len(expected)),
+			DefaultSectorSize)
+		if err != nil {
+			t.Errorf("%s: %v", btrfs.CompressionString(tc.t), err)
+		} else if !bytes.Equal(out, expected) {
+			t.Errorf("%s: unexpected output", btrfs.CompressionString(tc.t))
+		}
+	}
+
+	if _, err := Decompress(42, nil, 0, DefaultSectorSize); err == nil {
+		t.Error("expected error for unknown compression")
+	}
+}
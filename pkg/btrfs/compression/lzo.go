@@ -0,0 +1,220 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// LZO1X decompression
+
+package compression
+
+import (
+	"errors"
+)
+
+var (
+	errLZOInputOverrun    = errors.New("lzo: input overrun")
+	errLZOOutputOverrun   = errors.New("lzo: output overrun")
+	errLZOLookBehind      = errors.New("lzo: look-behind overrun")
+	errLZOInputNotEnded   = errors.New("lzo: input not consumed")
+	errLZOInvalidEncoding = errors.New("lzo: invalid encoding")
+)
+
+// Maximum distance of an M2 match
+const lzoM2MaxOffset = 0x0800
+
+// lzo1xDecompress decompresses a single LZO1X block, appending to out. At
+// most maxOut bytes are written. This follows the structure of the Linux
+// kernel's lzo1x_decompress_safe().
+func lzo1xDecompress(out, in []byte, maxOut int) ([]byte, error) {
+	ip := 0
+	start := len(out)
+	limit := start + maxOut
+
+	needIP := func(n int) error {
+		if ip+n > len(in) {
+			return errLZOInputOverrun
+		}
+		return nil
+	}
+	needOP := func(n int) error {
+		if len(out)+n > limit {
+			return errLZOOutputOverrun
+		}
+		return nil
+	}
+	// countZeros handles the run length encoding of long lengths: each zero
+	// byte adds 255, the final non-zero byte is added as is.
+	countZeros := func() (int, error) {
+		n := 0
+		for {
+			if err := needIP(1); err != nil {
+				return 0, err
+			}
+			if in[ip] != 0 {
+				break
+			}
+			n += 255
+			ip++
+		}
+		v := n + int(in[ip])
+		ip++
+		return v, nil
+	}
+	copyLiterals := func(t int) error {
+		if err := needIP(t); err != nil {
+			return err
+		}
+		if err := needOP(t); err != nil {
+			return err
+		}
+		out = append(out, in[ip:ip+t]...)
+		ip += t
+		return nil
+	}
+	copyMatch := func(mPos, t int) error {
+		if mPos < start {
+			return errLZOLookBehind
+		}
+		if err := needOP(t); err != nil {
+			return err
+		}
+		// Matches may overlap the output, copy byte-wise
+		for i := 0; i < t; i++ {
+			out = append(out, out[mPos+i])
+		}
+		return nil
+	}
+
+	if err := needIP(1); err != nil {
+		return out, err
+	}
+	state := 0
+	var t, next int
+	if in[0] > 17 {
+		t = int(in[0]) - 17
+		ip++
+		if t < 4 {
+			// Literals following the (non-existent) previous match
+			if err := copyLiterals(t); err != nil {
+				return out, err
+			}
+			state = t
+		} else {
+			if err := copyLiterals(t); err != nil {
+				return out, err
+			}
+			state = 4
+		}
+	}
+
+	for {
+		if err := needIP(1); err != nil {
+			return out, err
+		}
+		t = int(in[ip])
+		ip++
+		var mPos int
+		switch {
+		case t < 16 && state == 0:
+			// Literal run
+			if t == 0 {
+				v, err := countZeros()
+				if err != nil {
+					return out, err
+				}
+				t = v + 15
+			}
+			if err := copyLiterals(t + 3); err != nil {
+				return out, err
+			}
+			state = 4
+			continue
+		case t < 16 && state != 4:
+			// M1: two byte match right after a match with literals
+			if err := needIP(1); err != nil {
+				return out, err
+			}
+			next = t & 3
+			mPos = len(out) - 1 - t>>2 - int(in[ip])<<2
+			ip++
+			if err := copyMatch(mPos, 2); err != nil {
+				return out, err
+			}
+		case t < 16:
+			// M1: three byte match right after a literal run
+			if err := needIP(1); err != nil {
+				return out, err
+			}
+			next = t & 3
+			mPos = len(out) - (1 + lzoM2MaxOffset) - t>>2 - int(in[ip])<<2
+			ip++
+			if err := copyMatch(mPos, 3); err != nil {
+				return out, err
+			}
+		case t >= 64:
+			// M2
+			if err := needIP(1); err != nil {
+				return out, err
+			}
+			next = t & 3
+			mPos = len(out) - 1 - (t>>2)&7 - int(in[ip])<<3
+			ip++
+			if err := copyMatch(mPos, t>>5-1+2); err != nil {
+				return out, err
+			}
+		case t >= 32:
+			// M3
+			t = t&31 + 2
+			if t == 2 {
+				v, err := countZeros()
+				if err != nil {
+					return out, err
+				}
+				t += v + 31
+			}
+			if err := needIP(2); err != nil {
+				return out, err
+			}
+			next = int(in[ip]) | int(in[ip+1])<<8
+			ip += 2
+			mPos = len(out) - 1 - next>>2
+			next &= 3
+			if err := copyMatch(mPos, t); err != nil {
+				return out, err
+			}
+		default:
+			// M4, also encodes the end of stream
+			mPos = len(out) - (t&8)<<11
+			t = t&7 + 2
+			if t == 2 {
+				v, err := countZeros()
+				if err != nil {
+					return out, err
+				}
+				t += v + 7
+			}
+			if err := needIP(2); err != nil {
+				return out, err
+			}
+			next = int(in[ip]) | int(in[ip+1])<<8
+			ip += 2
+			mPos -= next >> 2
+			next &= 3
+			if mPos == len(out) {
+				if t != 3 {
+					return out, errLZOInvalidEncoding
+				}
+				if ip != len(in) {
+					return out, errLZOInputNotEnded
+				}
+				return out, nil
+			}
+			if err := copyMatch(mPos-0x4000, t); err != nil {
+				return out, err
+			}
+		}
+		// Up to three literals following a match
+		state = next
+		if err := copyLiterals(next); err != nil {
+			return out, err
+		}
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Checksum algorithms used by BTRFS for tree blocks, superblocks and data
+
+package csum
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"strings"
+
+	"github.com/cespare/xxhash/v2"
+	"golang.org/x/crypto/blake2b"
+
+	"blichmann.eu/code/btrfscue/pkg/btrfs"
+)
+
+// Types lists all supported checksum algorithms in order of likelihood.
+var Types = [...]uint16{
+	btrfs.CSumTypeCRC32,
+	btrfs.CSumTypeXXHash,
+	btrfs.CSumTypeSHA256,
+	btrfs.CSumTypeBlake2,
+}
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Size returns the number of significant bytes of a checksum of the given
+// type. Returns 0 for unknown types.
+func Size(t uint16) int {
+	switch t {
+	case btrfs.CSumTypeCRC32:
+		return crc32.Size
+	case btrfs.CSumTypeXXHash:
+		return 8
+	case btrfs.CSumTypeSHA256:
+		return sha256.Size
+	case btrfs.CSumTypeBlake2:
+		return blake2b.Size256
+	default:
+		return 0
+	}
+}
+
+// Sum computes the checksum of data using the given algorithm. Checksums
+// that are shorter than btrfs.CSumSize are zero-padded, just like they are
+// stored on disk.
+func Sum(t uint16, data []byte) (btrfs.CSum, error) {
+	c := btrfs.CSum{}
+	switch t {
+	case btrfs.CSumTypeCRC32:
+		binary.LittleEndian.PutUint32(c[:],
+			crc32.Checksum(data, castagnoliTable))
+	case btrfs.CSumTypeXXHash:
+		binary.LittleEndian.PutUint64(c[:], xxhash.Sum64(data))
+	case btrfs.CSumTypeSHA256:
+		s := sha256.Sum256(data)
+		copy(c[:], s[:])
+	case btrfs.CSumTypeBlake2:
+		s := blake2b.Sum256(data)
+		copy(c[:], s[:])
+	default:
+		return c, fmt.Errorf("unknown checksum type %d", t)
+	}
+	return c, nil
+}
+
+// Verify reports whether the stored checksum at the start of block, which
+// may be a tree block or a superblock, matches its contents.
+func Verify(t uint16, block []byte) bool {
+	if len(block) <= btrfs.CSumSize {
+		return false
+	}
+	c, err := Sum(t, block[btrfs.CSumSize:])
+	if err != nil {
+		return false
+	}
+	l := Size(t)
+	return bytes.Equal(c[:l], block[:l])
+}
+
+// Detect tries all supported checksum algorithms on the given block and
+// returns the first one that verifies.
+func Detect(block []byte) (uint16, bool) {
+	for _, t := range Types {
+		if Verify(t, block) {
+			return t, true
+		}
+	}
+	return 0, false
+}
+
+// ParseType parses a checksum algorithm name as returned by
+// btrfs.CSumTypeString().
+func ParseType(name string) (uint16, error) {
+	for _, t := range Types {
+		if strings.EqualFold(name, btrfs.CSumTypeString(t)) {
+			return t, nil
+		}
+	}
+	switch strings.ToLower(name) {
+	case "crc32":
+		return btrfs.CSumTypeCRC32, nil
+	case "xxhash":
+		return btrfs.CSumTypeXXHash, nil
+	case "blake2":
+		return btrfs.CSumTypeBlake2, nil
+	}
+	return 0, fmt.Errorf("unknown checksum algorithm: %s", name)
+}
+
+// Block checksum status as recorded in the index
+const (
+	StatusUnchecked = iota
+	StatusOK
+	StatusMismatch
+)
+
+func StatusString(s uint8) string {
+	switch s {
+	case StatusUnchecked:
+		return "unchecked"
+	case StatusOK:
+		return "ok"
+	case StatusMismatch:
+		return "mismatch"
+	default:
+		return fmt.Sprint(s)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Tests for BTRFS checksum algorithms
+
+package csum
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"blichmann.eu/code/btrfscue/pkg/btrfs"
+)
+
+func TestSum(t *testing.T) {
+	for _, c := range []struct {
+		t        uint16
+		data     string
+		expected string
+	}{
+		// Stored in little-endian: 0xe3069283
+		{btrfs.CSumTypeCRC32, "123456789", "839206e3"},
+		// Stored in little-endian: 0xef46db3751d8e999
+		{btrfs.CSumTypeXXHash, "", "99e9d85137db46ef"},
+		{btrfs.CSumTypeSHA256, "abc", "ba7816bf8f01cfea414140de5dae2223" +
+			"b00361a396177a9cb410ff61f20015ad"},
+		{btrfs.CSumTypeBlake2, "abc", "bddd813c634239723171ef3fee98579b" +
+			"94964e3bb1cb3e427262c8c068d52319"},
+	} {
+		s, err := Sum(c.t, []byte(c.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := hex.EncodeToString(s[:Size(c.t)]); actual != c.expected {
+			t.Errorf("%s: expected %s, actual %s", btrfs.CSumTypeString(c.t),
+				c.expected, actual)
+		}
+	}
+}
+
+func TestVerifyDetect(t *testing.T) {
+	for _, typ := range Types {
+		block := make([]byte, btrfs.X86RegularPageSize)
+		for i := btrfs.CSumSize; i < len(block); i++ {
+			block[i] = byte(i * 7)
+		}
+		s, _ := Sum(typ, block[btrfs.CSumSize:])
+		copy(block, s[:])
+		if !Verify(typ, block) {
+			t.Errorf("%s: expected block to verify", btrfs.CSumTypeString(typ))
+		}
+		if d, ok := Detect(block); !ok || d != typ {
+			t.Errorf("%s: detected %s", btrfs.CSumTypeString(typ),
+				btrfs.CSumTypeString(d))
+		}
+		block[100] ^= 1
+		if Verify(typ, block) {
+			t.Errorf("%s: expected corrupted block to fail",
+				btrfs.CSumTypeString(typ))
+		}
+		if _, ok := Detect(block); ok {
+			t.Errorf("%s: expected detection to fail", btrfs.CSumTypeString(typ))
+		}
+	}
+}
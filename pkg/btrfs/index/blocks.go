@@ -0,0 +1,242 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Per tree block information and auxiliary index metadata
+
+package index
+
+import (
+	"encoding/binary"
+
+	"go.etcd.io/bbolt"
+
+	"blichmann.eu/code/btrfscue/pkg/btrfs"
+)
+
+// Names of auxiliary buckets
+var (
+	blocksBucketName         = []byte("blocks")
+	blockLocationsBucketName = []byte("block-locations")
+	metadataBucketName       = []byte("metadata")
+)
+
+// Names of values in the metadata bucket
+const (
+	metadataCSumType  = "csum-type"
+	metadataScanState = "scan-state"
+)
+
+// BlockInfo holds information about a tree block that was found while
+// gathering metadata.
+type BlockInfo []byte
+
+// Offsets for parsing from byte slice
+const (
+	blockInfoPhysical   = 0
+	blockInfoOwner      = blockInfoPhysical + 8
+	blockInfoLevel      = blockInfoOwner + 8
+	blockInfoCSumStatus = blockInfoLevel + 1
+	blockInfoDevID      = blockInfoCSumStatus + 1
+	BlockInfoLen        = blockInfoDevID + 8
+)
+
+// Physical returns the on-disk offset the block was read from.
+func (b BlockInfo) Physical() uint64 { return btrfs.SliceUint64LE(b[blockInfoPhysical:]) }
+func (b BlockInfo) Owner() uint64    { return btrfs.SliceUint64LE(b[blockInfoOwner:]) }
+func (b BlockInfo) Level() uint8     { return b[blockInfoLevel] }
+
+// CSumStatus returns one of the csum.Status* constants.
+func (b BlockInfo) CSumStatus() uint8 { return b[blockInfoCSumStatus] }
+
+// DevID returns the id of the device the block was read from. Returns 0 if
+// unknown, which is the case for metadata written by older versions.
+func (b BlockInfo) DevID() uint64 {
+	if len(b) < BlockInfoLen {
+		return 0
+	}
+	return btrfs.SliceUint64LE(b[blockInfoDevID:])
+}
+
+// BlockLocation holds information about a tree block copy at a physical
+// location. Unlike BlockInfo, there is one per copy of a block.
+type BlockLocation []byte
+
+// Offsets for parsing from byte slice
+const (
+	blockLocationGeneration = 0
+	blockLocationOwner      = blockLocationGeneration + 8
+	blockLocationCSumStatus = blockLocationOwner + 8
+	BlockLocationLen        = blockLocationCSumStatus + 1
+)
+
+// Generation returns the latest generation of a block found at the location.
+func (b BlockLocation) Generation() uint64 { return btrfs.SliceUint64LE(b[blockLocationGeneration:]) }
+func (b BlockLocation) Owner() uint64      { return btrfs.SliceUint64LE(b[blockLocationOwner:]) }
+
+// CSumStatus returns one of the csum.Status* constants.
+func (b BlockLocation) CSumStatus() uint8 { return b[blockLocationCSumStatus] }
+
+// newBlockKey returns a key for the blocks bucket. The tuple
+// (logical, generation) is encoded in big endian for lexicographical
+// comparison.
+func newBlockKey(logical, generation uint64) []byte {
+	k := [16]byte{}
+	binary.BigEndian.PutUint64(k[:], logical)
+	binary.BigEndian.PutUint64(k[8:], generation)
+	return k[:]
+}
+
+// auxBucket returns the named bucket in the current transaction, creating it
+// if the index is writable. Returns nil if the bucket does not exist in a
+// read-only index.
+func (ix *Index) auxBucket(name []byte) (*bbolt.Bucket, error) {
+	if ix.tx == nil {
+		if err := ix.ensureTx(!ix.db.IsReadOnly()); err != nil {
+			return nil, err
+		}
+	}
+	if !ix.tx.Writable() {
+		return ix.tx.Bucket(name), nil
+	}
+	return ix.tx.CreateBucketIfNotExists(name)
+}
+
+// InsertBlock records information about a tree block, referenceable by its
+// logical address and generation. devID and physical give the location the
+// block was read from.
+func (ix *Index) InsertBlock(h btrfs.Header, devID, physical uint64,
+	csumStatus uint8) error {
+	if err := ix.ensureTx(true); err != nil {
+		return err
+	}
+	b, err := ix.auxBucket(blocksBucketName)
+	if err != nil {
+		return err
+	}
+	v := [BlockInfoLen]byte{}
+	binary.LittleEndian.PutUint64(v[blockInfoPhysical:], physical)
+	binary.LittleEndian.PutUint64(v[blockInfoOwner:], h.Owner())
+	v[blockInfoLevel] = h.Level()
+	v[blockInfoCSumStatus] = csumStatus
+	binary.LittleEndian.PutUint64(v[blockInfoDevID:], devID)
+	if err = b.Put(newBlockKey(h.ByteNr(), h.Generation()), v[:]); err != nil {
+		return err
+	}
+	if err = ix.insertBlockLocation(h, devID, physical,
+		csumStatus); err != nil {
+		return err
+	}
+	ix.txNum++
+	if ix.txNum > 10000 {
+		return ix.Commit()
+	}
+	return nil
+}
+
+// newBlockLocationKey returns a key for the block locations bucket, encoded
+// in big endian for lexicographical comparison.
+func newBlockLocationKey(logical, devID, physical uint64) []byte {
+	k := [24]byte{}
+	binary.BigEndian.PutUint64(k[:], logical)
+	binary.BigEndian.PutUint64(k[8:], devID)
+	binary.BigEndian.PutUint64(k[16:], physical)
+	return k[:]
+}
+
+// insertBlockLocation records the pair of logical and physical address of a
+// tree block. Where the same pair was seen before, the latest generation is
+// kept.
+func (ix *Index) insertBlockLocation(h btrfs.Header, devID, physical uint64,
+	csumStatus uint8) error {
+	b, err := ix.auxBucket(blockLocationsBucketName)
+	if err != nil {
+		return err
+	}
+	k := newBlockLocationKey(h.ByteNr(), devID, physical)
+	if old := BlockLocation(b.Get(k)); old != nil &&
+		old.Generation() > h.Generation() {
+		return nil
+	}
+	v := [BlockLocationLen]byte{}
+	binary.LittleEndian.PutUint64(v[blockLocationGeneration:],
+		h.Generation())
+	binary.LittleEndian.PutUint64(v[blockLocationOwner:], h.Owner())
+	v[blockLocationCSumStatus] = csumStatus
+	return b.Put(k, v[:])
+}
+
+// ForEachBlockLocation calls fn for every pair of logical and physical
+// address at which a tree block was found, in order of logical address,
+// device and physical address. Iteration stops at the first error.
+func (ix *Index) ForEachBlockLocation(fn func(logical, devID,
+	physical uint64, b BlockLocation) error) error {
+	b, _ := ix.auxBucket(blockLocationsBucketName)
+	if b == nil {
+		return nil
+	}
+	return b.ForEach(func(k, v []byte) error {
+		return fn(binary.BigEndian.Uint64(k), binary.BigEndian.Uint64(k[8:]),
+			binary.BigEndian.Uint64(k[16:]), v)
+	})
+}
+
+// FindBlock returns the information recorded for the tree block at the
+// given logical address and generation, or nil if there is none.
+func (ix *Index) FindBlock(logical, generation uint64) BlockInfo {
+	b, _ := ix.auxBucket(blocksBucketName)
+	if b == nil {
+		return nil
+	}
+	return b.Get(newBlockKey(logical, generation))
+}
+
+// ForEachBlock calls fn for every recorded tree block in order of logical
+// address and generation. Iteration stops at the first error.
+func (ix *Index) ForEachBlock(fn func(logical, generation uint64,
+	b BlockInfo) error) error {
+	b, _ := ix.auxBucket(blocksBucketName)
+	if b == nil {
+		return nil
+	}
+	return b.ForEach(func(k, v []byte) error {
+		return fn(binary.BigEndian.Uint64(k), binary.BigEndian.Uint64(k[8:]),
+			v)
+	})
+}
+
+// SetMetadataValue stores a named value in the index metadata.
+func (ix *Index) SetMetadataValue(name string, value []byte) error {
+	if err := ix.ensureTx(true); err != nil {
+		return err
+	}
+	b, err := ix.auxBucket(metadataBucketName)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(name), value)
+}
+
+// MetadataValue returns a named value from the index metadata or nil if it
+// was never set.
+func (ix *Index) MetadataValue(name string) []byte {
+	b, _ := ix.auxBucket(metadataBucketName)
+	if b == nil {
+		return nil
+	}
+	return b.Get([]byte(name))
+}
+
+// SetCSumType stores the checksum algorithm of the filesystem.
+func (ix *Index) SetCSumType(t uint16) error {
+	v := [2]byte{}
+	binary.LittleEndian.PutUint16(v[:], t)
+	return ix.SetMetadataValue(metadataCSumType, v[:])
+}
+
+// CSumType returns the checksum algorithm of the filesystem if it is known.
+func (ix *Index) CSumType() (uint16, bool) {
+	if v := ix.MetadataValue(metadataCSumType); len(v) == 2 {
+		return btrfs.SliceUint16LE(v), true
+	}
+	return 0, false
+}
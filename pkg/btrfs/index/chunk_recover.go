@@ -0,0 +1,259 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Reconstruction of chunk items from dev extents and block groups
+
+package index
+
+import (
+	"fmt"
+	"sort"
+
+	"blichmann.eu/code/btrfscue/pkg/btrfs"
+	"blichmann.eu/code/btrfscue/pkg/uuid"
+)
+
+// RecoveredChunk is a chunk that was rebuilt from its dev extents and its
+// block group item.
+type RecoveredChunk struct {
+	btrfs.ChunkMapping
+
+	// Latest generation of the items the chunk was rebuilt from
+	Generation uint64
+	// Whether an identical chunk item is known already
+	Known bool
+	// Whether the order of the stripes was assumed. Dev extents do not
+	// record it, so for profiles that stripe data (RAID0, RAID10, RAID5 and
+	// RAID6) device order is used, which may be wrong.
+	Unverified bool
+}
+
+// devExtent is a dev extent along with the location from its key.
+type devExtent struct {
+	devID, physical uint64
+	btrfs.DevExtent
+	generation uint64
+}
+
+// profileStripes returns the minimum number of stripes for a profile and
+// whether the number is fixed.
+func profileStripes(profile uint64) (int, bool) {
+	switch profile {
+	case 0:
+		return 1, true
+	case btrfs.BlockGroupDup, btrfs.BlockGroupRaid1:
+		return 2, true
+	case btrfs.BlockGroupRaid1C3:
+		return 3, true
+	case btrfs.BlockGroupRaid1C4:
+		return 4, true
+	case btrfs.BlockGroupRaid10:
+		return 2, false
+	case btrfs.BlockGroupRaid5:
+		return 2, false
+	case btrfs.BlockGroupRaid6:
+		return 3, false
+	}
+	return 1, false // RAID0
+}
+
+// sameChunk returns whether two mappings describe the same chunk. The order
+// of stripes is ignored, as it cannot be recovered from dev extents.
+func sameChunk(a, b *btrfs.ChunkMapping) bool {
+	if a.Logical != b.Logical || a.Length != b.Length || a.Type != b.Type ||
+		len(a.Stripes) != len(b.Stripes) {
+		return false
+	}
+	type loc struct{ devID, offset uint64 }
+	stripes := make(map[loc]int)
+	for _, s := range a.Stripes {
+		stripes[loc{s.DevID, s.Offset}]++
+	}
+	for _, s := range b.Stripes {
+		l := loc{s.DevID, s.Offset}
+		if stripes[l] == 0 {
+			return false
+		}
+		stripes[l]--
+	}
+	return true
+}
+
+// RecoverChunks rebuilds the chunks of the filesystem by pairing the dev
+// extents from the device tree with the block group items from the extent
+// tree or the block group tree, as they were at the index generation. This
+// allows mapping logical addresses even if no chunk tree leaves survived.
+// Chunks are returned in order of their logical address. Inconsistencies
+// between the sources, or with chunk items already in the index, are
+// returned as errors and the affected chunks are left out. Inferred chunks
+// are not taken into account.
+func (ix *Index) RecoverChunks() ([]RecoveredChunk, []error) {
+	var conflicts []error
+
+	devUUIDs := make(map[uint64]uuid.UUID)
+	for r, d := ix.DevItems(); r.HasNext(); d = r.Next() {
+		devUUIDs[r.Key().Offset] = btrfs.DevItem(d).UUID()
+	}
+
+	// Dev extents by the logical address of their chunk
+	extents := make(map[uint64][]devExtent)
+	for r, v := ix.RangeType(btrfs.DevTreeObjectID,
+		btrfs.DevExtentKey); r.HasNext(); v = r.Next() {
+		e := btrfs.DevExtent(v)
+		k := r.Key()
+		if e.ChunkTree() != btrfs.ChunkTreeObjectID {
+			conflicts = append(conflicts, fmt.Errorf("dev extent at %d on "+
+				"device %d belongs to unknown chunk tree %d", k.Offset,
+				k.ObjectID, e.ChunkTree()))
+			continue
+		}
+		extents[e.ChunkOffset()] = append(extents[e.ChunkOffset()],
+			devExtent{k.ObjectID, k.Offset, e, r.Generation()})
+	}
+
+	rebuilt := &btrfs.ChunkMap{}
+	generations := make(map[uint64]uint64)
+	paired := make(map[uint64]bool)
+	for _, owner := range []uint64{btrfs.ExtentTreeObjectID,
+		btrfs.BlockGroupTreeObjectID} {
+		for r, v := ix.RangeType(owner,
+			btrfs.BlockGroupItemKey); r.HasNext(); v = r.Next() {
+			bg := btrfs.BlockGroupItem(v)
+			logical, length := r.Key().ObjectID, r.Key().Offset
+			des := extents[logical]
+			if len(des) == 0 {
+				conflicts = append(conflicts, fmt.Errorf("block group [%d, "+
+					"%d) has no dev extents", logical, logical+length))
+				continue
+			}
+			paired[logical] = true
+			m, gen, err := pairChunk(logical, length, bg.Flags(), des,
+				devUUIDs)
+			if err != nil {
+				conflicts = append(conflicts, err)
+				continue
+			}
+			if r.Generation() > gen {
+				gen = r.Generation()
+			}
+			if err = rebuilt.Add(m); err != nil {
+				conflicts = append(conflicts, fmt.Errorf("block group: %s",
+					err))
+				continue
+			}
+			generations[logical] = gen
+		}
+	}
+	var unpaired []uint64
+	for logical := range extents {
+		if !paired[logical] {
+			unpaired = append(unpaired, logical)
+		}
+	}
+	sort.Slice(unpaired, func(i, j int) bool {
+		return unpaired[i] < unpaired[j]
+	})
+	for _, logical := range unpaired {
+		conflicts = append(conflicts, fmt.Errorf("%d dev extents for chunk "+
+			"at %d have no block group item", len(extents[logical]),
+			logical))
+	}
+
+	// Inferred chunks are only guesses, rebuilt ones replace them
+	known := ix.chunkItemMap()
+	var chunks []RecoveredChunk
+	for _, m := range rebuilt.Chunks() {
+		c := RecoveredChunk{ChunkMapping: m,
+			Generation: generations[m.Logical],
+			Unverified: m.DataStripes() > 1}
+		conflict := false
+		for _, k := range known.Chunks() {
+			if k.Logical >= m.End() || k.End() <= m.Logical {
+				continue
+			}
+			if sameChunk(&k, &m) {
+				c.Known = true
+				continue
+			}
+			conflicts = append(conflicts, fmt.Errorf("rebuilt chunk [%d, %d) "+
+				"conflicts with chunk item [%d, %d)", m.Logical, m.End(),
+				k.Logical, k.End()))
+			conflict = true
+		}
+		if !conflict {
+			chunks = append(chunks, c)
+		}
+	}
+	return chunks, conflicts
+}
+
+// pairChunk builds the chunk for a block group from its dev extents. It
+// returns the chunk along with the latest generation of the dev extents.
+func pairChunk(logical, length, flags uint64, des []devExtent,
+	devUUIDs map[uint64]uuid.UUID) (btrfs.ChunkMapping, uint64, error) {
+	// The stripe order of striped profiles is not recorded in dev extents,
+	// assume device order.
+	sort.Slice(des, func(i, j int) bool {
+		if des[i].devID != des[j].devID {
+			return des[i].devID < des[j].devID
+		}
+		return des[i].physical < des[j].physical
+	})
+	m := btrfs.ChunkMapping{
+		Logical:   logical,
+		Length:    length,
+		StripeLen: btrfs.StripeLen,
+		Type:      flags,
+		Stripes:   make([]btrfs.ChunkStripe, len(des)),
+	}
+	if m.Profile() == btrfs.BlockGroupRaid10 {
+		m.SubStripes = 2
+	} else {
+		m.SubStripes = 1
+	}
+	var gen uint64
+	for i, de := range des {
+		m.Stripes[i] = btrfs.ChunkStripe{DevID: de.devID,
+			Offset: de.physical, DevUUID: devUUIDs[de.devID]}
+		if de.generation > gen {
+			gen = de.generation
+		}
+	}
+
+	minStripes, fixed := profileStripes(m.Profile())
+	if n := len(des); n < minStripes || fixed && n != minStripes ||
+		m.Profile() == btrfs.BlockGroupRaid10 && n%2 != 0 {
+		return m, gen, fmt.Errorf("block group [%d, %d) with profile %s has "+
+			"%d dev extents", logical, logical+length,
+			btrfs.ProfileString(flags), n)
+	}
+	devLen := m.DevExtentLength()
+	if devLen*uint64(m.DataStripes()) != length {
+		return m, gen, fmt.Errorf("block group [%d, %d) with profile %s "+
+			"cannot be split into %d dev extents", logical, logical+length,
+			btrfs.ProfileString(flags), len(des))
+	}
+	for _, de := range des {
+		if de.Length() != devLen {
+			return m, gen, fmt.Errorf("dev extent at %d on device %d has "+
+				"length %d, block group [%d, %d) needs %d", de.physical,
+				de.devID, de.Length(), logical, logical+length, devLen)
+		}
+	}
+	return m, gen, nil
+}
+
+// InsertChunk stores a chunk item for the mapping at the given generation,
+// as if it was found in the chunk tree.
+func (ix *Index) InsertChunk(m btrfs.ChunkMapping, generation uint64,
+	sectorSize uint32) error {
+	c := m.Chunk(sectorSize)
+	k := btrfs.Key{ObjectID: btrfs.FirstChunkTreeObjectID,
+		Type: btrfs.ChunkItemKey, Offset: m.Logical}
+	if err := ix.insertItem(btrfs.ChunkTreeObjectID, k, generation,
+		btrfs.NewItem(k, 0, uint32(len(c))), c); err != nil {
+		return err
+	}
+	ix.chunkMap = nil // Rebuild on next use
+	return nil
+}
@@ -0,0 +1,165 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+package index
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"blichmann.eu/code/btrfscue/pkg/btrfs"
+	"blichmann.eu/code/btrfscue/pkg/uuid"
+)
+
+func TestRecoverChunks(t *testing.T) {
+	td, err := ioutil.TempDir("", "chunk_recover_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	const mib = 1 << 20
+	ix, err := Open(filepath.Join(td, "index"), 0644, &Options{
+		BlockSize: 4096, FSID: uuid.UUID{1}, Generation: ^uint64(0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ix.Close()
+
+	insert := func(owner, gen uint64, k btrfs.Key, data []byte) {
+		t.Helper()
+		if err := ix.InsertItem(k, makeTestHeader(0, gen, owner, 0, 0,
+			btrfs.HeaderLen), btrfs.NewItem(k, 0, uint32(len(data))),
+			data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	devExtent := func(devID, physical, logical, length uint64) {
+		e := make([]byte, btrfs.DevExtentLen)
+		binary.LittleEndian.PutUint64(e[0:], btrfs.ChunkTreeObjectID)
+		binary.LittleEndian.PutUint64(e[8:], btrfs.FirstChunkTreeObjectID)
+		binary.LittleEndian.PutUint64(e[16:], logical)
+		binary.LittleEndian.PutUint64(e[24:], length)
+		insert(btrfs.DevTreeObjectID, 5, btrfs.Key{ObjectID: devID,
+			Type: btrfs.DevExtentKey, Offset: physical}, e)
+	}
+	blockGroup := func(owner, logical, length, flags uint64) {
+		bg := make([]byte, 24)
+		binary.LittleEndian.PutUint64(bg[8:], btrfs.FirstChunkTreeObjectID)
+		binary.LittleEndian.PutUint64(bg[16:], flags)
+		insert(owner, 7, btrfs.Key{ObjectID: logical,
+			Type: btrfs.BlockGroupItemKey, Offset: length}, bg)
+	}
+
+	// Single data chunk
+	blockGroup(btrfs.ExtentTreeObjectID, 1*mib, 8*mib, btrfs.BlockGroupData)
+	devExtent(1, 20*mib, 1*mib, 8*mib)
+	// DUP metadata chunk, from the block group tree
+	blockGroup(btrfs.BlockGroupTreeObjectID, 16*mib, 2*mib,
+		btrfs.BlockGroupMetadata|btrfs.BlockGroupDup)
+	devExtent(1, 42*mib, 16*mib, 2*mib)
+	devExtent(1, 40*mib, 16*mib, 2*mib)
+	// RAID1 chunk with a missing mirror
+	blockGroup(btrfs.ExtentTreeObjectID, 32*mib, 4*mib,
+		btrfs.BlockGroupData|btrfs.BlockGroupRaid1)
+	devExtent(1, 60*mib, 32*mib, 4*mib)
+	// RAID0 chunk, its stripe order is unknown
+	blockGroup(btrfs.ExtentTreeObjectID, 48*mib, 4*mib,
+		btrfs.BlockGroupData|btrfs.BlockGroupRaid0)
+	devExtent(2, 10*mib, 48*mib, 2*mib)
+	devExtent(1, 70*mib, 48*mib, 2*mib)
+	// Dev extent without block group
+	devExtent(1, 80*mib, 64*mib, 1*mib)
+	// System chunk that has a chunk item
+	blockGroup(btrfs.ExtentTreeObjectID, 128*mib, 1*mib,
+		btrfs.BlockGroupSystem)
+	devExtent(1, 1*mib, 128*mib, 1*mib)
+	known := btrfs.ChunkMapping{Logical: 128 * mib, Length: 1 * mib,
+		StripeLen: btrfs.StripeLen, Type: btrfs.BlockGroupSystem,
+		SubStripes: 1, Stripes: []btrfs.ChunkStripe{{DevID: 1,
+			Offset: 1 * mib}}}
+	if err := ix.InsertChunk(known, 3, 4096); err != nil {
+		t.Fatal(err)
+	}
+
+	// Inferred chunk within the DUP chunk, must not get in the way
+	if err := ix.SetInferredChunks([]btrfs.ChunkMapping{{Logical: 17 * mib,
+		Length: 1 * mib, StripeLen: btrfs.StripeLen,
+		Type: btrfs.BlockGroupMetadata, SubStripes: 1,
+		Stripes: []btrfs.ChunkStripe{{DevID: 1, Offset: 90 * mib}}}},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	chunks, conflicts := ix.RecoverChunks()
+	if len(conflicts) != 2 {
+		t.Fatalf("expected 2 conflicts, actual %d: %v", len(conflicts),
+			conflicts)
+	}
+	for i, expected := range []string{"with profile raid1 has 1 dev extents",
+		"at 67108864 have no block group item"} {
+		if !strings.Contains(conflicts[i].Error(), expected) {
+			t.Errorf("expected conflict containing '%s', actual '%s'",
+				expected, conflicts[i])
+		}
+	}
+	if len(chunks) != 4 {
+		t.Fatalf("expected 4 chunks, actual %d", len(chunks))
+	}
+	for i, c := range []struct {
+		logical           uint64
+		stripes           int
+		known, unverified bool
+	}{{1 * mib, 1, false, false}, {16 * mib, 2, false, false},
+		{48 * mib, 2, false, true}, {128 * mib, 1, true, false}} {
+		if chunks[i].Logical != c.logical ||
+			len(chunks[i].Stripes) != c.stripes ||
+			chunks[i].Known != c.known || chunks[i].Unverified != c.unverified {
+			t.Errorf("chunk %d: expected logical %d, %d stripes, known %v, "+
+				"unverified %v, actual %d, %d, %v, %v", i, c.logical,
+				c.stripes, c.known, c.unverified, chunks[i].Logical,
+				len(chunks[i].Stripes), chunks[i].Known, chunks[i].Unverified)
+		}
+		if chunks[i].Generation != 7 {
+			t.Errorf("chunk %d: expected generation 7, actual %d", i,
+				chunks[i].Generation)
+		}
+	}
+
+	for _, c := range chunks[:3] {
+		if err := ix.InsertChunk(c.ChunkMapping, c.Generation,
+			4096); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if pr, err := ix.Physical(1*mib + 42); err != nil {
+		t.Fatal(err)
+	} else if pr.Offset != 20*mib+42 {
+		t.Errorf("expected physical %d, actual %d", 20*mib+42, pr.Offset)
+	}
+	if pr, err := ix.ChunkMap().Physical(16*mib+42, 1); err != nil {
+		t.Fatal(err)
+	} else if pr.Offset != 42*mib+42 {
+		t.Errorf("expected mirror at physical %d, actual %d", 42*mib+42,
+			pr.Offset)
+	}
+	if pr, err := ix.Physical(17*mib + 42); err != nil {
+		t.Fatal(err)
+	} else if pr.Offset != 41*mib+42 {
+		t.Errorf("expected rebuilt chunk at physical %d, actual %d",
+			41*mib+42, pr.Offset)
+	}
+	if chunks, conflicts = ix.RecoverChunks(); len(conflicts) != 2 {
+		t.Errorf("expected 2 conflicts after insert, actual %d",
+			len(conflicts))
+	}
+	for _, c := range chunks {
+		if !c.Known {
+			t.Errorf("expected chunk at %d to be known", c.Logical)
+		}
+	}
+}
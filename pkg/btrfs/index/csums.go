@@ -0,0 +1,83 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Lookup of data checksums from the checksum tree
+
+package index
+
+import (
+	"bytes"
+
+	"blichmann.eu/code/btrfscue/pkg/btrfs"
+	"blichmann.eu/code/btrfscue/pkg/btrfs/csum"
+)
+
+// DataCSum returns the checksum of the data sector at the given logical
+// address from the checksum tree. Returns false if the checksum algorithm is
+// unknown or no EXTENT_CSUM item covers the sector.
+func (ix *Index) DataCSum(logical uint64, sectorSize uint32) ([]byte,
+	bool) {
+	t, ok := ix.CSumType()
+	if !ok || sectorSize == 0 {
+		return nil, false
+	}
+	size := csum.Size(t)
+	if size == 0 {
+		return nil, false
+	}
+	// Find the item with the largest offset that is not beyond logical.
+	// EXTENT_CSUM items hold the checksums of consecutive sectors starting
+	// at their offset.
+	k := btrfs.Key{ObjectID: btrfs.ExtentCSumObjectID,
+		Type: btrfs.ExtentCSumKey, Offset: logical}
+	c := ix.bucket.Cursor()
+	search := newIndexKey(btrfs.CSumTreeObjectID, k, ^uint64(0))
+	var prev keyV2
+	if next, _ := c.Seek(search); next == nil {
+		prev, _ = c.Last()
+	} else if bytes.Equal(next, search) {
+		prev = next
+	} else {
+		prev, _ = c.Prev()
+	}
+	if prev == nil || !bytes.Equal(prev[:keyV2Offset],
+		search[:keyV2Offset]) {
+		return nil, false
+	}
+	ik, item := find(c, prev.Owner(), prev.Key(), ix.Generation)
+	if ik == nil {
+		return nil, false
+	}
+	i := (logical - ik.Offset()) / uint64(sectorSize)
+	data := item.Data()
+	if (i+1)*uint64(size) > uint64(len(data)) {
+		return nil, false
+	}
+	return data[i*uint64(size) : (i+1)*uint64(size)], true
+}
+
+// VerifyData reports whether the checksums of all sectors in buf, which
+// holds the data at the sector aligned logical address, match the checksum
+// tree. Sectors without a known checksum are considered valid.
+func (ix *Index) VerifyData(buf []byte, logical uint64,
+	sectorSize uint32) bool {
+	t, ok := ix.CSumType()
+	if !ok || sectorSize == 0 {
+		return true
+	}
+	ss := int(sectorSize)
+	for off := 0; off+ss <= len(buf); off += ss {
+		expected, ok := ix.DataCSum(logical+uint64(off), sectorSize)
+		if !ok {
+			continue
+		}
+		c, err := csum.Sum(t, buf[off:off+ss])
+		if err != nil {
+			return true
+		}
+		if !bytes.Equal(c[:len(expected)], expected) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,48 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Access to all recorded versions of filesystem items
+
+package index
+
+import (
+	"bytes"
+
+	"blichmann.eu/code/btrfscue/pkg/btrfs"
+)
+
+// ItemVersion is a filesystem item as it was at a specific generation.
+type ItemVersion struct {
+	Key        btrfs.Key
+	Generation uint64
+	Item       btrfs.Item
+}
+
+// ForEachVersion calls fn for every recorded version of every FS key in
+// [first, last] under the given owner, in key order and by ascending
+// generation. Unlike Range, this ignores the index generation. Iteration
+// stops at the first error.
+func (ix *Index) ForEachVersion(owner uint64, first, last btrfs.Key,
+	fn func(v ItemVersion) error) error {
+	c := ix.bucket.Cursor()
+	end := newIndexKey(owner, last, ^uint64(0))
+	for k, v := c.Seek(newIndexKey(owner, first, 0)); k != nil &&
+		bytes.Compare(k, end) <= 0; k, v = c.Next() {
+		ik := keyV2(k)
+		if err := fn(ItemVersion{ik.Key(), ik.Generation(), v}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// History returns all recorded versions of an FS key, ordered by ascending
+// generation.
+func (ix *Index) History(owner uint64, k btrfs.Key) []ItemVersion {
+	var versions []ItemVersion
+	ix.ForEachVersion(owner, k, k, func(v ItemVersion) error {
+		versions = append(versions, v)
+		return nil
+	})
+	return versions
+}
@@ -35,12 +35,6 @@ const (
 	MetadataVersionUpgradable = 20161109 // V1: Orignal format using Boltdb
 )
 
-type stripeMapEntry struct {
-	logical uint64
-	devID   uint64
-	offset  uint64
-}
-
 // Index encapsulates metadata of a BTRFS to be recovered/analyzed. It uses
 // a memory-mapped key-value store to quickly access FS objects.
 // When opened read/write, concurrent access to this object must be guarded.
@@ -53,7 +47,7 @@ type Index struct {
 	txNum      int
 	Generation uint64
 
-	stripeMap []stripeMapEntry
+	chunkMap *btrfs.ChunkMap
 }
 
 // Options sets options for opening a metadata index.
@@ -98,10 +92,32 @@ func Open(path string, m os.FileMode, o *Options) (*Index, error) {
 
 // OpenReadOnly opens a metadata index for reading/querying.
 func OpenReadOnly(path string) (*Index, error) {
+	return OpenReadOnlyAt(path, ^uint64(0))
+}
+
+// OpenReadOnlyAt opens a metadata index for reading/querying the filesystem
+// as it was at the given generation.
+func OpenReadOnlyAt(path string, generation uint64) (*Index, error) {
 	if _, err := os.Stat(path); err != nil {
 		return nil, err
 	}
-	return openIndex(path, 0644 /* Mode */, nil)
+	return openIndex(path, 0644 /* Mode */, &Options{ReadOnly: true,
+		Generation: generation})
+}
+
+// OpenForUpdate opens an existing metadata index for adding to it, using
+// the block size and filesystem id stored in it. Queries return the
+// filesystem as it was at the given generation.
+func OpenForUpdate(path string, generation uint64) (*Index, error) {
+	ix, err := OpenReadOnly(path)
+	if err != nil {
+		return nil, err
+	}
+	m := ix.Metadata()
+	o := &Options{BlockSize: uint(m.BlockSize()), FSID: m.FSID(),
+		Generation: generation}
+	ix.Close()
+	return Open(path, 0644, o)
 }
 
 func openIndex(path string, m os.FileMode, o *Options) (*Index, error) {
@@ -115,9 +131,11 @@ func openIndex(path string, m os.FileMode, o *Options) (*Index, error) {
 		return nil, err
 	}
 	if err = ix.checkUpdateMetadata(o); err != nil {
+		ix.db.Close()
 		return nil, err
 	}
 	if err = ix.ensureTx(!o.ReadOnly); err != nil {
+		ix.db.Close()
 		return nil, err
 	}
 	return ix, nil
@@ -212,6 +230,11 @@ func (ix *Index) ensureTx(writable bool) error {
 // its inline data.
 func (ix *Index) InsertItem(k btrfs.Key, h btrfs.Header, item,
 	data []byte) error {
+	return ix.insertItem(h.Owner(), k, h.Generation(), item, data)
+}
+
+func (ix *Index) insertItem(owner uint64, k btrfs.Key, generation uint64,
+	item, data []byte) error {
 	if err := ix.ensureTx(true); err != nil {
 		return err
 	}
@@ -219,7 +242,7 @@ func (ix *Index) InsertItem(k btrfs.Key, h btrfs.Header, item,
 	tc := make([]byte, l)
 	copy(tc, item)
 	copy(tc[btrfs.ItemLen:], data)
-	if err := ix.bucket.Put(newIndexKey(h.Owner(), k, h.Generation()),
+	if err := ix.bucket.Put(newIndexKey(owner, k, generation),
 		tc); err != nil {
 		return err
 	}
@@ -242,6 +265,16 @@ func (ix *Index) Commit() error {
 	return err
 }
 
+// Begin starts a new transaction if there is none pending, so that lookups
+// can continue after a commit. The transaction is writable unless the index
+// was opened read-only.
+func (ix *Index) Begin() error {
+	if ix.tx != nil {
+		return nil
+	}
+	return ix.ensureTx(!ix.db.IsReadOnly())
+}
+
 // RawTx executes a transaction function on underlying BoltDB database. This
 // is an advanced feature that should not be called in regular operation. It
 // is used by the upgrade-index sub-command, for example, to upgrade legacy
@@ -287,35 +320,54 @@ func lowerBound(c *bbolt.Cursor, owner uint64, k btrfs.Key, gen uint64,
 	}
 }
 
+// find returns the FS key at the latest generation smaller than or equal to
+// the given generation. Returns nil if there is none.
 func find(c *bbolt.Cursor, owner uint64, k btrfs.Key, generation uint64) (
 	keyV2, btrfs.Item) {
 	search := newIndexKey(owner, k, generation)
-	var found keyV2
 	found, v := c.Seek(search)
-	if bytes.Compare(found[:keyV2Generation],
-		search[:keyV2Generation]) <= 0 {
+	if found != nil && bytes.Equal(found, search) {
 		return found, v
 	}
-	if found, v = c.Prev(); len(found) > 0 && bytes.Equal(
-		found[:keyV2Generation], search[:keyV2Generation]) {
-		return found, v
+	// Seek() positions on the next larger key, the previous one may hold
+	// the same FS key at an earlier generation.
+	var prev keyV2
+	var pv []byte
+	if found == nil {
+		prev, pv = c.Last()
+	} else {
+		prev, pv = c.Prev()
+	}
+	if prev != nil && bytes.Equal(prev[:keyV2Generation],
+		search[:keyV2Generation]) {
+		return prev, pv
 	}
 	return nil, nil
 }
 
-func findNext(c *bbolt.Cursor, ik, end keyV2) (keyV2, btrfs.Item) {
-	search := newIndexKey(ik.Owner(), ik.Key(), ^uint64(0))
-	var found keyV2
-	if found, _ = c.Seek(search); found != nil {
-		search = newIndexKey(ik.Owner(), found.Key(), ik.Generation())
-		var v btrfs.Item
-		if found, v = c.Seek(search); bytes.Compare(found, search) <= 0 {
-			return found, v
-		} else if end != nil && bytes.Compare(found, end) <= 0 {
+// findNext finds the FS key following the one in ik, at the latest
+// generation smaller than or equal to the given generation. FS keys that
+// only exist at later generations are skipped. Returns nil if there is no
+// such key up to and including end.
+func findNext(c *bbolt.Cursor, ik, end keyV2, generation uint64) (keyV2,
+	btrfs.Item) {
+	for {
+		search := newIndexKey(ik.Owner(), ik.Key(), ^uint64(0))
+		var next keyV2
+		next, _ = c.Seek(search)
+		if next != nil && bytes.Equal(next, search) {
+			next, _ = c.Next()
+		}
+		if next == nil || (end != nil && bytes.Compare(
+			next[:keyV2Generation], end[:keyV2Generation]) > 0) {
+			return nil, nil
+		}
+		if found, v := find(c, next.Owner(), next.Key(),
+			generation); found != nil {
 			return found, v
 		}
+		ik = next
 	}
-	return nil, nil
 }
 
 // Range encapsulates a generic index range. Internally, it holds a cursor of
@@ -336,7 +388,8 @@ func (r *Range) HasNext() bool {
 }
 
 func (r *Range) Next() []byte {
-	if r.key, r.value = findNext(r.cursor, r.key, nil); r.key != nil {
+	if r.key, r.value = findNext(r.cursor, r.key, r.end,
+		r.ix.Generation); r.key != nil {
 		return r.value.Data()
 	}
 	return nil
@@ -349,14 +402,29 @@ func (r *Range) Item() btrfs.Item   { return r.value }
 
 // Range returns an index range [first, last) for the given keys.
 func (ix *Index) Range(owner uint64, first, last btrfs.Key) (Range, []byte) {
+	return ix.rangePrefix(owner, first, last, keyV2Offset)
+}
+
+// RangeType returns an index range for all items of the given type,
+// regardless of their object id.
+func (ix *Index) RangeType(owner uint64, t uint8) (Range, []byte) {
+	return ix.rangePrefix(owner, KF(uint64(t)), KL(uint64(t)), keyV2ObjectID)
+}
+
+func (ix *Index) rangePrefix(owner uint64, first, last btrfs.Key,
+	prefix int) (Range, []byte) {
 	r := Range{
 		ix:     ix,
 		cursor: ix.bucket.Cursor(),
 		end:    newIndexKey(owner, last, ix.Generation),
 	}
-	lowerFirst := lowerBound(r.cursor, owner, first, ix.Generation,
-		keyV2Offset)
+	lowerFirst := lowerBound(r.cursor, owner, first, ix.Generation, prefix)
 	r.key, r.value = find(r.cursor, owner, lowerFirst, ix.Generation)
+	if r.key == nil {
+		// Did not exist yet at the index generation
+		r.key, r.value = findNext(r.cursor, newIndexKey(owner, lowerFirst,
+			ix.Generation), r.end, ix.Generation)
+	}
 	if r.key != nil {
 		return r, r.value.Data()
 	}
@@ -429,8 +497,8 @@ func (ix *Index) DevItems() (Range, btrfs.DevItem) {
 }
 
 // FindItem searches for an FS key at the latest generation smaller or equal
-// to the current index generation. If the index generation is smaller than
-// any existing generation, the data at the earliest generatation is returned.
+// to the current index generation. Returns nil if the key did not exist yet
+// at the index generation.
 func (ix *Index) FindItem(owner uint64, k btrfs.Key) btrfs.Item {
 	_, i := find(ix.bucket.Cursor(), owner, k, ix.Generation)
 	return i
@@ -458,41 +526,62 @@ func (ix *Index) FindExtentItem(diskByteNr, diskNumBytes uint64) btrfs.ExtentIte
 	return nil
 }
 
-// Physical maps a filesystem logical address to a physical, on-disk address.
-// Note: No attempt is made to deal with "holes", missing chunk entries, or
-// logical addresses not mapping to any chunk.
-func (ix *Index) Physical(logical uint64) (devID uint64, offset uint64) {
-	if ix.stripeMap == nil {
-		ix.stripeMap = make([]stripeMapEntry, 0, 5 /* Initial capacity */)
-		for r, c := ix.Chunks(); r.HasNext(); c = r.Next() {
-			if c.NumStripes() == 0 {
-				// Invalid chunk, should always have at least one stripe
-				continue
+// ChunkMap returns the mapping of logical to physical addresses built from
+// the chunk items at the index generation and from the system chunks of all
+// stored superblock copies. The latter make sure that at least the chunk
+// tree can be located. Where chunks overlap, the one with the latest
+// generation takes precedence. Inferred chunks, see InferChunks, only fill
+// in where no other chunk applies.
+func (ix *Index) ChunkMap() *btrfs.ChunkMap {
+	if ix.chunkMap != nil {
+		return ix.chunkMap
+	}
+	ix.chunkMap = ix.chunkItemMap()
+	for _, m := range ix.InferredChunks() {
+		ix.chunkMap.Add(m)
+	}
+	return ix.chunkMap
+}
+
+// chunkItemMap is like ChunkMap, but leaves out inferred chunks.
+func (ix *Index) chunkItemMap() *btrfs.ChunkMap {
+	type genChunk struct {
+		generation uint64
+		m          btrfs.ChunkMapping
+	}
+	var chunks []genChunk
+	for r, c := ix.Chunks(); r.HasNext(); c = r.Next() {
+		m, err := btrfs.NewChunkMapping(r.Key().Offset, c)
+		if err != nil {
+			continue
+		}
+		chunks = append(chunks, genChunk{r.Generation(), m})
+	}
+	ix.ForEachSuperblock(func(s btrfs.Superblock) error {
+		keys, sysChunks := s.SysChunks()
+		for i, c := range sysChunks {
+			if m, err := btrfs.NewChunkMapping(keys[i].Offset,
+				c); err == nil {
+				chunks = append(chunks, genChunk{s.Generation(), m})
 			}
-			s := c.Stripe(0)
-			ix.stripeMap = append(ix.stripeMap, stripeMapEntry{
-				logical: r.Key().Offset,
-				devID:   s.DevID(),
-				offset:  s.Offset()})
-			fmt.Printf("stripe: %d => %d @ %d\n", r.Key().Offset, s.Offset(), r.Generation())
 		}
+		return nil
+	})
+	sort.SliceStable(chunks, func(i, j int) bool {
+		return chunks[i].generation > chunks[j].generation
+	})
+	cm := &btrfs.ChunkMap{}
+	for _, c := range chunks {
+		cm.Add(c.m) // Older, conflicting chunks are dropped
 	}
+	return cm
+}
 
-	stripeMapLen := len(ix.stripeMap)
-	// Index structure entries are sorted
-	i := sort.Search(stripeMapLen, func(i int) bool {
-		return ix.stripeMap[i].logical >= logical
-	})
-	if i == stripeMapLen || (i > 0 && ix.stripeMap[i].logical != logical) {
-		// Not found, adjust index value, as it's an insertion point (see
-		// documentation for sort.Search()). Unless i was 0, in which case the
-		// position is fine.
-		i--
-	}
-	s := ix.stripeMap[i]
-	// TODO(cblichmann): We can check for the failure case if we store the
-	//                   stripe length in the cache and do a range check here.
-	return s.devID, s.offset + logical - s.logical
+// Physical maps a filesystem logical address to a physical, on-disk address
+// on the first mirror. Returns a *btrfs.UnmappedError if the address does
+// not lie within any known chunk.
+func (ix *Index) Physical(logical uint64) (btrfs.PhysicalRange, error) {
+	return ix.ChunkMap().Physical(logical, 0)
 }
 
 // FindDirItemForPath finds the DirItem for a given FS path. It assumes that
@@ -6,11 +6,16 @@
 package index
 
 import (
+	"encoding/binary"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 
+	"blichmann.eu/code/btrfscue/pkg/btrfs"
 	"blichmann.eu/code/btrfscue/pkg/uuid"
 )
 
@@ -52,3 +57,208 @@ func TestCreation(t *testing.T) {
 	}
 	ix.Close()
 }
+
+func TestBlocks(t *testing.T) {
+	td, err := ioutil.TempDir("", "index_store_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+	testFile := filepath.Join(td, "index")
+
+	ix, err := Open(testFile, 0644, &Options{BlockSize: 4096,
+		Generation: ^uint64(0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := make(btrfs.Header, btrfs.HeaderLen)
+	binary.LittleEndian.PutUint64(h[48:], 1<<22)                // ByteNr
+	binary.LittleEndian.PutUint64(h[80:], 42)                   // Generation
+	binary.LittleEndian.PutUint64(h[88:], btrfs.FSTreeObjectID) // Owner
+	if err = ix.InsertBlock(h, 2, 1<<24, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err = ix.SetCSumType(btrfs.CSumTypeXXHash); err != nil {
+		t.Fatal(err)
+	}
+	scanDevs := []ScanDevice{{1, 1 << 30, 1 << 20}, {3, 1 << 31, 0}}
+	if err = ix.SetScanState("bad-csum=flag", scanDevs); err != nil {
+		t.Fatal(err)
+	}
+	ix.Close()
+
+	if ix, err = OpenReadOnly(testFile); err != nil {
+		t.Fatal(err)
+	}
+	defer ix.Close()
+	if b := ix.FindBlock(1<<22, 41); b != nil {
+		t.Errorf("expected no block at generation 41")
+	}
+	b := ix.FindBlock(1<<22, 42)
+	if b == nil {
+		t.Fatal("expected block at generation 42")
+	}
+	if b.DevID() != 2 || b.Physical() != 1<<24 ||
+		b.Owner() != btrfs.FSTreeObjectID || b.CSumStatus() != 2 {
+		t.Errorf("unexpected block info: %d %d %d %d", b.DevID(),
+			b.Physical(), b.Owner(), b.CSumStatus())
+	}
+	if b[:BlockInfoLen-8].DevID() != 0 {
+		t.Errorf("expected unknown device for legacy block info")
+	}
+	if ct, ok := ix.CSumType(); !ok || ct != btrfs.CSumTypeXXHash {
+		t.Errorf("expected checksum type %d, actual %d", btrfs.CSumTypeXXHash,
+			ct)
+	}
+	params, devs, ok, err := ix.ScanState()
+	if err != nil || !ok || params != "bad-csum=flag" ||
+		!reflect.DeepEqual(devs, scanDevs) {
+		t.Errorf("unexpected scan state %q %v %t (%v)", params, devs, ok, err)
+	}
+}
+
+func makeTestHeader(logical, generation, owner uint64, level uint8,
+	nrItems uint32, size int) btrfs.Header {
+	h := make(btrfs.Header, size)
+	binary.LittleEndian.PutUint64(h[48:], logical)
+	binary.LittleEndian.PutUint64(h[80:], generation)
+	binary.LittleEndian.PutUint64(h[88:], owner)
+	binary.LittleEndian.PutUint32(h[96:], nrItems)
+	h[100] = level
+	return h
+}
+
+func TestWalkTree(t *testing.T) {
+	td, err := ioutil.TempDir("", "index_store_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+	testFile := filepath.Join(td, "index")
+
+	ix, err := Open(testFile, 0644, &Options{BlockSize: 4096,
+		Generation: ^uint64(0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const root, leaf, missing = 1 << 22, 2 << 22, 3 << 22
+	n := btrfs.Node(makeTestHeader(root, 10, btrfs.FSTreeObjectID, 1, 2, 4096))
+	for i, ptr := range []uint64{leaf, missing} {
+		o := btrfs.HeaderLen + i*btrfs.KeyPtrLen
+		binary.LittleEndian.PutUint64(n[o:], uint64(256+i))
+		binary.LittleEndian.PutUint64(n[o+btrfs.KeyLen:], ptr)
+		binary.LittleEndian.PutUint64(n[o+btrfs.KeyLen+8:], 9)
+	}
+	if err = ix.InsertBlock(n.Header(), 1, 1<<24, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = ix.InsertNode(n); err != nil {
+		t.Fatal(err)
+	}
+	l := makeTestHeader(leaf, 9, btrfs.FSTreeObjectID, 0, 0, btrfs.HeaderLen)
+	if err = ix.InsertBlock(l, 1, 2<<24, 0); err != nil {
+		t.Fatal(err)
+	}
+	ix.Close()
+
+	if ix, err = OpenReadOnly(testFile); err != nil {
+		t.Fatal(err)
+	}
+	defer ix.Close()
+	if n := ix.FindNode(root, 10); n == nil || n.Len() != 2 ||
+		n.KeyPtr(1).BlockPtr() != missing {
+		t.Fatal("expected node with two key pointers")
+	}
+	found := map[uint64]bool{}
+	if err = ix.WalkTree(root, 10, func(logical, generation uint64,
+		level uint8, ok bool) error {
+		found[logical] = ok
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 3 || !found[root] || !found[leaf] || found[missing] {
+		t.Errorf("unexpected blocks visited: %v", found)
+	}
+}
+
+func TestRangeAtGeneration(t *testing.T) {
+	td, err := ioutil.TempDir("", "index_store_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+	testFile := filepath.Join(td, "index")
+
+	ix, err := Open(testFile, 0644, &Options{BlockSize: 4096,
+		Generation: ^uint64(0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Directory entries (offset, generation): 2 and 4 exist since generation
+	// 1, 3 was added at generation 5, 2 rewritten at generation 7 and 1
+	// added at generation 9.
+	for _, e := range [][2]uint64{{2, 1}, {4, 1}, {3, 5}, {2, 7},
+		{1, 9}} {
+		k := KF(btrfs.DirIndexKey, btrfs.FirstFreeObjectID, e[0])
+		h := makeTestHeader(0, e[1], btrfs.FSTreeObjectID, 0, 0,
+			btrfs.HeaderLen)
+		if err = ix.InsertItem(k, h, make([]byte, btrfs.ItemLen),
+			nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Reading continues after a commit
+	if err = ix.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err = ix.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for r, _ := ix.RangeAll(btrfs.FSTreeObjectID, btrfs.DirIndexKey,
+		btrfs.FirstFreeObjectID); r.HasNext(); r.Next() {
+		n++
+	}
+	if n != 4 {
+		t.Errorf("expected 4 entries after commit, got %d", n)
+	}
+	ix.Close()
+
+	for _, tc := range []struct {
+		generation uint64
+		expected   string
+	}{
+		{^uint64(0), "1@9 2@7 3@5 4@1"},
+		{8, "2@7 3@5 4@1"},
+		{6, "2@1 3@5 4@1"},
+		{4, "2@1 4@1"},
+		{1, "2@1 4@1"},
+	} {
+		ix, err := OpenReadOnlyAt(testFile, tc.generation)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var found []string
+		for r, _ := ix.RangeAll(btrfs.FSTreeObjectID, btrfs.DirIndexKey,
+			btrfs.FirstFreeObjectID); r.HasNext(); r.Next() {
+			found = append(found, fmt.Sprintf("%d@%d", r.Key().Offset,
+				r.Generation()))
+		}
+		// Items written after the generation do not exist yet
+		for _, offset := range []uint64{1, 3} {
+			i := ix.FindItem(btrfs.FSTreeObjectID, KF(btrfs.DirIndexKey,
+				btrfs.FirstFreeObjectID, offset))
+			if exists := strings.Contains(tc.expected,
+				fmt.Sprintf("%d@", offset)); (i != nil) != exists {
+				t.Errorf("generation %d: expected entry %d to exist: %v",
+					tc.generation, offset, exists)
+			}
+		}
+		ix.Close()
+		if s := strings.Join(found, " "); s != tc.expected {
+			t.Errorf("generation %d: expected %s, got: %s", tc.generation,
+				tc.expected, s)
+		}
+	}
+}
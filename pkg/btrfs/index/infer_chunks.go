@@ -0,0 +1,244 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Inference of chunks from the locations of tree blocks
+
+package index
+
+import (
+	"encoding/binary"
+	"sort"
+
+	"blichmann.eu/code/btrfscue/pkg/btrfs"
+	"blichmann.eu/code/btrfscue/pkg/btrfs/csum"
+)
+
+var inferredChunksBucketName = []byte("inferred-chunks")
+
+// DefaultMaxInferGap is the default for the largest gap between tree blocks
+// that InferChunks bridges. It is the maximum size of a metadata chunk.
+const DefaultMaxInferGap = 1 << 30
+
+// clusterStripe is the location of one mirror of a block cluster.
+type clusterStripe struct {
+	devID uint64
+	delta uint64 // physical - logical
+}
+
+// blockCluster is a run of tree blocks on the same device that share the
+// same offset between their logical and physical addresses.
+type blockCluster struct {
+	logical, end uint64
+	stripes      []clusterStripe // One per mirror
+	numBlocks    int
+	generation   uint64 // Latest generation of the blocks
+	system       bool   // Whether it holds chunk tree blocks
+}
+
+func (c *blockCluster) physicalOverlaps(o *blockCluster) bool {
+	for _, s := range c.stripes {
+		for _, os := range o.stripes {
+			if s.devID == os.devID && c.logical+s.delta < o.end+os.delta &&
+				o.logical+os.delta < c.end+s.delta {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// mirrorProfile returns the profile of a cluster with the given mirrors and
+// whether the combination is valid. Mirrors on the same device are only
+// valid as DUP.
+func mirrorProfile(stripes []clusterStripe) (uint64, bool) {
+	devs := make(map[uint64]bool)
+	for _, s := range stripes {
+		devs[s.devID] = true
+	}
+	switch {
+	case len(stripes) == 1:
+		return 0, true
+	case len(devs) == 1:
+		return btrfs.BlockGroupDup, len(stripes) == 2
+	case len(devs) != len(stripes):
+		return 0, false
+	}
+	switch len(stripes) {
+	case 2:
+		return btrfs.BlockGroupRaid1, true
+	case 3:
+		return btrfs.BlockGroupRaid1C3, true
+	case 4:
+		return btrfs.BlockGroupRaid1C4, true
+	}
+	return 0, false
+}
+
+// InferChunks infers the mapping of logical to physical addresses from the
+// tree blocks found while gathering metadata. Each tree block records its
+// logical address, the index records where each copy was read from. Blocks
+// of the same chunk have a constant offset between the two, so runs of
+// blocks on the same device with the same offset that are at most maxGap
+// bytes apart are combined into chunks. Where runs overlap physically, the
+// one with the latest generation wins, as the others are likely left over
+// from relocated chunks. Runs that overlap logically but not physically are
+// assumed to be mirrors, i.e. DUP on a single device or RAID1 across
+// devices. Striped profiles cannot be inferred.
+// This only covers metadata and system chunks, as data chunks do not hold
+// tree blocks. Blocks that failed checksum verification are ignored, as
+// their logical address cannot be trusted.
+func (ix *Index) InferChunks(blockSize, maxGap uint64) []btrfs.ChunkMapping {
+	type block struct {
+		logical, generation uint64
+		system              bool
+	}
+	byStripe := make(map[clusterStripe][]block)
+	ix.ForEachBlockLocation(func(logical, devID, physical uint64,
+		b BlockLocation) error {
+		if b.CSumStatus() == csum.StatusMismatch {
+			return nil
+		}
+		if devID == 0 {
+			devID = 1 // Unknown, assume a single device
+		}
+		s := clusterStripe{devID, physical - logical}
+		byStripe[s] = append(byStripe[s], block{logical, b.Generation(),
+			b.Owner() == btrfs.ChunkTreeObjectID})
+		return nil
+	})
+
+	var clusters []*blockCluster
+	for s, blocks := range byStripe {
+		sort.Slice(blocks, func(i, j int) bool {
+			return blocks[i].logical < blocks[j].logical
+		})
+		var c *blockCluster
+		for _, b := range blocks {
+			if c == nil || b.logical > c.end+maxGap {
+				c = &blockCluster{logical: b.logical,
+					stripes: []clusterStripe{s}}
+				clusters = append(clusters, c)
+			}
+			if end := b.logical + blockSize; end > c.end {
+				c.end = end
+			}
+			c.numBlocks++
+			if b.generation > c.generation {
+				c.generation = b.generation
+			}
+			c.system = c.system || b.system
+		}
+	}
+	sort.Slice(clusters, func(i, j int) bool {
+		if clusters[i].generation != clusters[j].generation {
+			return clusters[i].generation > clusters[j].generation
+		}
+		if clusters[i].numBlocks != clusters[j].numBlocks {
+			return clusters[i].numBlocks > clusters[j].numBlocks
+		}
+		return clusters[i].logical < clusters[j].logical
+	})
+
+	var accepted []*blockCluster
+next:
+	for _, c := range clusters {
+		var mirrorOf *blockCluster
+		for _, a := range accepted {
+			if c.physicalOverlaps(a) {
+				continue next // Stale
+			}
+			if c.logical < a.end && a.logical < c.end {
+				if mirrorOf != nil {
+					continue next
+				}
+				mirrorOf = a
+			}
+		}
+		if mirrorOf == nil {
+			accepted = append(accepted, c)
+			continue
+		}
+		a := mirrorOf
+		if _, ok := mirrorProfile(append(a.stripes[:len(a.stripes):len(
+			a.stripes)], c.stripes...)); !ok {
+			continue
+		}
+		if c.logical < a.logical {
+			a.logical = c.logical
+		}
+		if c.end > a.end {
+			a.end = c.end
+		}
+		a.stripes = append(a.stripes, c.stripes...)
+		a.numBlocks += c.numBlocks
+		a.system = a.system || c.system
+	}
+
+	chunks := make([]btrfs.ChunkMapping, 0, len(accepted))
+	for _, a := range accepted {
+		m := btrfs.ChunkMapping{
+			Logical:    a.logical,
+			Length:     a.end - a.logical,
+			StripeLen:  btrfs.StripeLen,
+			Type:       btrfs.BlockGroupMetadata,
+			SubStripes: 1,
+		}
+		if a.system {
+			m.Type = btrfs.BlockGroupSystem
+		}
+		profile, _ := mirrorProfile(a.stripes)
+		m.Type |= profile
+		for _, s := range a.stripes {
+			m.Stripes = append(m.Stripes, btrfs.ChunkStripe{DevID: s.devID,
+				Offset: a.logical + s.delta})
+		}
+		chunks = append(chunks, m)
+	}
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i].Logical < chunks[j].Logical
+	})
+	return chunks
+}
+
+// SetInferredChunks replaces the inferred chunks stored in the index. They
+// are used by ChunkMap for addresses that no chunk item maps.
+func (ix *Index) SetInferredChunks(chunks []btrfs.ChunkMapping) error {
+	if err := ix.ensureTx(true); err != nil {
+		return err
+	}
+	if ix.tx.Bucket(inferredChunksBucketName) != nil {
+		if err := ix.tx.DeleteBucket(inferredChunksBucketName); err != nil {
+			return err
+		}
+	}
+	b, err := ix.auxBucket(inferredChunksBucketName)
+	if err != nil {
+		return err
+	}
+	for _, m := range chunks {
+		if err = b.Put(newBlockKey(m.Logical, 0),
+			m.Chunk(btrfs.X86RegularPageSize)); err != nil {
+			return err
+		}
+	}
+	ix.chunkMap = nil // Rebuild on next use
+	return nil
+}
+
+// InferredChunks returns the inferred chunks stored in the index, in order
+// of their logical address.
+func (ix *Index) InferredChunks() []btrfs.ChunkMapping {
+	b, _ := ix.auxBucket(inferredChunksBucketName)
+	if b == nil {
+		return nil
+	}
+	var chunks []btrfs.ChunkMapping
+	b.ForEach(func(k, v []byte) error {
+		if m, err := btrfs.NewChunkMapping(binary.BigEndian.Uint64(k),
+			v); err == nil {
+			chunks = append(chunks, m)
+		}
+		return nil
+	})
+	return chunks
+}
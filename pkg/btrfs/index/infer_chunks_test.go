@@ -0,0 +1,128 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+package index
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"blichmann.eu/code/btrfscue/pkg/btrfs"
+	"blichmann.eu/code/btrfscue/pkg/btrfs/csum"
+	"blichmann.eu/code/btrfscue/pkg/uuid"
+)
+
+func TestInferChunks(t *testing.T) {
+	td, err := ioutil.TempDir("", "infer_chunks_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	const (
+		bs  = 16384
+		mib = 1 << 20
+		gib = 1 << 30
+	)
+	ix, err := Open(filepath.Join(td, "index"), 0644, &Options{
+		BlockSize: bs, FSID: uuid.UUID{1}, Generation: ^uint64(0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ix.Close()
+
+	insert := func(logical, devID, physical, generation, owner uint64,
+		status uint8) {
+		t.Helper()
+		if err := ix.InsertBlock(makeTestHeader(logical, generation, owner,
+			0, 1, btrfs.HeaderLen), devID, physical, status); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := uint64(0); i < 3; i++ {
+		// DUP metadata at 1 GiB
+		insert(gib+i*bs, 1, 10*mib+i*bs, 5, btrfs.FSTreeObjectID,
+			csum.StatusOK)
+		insert(gib+i*bs, 1, 20*mib+i*bs, 5, btrfs.FSTreeObjectID,
+			csum.StatusOK)
+		// RAID1 metadata at 3 GiB, same physical offset on both devices
+		insert(3*gib+i*bs, 1, 30*mib+i*bs, 5, btrfs.FSTreeObjectID,
+			csum.StatusOK)
+		insert(3*gib+i*bs, 2, 30*mib+i*bs, 5, btrfs.FSTreeObjectID,
+			csum.StatusOK)
+		// Stale blocks of a relocated chunk, overlapping the first mirror
+		insert(5*gib+i*bs, 1, 10*mib+(i+1)*bs, 2, btrfs.FSTreeObjectID,
+			csum.StatusOK)
+	}
+	// System chunk, identity mapped, and a block far away with the same
+	// offset
+	insert(22*mib, 1, 22*mib, 4, btrfs.ChunkTreeObjectID, csum.StatusOK)
+	insert(22*mib+2*gib, 1, 22*mib+2*gib, 4, btrfs.RootTreeObjectID,
+		csum.StatusOK)
+	// Garbage
+	insert(7*gib, 1, 40*mib, 9, btrfs.FSTreeObjectID, csum.StatusMismatch)
+
+	chunks := ix.InferChunks(bs, DefaultMaxInferGap)
+	expected := []struct {
+		logical, length, typ uint64
+		stripes              []btrfs.ChunkStripe
+	}{
+		{22 * mib, bs, btrfs.BlockGroupSystem,
+			[]btrfs.ChunkStripe{{DevID: 1, Offset: 22 * mib}}},
+		{gib, 3 * bs, btrfs.BlockGroupMetadata | btrfs.BlockGroupDup,
+			[]btrfs.ChunkStripe{{DevID: 1, Offset: 10 * mib},
+				{DevID: 1, Offset: 20 * mib}}},
+		{22*mib + 2*gib, bs, btrfs.BlockGroupMetadata,
+			[]btrfs.ChunkStripe{{DevID: 1, Offset: 22*mib + 2*gib}}},
+		{3 * gib, 3 * bs, btrfs.BlockGroupMetadata | btrfs.BlockGroupRaid1,
+			[]btrfs.ChunkStripe{{DevID: 1, Offset: 30 * mib},
+				{DevID: 2, Offset: 30 * mib}}},
+	}
+	if len(chunks) != len(expected) {
+		t.Fatalf("expected %d chunks, actual %d: %+v", len(expected),
+			len(chunks), chunks)
+	}
+	for i, e := range expected {
+		c := chunks[i]
+		if c.Logical != e.logical || c.Length != e.length || c.Type != e.typ {
+			t.Errorf("chunk %d: expected [%d, +%d) type %#x, actual "+
+				"[%d, +%d) type %#x", i, e.logical, e.length, e.typ,
+				c.Logical, c.Length, c.Type)
+		}
+		if len(c.Stripes) != len(e.stripes) {
+			t.Errorf("chunk %d: expected %d stripes, actual %d", i,
+				len(e.stripes), len(c.Stripes))
+			continue
+		}
+		stripes := map[btrfs.ChunkStripe]bool{}
+		for _, s := range c.Stripes {
+			stripes[s] = true
+		}
+		for _, s := range e.stripes {
+			if !stripes[s] {
+				t.Errorf("chunk %d: expected stripe at %d on device %d", i,
+					s.Offset, s.DevID)
+			}
+		}
+	}
+
+	if err := ix.SetInferredChunks(chunks[1:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := ix.SetInferredChunks(chunks); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(ix.InferredChunks()); n != len(chunks) {
+		t.Errorf("expected %d stored chunks, actual %d", len(chunks), n)
+	}
+	if pr, err := ix.Physical(gib + bs + 42); err != nil {
+		t.Fatal(err)
+	} else if pr.Offset != 10*mib+bs+42 && pr.Offset != 20*mib+bs+42 {
+		t.Errorf("unexpected physical %d", pr.Offset)
+	}
+	if _, err := ix.Physical(5 * gib); err == nil {
+		t.Errorf("expected stale chunk to be unmapped")
+	}
+}
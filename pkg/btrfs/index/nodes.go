@@ -0,0 +1,93 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Internal tree nodes and tree reachability
+
+package index
+
+import (
+	"blichmann.eu/code/btrfscue/pkg/btrfs"
+)
+
+var nodesBucketName = []byte("nodes")
+
+// InsertNode stores the header and key pointers of an internal tree node,
+// referenceable by its logical address and generation.
+func (ix *Index) InsertNode(n btrfs.Node) error {
+	if err := ix.ensureTx(true); err != nil {
+		return err
+	}
+	b, err := ix.auxBucket(nodesBucketName)
+	if err != nil {
+		return err
+	}
+	h := n.Header()
+	// Copy, as the node's backing buffer is usually reused by the caller.
+	v := append([]byte(nil), n.Compact()...)
+	if err = b.Put(newBlockKey(h.ByteNr(), h.Generation()), v); err != nil {
+		return err
+	}
+	ix.txNum++
+	if ix.txNum > 10000 {
+		return ix.Commit()
+	}
+	return nil
+}
+
+// FindNode returns the internal tree node at the given logical address and
+// generation, or nil if there is none.
+func (ix *Index) FindNode(logical, generation uint64) btrfs.Node {
+	b, _ := ix.auxBucket(nodesBucketName)
+	if b == nil {
+		return nil
+	}
+	return b.Get(newBlockKey(logical, generation))
+}
+
+// ForEachNode calls fn for every internal tree node in order of logical
+// address and generation. Iteration stops at the first error.
+func (ix *Index) ForEachNode(fn func(n btrfs.Node) error) error {
+	b, _ := ix.auxBucket(nodesBucketName)
+	if b == nil {
+		return nil
+	}
+	return b.ForEach(func(_, v []byte) error { return fn(v) })
+}
+
+// WalkTree visits all blocks reachable from the tree root at the given
+// logical address and generation, using the key pointers of indexed nodes.
+// For each block, fn is called with the block's logical address, generation
+// and level as well as a flag whether the block itself was found while
+// gathering metadata. Blocks that were not found have their level set to the
+// parent's level minus one, their subtrees cannot be visited.
+// Iteration stops at the first error.
+func (ix *Index) WalkTree(logical, generation uint64, fn func(logical,
+	generation uint64, level uint8, found bool) error) error {
+	visited := make(map[[2]uint64]bool)
+	var walk func(logical, generation uint64, level uint8) error
+	walk = func(logical, generation uint64, level uint8) error {
+		if visited[[2]uint64{logical, generation}] {
+			return nil // Guard against loops in corrupted trees
+		}
+		visited[[2]uint64{logical, generation}] = true
+		if n := ix.FindNode(logical, generation); n != nil {
+			if err := fn(logical, generation, n.Header().Level(),
+				true); err != nil {
+				return err
+			}
+			for _, p := range n.KeyPtrs() {
+				if err := walk(p.BlockPtr(), p.Generation(),
+					n.Header().Level()-1); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		b := ix.FindBlock(logical, generation)
+		if b != nil {
+			level = b.Level()
+		}
+		return fn(logical, generation, level, b != nil)
+	}
+	return walk(logical, generation, 0)
+}
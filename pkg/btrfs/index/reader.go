@@ -0,0 +1,174 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Access to filesystem data by logical address
+
+package index
+
+import (
+	"fmt"
+	"io"
+
+	"blichmann.eu/code/btrfscue/pkg/btrfs"
+	"blichmann.eu/code/btrfscue/pkg/btrfs/raid56"
+)
+
+// AnyDevice is the device id of an image that holds all devices not listed
+// explicitly. It is used if a single image is given without knowing its
+// BTRFS device id.
+const AnyDevice = ^uint64(0)
+
+// Devices maps BTRFS device ids to the images holding the devices.
+type Devices map[uint64]io.ReaderAt
+
+// Device returns the image holding the device with the given id.
+func (d Devices) Device(devID uint64) (io.ReaderAt, error) {
+	if r, ok := d[devID]; ok {
+		return r, nil
+	}
+	if r, ok := d[AnyDevice]; ok {
+		return r, nil
+	}
+	return nil, fmt.Errorf("no image for device %d", devID)
+}
+
+type logicalReader struct {
+	ix         *Index
+	devs       Devices
+	sectorSize uint32 // Determined on first use
+}
+
+// NewLogicalReader returns a reader that reads from the devices at the
+// physical addresses that the logical addresses passed to ReadAt map to.
+// Reads that span several chunks or stripes are split accordingly. For
+// chunks with several copies (DUP, RAID1, RAID1C3, RAID1C4 and RAID10), the
+// other copies are tried if reading one fails or its data does not match
+// the checksum tree. Data on missing or unreadable devices of RAID5 and
+// RAID6 chunks is reconstructed from parity. Reading from an unmapped
+// address fails with a *btrfs.UnmappedError.
+func (ix *Index) NewLogicalReader(devs Devices) io.ReaderAt {
+	return &logicalReader{ix: ix, devs: devs}
+}
+
+func (r *logicalReader) ReadAt(p []byte, off int64) (int, error) {
+	read := 0
+	for read < len(p) {
+		logical := uint64(off) + uint64(read)
+		m, err := r.ix.ChunkMap().Lookup(logical)
+		if err != nil {
+			return read, err
+		}
+		pr, err := m.Physical(logical, 0)
+		if err != nil {
+			return read, err
+		}
+		size := len(p) - read
+		if uint64(size) > pr.Length {
+			size = int(pr.Length)
+		}
+		piece := p[read : read+size]
+		var n int
+		if m.NumMirrors() > 1 {
+			n, err = r.readMirrored(piece, m, logical)
+		} else {
+			n, err = r.readPhysical(piece, pr)
+		}
+		if err != nil && m.ParityStripes() > 0 {
+			if rerr := r.reconstruct(piece, m, logical); rerr == nil {
+				n, err = size, nil
+			}
+		}
+		read += n
+		if err != nil {
+			return read, err
+		}
+	}
+	return read, nil
+}
+
+// readPhysical reads p from the device location pr.
+func (r *logicalReader) readPhysical(p []byte, pr btrfs.PhysicalRange) (int,
+	error) {
+	dev, err := r.devs.Device(pr.DevID)
+	if err != nil {
+		return 0, err
+	}
+	return dev.ReadAt(p, int64(pr.Offset))
+}
+
+// readMirrored reads p from the first copy that can be read and verifies
+// against the checksum tree. p must not cross a stripe boundary. The read is
+// extended to whole sectors for verification. If no copy verifies, the data
+// of the first readable one is returned, it is still the best guess.
+func (r *logicalReader) readMirrored(p []byte, m *btrfs.ChunkMapping,
+	logical uint64) (int, error) {
+	if r.sectorSize == 0 {
+		r.sectorSize = r.ix.SectorSize()
+	}
+	ss := uint64(r.sectorSize)
+	start := logical - logical%ss
+	end := logical + uint64(len(p))
+	if rem := end % ss; rem != 0 {
+		end += ss - rem
+	}
+	if end > m.End() {
+		end = m.End()
+	}
+	buf := p
+	if start != logical || end != logical+uint64(len(p)) {
+		buf = make([]byte, end-start)
+	}
+
+	var best []byte
+	var firstErr error
+	for mirror := 0; mirror < m.NumMirrors(); mirror++ {
+		pr, err := m.Physical(start, mirror)
+		if err == nil {
+			_, err = r.readPhysical(buf, pr)
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if r.ix.VerifyData(buf, start, r.sectorSize) {
+			copy(p, buf[logical-start:])
+			return len(p), nil
+		}
+		if best == nil {
+			best = append([]byte(nil), buf...)
+		}
+	}
+	if best != nil {
+		copy(p, best[logical-start:])
+		return len(p), nil
+	}
+	return 0, firstErr
+}
+
+// reconstruct fills p with the data at the logical address of a RAID5 or
+// RAID6 chunk from the other blocks in its stripe row. p must not cross a
+// stripe boundary.
+func (r *logicalReader) reconstruct(p []byte, m *btrfs.ChunkMapping,
+	logical uint64) error {
+	row, index, err := m.StripeRow(logical)
+	if err != nil {
+		return err
+	}
+	blocks := make([][]byte, len(row))
+	for i, pr := range row {
+		if i == index {
+			continue
+		}
+		b := make([]byte, len(p))
+		if _, err := r.readPhysical(b, pr); err == nil {
+			blocks[i] = b
+		}
+	}
+	if err = raid56.Reconstruct(blocks, m.ParityStripes()); err != nil {
+		return fmt.Errorf("cannot reconstruct logical %d: %w", logical, err)
+	}
+	copy(p, blocks[index])
+	return nil
+}
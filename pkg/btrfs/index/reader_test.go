@@ -0,0 +1,225 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+package index
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"blichmann.eu/code/btrfscue/pkg/btrfs"
+	"blichmann.eu/code/btrfscue/pkg/btrfs/csum"
+	"blichmann.eu/code/btrfscue/pkg/btrfs/raid56"
+	"blichmann.eu/code/btrfscue/pkg/uuid"
+)
+
+func TestLogicalReaderStriped(t *testing.T) {
+	td, err := ioutil.TempDir("", "reader_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	ix, err := Open(filepath.Join(td, "index"), 0644, &Options{
+		BlockSize: 4096, FSID: uuid.UUID{1}, Generation: ^uint64(0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ix.Close()
+
+	// RAID0 over two devices, the second stripe starts at logical 1M+64K
+	const sl = btrfs.StripeLen
+	const logical = 1 << 20
+	if err := ix.InsertChunk(btrfs.ChunkMapping{Logical: logical,
+		Length: 4 * sl, StripeLen: sl,
+		Type: btrfs.BlockGroupData | btrfs.BlockGroupRaid0,
+		Stripes: []btrfs.ChunkStripe{{DevID: 1, Offset: 0},
+			{DevID: 2, Offset: sl}}}, 1, 4096); err != nil {
+		t.Fatal(err)
+	}
+	dev1 := make([]byte, 2*sl)
+	dev2 := make([]byte, 3*sl)
+	copy(dev1[sl-3:], "abc")
+	copy(dev2[sl:], "def")
+	copy(dev2[2*sl-2:], "gh")
+	copy(dev1[sl:], "ij")
+	devs := Devices{1: bytes.NewReader(dev1), 2: bytes.NewReader(dev2)}
+
+	for _, tc := range []struct {
+		off      int64
+		expected string
+	}{
+		{logical + sl - 3, "abcdef"}, // Device 1 to device 2
+		{logical + 2*sl - 2, "ghij"}, // Device 2 back to device 1
+		{logical + sl, "def"},        // Within device 2
+	} {
+		buf := make([]byte, len(tc.expected))
+		if _, err := ix.NewLogicalReader(devs).ReadAt(buf,
+			tc.off); err != nil {
+			t.Errorf("%d: %s", tc.off, err)
+		} else if string(buf) != tc.expected {
+			t.Errorf("%d: expected %q, actual %q", tc.off, tc.expected, buf)
+		}
+	}
+	if _, err := ix.NewLogicalReader(Devices{1: bytes.NewReader(dev1)}).ReadAt(
+		make([]byte, 6), logical+sl-3); err == nil {
+		t.Error("expected error for missing device")
+	}
+}
+
+func TestLogicalReaderRAID56(t *testing.T) {
+	td, err := ioutil.TempDir("", "reader_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	ix, err := Open(filepath.Join(td, "index"), 0644, &Options{
+		BlockSize: 4096, FSID: uuid.UUID{1}, Generation: ^uint64(0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ix.Close()
+
+	// RAID6 over four devices with a single stripe row: data stripes on
+	// devices 1 and 2, P on 3 and Q on 4.
+	const sl = btrfs.StripeLen
+	const logical = 1 << 20
+	if err := ix.InsertChunk(btrfs.ChunkMapping{Logical: logical,
+		Length: 2 * sl, StripeLen: sl,
+		Type: btrfs.BlockGroupData | btrfs.BlockGroupRaid6,
+		Stripes: []btrfs.ChunkStripe{{DevID: 1}, {DevID: 2}, {DevID: 3},
+			{DevID: 4}}}, 1, 4096); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 2*sl)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	blocks := [][]byte{data[:sl], data[sl:], nil, nil}
+	if err := raid56.Reconstruct(blocks, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, missing := range [][]uint64{nil, {1}, {2}, {1, 2}, {2, 3},
+		{1, 4}} {
+		devs := Devices{}
+		for i, b := range blocks {
+			devs[uint64(i+1)] = bytes.NewReader(b)
+		}
+		for _, id := range missing {
+			delete(devs, id)
+		}
+		buf := make([]byte, 2*sl-200)
+		if _, err := ix.NewLogicalReader(devs).ReadAt(buf,
+			logical+100); err != nil {
+			t.Errorf("missing %v: %s", missing, err)
+		} else if !bytes.Equal(buf, data[100:2*sl-100]) {
+			t.Errorf("missing %v: reconstructed data differs", missing)
+		}
+	}
+	devs := Devices{3: bytes.NewReader(blocks[2])}
+	if _, err := ix.NewLogicalReader(devs).ReadAt(make([]byte, 10),
+		logical); err == nil {
+		t.Error("expected error with three devices missing")
+	}
+}
+
+func TestLogicalReaderMirrors(t *testing.T) {
+	td, err := ioutil.TempDir("", "reader_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	ix, err := Open(filepath.Join(td, "index"), 0644, &Options{
+		BlockSize: 4096, FSID: uuid.UUID{1}, Generation: ^uint64(0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ix.Close()
+
+	// DUP chunk of four sectors with copies at physical 0 and 16K, RAID1
+	// chunk with copies on devices 1 and 2.
+	const ss = 4096
+	const dup, raid1 = 1 << 20, 2 << 20
+	for _, m := range []btrfs.ChunkMapping{
+		{Logical: dup, Length: 4 * ss, StripeLen: btrfs.StripeLen,
+			Type:    btrfs.BlockGroupData | btrfs.BlockGroupDup,
+			Stripes: []btrfs.ChunkStripe{{DevID: 1}, {DevID: 1, Offset: 4 * ss}}},
+		{Logical: raid1, Length: 4 * ss, StripeLen: btrfs.StripeLen,
+			Type: btrfs.BlockGroupData | btrfs.BlockGroupRaid1,
+			Stripes: []btrfs.ChunkStripe{{DevID: 1, Offset: 8 * ss},
+				{DevID: 2}}},
+	} {
+		if err := ix.InsertChunk(m, 1, ss); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data := make([]byte, 4*ss)
+	for i := range data {
+		data[i] = byte(i * 13)
+	}
+	dev1 := make([]byte, 12*ss)
+	copy(dev1, data)
+	copy(dev1[4*ss:], data)
+	copy(dev1[8*ss:], data)
+	dev2 := append([]byte(nil), data...)
+	// Corrupt the second sector of the first DUP copy
+	dev1[ss+10] ^= 0xff
+
+	// Checksums of the DUP chunk's sectors
+	if err := ix.SetCSumType(btrfs.CSumTypeCRC32); err != nil {
+		t.Fatal(err)
+	}
+	var sums []byte
+	for off := 0; off < len(data); off += ss {
+		c, err := csum.Sum(btrfs.CSumTypeCRC32, data[off:off+ss])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sums = append(sums, c[:csum.Size(btrfs.CSumTypeCRC32)]...)
+	}
+	k := btrfs.Key{ObjectID: btrfs.ExtentCSumObjectID,
+		Type: btrfs.ExtentCSumKey, Offset: dup}
+	if err := ix.InsertItem(k, makeTestHeader(0, 1, btrfs.CSumTreeObjectID,
+		0, 1, btrfs.HeaderLen), btrfs.NewItem(k, 0, uint32(len(sums))),
+		sums); err != nil {
+		t.Fatal(err)
+	}
+	if c, ok := ix.DataCSum(dup+3*ss+5, ss); !ok ||
+		!bytes.Equal(c, sums[12:16]) {
+		t.Errorf("expected checksum %x for last sector, got: %x", sums[12:16],
+			c)
+	}
+	if _, ok := ix.DataCSum(dup+4*ss, ss); ok {
+		t.Error("expected no checksum beyond the checksum item")
+	}
+
+	for _, tc := range []struct {
+		name string
+		devs Devices
+		off  int64
+		size int
+	}{
+		{"dup", Devices{1: bytes.NewReader(dev1)}, dup + 100, 2 * ss},
+		{"dup unaligned", Devices{1: bytes.NewReader(dev1)}, dup + ss + 7, 3},
+		{"raid1", Devices{1: bytes.NewReader(dev1), 2: bytes.NewReader(dev2)},
+			raid1 + 10, 3 * ss},
+		{"raid1 missing device", Devices{2: bytes.NewReader(dev2)}, raid1,
+			4 * ss},
+	} {
+		buf := make([]byte, tc.size)
+		off := int(tc.off) &^ (1<<20 - 1)
+		if _, err := ix.NewLogicalReader(tc.devs).ReadAt(buf,
+			tc.off); err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+		} else if start := int(tc.off) - off; !bytes.Equal(buf,
+			data[start:start+tc.size]) {
+			t.Errorf("%s: data differs", tc.name)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Parameters and progress of the scan that gathered the metadata
+
+package index
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// ScanDevice is a device image that is scanned for metadata.
+type ScanDevice struct {
+	DevID uint64
+	Size  uint64
+	// All blocks before this offset have been indexed
+	Offset uint64
+}
+
+const scanDeviceLen = 24
+
+// SetScanState stores the scan parameters in params and the progress of the
+// scan of each device. It is committed along with the metadata that was
+// gathered up to that point, so that an interrupted scan can be resumed.
+func (ix *Index) SetScanState(params string, devs []ScanDevice) error {
+	v := make([]byte, 4+len(params)+len(devs)*scanDeviceLen)
+	binary.LittleEndian.PutUint32(v, uint32(len(params)))
+	copy(v[4:], params)
+	o := 4 + len(params)
+	for _, d := range devs {
+		binary.LittleEndian.PutUint64(v[o:], d.DevID)
+		binary.LittleEndian.PutUint64(v[o+8:], d.Size)
+		binary.LittleEndian.PutUint64(v[o+16:], d.Offset)
+		o += scanDeviceLen
+	}
+	return ix.SetMetadataValue(metadataScanState, v)
+}
+
+// ScanState returns the scan parameters and progress stored by the last
+// call to SetScanState. Returns false if there is none.
+func (ix *Index) ScanState() (string, []ScanDevice, bool, error) {
+	v := ix.MetadataValue(metadataScanState)
+	if v == nil {
+		return "", nil, false, nil
+	}
+	if len(v) < 4 {
+		return "", nil, false, errors.New("scan state too short")
+	}
+	n := int(binary.LittleEndian.Uint32(v))
+	if 4+n > len(v) || (len(v)-4-n)%scanDeviceLen != 0 {
+		return "", nil, false, errors.New("invalid scan state")
+	}
+	params := string(v[4 : 4+n])
+	var devs []ScanDevice
+	for o := 4 + n; o < len(v); o += scanDeviceLen {
+		devs = append(devs, ScanDevice{
+			DevID:  binary.LittleEndian.Uint64(v[o:]),
+			Size:   binary.LittleEndian.Uint64(v[o+8:]),
+			Offset: binary.LittleEndian.Uint64(v[o+16:]),
+		})
+	}
+	return params, devs, true, nil
+}
@@ -0,0 +1,69 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Superblock copies found while gathering metadata
+
+package index
+
+import (
+	"encoding/binary"
+	"io"
+
+	"blichmann.eu/code/btrfscue/pkg/btrfs"
+)
+
+var superblocksBucketName = []byte("superblocks")
+
+// newSuperblockKey returns a key for the superblocks bucket, encoded in big
+// endian for lexicographical comparison.
+func newSuperblockKey(generation, devID, bytenr uint64) []byte {
+	k := [24]byte{}
+	binary.BigEndian.PutUint64(k[:], generation)
+	binary.BigEndian.PutUint64(k[8:], devID)
+	binary.BigEndian.PutUint64(k[16:], bytenr)
+	return k[:]
+}
+
+// InsertSuperblock stores a copy of a superblock, referenceable by its
+// generation, device and physical address.
+func (ix *Index) InsertSuperblock(s btrfs.Superblock) error {
+	if err := ix.ensureTx(true); err != nil {
+		return err
+	}
+	b, err := ix.auxBucket(superblocksBucketName)
+	if err != nil {
+		return err
+	}
+	return b.Put(newSuperblockKey(s.Generation(), s.DevItem().DevID(),
+		s.ByteNr()), append([]byte(nil), s...))
+}
+
+// ForEachSuperblock calls fn for every stored superblock copy, latest
+// generation first. Iteration stops at the first error.
+func (ix *Index) ForEachSuperblock(fn func(s btrfs.Superblock) error) error {
+	b, _ := ix.auxBucket(superblocksBucketName)
+	if b == nil {
+		return nil
+	}
+	c := b.Cursor()
+	for k, v := c.Last(); k != nil; k, v = c.Prev() {
+		if err := fn(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SectorSize returns the sector size from the latest stored superblock or the
+// default if there is none.
+func (ix *Index) SectorSize() uint32 {
+	ss := uint32(btrfs.X86RegularPageSize)
+	ix.ForEachSuperblock(func(s btrfs.Superblock) error {
+		if s.SectorSize() != 0 {
+			ss = s.SectorSize()
+			return io.EOF // Stop
+		}
+		return nil
+	})
+	return ss
+}
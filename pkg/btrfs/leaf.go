@@ -6,6 +6,8 @@
 package btrfs
 
 import (
+	"encoding/binary"
+
 	"blichmann.eu/code/btrfscue/pkg/uuid"
 )
 
@@ -60,7 +62,21 @@ const (
 func (i Item) Key() Key       { return SliceKey(i[itemKey:]) }
 func (i Item) Offset() uint32 { return SliceUint32LE(i[itemOffset:]) }
 func (i Item) Size() uint32   { return SliceUint32LE(i[itemSize:]) }
-func (i Item) Data() []byte   { return i[ItemLen : ItemLen+i.Size()] }
+func (i Item) Data() []byte {
+	return SliceClamp(i, ItemLen, ItemLen+int(i.Size()))
+}
+
+// NewItem returns an item header for the given key whose data is at offset
+// and has size bytes.
+func NewItem(k Key, offset, size uint32) Item {
+	i := make(Item, ItemLen)
+	binary.LittleEndian.PutUint64(i[itemKey:], k.ObjectID)
+	i[itemKey+8] = k.Type
+	binary.LittleEndian.PutUint64(i[itemKey+9:], k.Offset)
+	binary.LittleEndian.PutUint32(i[itemOffset:], offset)
+	binary.LittleEndian.PutUint32(i[itemSize:], size)
+	return i
+}
 
 type Leaf []byte
 
@@ -68,8 +84,12 @@ func (l Leaf) Header() Header { return Header(l) }
 
 // Len returns the number of items in this leaf.
 func (l Leaf) Len() int {
-	// Clamp maximum number of items to avoid OOM in case NrItems is corrupted.
-	maxItems := cap(l) / ItemLen
+	// Clamp maximum number of items to avoid OOM or out of range accesses in
+	// case NrItems is corrupted.
+	if len(l) < HeaderLen {
+		return 0
+	}
+	maxItems := (len(l) - HeaderLen) / ItemLen
 	numItems := l.Header().NrItems()
 	if numItems > uint32(maxItems) {
 		numItems = uint32(maxItems)
@@ -96,12 +116,77 @@ func (l Leaf) Key(i int) Key {
 
 func (l Leaf) Data(i int) []byte {
 	item := l.Item(i)
-	o := HeaderLen + item.Offset()
-	// Guard against invalid Item lengths.
-	leafLen := uint32(len(l))
-	e := o + item.Size()
-	if e > leafLen {
-		e = leafLen
+	// Guard against invalid Item offsets and lengths. Use CheckItem() to
+	// detect these.
+	o := uint64(HeaderLen) + uint64(item.Offset())
+	e := o + uint64(item.Size())
+	if e > uint64(len(l)) {
+		e = uint64(len(l))
+	}
+	if o > e {
+		o = e
 	}
 	return l[o:e]
 }
+
+// MaxLevel is the maximum height of a BTRFS tree. Leaves are at level 0.
+const MaxLevel = 8
+
+// KeyPtr points from an internal tree node to a child block.
+type KeyPtr []byte
+
+// KeyPtr offsets for parsing from byte slice
+const (
+	keyPtrKey        = 0
+	keyPtrBlockPtr   = keyPtrKey + KeyLen
+	keyPtrGeneration = keyPtrBlockPtr + 8
+	KeyPtrLen        = keyPtrGeneration + 8
+)
+
+// Key returns the smallest key in the child's subtree.
+func (p KeyPtr) Key() Key { return SliceKey(p[keyPtrKey:]) }
+
+// BlockPtr returns the logical address of the child block.
+func (p KeyPtr) BlockPtr() uint64 { return SliceUint64LE(p[keyPtrBlockPtr:]) }
+
+// Generation returns the expected generation of the child block.
+func (p KeyPtr) Generation() uint64 { return SliceUint64LE(p[keyPtrGeneration:]) }
+
+// Node is an internal tree block (level > 0). Instead of items, it holds
+// key pointers to the blocks one level down.
+type Node []byte
+
+func (n Node) Header() Header { return Header(n) }
+
+// Len returns the number of key pointers in this node.
+func (n Node) Len() int {
+	// Clamp maximum number of key pointers in case NrItems is corrupted.
+	if len(n) < HeaderLen {
+		return 0
+	}
+	maxPtrs := (len(n) - HeaderLen) / KeyPtrLen
+	numPtrs := n.Header().NrItems()
+	if numPtrs > uint32(maxPtrs) {
+		numPtrs = uint32(maxPtrs)
+	}
+	return int(numPtrs)
+}
+
+func (n Node) KeyPtr(i int) KeyPtr {
+	o := HeaderLen + i*KeyPtrLen
+	return KeyPtr(n[o : o+KeyPtrLen])
+}
+
+func (n Node) KeyPtrs() []KeyPtr {
+	ptrs := make([]KeyPtr, n.Len())
+	for i := range ptrs {
+		ptrs[i] = n.KeyPtr(i)
+	}
+	return ptrs
+}
+
+// Compact returns the node header and its key pointers without the unused
+// space at the end of the block.
+func (n Node) Compact() Node {
+	return n[:HeaderLen+n.Len()*KeyPtrLen]
+}
@@ -0,0 +1,179 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Parity calculation and reconstruction for RAID5 and RAID6 stripe rows. Like
+// Linux MD, BTRFS computes P as the XOR of the data blocks and Q as a
+// Reed-Solomon syndrome over GF(2^8) with generator 2 and polynomial 0x11d.
+
+package raid56
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrTooManyMissing is returned if more blocks of a stripe row are missing
+// than its parity can make up for.
+var ErrTooManyMissing = errors.New("too many missing blocks to reconstruct")
+
+var (
+	gfExp [512]byte // Doubled to avoid a modulo in gfMul
+	gfLog [256]int
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfExp[i+255] = byte(x)
+		gfLog[x] = i
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	gfExp[510] = gfExp[0]
+	gfExp[511] = gfExp[1]
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[gfLog[a]+gfLog[b]]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-gfLog[a]]
+}
+
+// gfPow returns the generator raised to the power of e.
+func gfPow(e int) byte {
+	return gfExp[e%255]
+}
+
+// mulXor adds c*src to dst.
+func mulXor(dst, src []byte, c byte) {
+	if c == 1 {
+		for i, b := range src {
+			dst[i] ^= b
+		}
+		return
+	}
+	for i, b := range src {
+		dst[i] ^= gfMul(c, b)
+	}
+}
+
+// mul multiplies buf by c in place.
+func mul(buf []byte, c byte) {
+	for i, b := range buf {
+		buf[i] = gfMul(c, b)
+	}
+}
+
+// Reconstruct fills in the missing blocks of a stripe row. blocks holds the
+// data blocks in logical order, followed by P and, if parity is 2, Q.
+// Missing blocks are nil, all others need to have the same size. RAID5
+// (parity 1) can make up for any single missing block, RAID6 (parity 2) for
+// any two.
+func Reconstruct(blocks [][]byte, parity int) error {
+	if parity != 1 && parity != 2 {
+		return fmt.Errorf("invalid number of parity blocks %d", parity)
+	}
+	numData := len(blocks) - parity
+	if numData < 1 {
+		return fmt.Errorf("stripe row of %d blocks has no data", len(blocks))
+	}
+	size := -1
+	var missing []int
+	for i, b := range blocks {
+		if b == nil {
+			missing = append(missing, i)
+		} else if size < 0 {
+			size = len(b)
+		} else if len(b) != size {
+			return fmt.Errorf("block %d has size %d, expected %d", i, len(b),
+				size)
+		}
+	}
+	if len(missing) > parity {
+		return ErrTooManyMissing
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	data := blocks[:numData]
+	p := blocks[numData]
+	var q []byte
+	if parity == 2 {
+		q = blocks[numData+1]
+	}
+
+	var missingData []int
+	for _, i := range missing {
+		if i < numData {
+			missingData = append(missingData, i)
+			blocks[i] = make([]byte, size)
+		}
+	}
+	switch len(missingData) {
+	case 1:
+		x := missingData[0]
+		if p != nil {
+			// D_x = P + sum of the other data blocks
+			copy(data[x], p)
+			for i, d := range data {
+				if i != x {
+					mulXor(data[x], d, 1)
+				}
+			}
+			break
+		}
+		// D_x = (Q + sum of g^i * D_i for i != x) / g^x
+		copy(data[x], q)
+		for i, d := range data {
+			if i != x {
+				mulXor(data[x], d, gfPow(i))
+			}
+		}
+		mul(data[x], gfInv(gfPow(x)))
+	case 2:
+		// Both parity blocks are present. With Pxy and Qxy being P and Q
+		// computed over the remaining data blocks, D_y is
+		// (Pxy + P) / (g^(y-x) + 1) + (Qxy + Q) / (g^x + g^y) and
+		// D_x = D_y + Pxy + P.
+		x, y := missingData[0], missingData[1]
+		pxy := append([]byte(nil), p...)
+		qxy := append([]byte(nil), q...)
+		for i, d := range data {
+			if i != x && i != y {
+				mulXor(pxy, d, 1)
+				mulXor(qxy, d, gfPow(i))
+			}
+		}
+		pMul := gfInv(gfPow(y-x) ^ 1)
+		qMul := gfInv(gfPow(x) ^ gfPow(y))
+		dx, dy := data[x], data[y]
+		for i := range dy {
+			dy[i] = gfMul(pMul, pxy[i]) ^ gfMul(qMul, qxy[i])
+			dx[i] = dy[i] ^ pxy[i]
+		}
+	}
+
+	if p == nil {
+		p = make([]byte, size)
+		for _, d := range data {
+			mulXor(p, d, 1)
+		}
+		blocks[numData] = p
+	}
+	if parity == 2 && q == nil {
+		q = make([]byte, size)
+		for i, d := range data {
+			mulXor(q, d, gfPow(i))
+		}
+		blocks[numData+1] = q
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Tests for RAID5 and RAID6 reconstruction
+
+package raid56
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func makeRow(r *rand.Rand, numData, parity, size int) [][]byte {
+	row := make([][]byte, numData+parity)
+	for i := 0; i < numData; i++ {
+		row[i] = make([]byte, size)
+		r.Read(row[i])
+	}
+	return row
+}
+
+func TestParity(t *testing.T) {
+	row := [][]byte{{0x01, 0x80}, {0x02, 0x01}, nil, nil}
+	if err := Reconstruct(row, 2); err != nil {
+		t.Fatal(err)
+	}
+	// P = D0 + D1, Q = D0 + 2 * D1 in GF(2^8) with polynomial 0x11d
+	if !bytes.Equal(row[2], []byte{0x03, 0x81}) {
+		t.Errorf("unexpected P: %x", row[2])
+	}
+	if !bytes.Equal(row[3], []byte{0x05, 0x82}) {
+		t.Errorf("unexpected Q: %x", row[3])
+	}
+	row = [][]byte{{0x80}, {0x80}, {0x80}, nil, nil}
+	if err := Reconstruct(row, 2); err != nil {
+		t.Fatal(err)
+	}
+	// 0x80 + 2*0x80 + 4*0x80 = 0x80 + 0x1d + 0x3a
+	if row[3][0] != 0x80 || row[4][0] != 0x80^0x1d^0x3a {
+		t.Errorf("unexpected P/Q: %x/%x", row[3], row[4])
+	}
+}
+
+func TestReconstruct(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, parity := range []int{1, 2} {
+		for numData := 1; numData <= 5; numData++ {
+			full := makeRow(r, numData, parity, 64)
+			if err := Reconstruct(full, parity); err != nil {
+				t.Fatal(err)
+			}
+			n := len(full)
+			// Remove every combination of up to parity blocks
+			for a := 0; a < n; a++ {
+				for b := a; b < n; b++ {
+					if parity == 1 && b != a {
+						continue
+					}
+					row := append([][]byte(nil), full...)
+					row[a], row[b] = nil, nil
+					if err := Reconstruct(row, parity); err != nil {
+						t.Fatalf("parity %d, %d data, missing %d/%d: %s",
+							parity, numData, a, b, err)
+					}
+					for i := range row {
+						if !bytes.Equal(row[i], full[i]) {
+							t.Errorf("parity %d, %d data, missing %d/%d: "+
+								"block %d differs", parity, numData, a, b, i)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	row := makeRow(r, 3, 1, 16)
+	row[0] = nil
+	if err := Reconstruct(row, 1); err != ErrTooManyMissing {
+		t.Errorf("expected ErrTooManyMissing, got: %v", err)
+	}
+	if err := Reconstruct([][]byte{{1}, {1, 2}, nil}, 1); err == nil {
+		t.Error("expected error for blocks of different size")
+	}
+}
@@ -29,3 +29,18 @@ func SliceKey(b []byte) Key {
 func SliceTimeLE(b []byte) time.Time {
 	return time.Unix(int64(SliceUint64LE(b)), int64(SliceUint32LE(b[8:])))
 }
+
+// SliceClamp returns b[start:end], with start and end clamped to the bounds
+// of b. Use this to access variable length data from untrusted input.
+func SliceClamp(b []byte, start, end int) []byte {
+	if end > len(b) {
+		end = len(b)
+	}
+	if start > end {
+		start = end
+	}
+	if start < 0 {
+		start = 0
+	}
+	return b[start:end]
+}
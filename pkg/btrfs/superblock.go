@@ -0,0 +1,322 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// BTRFS filesystem structures - Superblock and backup roots
+
+package btrfs
+
+import (
+	"bytes"
+
+	"blichmann.eu/code/btrfscue/pkg/uuid"
+)
+
+// SuperInfoSize is the size of the superblock on disk. It is independent of
+// the filesystem's node or sector size.
+const SuperInfoSize = 4096
+
+// SuperInfoOffsets lists the offsets of all superblock copies in order.
+var SuperInfoOffsets = [...]uint64{
+	SuperInfoOffset,
+	SuperInfoOffset2,
+	SuperInfoOffset3,
+	SuperInfoOffset4,
+}
+
+// Number of backup root entries stored in the superblock
+const NumBackupRoots = 4
+
+// Superblock flags
+const (
+	SuperFlagWritten        = 1 << 0
+	SuperFlagReloc          = 1 << 1
+	SuperFlagError          = 1 << 2
+	SuperFlagSeeding        = 1 << 32
+	SuperFlagMetadump       = 1 << 33
+	SuperFlagMetadumpV2     = 1 << 34
+	SuperFlagChangingFSID   = 1 << 35
+	SuperFlagChangingFSIDV2 = 1 << 36
+)
+
+// Compat read-only feature flags
+const (
+	FeatureCompatROFreeSpaceTree      = 1 << 0
+	FeatureCompatROFreeSpaceTreeValid = 1 << 1
+	FeatureCompatROVerity             = 1 << 2
+	FeatureCompatROBlockGroupTree     = 1 << 3
+)
+
+// Incompat feature flags
+const (
+	FeatureIncompatMixedBackref   = 1 << 0
+	FeatureIncompatDefaultSubvol  = 1 << 1
+	FeatureIncompatMixedGroups    = 1 << 2
+	FeatureIncompatCompressLZO    = 1 << 3
+	FeatureIncompatCompressZstd   = 1 << 4
+	FeatureIncompatBigMetadata    = 1 << 5
+	FeatureIncompatExtendedIRef   = 1 << 6
+	FeatureIncompatRAID56         = 1 << 7
+	FeatureIncompatSkinnyMetadata = 1 << 8
+	FeatureIncompatNoHoles        = 1 << 9
+	FeatureIncompatMetadataUUID   = 1 << 10
+	FeatureIncompatRAID1C34       = 1 << 11
+	FeatureIncompatZoned          = 1 << 12
+	FeatureIncompatExtentTreeV2   = 1 << 13
+	FeatureIncompatRaidStripeTree = 1 << 14
+	FeatureIncompatSimpleQuota    = 1 << 16
+)
+
+// Checksum algorithms
+const (
+	CSumTypeCRC32  = 0
+	CSumTypeXXHash = 1
+	CSumTypeSHA256 = 2
+	CSumTypeBlake2 = 3
+)
+
+type Superblock []byte
+
+// Superblock offsets for parsing from byte slice
+const (
+	superCSum = 0
+	// The following three fields must match struct Header
+	superFSID                = superCSum + CSumSize
+	superByteNr              = superFSID + uuid.UUIDSize
+	superFlags               = superByteNr + 8
+	superMagic               = superFlags + 8
+	superGeneration          = superMagic + 8
+	superRoot                = superGeneration + 8
+	superChunkRoot           = superRoot + 8
+	superLogRoot             = superChunkRoot + 8
+	superLogRootTransID      = superLogRoot + 8 // Unused
+	superTotalBytes          = superLogRootTransID + 8
+	superBytesUsed           = superTotalBytes + 8
+	superRootDirObjectID     = superBytesUsed + 8
+	superNumDevices          = superRootDirObjectID + 8
+	superSectorSize          = superNumDevices + 8
+	superNodeSize            = superSectorSize + 4
+	superLeafSize            = superNodeSize + 4 // Unused, same as nodesize
+	superStripeSize          = superLeafSize + 4
+	superSysChunkArraySize   = superStripeSize + 4
+	superChunkRootGeneration = superSysChunkArraySize + 4
+	superCompatFlags         = superChunkRootGeneration + 8
+	superCompatROFlags       = superCompatFlags + 8
+	superIncompatFlags       = superCompatROFlags + 8
+	superCSumType            = superIncompatFlags + 8
+	superRootLevel           = superCSumType + 2
+	superChunkRootLevel      = superRootLevel + 1
+	superLogRootLevel        = superChunkRootLevel + 1
+	superDevItem             = superLogRootLevel + 1
+	superLabel               = superDevItem + DevItemLen
+	superCacheGeneration     = superLabel + LabelSize
+	superUUIDTreeGeneration  = superCacheGeneration + 8
+	superMetadataUUID        = superUUIDTreeGeneration + 8
+	superNumGlobalRoots      = superMetadataUUID + uuid.UUIDSize
+	superBlockGroupRoot      = superNumGlobalRoots + 8
+	superBlockGroupRootGen   = superBlockGroupRoot + 8
+	superBlockGroupRootLevel = superBlockGroupRootGen + 8
+	superReserved            = superBlockGroupRootLevel + 1 + 7
+	superSysChunkArray       = superReserved + 24*8
+	superBackupRoots         = superSysChunkArray + SystemChunkArraySize
+	superPadding             = superBackupRoots + NumBackupRoots*RootBackupLen
+)
+
+// CSum returns the raw checksum over the rest of the superblock.
+func (s Superblock) CSum() CSum {
+	c := CSum{}
+	copy(c[:], s[superCSum:superCSum+CSumSize])
+	return c
+}
+
+// FSID returns the filesystem specific UUID. If the metadata UUID feature
+// is in use, this is the user-visible UUID and tree blocks are stamped with
+// MetadataUUID() instead.
+func (s Superblock) FSID() uuid.UUID { return SliceUUID(s[superFSID:]) }
+
+// ByteNr returns the physical address of this superblock copy.
+func (s Superblock) ByteNr() uint64 { return SliceUint64LE(s[superByteNr:]) }
+func (s Superblock) Flags() uint64  { return SliceUint64LE(s[superFlags:]) }
+func (s Superblock) Magic() uint64  { return SliceUint64LE(s[superMagic:]) }
+
+// Generation returns the transaction id of the last committed transaction.
+func (s Superblock) Generation() uint64 { return SliceUint64LE(s[superGeneration:]) }
+
+// Root returns the logical address of the root of the tree of tree roots.
+func (s Superblock) Root() uint64 { return SliceUint64LE(s[superRoot:]) }
+
+// ChunkRoot returns the logical address of the root of the chunk tree.
+func (s Superblock) ChunkRoot() uint64 { return SliceUint64LE(s[superChunkRoot:]) }
+
+// LogRoot returns the logical address of the root of the log tree, zero if
+// there is no log to replay.
+func (s Superblock) LogRoot() uint64         { return SliceUint64LE(s[superLogRoot:]) }
+func (s Superblock) TotalBytes() uint64      { return SliceUint64LE(s[superTotalBytes:]) }
+func (s Superblock) BytesUsed() uint64       { return SliceUint64LE(s[superBytesUsed:]) }
+func (s Superblock) RootDirObjectID() uint64 { return SliceUint64LE(s[superRootDirObjectID:]) }
+func (s Superblock) NumDevices() uint64      { return SliceUint64LE(s[superNumDevices:]) }
+func (s Superblock) SectorSize() uint32      { return SliceUint32LE(s[superSectorSize:]) }
+func (s Superblock) NodeSize() uint32        { return SliceUint32LE(s[superNodeSize:]) }
+func (s Superblock) StripeSize() uint32      { return SliceUint32LE(s[superStripeSize:]) }
+
+// SysChunkArraySize returns the number of valid bytes in SysChunkArray().
+func (s Superblock) SysChunkArraySize() uint32 {
+	return SliceUint32LE(s[superSysChunkArraySize:])
+}
+
+func (s Superblock) ChunkRootGeneration() uint64 {
+	return SliceUint64LE(s[superChunkRootGeneration:])
+}
+func (s Superblock) CompatFlags() uint64   { return SliceUint64LE(s[superCompatFlags:]) }
+func (s Superblock) CompatROFlags() uint64 { return SliceUint64LE(s[superCompatROFlags:]) }
+func (s Superblock) IncompatFlags() uint64 { return SliceUint64LE(s[superIncompatFlags:]) }
+
+// CSumType returns the checksum algorithm used for metadata and data blocks.
+func (s Superblock) CSumType() uint16      { return SliceUint16LE(s[superCSumType:]) }
+func (s Superblock) RootLevel() uint8      { return s[superRootLevel] }
+func (s Superblock) ChunkRootLevel() uint8 { return s[superChunkRootLevel] }
+func (s Superblock) LogRootLevel() uint8   { return s[superLogRootLevel] }
+
+// DevItem returns the device item of the device this superblock copy was
+// read from.
+func (s Superblock) DevItem() DevItem { return DevItem(s[superDevItem:superLabel]) }
+
+// Label returns the filesystem label, without trailing NUL bytes.
+func (s Superblock) Label() string {
+	l := s[superLabel : superLabel+LabelSize]
+	if i := bytes.IndexByte(l, 0); i >= 0 {
+		l = l[:i]
+	}
+	return string(l)
+}
+
+func (s Superblock) CacheGeneration() uint64 { return SliceUint64LE(s[superCacheGeneration:]) }
+func (s Superblock) UUIDTreeGeneration() uint64 {
+	return SliceUint64LE(s[superUUIDTreeGeneration:])
+}
+
+// MetadataUUID returns the UUID stamped into all tree blocks. This is only
+// valid if FeatureIncompatMetadataUUID is set, use TreeFSID() otherwise.
+func (s Superblock) MetadataUUID() uuid.UUID { return SliceUUID(s[superMetadataUUID:]) }
+
+// TreeFSID returns the UUID that is expected in the headers of this
+// filesystem's tree blocks.
+func (s Superblock) TreeFSID() uuid.UUID {
+	if s.IncompatFlags()&FeatureIncompatMetadataUUID != 0 {
+		return s.MetadataUUID()
+	}
+	return s.FSID()
+}
+
+func (s Superblock) NumGlobalRoots() uint64 { return SliceUint64LE(s[superNumGlobalRoots:]) }
+func (s Superblock) BlockGroupRoot() uint64 { return SliceUint64LE(s[superBlockGroupRoot:]) }
+func (s Superblock) BlockGroupRootGeneration() uint64 {
+	return SliceUint64LE(s[superBlockGroupRootGen:])
+}
+func (s Superblock) BlockGroupRootLevel() uint8 { return s[superBlockGroupRootLevel] }
+
+// SysChunkArray returns the raw bytes of the bootstrap chunk array. It holds
+// (Key, Chunk) pairs for all SYSTEM chunks, which is needed to read the
+// chunk tree.
+func (s Superblock) SysChunkArray() []byte {
+	l := s.SysChunkArraySize()
+	if l > SystemChunkArraySize {
+		l = SystemChunkArraySize
+	}
+	return s[superSysChunkArray : superSysChunkArray+l]
+}
+
+// BackupRoot returns the ith backup root entry. The kernel uses these
+// entries as a ring buffer, so the newest entry is not necessarily the last.
+func (s Superblock) BackupRoot(i int) RootBackup {
+	o := superBackupRoots + i*RootBackupLen
+	return RootBackup(s[o : o+RootBackupLen])
+}
+
+// BackupRoots returns all backup root entries.
+func (s Superblock) BackupRoots() []RootBackup {
+	roots := make([]RootBackup, NumBackupRoots)
+	for i := range roots {
+		roots[i] = s.BackupRoot(i)
+	}
+	return roots
+}
+
+// IsValid reports whether this looks like a superblock, i.e. the buffer is
+// large enough and has the correct magic.
+func (s Superblock) IsValid() bool {
+	return len(s) >= SuperInfoSize && s.Magic() == Magic
+}
+
+// RootBackup stores the tree roots of a recent transaction so that they can
+// be used as a fallback if the latest tree roots are damaged.
+type RootBackup []byte
+
+// RootBackup offsets for parsing from byte slice
+const (
+	rootBackupTreeRoot        = 0
+	rootBackupTreeRootGen     = rootBackupTreeRoot + 8
+	rootBackupChunkRoot       = rootBackupTreeRootGen + 8
+	rootBackupChunkRootGen    = rootBackupChunkRoot + 8
+	rootBackupExtentRoot      = rootBackupChunkRootGen + 8
+	rootBackupExtentRootGen   = rootBackupExtentRoot + 8
+	rootBackupFSRoot          = rootBackupExtentRootGen + 8
+	rootBackupFSRootGen       = rootBackupFSRoot + 8
+	rootBackupDevRoot         = rootBackupFSRootGen + 8
+	rootBackupDevRootGen      = rootBackupDevRoot + 8
+	rootBackupCSumRoot        = rootBackupDevRootGen + 8
+	rootBackupCSumRootGen     = rootBackupCSumRoot + 8
+	rootBackupTotalBytes      = rootBackupCSumRootGen + 8
+	rootBackupBytesUsed       = rootBackupTotalBytes + 8
+	rootBackupNumDevices      = rootBackupBytesUsed + 8
+	rootBackupUnused64        = rootBackupNumDevices + 8
+	rootBackupTreeRootLevel   = rootBackupUnused64 + 4*8
+	rootBackupChunkRootLevel  = rootBackupTreeRootLevel + 1
+	rootBackupExtentRootLevel = rootBackupChunkRootLevel + 1
+	rootBackupFSRootLevel     = rootBackupExtentRootLevel + 1
+	rootBackupDevRootLevel    = rootBackupFSRootLevel + 1
+	rootBackupCSumRootLevel   = rootBackupDevRootLevel + 1
+	rootBackupUnused8         = rootBackupCSumRootLevel + 1
+	RootBackupLen             = rootBackupUnused8 + 10
+)
+
+func (r RootBackup) TreeRoot() uint64       { return SliceUint64LE(r[rootBackupTreeRoot:]) }
+func (r RootBackup) TreeRootGen() uint64    { return SliceUint64LE(r[rootBackupTreeRootGen:]) }
+func (r RootBackup) ChunkRoot() uint64      { return SliceUint64LE(r[rootBackupChunkRoot:]) }
+func (r RootBackup) ChunkRootGen() uint64   { return SliceUint64LE(r[rootBackupChunkRootGen:]) }
+func (r RootBackup) ExtentRoot() uint64     { return SliceUint64LE(r[rootBackupExtentRoot:]) }
+func (r RootBackup) ExtentRootGen() uint64  { return SliceUint64LE(r[rootBackupExtentRootGen:]) }
+func (r RootBackup) FSRoot() uint64         { return SliceUint64LE(r[rootBackupFSRoot:]) }
+func (r RootBackup) FSRootGen() uint64      { return SliceUint64LE(r[rootBackupFSRootGen:]) }
+func (r RootBackup) DevRoot() uint64        { return SliceUint64LE(r[rootBackupDevRoot:]) }
+func (r RootBackup) DevRootGen() uint64     { return SliceUint64LE(r[rootBackupDevRootGen:]) }
+func (r RootBackup) CSumRoot() uint64       { return SliceUint64LE(r[rootBackupCSumRoot:]) }
+func (r RootBackup) CSumRootGen() uint64    { return SliceUint64LE(r[rootBackupCSumRootGen:]) }
+func (r RootBackup) TotalBytes() uint64     { return SliceUint64LE(r[rootBackupTotalBytes:]) }
+func (r RootBackup) BytesUsed() uint64      { return SliceUint64LE(r[rootBackupBytesUsed:]) }
+func (r RootBackup) NumDevices() uint64     { return SliceUint64LE(r[rootBackupNumDevices:]) }
+func (r RootBackup) TreeRootLevel() uint8   { return r[rootBackupTreeRootLevel] }
+func (r RootBackup) ChunkRootLevel() uint8  { return r[rootBackupChunkRootLevel] }
+func (r RootBackup) ExtentRootLevel() uint8 { return r[rootBackupExtentRootLevel] }
+func (r RootBackup) FSRootLevel() uint8     { return r[rootBackupFSRootLevel] }
+func (r RootBackup) DevRootLevel() uint8    { return r[rootBackupDevRootLevel] }
+func (r RootBackup) CSumRootLevel() uint8   { return r[rootBackupCSumRootLevel] }
+
+// SysChunks parses the bootstrap chunk array and returns the keys and chunk
+// items of all SYSTEM chunks. Parsing stops at the first truncated entry.
+func (s Superblock) SysChunks() ([]Key, []Chunk) {
+	var keys []Key
+	var chunks []Chunk
+	a := s.SysChunkArray()
+	for len(a) >= KeyLen+chunkStripes {
+		k := SliceKey(a)
+		c := Chunk(a[KeyLen:])
+		l := chunkStripes + int(c.NumStripes())*stripeEnd
+		if c.NumStripes() == 0 || len(c) < l {
+			break
+		}
+		keys = append(keys, k)
+		chunks = append(chunks, c[:l])
+		a = a[KeyLen+l:]
+	}
+	return keys, chunks
+}
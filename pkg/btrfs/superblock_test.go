@@ -0,0 +1,75 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Tests for superblock parsing
+
+package btrfs
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestSuperblockLayout(t *testing.T) {
+	// Offsets as documented in the on-disk format description
+	for _, c := range []struct {
+		name             string
+		actual, expected int
+	}{
+		{"dev_item", superDevItem, 0xc9},
+		{"label", superLabel, 0x12b},
+		{"metadata_uuid", superMetadataUUID, 0x23b},
+		{"sys_chunk_array", superSysChunkArray, 0x32b},
+		{"super_roots", superBackupRoots, 0xb2b},
+		{"padding", superPadding, SuperInfoSize - 565},
+	} {
+		if c.actual != c.expected {
+			t.Errorf("%s: expected offset %#x, actual %#x", c.name, c.expected,
+				c.actual)
+		}
+	}
+}
+
+func TestSuperblockSysChunks(t *testing.T) {
+	s := make(Superblock, SuperInfoSize)
+	binary.LittleEndian.PutUint64(s[superMagic:], Magic)
+	copy(s[superLabel:], "rescue-me")
+
+	a := s[superSysChunkArray:]
+	o := 0
+	for i, numStripes := range []uint16{1, 2} {
+		binary.LittleEndian.PutUint64(a[o:], FirstChunkTreeObjectID)
+		a[o+8] = ChunkItemKey
+		binary.LittleEndian.PutUint64(a[o+9:], uint64(i+1)<<22)
+		o += KeyLen
+		binary.LittleEndian.PutUint64(a[o+chunkLength:], 8<<20)
+		binary.LittleEndian.PutUint64(a[o+chunkType:], BlockGroupSystem)
+		binary.LittleEndian.PutUint16(a[o+chunkNumStripes:], numStripes)
+		for j := 0; j < int(numStripes); j++ {
+			binary.LittleEndian.PutUint64(a[o+chunkStripes+j*stripeEnd+
+				stripeOffset:], uint64(j+1)<<24)
+		}
+		o += chunkStripes + int(numStripes)*stripeEnd
+	}
+	binary.LittleEndian.PutUint32(s[superSysChunkArraySize:], uint32(o))
+
+	if !s.IsValid() {
+		t.Fatal("expected valid superblock")
+	}
+	if l := s.Label(); l != "rescue-me" {
+		t.Errorf("expected label 'rescue-me', actual '%s'", l)
+	}
+	keys, chunks := s.SysChunks()
+	if len(keys) != 2 || len(chunks) != 2 {
+		t.Fatalf("expected 2 chunks, actual %d", len(chunks))
+	}
+	if keys[1].Offset != 2<<22 {
+		t.Errorf("expected logical %d, actual %d", 2<<22, keys[1].Offset)
+	}
+	if n := chunks[1].NumStripes(); n != 2 {
+		t.Fatalf("expected 2 stripes, actual %d", n)
+	}
+	if o := chunks[1].Stripe(1).Offset(); o != 2<<24 {
+		t.Errorf("expected stripe offset %d, actual %d", 2<<24, o)
+	}
+}
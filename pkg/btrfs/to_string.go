@@ -7,6 +7,7 @@ package btrfs
 
 import (
 	"fmt"
+	"strings"
 )
 
 func ObjectIDString(id uint64) string {
@@ -148,3 +149,131 @@ func (k Key) String() string {
 	return fmt.Sprintf("key (%s %s %d)", ObjectIDString(k.ObjectID),
 		KeyTypeString(k.Type), int64(k.Offset))
 }
+
+// ProfileString returns the name of the replication profile in the given
+// block group flags.
+func ProfileString(flags uint64) string {
+	switch flags & BlockGroupProfileMask {
+	case 0:
+		return "single"
+	case BlockGroupRaid0:
+		return "raid0"
+	case BlockGroupRaid1:
+		return "raid1"
+	case BlockGroupDup:
+		return "dup"
+	case BlockGroupRaid10:
+		return "raid10"
+	case BlockGroupRaid5:
+		return "raid5"
+	case BlockGroupRaid6:
+		return "raid6"
+	case BlockGroupRaid1C3:
+		return "raid1c3"
+	case BlockGroupRaid1C4:
+		return "raid1c4"
+	}
+	return fmt.Sprintf("%#x", flags&BlockGroupProfileMask)
+}
+
+// BlockGroupTypeString returns the allocation types in the given block
+// group flags, like "DATA|METADATA".
+func BlockGroupTypeString(flags uint64) string {
+	return flagsString(flags&BlockGroupTypeMask, map[uint64]string{
+		BlockGroupData:     "DATA",
+		BlockGroupSystem:   "SYSTEM",
+		BlockGroupMetadata: "METADATA",
+	})
+}
+
+func CompressionString(t uint8) string {
+	switch t {
+	case CompressNone:
+		return "none"
+	case CompressZlib:
+		return "zlib"
+	case CompressLZO:
+		return "lzo"
+	case CompressZstd:
+		return "zstd"
+	}
+	return fmt.Sprintf("%d", t)
+}
+
+func CSumTypeString(t uint16) string {
+	switch t {
+	case CSumTypeCRC32:
+		return "crc32c"
+	case CSumTypeXXHash:
+		return "xxhash64"
+	case CSumTypeSHA256:
+		return "sha256"
+	case CSumTypeBlake2:
+		return "blake2b"
+	default:
+		return fmt.Sprint(t)
+	}
+}
+
+// flagsString formats a set of flags as a list of names separated by '|'.
+// Unknown bits are printed in hex.
+func flagsString(flags uint64, names map[uint64]string) string {
+	var s []string
+	for bit := uint64(1); bit != 0; bit <<= 1 {
+		if flags&bit == 0 {
+			continue
+		}
+		if n, ok := names[bit]; ok {
+			s = append(s, n)
+		} else {
+			s = append(s, fmt.Sprintf("%#x", bit))
+		}
+	}
+	if len(s) == 0 {
+		return "0"
+	}
+	return strings.Join(s, "|")
+}
+
+func SuperFlagsString(flags uint64) string {
+	return flagsString(flags, map[uint64]string{
+		SuperFlagWritten:        "WRITTEN",
+		SuperFlagReloc:          "RELOC",
+		SuperFlagError:          "ERROR",
+		SuperFlagSeeding:        "SEEDING",
+		SuperFlagMetadump:       "METADUMP",
+		SuperFlagMetadumpV2:     "METADUMP_V2",
+		SuperFlagChangingFSID:   "CHANGING_FSID",
+		SuperFlagChangingFSIDV2: "CHANGING_FSID_V2",
+	})
+}
+
+func CompatROFlagsString(flags uint64) string {
+	return flagsString(flags, map[uint64]string{
+		FeatureCompatROFreeSpaceTree:      "FREE_SPACE_TREE",
+		FeatureCompatROFreeSpaceTreeValid: "FREE_SPACE_TREE_VALID",
+		FeatureCompatROVerity:             "VERITY",
+		FeatureCompatROBlockGroupTree:     "BLOCK_GROUP_TREE",
+	})
+}
+
+func IncompatFlagsString(flags uint64) string {
+	return flagsString(flags, map[uint64]string{
+		FeatureIncompatMixedBackref:   "MIXED_BACKREF",
+		FeatureIncompatDefaultSubvol:  "DEFAULT_SUBVOL",
+		FeatureIncompatMixedGroups:    "MIXED_GROUPS",
+		FeatureIncompatCompressLZO:    "COMPRESS_LZO",
+		FeatureIncompatCompressZstd:   "COMPRESS_ZSTD",
+		FeatureIncompatBigMetadata:    "BIG_METADATA",
+		FeatureIncompatExtendedIRef:   "EXTENDED_IREF",
+		FeatureIncompatRAID56:         "RAID56",
+		FeatureIncompatSkinnyMetadata: "SKINNY_METADATA",
+		FeatureIncompatNoHoles:        "NO_HOLES",
+		FeatureIncompatMetadataUUID:   "METADATA_UUID",
+		FeatureIncompatRAID1C34:       "RAID1C34",
+		FeatureIncompatZoned:          "ZONED",
+		FeatureIncompatExtentTreeV2:   "EXTENT_TREE_V2",
+		FeatureIncompatRaidStripeTree: "RAID_STRIPE_TREE",
+		FeatureIncompatSimpleQuota:    "SIMPLE_QUOTA",
+	})
+}
@@ -0,0 +1,210 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Validation of untrusted leaves and items
+
+package btrfs
+
+import (
+	"fmt"
+)
+
+// Maximum length of a file or extended attribute name
+const MaxNameLen = 255
+
+// ItemError describes an item that failed validation.
+type ItemError struct {
+	Index  int // Index of the item in its leaf, -1 if unknown
+	Key    Key
+	Reason string
+}
+
+func (e *ItemError) Error() string {
+	if e.Index < 0 {
+		return fmt.Sprintf("invalid item %s: %s", e.Key, e.Reason)
+	}
+	return fmt.Sprintf("invalid item %d %s: %s", e.Index, e.Key, e.Reason)
+}
+
+func itemErrorf(i int, k Key, format string, v ...any) error {
+	return &ItemError{Index: i, Key: k, Reason: fmt.Sprintf(format, v...)}
+}
+
+// CheckHeader checks that a leaf's header is consistent with the size of the
+// leaf. Items beyond the block size are never returned by Len(), so a leaf
+// that fails this check may still contain valid items.
+func (l Leaf) CheckHeader() error {
+	if len(l) < HeaderLen {
+		return fmt.Errorf("leaf too small: %d bytes", len(l))
+	}
+	if n := uint64(l.Header().NrItems()); n > uint64(l.Len()) {
+		return fmt.Errorf("leaf %d claims %d items, only %d fit",
+			l.Header().ByteNr(), n, l.Len())
+	}
+	return nil
+}
+
+// CheckItem validates the ith item of a leaf. It checks that the item's data
+// lies within the leaf and after the item headers, and that the data is
+// well-formed for the item's type.
+func (l Leaf) CheckItem(i int) error {
+	if i < 0 || i >= l.Len() {
+		return fmt.Errorf("item index %d out of range", i)
+	}
+	item := l.Item(i)
+	k := item.Key()
+	start := uint64(HeaderLen) + uint64(item.Offset())
+	end := start + uint64(item.Size())
+	if start < uint64(HeaderLen+l.Len()*ItemLen) {
+		return itemErrorf(i, k, "data offset %d overlaps item headers",
+			item.Offset())
+	}
+	if end > uint64(len(l)) {
+		return itemErrorf(i, k, "data [%d, %d) exceeds leaf size %d", start,
+			end, len(l))
+	}
+	if err := CheckItemData(k, l[start:end]); err != nil {
+		if e, ok := err.(*ItemError); ok {
+			e.Index = i
+		}
+		return err
+	}
+	return nil
+}
+
+// CheckItemData validates the data of an item with the given key. Items with
+// unknown types are accepted as is.
+func CheckItemData(k Key, data []byte) error {
+	minLen := func(l int) error {
+		if len(data) < l {
+			return itemErrorf(-1, k, "size %d smaller than %d", len(data), l)
+		}
+		return nil
+	}
+	switch k.Type {
+	case InodeItemKey:
+		return minLen(InodeItemLen)
+	case InodeRefKey:
+		return checkInodeRefs(k, data)
+	case DirItemKey, DirIndexKey, XAttrItemKey:
+		return checkDirItems(k, data)
+	case ExtentDataKey:
+		return checkFileExtentItem(k, data)
+	case RootItemKey:
+		// Root items written by old kernels end before the generation_v2
+		// field.
+		return minLen(rootItemGenerationV2)
+	case RootRefKey, RootBackRefKey:
+		if err := minLen(rootRefName); err != nil {
+			return err
+		}
+		r := RootRef(data)
+		if l := int(r.NameLen()); l > MaxNameLen ||
+			rootRefName+l > len(data) {
+			return itemErrorf(-1, k, "invalid name length %d", l)
+		}
+	case ChunkItemKey:
+		if err := minLen(chunkStripes); err != nil {
+			return err
+		}
+		c := Chunk(data)
+		if c.NumStripes() == 0 {
+			return itemErrorf(-1, k, "chunk without stripes")
+		}
+		return minLen(chunkStripes + int(c.NumStripes())*stripeEnd)
+	case DevItemKey:
+		return minLen(DevItemLen)
+	case DevExtentKey:
+		return minLen(DevExtentLen)
+	case BlockGroupItemKey:
+		return minLen(blockGroupItemEnd)
+	}
+	return nil
+}
+
+func checkDirItems(k Key, data []byte) error {
+	// Multiple entries are packed into a single item if their name hashes
+	// collide.
+	for o := 0; o < len(data); {
+		if o+dirItemName > len(data) {
+			return itemErrorf(-1, k, "truncated entry at %d", o)
+		}
+		d := DirItem(data[o:])
+		nameLen, dataLen := int(d.NameLen()), int(d.DataLen())
+		if nameLen == 0 || nameLen > MaxNameLen {
+			return itemErrorf(-1, k, "invalid name length %d", nameLen)
+		}
+		if k.Type != XAttrItemKey && dataLen != 0 {
+			return itemErrorf(-1, k, "unexpected data length %d", dataLen)
+		}
+		if d.Type() >= FtMax {
+			return itemErrorf(-1, k, "invalid type %d", d.Type())
+		}
+		o += dirItemName + nameLen + dataLen
+		if o > len(data) {
+			return itemErrorf(-1, k, "name and data exceed item size %d",
+				len(data))
+		}
+	}
+	return nil
+}
+
+func checkInodeRefs(k Key, data []byte) error {
+	// An inode can have several hard links in the same directory.
+	for o := 0; o < len(data); {
+		if o+inodeRefItemName > len(data) {
+			return itemErrorf(-1, k, "truncated entry at %d", o)
+		}
+		nameLen := int(InodeRefItem(data[o:]).NameLen())
+		if nameLen == 0 || nameLen > MaxNameLen {
+			return itemErrorf(-1, k, "invalid name length %d", nameLen)
+		}
+		o += inodeRefItemName + nameLen
+		if o > len(data) {
+			return itemErrorf(-1, k, "name exceeds item size %d", len(data))
+		}
+	}
+	return nil
+}
+
+func checkFileExtentItem(k Key, data []byte) error {
+	if len(data) < fileExtentItemDiskByteNr {
+		return itemErrorf(-1, k, "size %d smaller than %d", len(data),
+			fileExtentItemDiskByteNr)
+	}
+	e := FileExtentItem(data)
+	switch e.Type() {
+	case FileExtentInline:
+		inlineLen := uint64(len(data) - fileExtentItemDiskByteNr)
+		if e.Compression() == 0 && e.RAMBytes() != inlineLen {
+			return itemErrorf(-1, k, "inline data length %d does not match "+
+				"%d", inlineLen, e.RAMBytes())
+		}
+	case FileExtentReg, FileExtentPreAlloc:
+		if len(data) < FileExtentItemEnd {
+			return itemErrorf(-1, k, "size %d smaller than %d", len(data),
+				FileExtentItemEnd)
+		}
+	default:
+		return itemErrorf(-1, k, "invalid extent type %d", e.Type())
+	}
+	return nil
+}
+
+// CheckHeader checks that an internal node's header is consistent with the
+// size of the node.
+func (n Node) CheckHeader() error {
+	if len(n) < HeaderLen {
+		return fmt.Errorf("node too small: %d bytes", len(n))
+	}
+	h := n.Header()
+	if h.Level() == 0 || h.Level() >= MaxLevel {
+		return fmt.Errorf("node %d has invalid level %d", h.ByteNr(),
+			h.Level())
+	}
+	if num := uint64(h.NrItems()); num > uint64(n.Len()) {
+		return fmt.Errorf("node %d claims %d key pointers, only %d fit",
+			h.ByteNr(), num, n.Len())
+	}
+	return nil
+}
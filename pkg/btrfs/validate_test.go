@@ -0,0 +1,91 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Tests for leaf and item validation
+
+package btrfs
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+type testItem struct {
+	key  Key
+	data []byte
+}
+
+// makeLeaf builds a leaf the way BTRFS does: item headers grow from the
+// start of the block, item data grows from its end.
+func makeLeaf(size int, items []testItem) Leaf {
+	l := make(Leaf, size)
+	binary.LittleEndian.PutUint32(l[headerNrItems:], uint32(len(items)))
+	end := size - HeaderLen
+	for i, it := range items {
+		end -= len(it.data)
+		o := HeaderLen + i*ItemLen
+		binary.LittleEndian.PutUint64(l[o:], it.key.ObjectID)
+		l[o+8] = it.key.Type
+		binary.LittleEndian.PutUint64(l[o+9:], it.key.Offset)
+		binary.LittleEndian.PutUint32(l[o+itemOffset:], uint32(end))
+		binary.LittleEndian.PutUint32(l[o+itemSize:], uint32(len(it.data)))
+		copy(l[HeaderLen+end:], it.data)
+	}
+	return l
+}
+
+func makeDirItemData(name string, nameLen uint16) []byte {
+	d := make([]byte, dirItemName+len(name))
+	binary.LittleEndian.PutUint16(d[dirItemNameLen:], nameLen)
+	d[dirItemType] = FtRegFile
+	copy(d[dirItemName:], name)
+	return d
+}
+
+func makeInlineExtentData(data string, ramBytes uint64) []byte {
+	e := make([]byte, fileExtentItemDiskByteNr+len(data))
+	binary.LittleEndian.PutUint64(e[fileExtentItemRAMBytes:], ramBytes)
+	e[fileExtentItemType] = FileExtentInline
+	copy(e[fileExtentItemDiskByteNr:], data)
+	return e
+}
+
+func TestCheckItem(t *testing.T) {
+	l := makeLeaf(X86RegularPageSize, []testItem{
+		{Key{256, InodeItemKey, 0}, make([]byte, InodeItemLen)},
+		{Key{256, DirItemKey, 1}, makeDirItemData("file", 4)},
+		{Key{256, DirItemKey, 2}, makeDirItemData("file", 200)},
+		{Key{257, InodeItemKey, 0}, make([]byte, 10)},
+		{Key{257, ExtentDataKey, 0}, makeInlineExtentData("hello", 5)},
+		{Key{258, ExtentDataKey, 0}, makeInlineExtentData("hello", 4096)},
+		{Key{259, InodeItemKey, 0}, make([]byte, InodeItemLen)},
+	})
+	// Corrupt the offset of the last item
+	binary.LittleEndian.PutUint32(l[HeaderLen+6*ItemLen+itemOffset:],
+		0xFFFFFF00)
+
+	if err := l.CheckHeader(); err != nil {
+		t.Fatalf("expected valid header, got: %s", err)
+	}
+	for i, valid := range []bool{true, true, false, false, true, false,
+		false} {
+		err := l.CheckItem(i)
+		if valid && err != nil {
+			t.Errorf("item %d: expected valid, got: %s", i, err)
+		} else if !valid && err == nil {
+			t.Errorf("item %d: expected error", i)
+		}
+		// Variable length accessors must not panic, even for invalid items
+		if _ = l.Data(i); l.Key(i).Type == DirItemKey {
+			_ = DirItem(l.Data(i)).Name()
+		}
+	}
+
+	binary.LittleEndian.PutUint32(l[headerNrItems:], 0xFFFFFFFF)
+	if err := l.CheckHeader(); err == nil {
+		t.Error("expected error for oversized item count")
+	}
+	if n := l.Len(); n != (X86RegularPageSize-HeaderLen)/ItemLen {
+		t.Errorf("expected item count to be clamped, got %d", n)
+	}
+}
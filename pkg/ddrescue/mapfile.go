@@ -0,0 +1,195 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Package ddrescue reads GNU ddrescue mapfiles and restricts reads of the
+// rescued images to the areas that were actually rescued.
+package ddrescue
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Block status characters used in mapfiles
+const (
+	NonTried   = '?'
+	NonTrimmed = '*'
+	NonScraped = '/'
+	BadSector  = '-'
+	Finished   = '+'
+)
+
+// Block is a range of the rescued device with a common status.
+type Block struct {
+	Pos, Size uint64
+	Status    byte
+}
+
+// End returns the offset just past the block.
+func (b Block) End() uint64 { return b.Pos + b.Size }
+
+// Mapfile is the list of blocks of a ddrescue mapfile, sorted by position.
+type Mapfile struct {
+	Blocks []Block
+}
+
+// Parse parses a ddrescue mapfile. Lines starting with '#' are comments, the
+// first other line holds the current position and status of ddrescue and is
+// ignored. All following lines describe a block as "pos size status".
+func Parse(r io.Reader) (*Mapfile, error) {
+	m := &Mapfile{}
+	sc := bufio.NewScanner(r)
+	haveStatus := false
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || text[0] == '#' {
+			continue
+		}
+		if !haveStatus {
+			haveStatus = true
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) < 3 || len(fields[2]) != 1 {
+			return nil, fmt.Errorf("line %d: invalid block: %s", line, text)
+		}
+		pos, err := strconv.ParseUint(fields[0], 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid position: %s", line,
+				fields[0])
+		}
+		size, err := strconv.ParseUint(fields[1], 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid size: %s", line,
+				fields[1])
+		}
+		status := fields[2][0]
+		if !strings.ContainsRune("?*/-+", rune(status)) {
+			return nil, fmt.Errorf("line %d: invalid status: %c", line,
+				status)
+		}
+		if size > 0 {
+			m.Blocks = append(m.Blocks, Block{pos, size, status})
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if !haveStatus {
+		return nil, fmt.Errorf("missing status line")
+	}
+	sort.Slice(m.Blocks, func(i, j int) bool {
+		return m.Blocks[i].Pos < m.Blocks[j].Pos
+	})
+	for i := 1; i < len(m.Blocks); i++ {
+		if m.Blocks[i].Pos < m.Blocks[i-1].End() {
+			return nil, fmt.Errorf("overlapping blocks at %d",
+				m.Blocks[i].Pos)
+		}
+	}
+	return m, nil
+}
+
+// Open reads the mapfile at path.
+func Open(path string) (*Mapfile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return m, nil
+}
+
+// FirstUnreadable returns the first part of [off, off+size) that was not
+// rescued. Areas not covered by the mapfile count as non-tried.
+func (m *Mapfile) FirstUnreadable(off, size uint64) (Block, bool) {
+	end := off + size
+	i := sort.Search(len(m.Blocks), func(i int) bool {
+		return m.Blocks[i].End() > off
+	})
+	for pos := off; pos < end; i++ {
+		if i == len(m.Blocks) {
+			return Block{pos, end - pos, NonTried}, true
+		}
+		b := m.Blocks[i]
+		if b.Pos > pos {
+			return Block{pos, min(b.Pos, end) - pos, NonTried}, true
+		}
+		if b.Status != Finished {
+			return Block{pos, min(b.End(), end) - pos, b.Status}, true
+		}
+		pos = b.End()
+	}
+	return Block{}, false
+}
+
+// Unreadable returns the parts of [off, off+size) that were not rescued,
+// with adjacent ones merged.
+func (m *Mapfile) Unreadable(off, size uint64) []Block {
+	var bad []Block
+	end := off + size
+	for off < end {
+		b, ok := m.FirstUnreadable(off, end-off)
+		if !ok {
+			break
+		}
+		if n := len(bad); n > 0 && bad[n-1].End() == b.Pos {
+			bad[n-1].Size += b.Size
+		} else {
+			bad = append(bad, b)
+		}
+		off = b.End()
+	}
+	return bad
+}
+
+// UnreadableError is returned when reading from an area that ddrescue did
+// not rescue.
+type UnreadableError struct {
+	Offset, Size uint64
+	Status       byte
+}
+
+func (e *UnreadableError) Error() string {
+	return fmt.Sprintf("bytes [%d, %d) were not rescued (status '%c')",
+		e.Offset, e.Offset+e.Size, e.Status)
+}
+
+type readerAt struct {
+	r io.ReaderAt
+	m *Mapfile
+}
+
+// NewReaderAt returns a reader that reads from r, but fails with an
+// *UnreadableError for areas that m does not list as finished. Such a read
+// returns the data up to the first unreadable byte.
+func NewReaderAt(r io.ReaderAt, m *Mapfile) io.ReaderAt {
+	return &readerAt{r, m}
+}
+
+func (r *readerAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	bad, ok := r.m.FirstUnreadable(uint64(off), uint64(len(p)))
+	if !ok {
+		return r.r.ReadAt(p, off)
+	}
+	n := 0
+	if good := bad.Pos - uint64(off); good > 0 {
+		var err error
+		if n, err = r.r.ReadAt(p[:good], off); err != nil {
+			return n, err
+		}
+	}
+	return n, &UnreadableError{bad.Pos, bad.Size, bad.Status}
+}
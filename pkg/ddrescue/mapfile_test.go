@@ -0,0 +1,99 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Tests for ddrescue mapfiles
+
+package ddrescue
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testMapfile = `# Mapfile. Created by GNU ddrescue version 1.27
+# Command line: ddrescue /dev/sdb sdb.img sdb.map
+# current_pos  current_status  current_pass
+0x00000400     +               1
+#      pos        size  status
+0x00000000  0x00000400  +
+0x00000400  0x00000200  -
+0x00000600  0x00000200  /
+0x00000800  0x00000800  +
+`
+
+func TestParse(t *testing.T) {
+	m, err := Parse(strings.NewReader(testMapfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Block{
+		{0, 0x400, Finished},
+		{0x400, 0x200, BadSector},
+		{0x600, 0x200, NonScraped},
+		{0x800, 0x800, Finished},
+	}
+	if !reflect.DeepEqual(m.Blocks, expected) {
+		t.Errorf("%v vs %v", expected, m.Blocks)
+	}
+
+	for _, bad := range []string{
+		"",
+		"0 +\n0 10\n",
+		"0 +\n0 10 x\n",
+		"0 +\nzero 10 +\n",
+		"0 +\n0 10 +\n5 10 -\n",
+	} {
+		if _, err := Parse(strings.NewReader(bad)); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestUnreadable(t *testing.T) {
+	m, err := Parse(strings.NewReader(testMapfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, ok := m.FirstUnreadable(0, 0x400); ok {
+		t.Errorf("unexpected unreadable %v", b)
+	}
+	if b, ok := m.FirstUnreadable(0x300, 0x200); !ok ||
+		b != (Block{0x400, 0x100, BadSector}) {
+		t.Errorf("unexpected %v, %v", b, ok)
+	}
+	// Past the end of the mapfile
+	if b, ok := m.FirstUnreadable(0xf00, 0x200); !ok ||
+		b != (Block{0x1000, 0x100, NonTried}) {
+		t.Errorf("unexpected %v, %v", b, ok)
+	}
+	expected := []Block{{0x400, 0x400, BadSector}, {0x1000, 0x10, NonTried}}
+	if bad := m.Unreadable(0, 0x1010); !reflect.DeepEqual(bad, expected) {
+		t.Errorf("%v vs %v", expected, bad)
+	}
+}
+
+func TestReaderAt(t *testing.T) {
+	m, err := Parse(strings.NewReader(testMapfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte{0xab}, 0x1000)
+	r := NewReaderAt(bytes.NewReader(data), m)
+
+	buf := make([]byte, 0x200)
+	if n, err := r.ReadAt(buf, 0x100); n != len(buf) || err != nil {
+		t.Errorf("unexpected %d, %v", n, err)
+	}
+	n, err := r.ReadAt(buf, 0x300)
+	var unreadable *UnreadableError
+	if n != 0x100 || !errors.As(err, &unreadable) ||
+		unreadable.Offset != 0x400 || unreadable.Size != 0x100 {
+		t.Errorf("unexpected %d, %v", n, err)
+	}
+	if n, err := r.ReadAt(buf, 0xa00); n != len(buf) || err != nil {
+		t.Errorf("unexpected %d, %v", n, err)
+	}
+}
@@ -0,0 +1,547 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Advanced Forensic Format 4 (AFF4) images, stored in a zip volume
+
+package diskimage
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/snappy"
+)
+
+const (
+	zipMagic = "PK\x03\x04"
+	aff4NS   = "http://aff4.org/Schema#"
+)
+
+// Compression methods of image streams, the empty string for none
+var aff4Compression = map[string]string{
+	"http://code.google.com/p/snappy/":     "snappy",
+	"https://code.google.com/p/snappy/":    "snappy",
+	"https://code.google.com/p/lz4/":       "lz4",
+	"https://tools.ietf.org/html/rfc1951":  "deflate",
+	"https://www.ietf.org/rfc/rfc1950.txt": "zlib",
+	aff4NS + "NullCompressor":              "",
+	aff4NS + "nullCompressor":              "",
+}
+
+// Digest algorithms of aff4:hash literals
+var aff4Digests = map[string]string{
+	aff4NS + "MD5":    "md5",
+	aff4NS + "SHA1":   "sha1",
+	aff4NS + "SHA256": "sha256",
+	aff4NS + "SHA512": "sha512",
+}
+
+const (
+	// Size of bevy index entries, the offset and length of each chunk
+	aff4IndexEntrySize = 12
+	// Size of map entries, the mapped offset, length, target offset and
+	// target index
+	aff4MapEntrySize = 28
+	// Number of bevy indexes to keep in memory
+	aff4IndexCacheSize = 64
+)
+
+// sizedReaderAt is the virtual data of an AFF4 stream or map.
+type sizedReaderAt interface {
+	io.ReaderAt
+	Size() int64
+}
+
+type aff4Volume struct {
+	f       *os.File
+	graph   rdfGraph
+	members map[string]*zip.File // By URN
+}
+
+type aff4Image struct {
+	sizedReaderAt
+	f       *os.File
+	digests []Digest
+}
+
+// openAFF4 opens the single image in the AFF4 volume f. Volumes that are
+// split over several zip files are not supported.
+func openAFF4(f *os.File) (Image, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	zr, err := zip.NewReader(f, fi.Size())
+	if err != nil {
+		return nil, err
+	}
+	v := &aff4Volume{f: f, members: make(map[string]*zip.File)}
+	// The zip comment holds the volume URN, member names are relative to
+	// it unless they are escaped URNs themselves
+	volume := strings.TrimSpace(zr.Comment)
+	var turtle *zip.File
+	for _, zf := range zr.File {
+		switch zf.Name {
+		case "information.turtle":
+			turtle = zf
+		case "container.description":
+			if volume == "" {
+				if b, err := v.readMember(zf); err == nil {
+					volume = strings.TrimSpace(string(b))
+				}
+			}
+		}
+	}
+	if turtle == nil {
+		return nil, fmt.Errorf("zip file without information.turtle is " +
+			"not an AFF4 volume")
+	}
+	for _, zf := range zr.File {
+		name, err := url.PathUnescape(zf.Name)
+		if err != nil {
+			name = zf.Name
+		}
+		if !strings.HasPrefix(name, "aff4:") {
+			name = volume + "/" + name
+		}
+		v.members[name] = zf
+	}
+	b, err := v.readMember(turtle)
+	if err != nil {
+		return nil, err
+	}
+	if v.graph, err = parseTurtle(string(b)); err != nil {
+		return nil, fmt.Errorf("information.turtle: %w", err)
+	}
+
+	urn, err := v.image()
+	if err != nil {
+		return nil, err
+	}
+	img := &aff4Image{f: f}
+	if img.sizedReaderAt, err = v.open(urn, 0); err != nil {
+		return nil, err
+	}
+	// The image and the data streams it refers to have the same contents,
+	// up to the stream that is read
+	for i := 0; i <= maxBackingDepth; i++ {
+		for _, o := range v.graph[urn][aff4NS+"hash"] {
+			alg, ok := aff4Digests[o.datatype]
+			sum, err := hex.DecodeString(o.value)
+			if ok && o.literal && err == nil && len(sum) == digestSize[alg] {
+				img.digests = setDigest(img.digests, Digest{alg, sum})
+			}
+		}
+		ds, ok := v.graph.value(urn, aff4NS+"dataStream")
+		if !ok || v.graph.hasType(urn, aff4NS+"Map") ||
+			v.graph.hasType(urn, aff4NS+"ImageStream") {
+			break
+		}
+		urn = ds.value
+	}
+	return img, nil
+}
+
+func (img *aff4Image) Format() string    { return FormatAFF4 }
+func (img *aff4Image) Close() error      { return img.f.Close() }
+func (img *aff4Image) Digests() []Digest { return img.digests }
+
+// image returns the URN of the image in the volume. Without an aff4:Image,
+// a single map or image stream is used.
+func (v *aff4Volume) image() (string, error) {
+	for _, typ := range []string{"Image", "Map", "ImageStream"} {
+		var urns []string
+		for s := range v.graph {
+			if v.graph.hasType(s, aff4NS+typ) {
+				urns = append(urns, s)
+			}
+		}
+		switch len(urns) {
+		case 0:
+			continue
+		case 1:
+			return urns[0], nil
+		}
+		sort.Strings(urns)
+		return "", fmt.Errorf("AFF4 volume holds %d images: %s", len(urns),
+			strings.Join(urns, ", "))
+	}
+	return "", fmt.Errorf("AFF4 volume holds no image")
+}
+
+// open returns the data of the map or image stream urn, following
+// aff4:dataStream references of other objects.
+func (v *aff4Volume) open(urn string, depth int) (sizedReaderAt, error) {
+	if depth > maxBackingDepth {
+		return nil, fmt.Errorf("too many levels of AFF4 data streams")
+	}
+	switch {
+	case v.graph.hasType(urn, aff4NS+"Map"):
+		return v.openMap(urn, depth)
+	case v.graph.hasType(urn, aff4NS+"ImageStream"):
+		return v.openStream(urn)
+	}
+	if ds, ok := v.graph.value(urn, aff4NS+"dataStream"); ok {
+		return v.open(ds.value, depth+1)
+	}
+	return nil, fmt.Errorf("AFF4 object %s has no data", urn)
+}
+
+// readMember returns the contents of a zip member.
+func (v *aff4Volume) readMember(zf *zip.File) ([]byte, error) {
+	rc, err := zf.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// member returns a reader for the zip member holding urn. Stored members
+// are read from the volume directly, others are decompressed into memory.
+func (v *aff4Volume) member(urn string) (*io.SectionReader, error) {
+	zf, ok := v.members[urn]
+	if !ok {
+		return nil, fmt.Errorf("AFF4 volume has no member for %s", urn)
+	}
+	if zf.Method == zip.Store {
+		off, err := zf.DataOffset()
+		if err != nil {
+			return nil, err
+		}
+		return io.NewSectionReader(v.f, off, int64(zf.UncompressedSize64)),
+			nil
+	}
+	b, err := v.readMember(zf)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", zf.Name, err)
+	}
+	return io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b))), nil
+}
+
+// aff4Stream is an aff4:ImageStream, split into chunks that are compressed
+// individually and grouped in segments called bevies.
+type aff4Stream struct {
+	v           *aff4Volume
+	urn         string
+	size        int64
+	chunkSize   int64
+	perBevy     int64
+	compression string
+
+	mu         sync.Mutex
+	indexCache map[int64][]byte
+	// Last read chunk and its data
+	lastChunk int64
+	lastData  []byte
+}
+
+func (v *aff4Volume) openStream(urn string) (*aff4Stream, error) {
+	s := &aff4Stream{
+		v:          v,
+		urn:        urn,
+		indexCache: make(map[int64][]byte),
+		lastChunk:  -1,
+	}
+	var err error
+	if s.size, err = v.graph.int(urn, aff4NS+"size"); err != nil {
+		return nil, err
+	}
+	if s.chunkSize, err = v.graph.int(urn, aff4NS+"chunkSize"); err != nil {
+		return nil, err
+	}
+	if s.perBevy, err = v.graph.int(urn,
+		aff4NS+"chunksInSegment"); err != nil {
+		return nil, err
+	}
+	if s.size < 0 || s.chunkSize <= 0 || s.chunkSize > 64<<20 ||
+		s.perBevy <= 0 {
+		return nil, fmt.Errorf("AFF4 stream %s has invalid size, chunk "+
+			"size or chunks per segment", urn)
+	}
+	if o, ok := v.graph.value(urn, aff4NS+"compressionMethod"); ok {
+		var known bool
+		if s.compression, known = aff4Compression[o.value]; !known {
+			return nil, fmt.Errorf("AFF4 stream %s uses unsupported "+
+				"compression %s", urn, o.value)
+		}
+	}
+	return s, nil
+}
+
+func (s *aff4Stream) Size() int64 { return s.size }
+
+func (s *aff4Stream) ReadAt(p []byte, off int64) (int, error) {
+	return readVirtual(p, off, s.size, s.chunkSize, s.readChunk)
+}
+
+// readChunk reads p, which lies within a single chunk, at off.
+func (s *aff4Stream) readChunk(p []byte, off int64) error {
+	i := off / s.chunkSize
+	data, err := s.chunk(i)
+	if err != nil {
+		return fmt.Errorf("AFF4 chunk at %d: %w", i*s.chunkSize, err)
+	}
+	copy(p, data[off%s.chunkSize:])
+	return nil
+}
+
+// bevyIndex returns the index of bevy b.
+func (s *aff4Stream) bevyIndex(b int64) ([]byte, error) {
+	if index, ok := s.indexCache[b]; ok {
+		return index, nil
+	}
+	r, err := s.v.member(fmt.Sprintf("%s/%08d.index", s.urn, b))
+	if err != nil {
+		return nil, err
+	}
+	index := make([]byte, min(r.Size(), s.perBevy*aff4IndexEntrySize))
+	if err := readFullAt(r, index, 0); err != nil {
+		return nil, err
+	}
+	if len(s.indexCache) >= aff4IndexCacheSize {
+		for k := range s.indexCache {
+			delete(s.indexCache, k) // Evict an arbitrary index
+			break
+		}
+	}
+	s.indexCache[b] = index
+	return index, nil
+}
+
+// chunk returns the data of chunk i. Chunks that did not compress are
+// stored as they are.
+func (s *aff4Stream) chunk(i int64) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lastChunk == i {
+		return s.lastData, nil
+	}
+	le := binary.LittleEndian
+	b, j := i/s.perBevy, i%s.perBevy
+	index, err := s.bevyIndex(b)
+	if err != nil {
+		return nil, err
+	}
+	if (j+1)*aff4IndexEntrySize > int64(len(index)) {
+		return nil, fmt.Errorf("missing from index of segment %d", b)
+	}
+	e := index[j*aff4IndexEntrySize:]
+	offset, length := int64(le.Uint64(e)), int64(le.Uint32(e[8:]))
+	if length > 2*s.chunkSize {
+		return nil, fmt.Errorf("invalid length %d", length)
+	}
+	bevy, err := s.v.member(fmt.Sprintf("%s/%08d", s.urn, b))
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, length)
+	if err := readFullAt(bevy, buf, offset); err != nil {
+		return nil, err
+	}
+
+	// The last chunk may be short or padded
+	expected := min(s.chunkSize, s.size-i*s.chunkSize)
+	data := buf
+	if s.compression != "" && length != s.chunkSize && length != expected {
+		if data, err = aff4Decompress(s.compression, buf,
+			s.chunkSize); err != nil {
+			return nil, fmt.Errorf("cannot decompress: %w", err)
+		}
+	}
+	if int64(len(data)) < expected {
+		return nil, fmt.Errorf("chunk has %d bytes", len(data))
+	}
+	s.lastChunk, s.lastData = i, data[:expected]
+	return s.lastData, nil
+}
+
+func aff4Decompress(method string, in []byte, maxOut int64) ([]byte,
+	error) {
+	var r io.Reader
+	switch method {
+	case "snappy":
+		if n, err := snappy.DecodedLen(in); err != nil {
+			return nil, err
+		} else if int64(n) > maxOut {
+			return nil, fmt.Errorf("snappy: chunk too large")
+		}
+		return snappy.Decode(nil, in)
+	case "lz4":
+		return lz4Decompress(in, int(maxOut))
+	case "deflate":
+		r = flate.NewReader(bytes.NewReader(in))
+	case "zlib":
+		zr, err := zlib.NewReader(bytes.NewReader(in))
+		if err != nil {
+			return nil, err
+		}
+		r = zr
+	}
+	return io.ReadAll(io.LimitReader(r, maxOut))
+}
+
+// aff4Target reads p at off from the target of a map entry.
+type aff4Target func(p []byte, off int64) error
+
+type aff4MapEntry struct {
+	mapped, length, target int64
+	id                     uint32
+}
+
+// aff4Map is an aff4:Map that assembles an image from ranges of other
+// streams.
+type aff4Map struct {
+	size    int64
+	entries []aff4MapEntry // Sorted by mapped offset
+	targets []aff4Target
+	gap     aff4Target // For ranges not in the map
+}
+
+func (v *aff4Volume) openMap(urn string, depth int) (*aff4Map, error) {
+	m := &aff4Map{}
+	var err error
+	if m.size, err = v.graph.int(urn, aff4NS+"size"); err != nil {
+		return nil, err
+	}
+	if m.gap, err = v.target(aff4NS+"Zero", depth); err != nil {
+		return nil, err
+	}
+	if o, ok := v.graph.value(urn, aff4NS+"mapGapDefaultStream"); ok {
+		if m.gap, err = v.target(o.value, depth); err != nil {
+			return nil, err
+		}
+	}
+
+	r, err := v.member(urn + "/idx")
+	if err != nil {
+		return nil, err
+	}
+	idx := make([]byte, r.Size())
+	if err := readFullAt(r, idx, 0); err != nil {
+		return nil, err
+	}
+	for _, t := range strings.Fields(string(idx)) {
+		target, err := v.target(t, depth)
+		if err != nil {
+			return nil, err
+		}
+		m.targets = append(m.targets, target)
+	}
+
+	if r, err = v.member(urn + "/map"); err != nil {
+		return nil, err
+	}
+	b := make([]byte, r.Size()/aff4MapEntrySize*aff4MapEntrySize)
+	if err := readFullAt(r, b, 0); err != nil {
+		return nil, err
+	}
+	le := binary.LittleEndian
+	for i := 0; i < len(b); i += aff4MapEntrySize {
+		e := aff4MapEntry{
+			mapped: int64(le.Uint64(b[i:])),
+			length: int64(le.Uint64(b[i+8:])),
+			target: int64(le.Uint64(b[i+16:])),
+			id:     le.Uint32(b[i+24:]),
+		}
+		if e.mapped < 0 || e.length <= 0 || e.target < 0 ||
+			int(e.id) >= len(m.targets) {
+			return nil, fmt.Errorf("invalid entry in AFF4 map %s", urn)
+		}
+		m.entries = append(m.entries, e)
+	}
+	sort.Slice(m.entries, func(i, j int) bool {
+		return m.entries[i].mapped < m.entries[j].mapped
+	})
+	return m, nil
+}
+
+// target returns a reader for the map target urn. Besides streams, these
+// can be zeros, a repeated byte or data that could not be acquired.
+func (v *aff4Volume) target(urn string, depth int) (aff4Target, error) {
+	switch {
+	case urn == aff4NS+"Zero":
+		return func(p []byte, off int64) error {
+			clear(p)
+			return nil
+		}, nil
+	case urn == aff4NS+"UnknownData" || urn == aff4NS+"UnreadableData":
+		return func(p []byte, off int64) error {
+			return fmt.Errorf("AFF4 image has no data for %d bytes at %d",
+				len(p), off)
+		}, nil
+	case strings.HasPrefix(urn, aff4NS+"SymbolicStream"):
+		b, err := strconv.ParseUint(strings.TrimPrefix(urn,
+			aff4NS+"SymbolicStream"), 16, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid AFF4 symbolic stream %s", urn)
+		}
+		return func(p []byte, off int64) error {
+			for i := range p {
+				p[i] = byte(b)
+			}
+			return nil
+		}, nil
+	}
+	r, err := v.open(urn, depth+1)
+	if err != nil {
+		return nil, err
+	}
+	return func(p []byte, off int64) error {
+		return readFullAt(r, p, off)
+	}, nil
+}
+
+func (m *aff4Map) Size() int64 { return m.size }
+
+func (m *aff4Map) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	if off >= m.size {
+		return 0, io.EOF
+	}
+	var eof error
+	if off+int64(len(p)) > m.size {
+		p, eof = p[:m.size-off], io.EOF
+	}
+	read := 0
+	for read < len(p) {
+		pos := off + int64(read)
+		i := sort.Search(len(m.entries), func(i int) bool {
+			return m.entries[i].mapped+m.entries[i].length > pos
+		})
+		var n int64
+		var err error
+		if i < len(m.entries) && m.entries[i].mapped <= pos {
+			e := m.entries[i]
+			n = min(int64(len(p)-read), e.mapped+e.length-pos)
+			err = m.targets[e.id](p[read:read+int(n)],
+				e.target+pos-e.mapped)
+		} else {
+			end := m.size
+			if i < len(m.entries) {
+				end = m.entries[i].mapped
+			}
+			n = min(int64(len(p)-read), end-pos)
+			err = m.gap(p[read:read+int(n)], pos)
+		}
+		if err != nil {
+			return read, err
+		}
+		read += int(n)
+	}
+	return read, eof
+}
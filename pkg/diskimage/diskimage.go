@@ -0,0 +1,175 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Package diskimage reads the virtual disks of qcow2, VMDK and VHDX images,
+// E01, Ex01 and AFF4 evidence files as well as raw images. The format is
+// determined from the file header.
+package diskimage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Image is an opened disk image. ReadAt reads from the virtual disk and is
+// safe for concurrent use.
+type Image interface {
+	io.ReaderAt
+	io.Closer
+
+	// Size returns the size of the virtual disk in bytes.
+	Size() int64
+	// Format returns the name of the image format.
+	Format() string
+}
+
+// Image format names
+const (
+	FormatRaw   = "raw"
+	FormatQCOW2 = "qcow2"
+	FormatVMDK  = "vmdk"
+	FormatVHDX  = "vhdx"
+	FormatEWF   = "e01"
+	FormatAFF4  = "aff4"
+)
+
+// Open opens the disk image at path. qcow2, VMDK, VHDX, E01, Ex01 and AFF4
+// images are detected by their headers, all other files are treated as raw
+// images. For E01 and Ex01 images, path is the first segment file.
+func Open(path string) (Image, error) {
+	return open(path, 0)
+}
+
+// Limit for chains of backing files, guards against loops
+const maxBackingDepth = 16
+
+func open(path string, depth int) (Image, error) {
+	if depth > maxBackingDepth {
+		return nil, fmt.Errorf("%s: too many levels of backing files", path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	var img Image
+	switch sniff(f) {
+	case FormatQCOW2:
+		img, err = openQCOW2(f, path, depth)
+	case FormatVMDK:
+		img, err = openVMDK(f, path, depth)
+	case FormatVHDX:
+		img, err = openVHDX(f)
+	case FormatEWF:
+		img, err = openEWF(f, path)
+	case FormatAFF4:
+		img, err = openAFF4(f)
+	default:
+		img, err = openRaw(f)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return img, nil
+}
+
+// VMDK descriptor files start with a comment
+var vmdkDescriptorMagic = []byte("# Disk DescriptorFile")
+
+// sniff returns the format of the image from its header.
+func sniff(r io.ReaderAt) string {
+	hdr := make([]byte, len(vmdkDescriptorMagic))
+	if n, _ := r.ReadAt(hdr, 0); n < len(hdr) {
+		return FormatRaw
+	}
+	switch {
+	case bytes.Equal(hdr[:4], []byte(qcow2Magic)):
+		return FormatQCOW2
+	case bytes.Equal(hdr[:4], []byte(vmdkSparseMagic)),
+		bytes.Equal(hdr, vmdkDescriptorMagic):
+		return FormatVMDK
+	case bytes.Equal(hdr[:8], []byte(vhdxFileMagic)):
+		return FormatVHDX
+	case bytes.Equal(hdr[:8], []byte(ewfMagic)),
+		bytes.Equal(hdr[:8], []byte(ewf2Magic)):
+		return FormatEWF
+	case bytes.Equal(hdr[:4], []byte(zipMagic)):
+		return FormatAFF4
+	}
+	return FormatRaw
+}
+
+type rawImage struct {
+	*os.File
+	size int64
+}
+
+func openRaw(f *os.File) (Image, error) {
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	return &rawImage{f, size}, nil
+}
+
+func (r *rawImage) Size() int64    { return r.size }
+func (r *rawImage) Format() string { return FormatRaw }
+
+// readVirtual splits a read from a virtual disk into pieces of at most
+// blockSize bytes that do not cross block boundaries and reads them with
+// readBlock. Reads beyond the end of the disk are cut short with io.EOF.
+func readVirtual(p []byte, off, size, blockSize int64,
+	readBlock func(p []byte, off int64) error) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	if off >= size {
+		return 0, io.EOF
+	}
+	var eof error
+	if off+int64(len(p)) > size {
+		p, eof = p[:size-off], io.EOF
+	}
+	read := 0
+	for read < len(p) {
+		pos := off + int64(read)
+		n := blockSize - pos%blockSize
+		if rem := int64(len(p) - read); n > rem {
+			n = rem
+		}
+		if err := readBlock(p[read:read+int(n)], pos); err != nil {
+			return read, err
+		}
+		read += int(n)
+	}
+	return read, eof
+}
+
+// readBacking reads p from a backing image at off, the parts beyond its end
+// read as zeros. backing may be nil.
+func readBacking(backing Image, p []byte, off int64) error {
+	clear(p)
+	if backing == nil || off >= backing.Size() {
+		return nil
+	}
+	n, err := backing.ReadAt(p, off)
+	if err == io.EOF && off+int64(n) >= min(off+int64(len(p)),
+		backing.Size()) {
+		err = nil
+	}
+	return err
+}
+
+// readFullAt reads exactly len(p) bytes at off, like io.ReadFull.
+func readFullAt(r io.ReaderAt, p []byte, off int64) error {
+	n, err := r.ReadAt(p, off)
+	if n == len(p) {
+		return nil
+	}
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
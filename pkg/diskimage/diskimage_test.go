@@ -0,0 +1,819 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Tests for reading disk images
+
+package diskimage
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"hash/adler32"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/snappy"
+
+	"blichmann.eu/code/btrfscue/pkg/uuid"
+)
+
+const testDiskSize = 3 << 20
+
+// pattern returns size bytes that differ per seed and per 512 byte sector.
+func pattern(seed byte, size int) []byte {
+	b := make([]byte, size)
+	for i := range b {
+		b[i] = seed ^ byte(i/512) ^ byte(i)
+	}
+	return b
+}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkImage opens the image at path and compares its virtual disk with
+// expected, using reads that cross block boundaries.
+func checkImage(t *testing.T, path, format string, expected []byte) {
+	img, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	if img.Format() != format {
+		t.Errorf("expected format %s, got %s", format, img.Format())
+	}
+	if img.Size() != int64(len(expected)) {
+		t.Fatalf("expected size %d, got %d", len(expected), img.Size())
+	}
+	buf := make([]byte, 10000)
+	for off := 0; off < len(expected); off += len(buf) {
+		n, err := img.ReadAt(buf, int64(off))
+		if err != nil && !(err == io.EOF && off+n == len(expected)) {
+			t.Fatalf("read at %d: %v", off, err)
+		}
+		if !bytes.Equal(buf[:n], expected[off:off+n]) {
+			t.Fatalf("unexpected data at %d", off)
+		}
+	}
+	if _, err := img.ReadAt(buf, int64(len(expected))); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+}
+
+func TestRaw(t *testing.T) {
+	td := t.TempDir()
+	data := pattern(1, 5000)
+	writeFile(t, filepath.Join(td, "disk.img"), data)
+	checkImage(t, filepath.Join(td, "disk.img"), FormatRaw, data)
+}
+
+func TestQCOW2(t *testing.T) {
+	const (
+		clusterBits = 12
+		clusterSize = 1 << clusterBits
+	)
+	be := binary.BigEndian
+	td := t.TempDir()
+	backing := pattern(2, 4*clusterSize+clusterSize/2)
+	writeFile(t, filepath.Join(td, "base.img"), backing)
+
+	// Header, L1 table, two L2 tables, then data
+	f := make([]byte, 6*clusterSize)
+	copy(f, qcow2Magic)
+	be.PutUint32(f[4:], 3)
+	be.PutUint64(f[8:], 200) // Backing file name
+	be.PutUint32(f[16:], uint32(copy(f[200:], "base.img")))
+	be.PutUint32(f[20:], clusterBits)
+	be.PutUint64(f[24:], testDiskSize)
+	be.PutUint32(f[36:], 2)
+	be.PutUint64(f[40:], clusterSize)
+	be.PutUint32(f[100:], 104)
+	be.PutUint64(f[clusterSize:], 2*clusterSize)
+	be.PutUint64(f[clusterSize+8:], 3*clusterSize)
+	l2 := f[2*clusterSize:]
+
+	expected := make([]byte, testDiskSize)
+	// Cluster 0 is stored, cluster 1 compressed, cluster 2 zero, cluster 3
+	// from the backing file and cluster 600 in the second L2 table stored
+	data := pattern(3, clusterSize)
+	copy(f[4*clusterSize:], data)
+	copy(expected, data)
+	be.PutUint64(l2, 4*clusterSize)
+
+	data = pattern(4, clusterSize)
+	var compressed bytes.Buffer
+	w, _ := flate.NewWriter(&compressed, flate.BestCompression)
+	w.Write(data)
+	w.Close()
+	const compressedOff = 5*clusterSize + 100
+	f = append(f[:compressedOff], compressed.Bytes()...)
+	sectors := uint64((100+compressed.Len()+511)/512 - 1)
+	be.PutUint64(l2[8:], qcow2Compressed|sectors<<58|compressedOff)
+	copy(expected[clusterSize:], data)
+
+	be.PutUint64(l2[16:], qcow2ZeroFlag)
+	copy(expected[3*clusterSize:], backing[3*clusterSize:])
+
+	f = append(f, make([]byte, -len(f)&(clusterSize-1))...)
+	data = pattern(5, clusterSize)
+	be.PutUint64(f[3*clusterSize+(600-512)*8:], uint64(len(f)))
+	f = append(f, data...)
+	copy(expected[600*clusterSize:], data)
+	// The backing file is shorter than the disk
+	copy(expected[4*clusterSize:], backing[4*clusterSize:])
+	writeFile(t, filepath.Join(td, "disk.qcow2"), f)
+
+	checkImage(t, filepath.Join(td, "disk.qcow2"), FormatQCOW2, expected)
+
+	// Overlong backing file names are rejected before reading them
+	be.PutUint32(f[16:], ^uint32(0))
+	writeFile(t, filepath.Join(td, "bad.qcow2"), f)
+	if img, err := Open(filepath.Join(td, "bad.qcow2")); err == nil {
+		img.Close()
+		t.Error("expected an error for an overlong backing file name")
+	}
+}
+
+// makeVMDKSparse returns a sparse extent of testDiskSize bytes with 4 KiB
+// grains. Grain 0 and 600 hold data, grain 1 is zeroed and all others are
+// unallocated. Grains are compressed in a stream-optimized extent.
+func makeVMDKSparse(desc string, compressed bool) ([]byte, []byte) {
+	const (
+		grainSectors = 8
+		grainSize    = grainSectors * sectorSize
+		gtEntries    = 512
+	)
+	le := binary.LittleEndian
+	f := make([]byte, 20*sectorSize)
+	copy(f, vmdkSparseMagic)
+	le.PutUint32(f[4:], 1)
+	le.PutUint64(f[12:], testDiskSize/sectorSize)
+	le.PutUint64(f[20:], grainSectors)
+	if desc != "" {
+		le.PutUint64(f[28:], 1)
+		le.PutUint64(f[36:], 8)
+		copy(f[sectorSize:], desc)
+	}
+	le.PutUint32(f[44:], gtEntries)
+	// Grain directory at sector 10, grain tables at 11 and 15
+	le.PutUint32(f[10*sectorSize:], 11)
+	le.PutUint32(f[10*sectorSize+4:], 15)
+	setGTE := func(grain int, sector uint32) {
+		le.PutUint32(f[11*sectorSize+grain*4:], sector)
+	}
+
+	expected := make([]byte, testDiskSize)
+	for i, grain := range []int{0, 600} {
+		data := pattern(byte(6+i), grainSize)
+		copy(expected[grain*grainSize:], data)
+		setGTE(grain, uint32(len(f)/sectorSize))
+		if compressed {
+			var c bytes.Buffer
+			w := zlib.NewWriter(&c)
+			w.Write(data)
+			w.Close()
+			marker := make([]byte, 12)
+			le.PutUint64(marker, uint64(grain*grainSectors))
+			le.PutUint32(marker[8:], uint32(c.Len()))
+			data = append(marker, c.Bytes()...)
+			data = append(data, make([]byte, -len(data)&(sectorSize-1))...)
+		}
+		f = append(f, data...)
+	}
+	setGTE(1, 1)
+
+	if compressed {
+		// Move the grain directory to the footer
+		le.PutUint32(f[8:], vmdkCompressed)
+		footer := append([]byte(nil), f[:sectorSize]...)
+		le.PutUint64(footer[56:], 10)
+		le.PutUint64(f[56:], vmdkGDAtEnd)
+		f = append(f, footer...)
+		f = append(f, make([]byte, sectorSize)...)
+	} else {
+		le.PutUint64(f[56:], 10)
+	}
+	return f, expected
+}
+
+func TestVMDKSparse(t *testing.T) {
+	td := t.TempDir()
+	for _, compressed := range []bool{false, true} {
+		f, expected := makeVMDKSparse("", compressed)
+		path := filepath.Join(td, "disk.vmdk")
+		writeFile(t, path, f)
+		checkImage(t, path, FormatVMDK, expected)
+	}
+
+	// Header values that overflow or do not fit the file
+	le := binary.LittleEndian
+	for _, tc := range []struct {
+		offset   int
+		value    uint64
+		expected string
+	}{
+		{12, 1<<54 + 1, "invalid capacity"},
+		{12, 1 << 40, "grain directory"},
+		{20, 1<<55 + 8, "invalid grain size"},
+		{36, 1<<54 + 1, "descriptor"},
+	} {
+		f, _ := makeVMDKSparse("ddb.adapterType = \"ide\"\n", false)
+		le.PutUint64(f[tc.offset:], tc.value)
+		path := filepath.Join(td, "bad.vmdk")
+		writeFile(t, path, f)
+		img, err := Open(path)
+		if err == nil {
+			img.Close()
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Errorf("header value %d at %d: expected error containing "+
+				"'%s', got %v", tc.value, tc.offset, tc.expected, err)
+		}
+	}
+}
+
+func TestVMDKParent(t *testing.T) {
+	td := t.TempDir()
+	parent := pattern(9, testDiskSize)
+	writeFile(t, filepath.Join(td, "parent.img"), parent)
+	f, expected := makeVMDKSparse("# Disk DescriptorFile\n"+
+		"parentCID=12345678\n"+
+		`parentFileNameHint="parent.img"`+"\n"+
+		`RW 6144 SPARSE "disk.vmdk"`+"\n", false)
+	for off := 0; off < testDiskSize; off += 4096 {
+		if off/4096 != 0 && off/4096 != 1 && off/4096 != 600 {
+			copy(expected[off:off+4096], parent[off:])
+		}
+	}
+	writeFile(t, filepath.Join(td, "disk.vmdk"), f)
+	checkImage(t, filepath.Join(td, "disk.vmdk"), FormatVMDK, expected)
+}
+
+func TestVMDKDescriptor(t *testing.T) {
+	td := t.TempDir()
+	flat := pattern(10, 2<<20)
+	writeFile(t, filepath.Join(td, "disk-flat.vmdk"), flat)
+	writeFile(t, filepath.Join(td, "disk.vmdk"), []byte(
+		"# Disk DescriptorFile\n"+
+			"version=1\n"+
+			"createType=\"monolithicFlat\"\n\n"+
+			"# Extent description\n"+
+			"RW 2048 FLAT \"disk-flat.vmdk\" 0\n"+
+			"RW 2048 ZERO\n"+
+			"RW 2040 FLAT \"disk-flat.vmdk\" 8\n"))
+	expected := make([]byte, 6136*sectorSize)
+	copy(expected, flat[:1<<20])
+	copy(expected[2<<20:], flat[8*sectorSize:])
+	checkImage(t, filepath.Join(td, "disk.vmdk"), FormatVMDK, expected)
+}
+
+func TestVHDX(t *testing.T) {
+	const (
+		blockSize  = 1 << 20
+		metaOffset = 1 << 20
+		batOffset  = 2 << 20
+	)
+	le := binary.LittleEndian
+	guid := func(b []byte, s string) {
+		// Swapping the byte order of the fields is its own inverse
+		u, _ := uuid.New(s)
+		u = uuid.FromMixedEndian(u[:])
+		copy(b, u[:])
+	}
+	checksum := func(b []byte) {
+		le.PutUint32(b[4:], crc32.Checksum(b, castagnoli))
+	}
+
+	f := make([]byte, 3<<20)
+	copy(f, vhdxFileMagic)
+	hdr := f[vhdxHeader1 : vhdxHeader1+vhdxHeaderSize]
+	copy(hdr, "head")
+	le.PutUint64(hdr[8:], 1)
+	le.PutUint16(hdr[66:], 1)
+	checksum(hdr)
+
+	rt := f[vhdxRegionTable1 : vhdxRegionTable1+vhdxRegionSize]
+	copy(rt, "regi")
+	le.PutUint32(rt[8:], 2)
+	guid(rt[16:], vhdxBATRegion)
+	le.PutUint64(rt[32:], batOffset)
+	le.PutUint32(rt[40:], 1<<20)
+	guid(rt[48:], vhdxMetadataRegion)
+	le.PutUint64(rt[64:], metaOffset)
+	le.PutUint32(rt[72:], 64<<10)
+	checksum(rt)
+
+	meta := f[metaOffset:]
+	copy(meta, "metadata")
+	le.PutUint16(meta[10:], 3)
+	for i, item := range []struct {
+		id   string
+		data []byte
+	}{
+		{vhdxFileParameters, []byte{0, 0, 0x10, 0, 0, 0, 0, 0}},
+		{vhdxVirtualDiskSize, []byte{0, 0, 0x30, 0, 0, 0, 0, 0}},
+		{vhdxLogicalSectorSize, []byte{0, 2, 0, 0}},
+	} {
+		e := meta[32+i*32:]
+		guid(e, item.id)
+		le.PutUint32(e[16:], uint32(4096+i*8))
+		le.PutUint32(e[20:], uint32(len(item.data)))
+		copy(meta[4096+i*8:], item.data)
+	}
+
+	expected := make([]byte, testDiskSize)
+	for i, state := range []uint64{vhdxBlockFullyPresent, vhdxBlockZero,
+		vhdxBlockFullyPresent} {
+		entry := state
+		if state == vhdxBlockFullyPresent {
+			data := pattern(byte(11+i), blockSize)
+			entry |= uint64(len(f))
+			f = append(f, data...)
+			copy(expected[i*blockSize:], data)
+		}
+		le.PutUint64(f[batOffset+i*8:], entry)
+	}
+	path := filepath.Join(t.TempDir(), "disk.vhdx")
+	writeFile(t, path, f)
+	checkImage(t, path, FormatVHDX, expected)
+
+	// Virtual disk sizes out of range
+	diskSize := f[metaOffset+4096+8:]
+	for _, size := range []uint64{0, 1 << 63, 64<<40 + 1} {
+		le.PutUint64(diskSize, size)
+		writeFile(t, path, f)
+		if img, err := Open(path); err == nil {
+			img.Close()
+			t.Errorf("disk size %d: expected error", size)
+		}
+	}
+	le.PutUint64(diskSize, testDiskSize)
+
+	// A damaged region table is not used
+	f[vhdxRegionTable1+20]++
+	writeFile(t, path, f)
+	if img, err := Open(path); err == nil {
+		img.Close()
+		t.Errorf("expected error")
+	}
+}
+
+// ewfSegment returns an E01 segment file with the given sections. Chunks are
+// stored in a sectors section followed by their table.
+func ewfSegment(n int, sections []ewfTestSection, last string) []byte {
+	le := binary.LittleEndian
+	f := append([]byte(ewfMagic), 1, 0, 0, 0, 0)
+	le.PutUint16(f[9:], uint16(n))
+	sections = append(sections, ewfTestSection{typ: last})
+	for i, s := range sections {
+		off := len(f)
+		desc := make([]byte, ewfSectionSize)
+		copy(desc, s.typ)
+		data := s.data
+		if s.chunks != nil {
+			data = nil
+			var entries []byte
+			for _, c := range s.chunks {
+				e := uint32(off + ewfSectionSize + len(data))
+				if c.compressed {
+					e |= ewfCompressed
+				}
+				entries = le.AppendUint32(entries, e)
+				data = append(data, c.data...)
+			}
+			// The table follows the sectors section
+			table := make([]byte, ewfTableHeaderSize)
+			le.PutUint32(table, uint32(len(s.chunks)))
+			le.PutUint32(table[20:], adler32.Checksum(table[:20]))
+			sections[i+1].data = append(table, entries...)
+		}
+		size := ewfSectionSize + len(data)
+		next := off + size
+		if i == len(sections)-1 {
+			next = off
+		}
+		le.PutUint64(desc[16:], uint64(next))
+		le.PutUint64(desc[24:], uint64(size))
+		le.PutUint32(desc[72:], adler32.Checksum(desc[:72]))
+		f = append(append(f, desc...), data...)
+	}
+	return f
+}
+
+type ewfTestChunk struct {
+	data       []byte
+	compressed bool
+}
+
+type ewfTestSection struct {
+	typ    string
+	data   []byte
+	chunks []ewfTestChunk // Of a sectors section
+}
+
+func TestEWF(t *testing.T) {
+	const (
+		chunkSize = 64 * 512
+		numChunks = 4
+		size      = (numChunks-1)*chunkSize + 8*512
+	)
+	le := binary.LittleEndian
+	expected := pattern(15, size)
+	chunk := func(i int, compressed bool) ewfTestChunk {
+		data := expected[i*chunkSize : min((i+1)*chunkSize, size)]
+		if compressed {
+			var c bytes.Buffer
+			w := zlib.NewWriter(&c)
+			w.Write(data)
+			w.Close()
+			return ewfTestChunk{c.Bytes(), true}
+		}
+		return ewfTestChunk{le.AppendUint32(append([]byte(nil), data...),
+			adler32.Checksum(data)), false}
+	}
+	volume := make([]byte, ewfVolumeSize)
+	le.PutUint32(volume[4:], numChunks)
+	le.PutUint32(volume[8:], 64)
+	le.PutUint32(volume[12:], 512)
+	le.PutUint64(volume[16:], size/512)
+	md5Sum := md5.Sum(expected)
+	sha1Sum := sha1.Sum(expected)
+	digest := append(md5Sum[:], sha1Sum[:]...)
+
+	td := t.TempDir()
+	writeFile(t, filepath.Join(td, "disk.E01"), ewfSegment(1,
+		[]ewfTestSection{
+			{typ: "header", data: []byte("header")},
+			{typ: "volume", data: volume},
+			{typ: "sectors", chunks: []ewfTestChunk{chunk(0, true),
+				chunk(1, false)}},
+			{typ: "table"},
+		}, "next"))
+	writeFile(t, filepath.Join(td, "disk.E02"), ewfSegment(2,
+		[]ewfTestSection{
+			{typ: "sectors", chunks: []ewfTestChunk{chunk(2, false),
+				chunk(3, true)}},
+			{typ: "table"},
+			{typ: "digest", data: append(digest, make([]byte, 44)...)},
+		}, "done"))
+	checkImage(t, filepath.Join(td, "disk.E01"), FormatEWF, expected)
+
+	img, err := Open(filepath.Join(td, "disk.E01"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	vs, err := Verify(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vs) != 2 || !vs[0].OK() || !vs[1].OK() {
+		t.Errorf("unexpected verification result %v", vs)
+	}
+}
+
+// ewf2Segment returns an Ex01 segment file with the given sections. Chunks
+// of a sector data section are listed in the sector table that follows.
+func ewf2Segment(n int, sections []ewf2TestSection, last uint32) []byte {
+	le := binary.LittleEndian
+	f := make([]byte, ewf2FileHeaderSize)
+	copy(f, ewf2Magic)
+	f[8], f[9] = 2, 1
+	le.PutUint16(f[10:], ewf2Deflate)
+	le.PutUint32(f[12:], uint32(n))
+	sections = append(sections, ewf2TestSection{typ: last})
+	prev := 0
+	for i, s := range sections {
+		data := s.data
+		if s.chunks != nil {
+			data = nil
+			table := make([]byte, ewf2TableHeaderSize)
+			le.PutUint64(table, s.first)
+			le.PutUint32(table[8:], uint32(len(s.chunks)))
+			le.PutUint32(table[16:], adler32.Checksum(table[:16]))
+			for _, c := range s.chunks {
+				e := make([]byte, ewf2TableEntrySize)
+				if c.flags&ewf2ChunkPattern != 0 {
+					copy(e, c.data)
+				} else {
+					le.PutUint64(e, uint64(len(f)+len(data)))
+				}
+				le.PutUint32(e[8:], uint32(len(c.data)))
+				le.PutUint32(e[12:], c.flags)
+				table = append(table, e...)
+				data = append(data, c.data...)
+			}
+			sections[i+1].data = table
+		}
+		// Sections are padded to 16 bytes
+		padding := -len(data) & 15
+		data = append(data, make([]byte, padding)...)
+		desc := make([]byte, ewf2SectionSize)
+		le.PutUint32(desc, s.typ)
+		le.PutUint64(desc[8:], uint64(prev))
+		le.PutUint64(desc[16:], uint64(len(data)))
+		le.PutUint32(desc[24:], ewf2SectionSize)
+		le.PutUint32(desc[28:], uint32(padding))
+		le.PutUint32(desc[60:], adler32.Checksum(desc[:60]))
+		f = append(f, data...)
+		prev = len(f)
+		f = append(f, desc...)
+	}
+	return f
+}
+
+// ewf2Text returns the zlib compressed UTF-16 text of a device information
+// or case data section with the given keys and values.
+func ewf2Text(keys, values string) []byte {
+	var c bytes.Buffer
+	w := zlib.NewWriter(&c)
+	for _, r := range "\ufeff1\nmain\n" + keys + "\n" + values + "\n\n" {
+		binary.Write(w, binary.LittleEndian, uint16(r))
+	}
+	w.Close()
+	return c.Bytes()
+}
+
+type ewf2TestChunk struct {
+	data  []byte
+	flags uint32
+}
+
+type ewf2TestSection struct {
+	typ    uint32
+	data   []byte
+	first  uint64          // Number of the first chunk
+	chunks []ewf2TestChunk // Of a sector data section
+}
+
+func TestEWF2(t *testing.T) {
+	const (
+		chunkSize = 64 * 512
+		numChunks = 4
+		size      = (numChunks-1)*chunkSize + 8*512
+	)
+	le := binary.LittleEndian
+	expected := pattern(16, size)
+	// Chunk 2 is filled with a pattern
+	fill := []byte("pattern!")
+	for i := 2 * chunkSize; i < 3*chunkSize; i += len(fill) {
+		copy(expected[i:], fill)
+	}
+	data := func(i int) []byte {
+		return expected[i*chunkSize : min((i+1)*chunkSize, size)]
+	}
+	var compressed bytes.Buffer
+	w := zlib.NewWriter(&compressed)
+	w.Write(data(0))
+	w.Close()
+	md5Sum := md5.Sum(expected)
+	sha1Sum := sha1.Sum(expected)
+
+	td := t.TempDir()
+	writeFile(t, filepath.Join(td, "disk.Ex01"), ewf2Segment(1,
+		[]ewf2TestSection{
+			{typ: ewf2DeviceInfo, data: ewf2Text("sn\tts\tbp",
+				fmt.Sprintf("1234\t%d\t512", size/512))},
+			{typ: ewf2CaseData, data: ewf2Text("nm\tsb\tcp",
+				"evidence\t64\t1")},
+			{typ: 0x03, chunks: []ewf2TestChunk{
+				{compressed.Bytes(), ewf2ChunkCompressed},
+				{le.AppendUint32(append([]byte(nil), data(1)...),
+					adler32.Checksum(data(1))), ewf2ChunkChecksum}}},
+			{typ: ewf2SectorTable},
+		}, ewf2Next))
+	writeFile(t, filepath.Join(td, "disk.Ex02"), ewf2Segment(2,
+		[]ewf2TestSection{
+			{typ: 0x03, first: 2, chunks: []ewf2TestChunk{
+				{fill, ewf2ChunkPattern}, {data(3), 0}}},
+			{typ: ewf2SectorTable},
+			{typ: ewf2MD5Hash, data: md5Sum[:]},
+			{typ: ewf2SHA1Hash, data: sha1Sum[:]},
+		}, ewf2Done))
+	checkImage(t, filepath.Join(td, "disk.Ex01"), FormatEWF, expected)
+
+	img, err := Open(filepath.Join(td, "disk.Ex01"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	vs, err := Verify(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vs) != 2 || !vs[0].OK() || !vs[1].OK() {
+		t.Errorf("unexpected verification result %v", vs)
+	}
+}
+
+func TestEWFSegmentPath(t *testing.T) {
+	for _, test := range []struct {
+		n        int
+		expected string
+	}{
+		{2, "disk.E02"},
+		{99, "disk.E99"},
+		{100, "disk.EAA"},
+		{101, "disk.EAB"},
+		{100 + 26*26, "disk.FAA"},
+	} {
+		if p, err := ewfSegmentPath("disk.E01", test.n); err != nil ||
+			p != test.expected {
+			t.Errorf("segment %d: expected %s, got %s (%v)", test.n,
+				test.expected, p, err)
+		}
+	}
+	if p, _ := ewfSegmentPath("disk.e01", 100); p != "disk.eaa" {
+		t.Errorf("expected lower case, got %s", p)
+	}
+	for n, expected := range map[int]string{2: "disk.Ex02",
+		100: "disk.ExAA", 101 + 26: "disk.ExBB"} {
+		if p, err := ewfSegmentPath("disk.Ex01", n); err != nil ||
+			p != expected {
+			t.Errorf("segment %d: expected %s, got %s (%v)", n, expected,
+				p, err)
+		}
+	}
+}
+
+func TestLZ4(t *testing.T) {
+	// Literals "abc", a match of 7 bytes at offset 3 and the literal "d"
+	in := []byte{0x33, 'a', 'b', 'c', 3, 0, 0x10, 'd'}
+	out, err := lz4Decompress(in, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "abcabcabcad" {
+		t.Errorf("unexpected output %q", out)
+	}
+	if _, err := lz4Decompress(in, 5); err != errLZ4OutputOverrun {
+		t.Errorf("expected output overrun, got %v", err)
+	}
+	if _, err := lz4Decompress([]byte{0x10, 'a', 2, 0}, 100); err !=
+		errLZ4LookBehind {
+		t.Errorf("expected look-behind overrun, got %v", err)
+	}
+}
+
+func TestParseTurtle(t *testing.T) {
+	g, err := parseTurtle(`@prefix aff4: <http://aff4.org/Schema#> .
+@prefix xsd: <http://www.w3.org/2001/XMLSchema#> .
+# A comment
+<aff4://image> a aff4:Image, aff4:DiskImage ;
+    aff4:size "1048576"^^xsd:long ;
+    aff4:dataStream <aff4://map> ;
+    aff4:description "tab\tand \"quote\""@en ;
+    aff4:info [ aff4:count 3 ] .
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !g.hasType("aff4://image", aff4NS+"DiskImage") {
+		t.Errorf("missing type")
+	}
+	if v, err := g.int("aff4://image", aff4NS+"size"); err != nil ||
+		v != 1048576 {
+		t.Errorf("unexpected size %d (%v)", v, err)
+	}
+	if o, _ := g.value("aff4://image", aff4NS+"size"); o.datatype !=
+		xsdNS+"long" {
+		t.Errorf("unexpected datatype %s", o.datatype)
+	}
+	if o, _ := g.value("aff4://image", aff4NS+"dataStream"); o.value !=
+		"aff4://map" || o.literal {
+		t.Errorf("unexpected data stream %v", o)
+	}
+	if o, _ := g.value("aff4://image", aff4NS+"description"); o.value !=
+		"tab\tand \"quote\"" {
+		t.Errorf("unexpected description %q", o.value)
+	}
+	b, _ := g.value("aff4://image", aff4NS+"info")
+	if v, err := g.int(b.value, aff4NS+"count"); err != nil || v != 3 {
+		t.Errorf("unexpected count %d (%v)", v, err)
+	}
+	if _, err := parseTurtle("<a> x:y <b> ."); err == nil {
+		t.Errorf("expected error for unknown prefix")
+	}
+}
+
+func TestAFF4(t *testing.T) {
+	const (
+		volume    = "aff4://volume"
+		stream    = "aff4://stream"
+		chunkSize = 4096
+		perBevy   = 2
+		size      = 5*chunkSize - 100
+	)
+	le := binary.LittleEndian
+	data := pattern(16, size)
+	data[chunkSize] = 0 // Compresses better than the pattern
+	for i := chunkSize; i < 2*chunkSize; i++ {
+		data[i] = byte(i / 100)
+	}
+
+	var zb bytes.Buffer
+	zw := zip.NewWriter(&zb)
+	zw.SetComment(volume)
+	store := func(name string, b []byte) {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name,
+			Method: zip.Store})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(b)
+	}
+	for b := 0; b*perBevy*chunkSize < size; b++ {
+		var bevy, index []byte
+		for i := b * perBevy; i < (b+1)*perBevy &&
+			i*chunkSize < size; i++ {
+			c := data[i*chunkSize : min((i+1)*chunkSize, size)]
+			if compressed := snappy.Encode(nil, c); len(compressed) <
+				len(c) {
+				c = compressed
+			}
+			index = le.AppendUint64(index, uint64(len(bevy)))
+			index = le.AppendUint32(index, uint32(len(c)))
+			bevy = append(bevy, c...)
+		}
+		// Stream URNs outside the volume are escaped
+		name := fmt.Sprintf("aff4%%3A%%2F%%2Fstream/%08d", b)
+		store(name, bevy)
+		store(name+".index", index)
+	}
+
+	// The map has the stream at 0 and 8192, with a gap and a symbolic
+	// stream in between
+	var m []byte
+	for _, e := range []struct {
+		mapped, length, target uint64
+		id                     uint32
+	}{
+		{0, 3 * chunkSize, 0, 0},
+		{4 * chunkSize, 1000, 0, 1},
+		{5 * chunkSize, 2 * chunkSize, 2 * chunkSize, 0},
+	} {
+		m = le.AppendUint64(m, e.mapped)
+		m = le.AppendUint64(m, e.length)
+		m = le.AppendUint64(m, e.target)
+		m = le.AppendUint32(m, e.id)
+	}
+	store("map/map", m)
+	store("map/idx", []byte(stream+"\n"+aff4NS+"SymbolicStreamFF\n"))
+
+	expected := make([]byte, 7*chunkSize)
+	copy(expected, data[:3*chunkSize])
+	for i := 4 * chunkSize; i < 4*chunkSize+1000; i++ {
+		expected[i] = 0xff
+	}
+	copy(expected[5*chunkSize:], data[2*chunkSize:4*chunkSize])
+	sum := sha1.Sum(expected)
+
+	w, _ := zw.Create("information.turtle")
+	fmt.Fprintf(w, `@prefix aff4: <http://aff4.org/Schema#> .
+@prefix xsd: <http://www.w3.org/2001/XMLSchema#> .
+
+<%[1]s/image> a aff4:Image ;
+    aff4:dataStream <%[1]s/map> ;
+    aff4:hash "%[4]x"^^aff4:SHA1 .
+
+<%[1]s/map> a aff4:Map ;
+    aff4:size "%[5]d"^^xsd:long .
+
+<%[2]s> a aff4:ImageStream ;
+    aff4:size "%[3]d"^^xsd:long ;
+    aff4:chunkSize "4096"^^xsd:int ;
+    aff4:chunksInSegment "2"^^xsd:int ;
+    aff4:compressionMethod <https://code.google.com/p/snappy/> .
+`, volume, stream, size, sum, len(expected))
+	zw.Close()
+
+	path := filepath.Join(t.TempDir(), "disk.aff4")
+	writeFile(t, path, zb.Bytes())
+	checkImage(t, path, FormatAFF4, expected)
+
+	img, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	vs, err := Verify(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vs) != 1 || vs[0].Algorithm != "sha1" || !vs[0].OK() {
+		t.Errorf("unexpected verification result %v", vs)
+	}
+}
@@ -0,0 +1,408 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// EnCase evidence files (EWF-E01), split into segment files .E01, .E02, ...
+// The sections of version 2 files (EWF2-Ex01) are in ewf2.go.
+
+package diskimage
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"hash/adler32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	ewfMagic  = "EVF\x09\x0d\x0a\xff\x00"
+	ewf2Magic = "EVF2\x0d\x0a\x81\x00" // Ex01 files
+)
+
+// Sizes of the on-disk structures
+const (
+	ewfFileHeaderSize  = 13
+	ewfSectionSize     = 76 // Section descriptor
+	ewfTableHeaderSize = 24
+	ewfVolumeSize      = 1052 // Volume section data, smaller in SMART files
+)
+
+const (
+	// Bit of table entries that marks compressed chunks
+	ewfCompressed = 1 << 31
+	// Sanity limits for volume and table sections
+	ewfMaxChunkSize    = 64 << 20
+	ewfMaxTableEntries = 1 << 20
+)
+
+type ewfChunk struct {
+	seg        int
+	offset     int64 // Or the fill pattern
+	size       int64 // Stored size, up to the next chunk or section
+	compressed bool
+	checksum   bool // Uncompressed data is followed by its Adler-32
+	pattern    bool // The chunk repeats the 8 bytes of offset
+}
+
+type ewfImage struct {
+	segs      []*os.File
+	size      int64
+	chunkSize int64
+	chunks    []ewfChunk
+	digests   []Digest
+	bzip2     bool // Compressed chunks use bzip2 instead of zlib
+
+	mu sync.Mutex
+	// Last read chunk and its data
+	lastChunk int64
+	lastData  []byte
+}
+
+// ewfSegmentPath returns the name of segment file n of the evidence file
+// whose first segment is first. After .E99 come .EAA to .EZZ, then .FAA and
+// so on. Version 2 files go from .Ex01 to .Ex99 and then .ExAA to .ExZZ.
+// The case of the extension is kept.
+func ewfSegmentPath(first string, n int) (string, error) {
+	ext := filepath.Ext(first)
+	if len(ext) != 4 && len(ext) != 5 {
+		return "", fmt.Errorf("cannot derive segment file names from %s",
+			first)
+	}
+	if n <= 99 {
+		return fmt.Sprintf("%s%02d", first[:len(first)-2], n), nil
+	}
+	a := byte('A')
+	if ext[1] >= 'a' {
+		a = 'a'
+	}
+	n -= 100
+	if len(ext) == 5 {
+		if n >= 26*26 {
+			return "", fmt.Errorf("too many segment files")
+		}
+		return first[:len(first)-2] + string([]byte{a + byte(n/26),
+			a + byte(n%26)}), nil
+	}
+	c := ext[1] + byte(n/(26*26))
+	if n/(26*26) >= 26 || c > a+25 {
+		return "", fmt.Errorf("too many segment files")
+	}
+	return first[:len(first)-3] + string([]byte{c, a + byte(n/26%26),
+		a + byte(n%26)}), nil
+}
+
+// openEWF opens an EnCase evidence file, f being its first segment. The
+// remaining segments are opened from the same directory.
+func openEWF(f *os.File, path string) (Image, error) {
+	hdr := make([]byte, len(ewf2Magic))
+	if err := readFullAt(f, hdr, 0); err != nil {
+		return nil, err
+	}
+	img := &ewfImage{segs: []*os.File{f}, lastChunk: -1}
+	readSegment := img.readSegment
+	// Device information and case data of version 2 files
+	values := make(map[string]string)
+	if string(hdr) == ewf2Magic {
+		readSegment = func(i int) (bool, error) {
+			return img.readSegment2(i, values)
+		}
+	}
+	for i := 0; ; i++ {
+		more, err := readSegment(i)
+		if err == nil && more {
+			var next string
+			if next, err = ewfSegmentPath(path, i+2); err == nil {
+				var f *os.File
+				if f, err = os.Open(next); err == nil {
+					img.segs = append(img.segs, f)
+				}
+			}
+		}
+		if err != nil {
+			// The first segment is closed by the caller
+			for _, f := range img.segs[1:] {
+				f.Close()
+			}
+			return nil, err
+		}
+		if !more {
+			break
+		}
+	}
+	if string(hdr) == ewf2Magic {
+		if err := img.setGeometry2(values); err != nil {
+			img.Close()
+			return nil, err
+		}
+	}
+	if img.chunkSize == 0 {
+		img.Close()
+		return nil, fmt.Errorf("no volume section in evidence file")
+	}
+	if numChunks := (img.size + img.chunkSize - 1) / img.chunkSize; int64(
+		len(img.chunks)) < numChunks {
+		img.Close()
+		return nil, fmt.Errorf("evidence file has %d of %d chunks, "+
+			"missing segment files?", len(img.chunks), numChunks)
+	}
+	return img, nil
+}
+
+// readSegment reads the sections of segment i and reports whether there are
+// more segments.
+func (img *ewfImage) readSegment(i int) (bool, error) {
+	le := binary.LittleEndian
+	f := img.segs[i]
+	hdr := make([]byte, ewfFileHeaderSize)
+	if err := readFullAt(f, hdr, 0); err != nil {
+		return false, fmt.Errorf("%s: %w", f.Name(), err)
+	}
+	if string(hdr[:len(ewfMagic)]) != ewfMagic ||
+		int(le.Uint16(hdr[9:])) != i+1 {
+		return false, fmt.Errorf("%s is not segment %d of the evidence "+
+			"file", f.Name(), i+1)
+	}
+
+	first := len(img.chunks)
+	// Section offsets in ascending order, chunk data ends at the next one
+	var starts []int64
+	more := false
+	desc := make([]byte, ewfSectionSize)
+	for off := int64(ewfFileHeaderSize); ; {
+		if err := readFullAt(f, desc, off); err != nil {
+			return false, fmt.Errorf("%s: section at %d: %w", f.Name(), off,
+				err)
+		}
+		if adler32.Checksum(desc[:72]) != le.Uint32(desc[72:]) {
+			return false, fmt.Errorf("%s: bad section descriptor checksum "+
+				"at %d", f.Name(), off)
+		}
+		starts = append(starts, off)
+		typ := string(bytes.TrimRight(desc[:16], "\x00"))
+		next := int64(le.Uint64(desc[16:]))
+		data, size := off+ewfSectionSize, int64(le.Uint64(desc[24:]))
+
+		var err error
+		switch typ {
+		case "volume", "disk":
+			err = img.readVolume(f, data, size-ewfSectionSize)
+		case "table":
+			err = img.readTable(f, i, data)
+		case "hash":
+			err = img.readDigests(f, data, "md5")
+		case "digest":
+			err = img.readDigests(f, data, "md5", "sha1")
+		}
+		if err != nil {
+			return false, fmt.Errorf("%s: %s section: %w", f.Name(), typ, err)
+		}
+		if typ == "next" || typ == "done" {
+			more = typ == "next"
+			break
+		}
+		if next <= off {
+			return false, fmt.Errorf("%s: section chain ends at %d without "+
+				"done section", f.Name(), off)
+		}
+		off = next
+	}
+
+	chunks := img.chunks[first:]
+	for j := range chunks {
+		c := &chunks[j]
+		end := int64(-1)
+		for _, s := range starts {
+			if s > c.offset {
+				end = s
+				break
+			}
+		}
+		if j+1 < len(chunks) && chunks[j+1].offset > c.offset &&
+			(end < 0 || chunks[j+1].offset < end) {
+			end = chunks[j+1].offset
+		}
+		if end < 0 {
+			return false, fmt.Errorf("%s: chunk at %d lies beyond the last "+
+				"section", f.Name(), c.offset)
+		}
+		c.size = end - c.offset
+	}
+	return more, nil
+}
+
+func (img *ewfImage) readVolume(f *os.File, off, length int64) error {
+	le := binary.LittleEndian
+	if length < 24 {
+		return fmt.Errorf("too short")
+	}
+	b := make([]byte, 24)
+	if err := readFullAt(f, b, off); err != nil {
+		return err
+	}
+	chunkSectors := int64(le.Uint32(b[8:]))
+	sectorSize := int64(le.Uint32(b[12:]))
+	sectors := int64(le.Uint32(b[16:]))
+	if length >= ewfVolumeSize {
+		sectors = int64(le.Uint64(b[16:]))
+	}
+	return img.setGeometry(chunkSectors, sectorSize, sectors)
+}
+
+// setGeometry sets the chunk size and the size of the image.
+func (img *ewfImage) setGeometry(chunkSectors, sectorSize,
+	sectors int64) error {
+	if chunkSectors <= 0 || chunkSectors > ewfMaxChunkSize ||
+		sectorSize <= 0 || sectorSize > ewfMaxChunkSize ||
+		chunkSectors*sectorSize > ewfMaxChunkSize || sectors < 0 ||
+		sectors > (1<<62)/sectorSize {
+		return fmt.Errorf("invalid geometry: %d sectors of %d bytes, %d "+
+			"per chunk", sectors, sectorSize, chunkSectors)
+	}
+	img.chunkSize, img.size = chunkSectors*sectorSize, sectors*sectorSize
+	return nil
+}
+
+// readTable adds the chunks listed in the table section at off in segment
+// seg.
+func (img *ewfImage) readTable(f *os.File, seg int, off int64) error {
+	le := binary.LittleEndian
+	hdr := make([]byte, ewfTableHeaderSize)
+	if err := readFullAt(f, hdr, off); err != nil {
+		return err
+	}
+	if adler32.Checksum(hdr[:20]) != le.Uint32(hdr[20:]) {
+		return fmt.Errorf("bad header checksum")
+	}
+	n := le.Uint32(hdr)
+	if n > ewfMaxTableEntries {
+		return fmt.Errorf("too many entries: %d", n)
+	}
+	base := int64(le.Uint64(hdr[8:]))
+	entries := make([]byte, 4*n)
+	if err := readFullAt(f, entries, off+ewfTableHeaderSize); err != nil {
+		return err
+	}
+	for i := 0; i < int(n); i++ {
+		e := le.Uint32(entries[i*4:])
+		img.chunks = append(img.chunks, ewfChunk{
+			seg:        seg,
+			offset:     base + int64(e&^ewfCompressed),
+			compressed: e&ewfCompressed != 0,
+			checksum:   e&ewfCompressed == 0,
+		})
+	}
+	return nil
+}
+
+// readDigests reads the digests stored one after the other at off. Unset
+// digests are all zeros.
+func (img *ewfImage) readDigests(f *os.File, off int64,
+	algorithms ...string) error {
+	for _, alg := range algorithms {
+		sum := make([]byte, digestSize[alg])
+		if err := readFullAt(f, sum, off); err != nil {
+			return err
+		}
+		off += int64(len(sum))
+		if !bytes.Equal(sum, make([]byte, len(sum))) {
+			img.digests = setDigest(img.digests, Digest{alg, sum})
+		}
+	}
+	return nil
+}
+
+func (img *ewfImage) Size() int64       { return img.size }
+func (img *ewfImage) Format() string    { return FormatEWF }
+func (img *ewfImage) Digests() []Digest { return img.digests }
+
+func (img *ewfImage) Close() error {
+	var err error
+	for _, f := range img.segs {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (img *ewfImage) ReadAt(p []byte, off int64) (int, error) {
+	return readVirtual(p, off, img.size, img.chunkSize, img.readChunk)
+}
+
+// readChunk reads p, which lies within a single chunk, at off.
+func (img *ewfImage) readChunk(p []byte, off int64) error {
+	i := off / img.chunkSize
+	data, err := img.chunk(i)
+	if err != nil {
+		return fmt.Errorf("E01 chunk at %d: %w", i*img.chunkSize, err)
+	}
+	copy(p, data[off%img.chunkSize:])
+	return nil
+}
+
+// chunk returns the data of chunk i. Compressed chunks are checked by the
+// checksum of zlib or bzip2, the others by the Adler-32 following the data,
+// if there is one.
+func (img *ewfImage) chunk(i int64) ([]byte, error) {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	if img.lastChunk == i {
+		return img.lastData, nil
+	}
+	c := img.chunks[i]
+	length := min(img.chunkSize, img.size-i*img.chunkSize)
+	var data []byte
+	switch {
+	case c.pattern:
+		data = make([]byte, length+8)
+		for j := int64(0); j < length; j += 8 {
+			binary.LittleEndian.PutUint64(data[j:], uint64(c.offset))
+		}
+		data = data[:length]
+	case c.compressed:
+		// zlib adds a few bytes to incompressible data at most
+		buf := make([]byte, min(c.size, 2*img.chunkSize))
+		if err := readFullAt(img.segs[c.seg], buf, c.offset); err != nil {
+			return nil, err
+		}
+		var zr io.Reader = bzip2.NewReader(bytes.NewReader(buf))
+		if !img.bzip2 {
+			r, err := zlib.NewReader(bytes.NewReader(buf))
+			if err != nil {
+				return nil, err
+			}
+			zr = r
+		}
+		// Reading to the end verifies the checksum
+		var err error
+		data, err = io.ReadAll(io.LimitReader(zr, length+1))
+		if err == nil && int64(len(data)) != length {
+			err = fmt.Errorf("chunk has %d bytes", len(data))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot decompress: %w", err)
+		}
+	case c.checksum:
+		buf := make([]byte, length+4)
+		if err := readFullAt(img.segs[c.seg], buf, c.offset); err != nil {
+			return nil, err
+		}
+		data = buf[:length]
+		if adler32.Checksum(data) != binary.LittleEndian.Uint32(
+			buf[length:]) {
+			return nil, fmt.Errorf("checksum mismatch")
+		}
+	default:
+		data = make([]byte, length)
+		if err := readFullAt(img.segs[c.seg], data, c.offset); err != nil {
+			return nil, err
+		}
+	}
+	img.lastChunk, img.lastData = i, data
+	return data, nil
+}
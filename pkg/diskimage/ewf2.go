@@ -0,0 +1,259 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// EnCase evidence files, version 2 (EWF2-Ex01). Unlike in version 1, the
+// section descriptors follow the section data and the sections of a segment
+// file are chained from its end.
+
+package diskimage
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"hash/adler32"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// Sizes of the on-disk structures
+const (
+	ewf2FileHeaderSize  = 32
+	ewf2SectionSize     = 64 // Section descriptor
+	ewf2TableHeaderSize = 32
+	ewf2TableEntrySize  = 16
+)
+
+// Section types
+const (
+	ewf2DeviceInfo  = 0x01
+	ewf2CaseData    = 0x02
+	ewf2SectorTable = 0x04
+	ewf2MD5Hash     = 0x08
+	ewf2SHA1Hash    = 0x09
+	ewf2Next        = 0x0d
+	ewf2Done        = 0x0f
+)
+
+// Section data flag of encrypted sections
+const ewf2Encrypted = 1 << 1
+
+// Table entry flags
+const (
+	ewf2ChunkCompressed = 1 << 0
+	ewf2ChunkChecksum   = 1 << 1
+	ewf2ChunkPattern    = 1 << 2
+)
+
+// Compression methods in the file header
+const (
+	ewf2NoCompression = 0
+	ewf2Deflate       = 1
+	ewf2BZip2         = 2
+)
+
+// Limit for the text of device information and case data sections
+const ewf2MaxTextSize = 1 << 20
+
+// readSegment2 reads the sections of segment i of a version 2 evidence file
+// and reports whether there are more segments. The values of the device
+// information and case data sections are added to values.
+func (img *ewfImage) readSegment2(i int, values map[string]string) (bool,
+	error) {
+	le := binary.LittleEndian
+	f := img.segs[i]
+	hdr := make([]byte, ewf2FileHeaderSize)
+	if err := readFullAt(f, hdr, 0); err != nil {
+		return false, fmt.Errorf("%s: %w", f.Name(), err)
+	}
+	if string(hdr[:len(ewf2Magic)]) != ewf2Magic || hdr[8] != 2 ||
+		int(le.Uint32(hdr[12:])) != i+1 {
+		return false, fmt.Errorf("%s is not segment %d of the evidence "+
+			"file", f.Name(), i+1)
+	}
+	switch le.Uint16(hdr[10:]) {
+	case ewf2NoCompression, ewf2Deflate:
+	case ewf2BZip2:
+		img.bzip2 = true
+	default:
+		return false, fmt.Errorf("%s: unsupported compression method %d",
+			f.Name(), le.Uint16(hdr[10:]))
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	// Sector tables in the order they were found, last to first
+	type table struct{ off, length int64 }
+	var tables []table
+	more := false
+	desc := make([]byte, ewf2SectionSize)
+	for off, last := fi.Size()-ewf2SectionSize, true; ; last = false {
+		if off < ewf2FileHeaderSize {
+			return false, fmt.Errorf("%s: section at %d lies outside of "+
+				"the file", f.Name(), off)
+		}
+		if err := readFullAt(f, desc, off); err != nil {
+			return false, fmt.Errorf("%s: section at %d: %w", f.Name(), off,
+				err)
+		}
+		if adler32.Checksum(desc[:60]) != le.Uint32(desc[60:]) {
+			return false, fmt.Errorf("%s: bad section descriptor checksum "+
+				"at %d", f.Name(), off)
+		}
+		typ := le.Uint32(desc)
+		prev := int64(le.Uint64(desc[8:]))
+		size, padding := le.Uint64(desc[16:]), uint64(le.Uint32(desc[28:]))
+		if size > uint64(off-ewf2FileHeaderSize) || padding > size {
+			return false, fmt.Errorf("%s: invalid size of section at %d",
+				f.Name(), off)
+		}
+		data, length := off-int64(size), int64(size-padding)
+		if last {
+			if typ != ewf2Next && typ != ewf2Done {
+				return false, fmt.Errorf("%s: last section is not a next "+
+					"or done section", f.Name())
+			}
+			more = typ == ewf2Next
+		}
+		if le.Uint32(desc[4:])&ewf2Encrypted != 0 {
+			return false, fmt.Errorf("%s: encrypted Ex01 evidence files "+
+				"are not supported", f.Name())
+		}
+
+		switch typ {
+		case ewf2DeviceInfo, ewf2CaseData:
+			err = readEWF2Values(f, data, length, values)
+		case ewf2SectorTable:
+			tables = append(tables, table{data, length})
+		case ewf2MD5Hash:
+			err = img.readDigests(f, data, "md5")
+		case ewf2SHA1Hash:
+			err = img.readDigests(f, data, "sha1")
+		}
+		if err != nil {
+			return false, fmt.Errorf("%s: section type %d: %w", f.Name(),
+				typ, err)
+		}
+		if prev == 0 {
+			break
+		}
+		if prev < 0 || prev >= off {
+			return false, fmt.Errorf("%s: section chain loops at %d",
+				f.Name(), off)
+		}
+		off = prev
+	}
+	for j := len(tables) - 1; j >= 0; j-- {
+		if err := img.readTable2(f, i, tables[j].off,
+			tables[j].length); err != nil {
+			return false, fmt.Errorf("%s: sector table: %w", f.Name(), err)
+		}
+	}
+	return more, nil
+}
+
+// readTable2 adds the chunks listed in the sector table of length bytes at
+// off in segment seg. Tables need to follow each other without gaps.
+func (img *ewfImage) readTable2(f *os.File, seg int, off,
+	length int64) error {
+	le := binary.LittleEndian
+	hdr := make([]byte, ewf2TableHeaderSize)
+	if err := readFullAt(f, hdr, off); err != nil {
+		return err
+	}
+	if adler32.Checksum(hdr[:16]) != le.Uint32(hdr[16:]) {
+		return fmt.Errorf("bad header checksum")
+	}
+	first, n := le.Uint64(hdr), le.Uint32(hdr[8:])
+	if n > ewfMaxTableEntries ||
+		int64(n)*ewf2TableEntrySize > length-ewf2TableHeaderSize {
+		return fmt.Errorf("invalid number of entries %d", n)
+	}
+	if first != uint64(len(img.chunks)) {
+		return fmt.Errorf("table starts at chunk %d, expected %d", first,
+			len(img.chunks))
+	}
+	entries := make([]byte, ewf2TableEntrySize*int(n))
+	if err := readFullAt(f, entries, off+ewf2TableHeaderSize); err != nil {
+		return err
+	}
+	for i := 0; i < int(n); i++ {
+		e := entries[i*ewf2TableEntrySize:]
+		flags := le.Uint32(e[12:])
+		img.chunks = append(img.chunks, ewfChunk{
+			seg:        seg,
+			offset:     int64(le.Uint64(e)),
+			size:       int64(le.Uint32(e[8:])),
+			compressed: flags&ewf2ChunkCompressed != 0,
+			checksum:   flags&ewf2ChunkChecksum != 0,
+			pattern:    flags&ewf2ChunkPattern != 0,
+		})
+	}
+	return nil
+}
+
+// readEWF2Values adds the values of a device information or case data
+// section of length bytes at off to values. The section holds zlib
+// compressed UTF-16 text with lines of tab separated keys, each followed by
+// a line of their values.
+func readEWF2Values(f *os.File, off, length int64,
+	values map[string]string) error {
+	if length > ewf2MaxTextSize {
+		return fmt.Errorf("too large")
+	}
+	buf := make([]byte, length)
+	if err := readFullAt(f, buf, off); err != nil {
+		return err
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	raw, err := io.ReadAll(io.LimitReader(zr, ewf2MaxTextSize))
+	if err != nil {
+		return err
+	}
+	u := make([]uint16, len(raw)/2)
+	for i := range u {
+		u[i] = binary.LittleEndian.Uint16(raw[i*2:])
+	}
+	text := strings.TrimPrefix(string(utf16.Decode(u)), "\ufeff")
+	lines := strings.Split(strings.ReplaceAll(text, "\r", ""), "\n")
+	for i := 0; i+1 < len(lines); i++ {
+		keys, vals := strings.Split(lines[i], "\t"), strings.Split(
+			lines[i+1], "\t")
+		if len(keys) < 2 || len(keys) != len(vals) {
+			continue
+		}
+		for j, k := range keys {
+			values[k] = vals[j]
+		}
+		i++
+	}
+	return nil
+}
+
+// setGeometry2 sets the chunk size and the size of the image from the
+// number of sectors and bytes per sector in the device information and the
+// sectors per chunk in the case data.
+func (img *ewfImage) setGeometry2(values map[string]string) error {
+	var geometry [3]int64
+	for i, key := range []string{"sb", "bp", "ts"} {
+		v, ok := values[key]
+		if !ok {
+			return fmt.Errorf("evidence file lacks the %s value", key)
+		}
+		var err error
+		if geometry[i], err = strconv.ParseInt(v, 10, 64); err != nil {
+			return fmt.Errorf("invalid %s value in evidence file: %w", key,
+				err)
+		}
+	}
+	return img.setGeometry(geometry[0], geometry[1], geometry[2])
+}
@@ -0,0 +1,87 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// LZ4 block decompression
+
+package diskimage
+
+import (
+	"errors"
+)
+
+var (
+	errLZ4InputOverrun  = errors.New("lz4: input overrun")
+	errLZ4OutputOverrun = errors.New("lz4: output overrun")
+	errLZ4LookBehind    = errors.New("lz4: look-behind overrun")
+)
+
+// LZ4 matches are at least this long
+const lz4MinMatch = 4
+
+// lz4Decompress decompresses a single LZ4 block of at most maxOut bytes.
+func lz4Decompress(in []byte, maxOut int) ([]byte, error) {
+	out := make([]byte, 0, maxOut)
+	ip := 0
+	// length decodes a length of which the token holds the low 4 bits. If
+	// these are all set, each following byte is added up to one that is
+	// not 255.
+	length := func(n int) (int, error) {
+		if n != 15 {
+			return n, nil
+		}
+		for {
+			if ip >= len(in) {
+				return 0, errLZ4InputOverrun
+			}
+			b := in[ip]
+			ip++
+			n += int(b)
+			if b != 255 {
+				return n, nil
+			}
+		}
+	}
+	for {
+		if ip >= len(in) {
+			return nil, errLZ4InputOverrun
+		}
+		token := in[ip]
+		ip++
+		n, err := length(int(token >> 4))
+		if err != nil {
+			return nil, err
+		}
+		if n > len(in)-ip {
+			return nil, errLZ4InputOverrun
+		}
+		if n > maxOut-len(out) {
+			return nil, errLZ4OutputOverrun
+		}
+		out = append(out, in[ip:ip+n]...)
+		ip += n
+		// The last sequence only has literals
+		if ip == len(in) {
+			return out, nil
+		}
+
+		if ip+2 > len(in) {
+			return nil, errLZ4InputOverrun
+		}
+		offset := int(in[ip]) | int(in[ip+1])<<8
+		ip += 2
+		if offset == 0 || offset > len(out) {
+			return nil, errLZ4LookBehind
+		}
+		if n, err = length(int(token & 15)); err != nil {
+			return nil, err
+		}
+		n += lz4MinMatch
+		if n > maxOut-len(out) {
+			return nil, errLZ4OutputOverrun
+		}
+		// Matches may overlap the output they produce
+		for i := 0; i < n; i++ {
+			out = append(out, out[len(out)-offset])
+		}
+	}
+}
@@ -0,0 +1,259 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// QEMU copy-on-write images, version 2 and 3
+
+package diskimage
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const qcow2Magic = "QFI\xfb"
+
+// Incompatible feature bits of qcow2 version 3
+const (
+	qcow2Dirty           = 1 << 0
+	qcow2Corrupt         = 1 << 1
+	qcow2ExternalData    = 1 << 2
+	qcow2CompressionType = 1 << 3
+	qcow2ExtendedL2      = 1 << 4
+)
+
+// L1 and L2 table entry bits
+const (
+	qcow2OffsetMask = 0x00fffffffffffe00
+	qcow2Compressed = 1 << 62
+	qcow2ZeroFlag   = 1 << 0
+)
+
+const (
+	// Number of L2 tables to keep in memory
+	qcow2L2CacheSize = 64
+	// Maximum number of L1 table entries, as in QEMU
+	qcow2MaxL1Size = 1 << 22
+)
+
+type qcow2Image struct {
+	f           *os.File
+	size        int64
+	clusterBits uint
+	clusterSize int64
+	l1          []uint64
+	zstd        bool // Compression type, deflate otherwise
+	backing     Image
+
+	mu      sync.Mutex
+	l2Cache map[uint64][]uint64
+	// Last decompressed cluster and its L2 entry
+	lastEntry uint64
+	lastData  []byte
+}
+
+func openQCOW2(f *os.File, path string, depth int) (Image, error) {
+	be := binary.BigEndian
+	hdr := make([]byte, 112)
+	if n, err := f.ReadAt(hdr, 0); n < 72 {
+		return nil, fmt.Errorf("short qcow2 header: %v", err)
+	}
+	version := be.Uint32(hdr[4:])
+	if version != 2 && version != 3 {
+		return nil, fmt.Errorf("unsupported qcow2 version %d", version)
+	}
+	img := &qcow2Image{
+		f:           f,
+		size:        int64(be.Uint64(hdr[24:])),
+		clusterBits: uint(be.Uint32(hdr[20:])),
+		l2Cache:     make(map[uint64][]uint64),
+	}
+	if img.clusterBits < 9 || img.clusterBits > 21 {
+		return nil, fmt.Errorf("invalid qcow2 cluster bits %d",
+			img.clusterBits)
+	}
+	img.clusterSize = 1 << img.clusterBits
+	if method := be.Uint32(hdr[32:]); method != 0 {
+		return nil, fmt.Errorf("encrypted qcow2 images are not supported")
+	}
+	if version == 3 {
+		features := be.Uint64(hdr[72:])
+		if features&qcow2Corrupt != 0 {
+			return nil, fmt.Errorf("qcow2 image is marked corrupt")
+		}
+		if features&(qcow2ExternalData|qcow2ExtendedL2) != 0 ||
+			features&^(qcow2Dirty|qcow2CompressionType|qcow2ExternalData|
+				qcow2ExtendedL2) != 0 {
+			return nil, fmt.Errorf("unsupported qcow2 features %#x",
+				features)
+		}
+		if features&qcow2CompressionType != 0 &&
+			be.Uint32(hdr[100:]) > 104 {
+			switch hdr[104] {
+			case 0:
+			case 1:
+				img.zstd = true
+			default:
+				return nil, fmt.Errorf("unsupported qcow2 compression "+
+					"type %d", hdr[104])
+			}
+		}
+	}
+
+	l1Size := be.Uint32(hdr[36:])
+	l1Offset := int64(be.Uint64(hdr[40:]))
+	if l1Size > qcow2MaxL1Size {
+		return nil, fmt.Errorf("invalid qcow2 L1 table size %d", l1Size)
+	}
+	l1 := make([]byte, 8*int(l1Size))
+	if err := readFullAt(f, l1, l1Offset); err != nil {
+		return nil, fmt.Errorf("cannot read qcow2 L1 table: %w", err)
+	}
+	img.l1 = make([]uint64, l1Size)
+	for i := range img.l1 {
+		img.l1[i] = be.Uint64(l1[i*8:])
+	}
+
+	if backingOffset := int64(be.Uint64(hdr[8:])); backingOffset != 0 {
+		nameLen := be.Uint32(hdr[16:])
+		if nameLen > 1023 {
+			return nil, fmt.Errorf("invalid qcow2 backing file name")
+		}
+		name := make([]byte, nameLen)
+		if err := readFullAt(f, name, backingOffset); err != nil {
+			return nil, fmt.Errorf("cannot read qcow2 backing file name: "+
+				"%w", err)
+		}
+		backing := string(name)
+		if !filepath.IsAbs(backing) {
+			backing = filepath.Join(filepath.Dir(path), backing)
+		}
+		var err error
+		if img.backing, err = open(backing, depth+1); err != nil {
+			return nil, fmt.Errorf("backing file: %w", err)
+		}
+	}
+	return img, nil
+}
+
+func (img *qcow2Image) Size() int64    { return img.size }
+func (img *qcow2Image) Format() string { return FormatQCOW2 }
+
+func (img *qcow2Image) Close() error {
+	if img.backing != nil {
+		img.backing.Close()
+	}
+	return img.f.Close()
+}
+
+func (img *qcow2Image) ReadAt(p []byte, off int64) (int, error) {
+	return readVirtual(p, off, img.size, img.clusterSize, img.readCluster)
+}
+
+// l2Table returns the L2 table at the given offset in the image file.
+func (img *qcow2Image) l2Table(offset uint64) ([]uint64, error) {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	if t, ok := img.l2Cache[offset]; ok {
+		return t, nil
+	}
+	buf := make([]byte, img.clusterSize)
+	if err := readFullAt(img.f, buf, int64(offset)); err != nil {
+		return nil, fmt.Errorf("cannot read qcow2 L2 table: %w", err)
+	}
+	t := make([]uint64, len(buf)/8)
+	for i := range t {
+		t[i] = binary.BigEndian.Uint64(buf[i*8:])
+	}
+	if len(img.l2Cache) >= qcow2L2CacheSize {
+		for k := range img.l2Cache {
+			delete(img.l2Cache, k) // Evict an arbitrary table
+			break
+		}
+	}
+	img.l2Cache[offset] = t
+	return t, nil
+}
+
+// readCluster reads p, which lies within a single cluster, at off.
+func (img *qcow2Image) readCluster(p []byte, off int64) error {
+	l2Entries := img.clusterSize / 8
+	cluster := off >> img.clusterBits
+	l1Index := cluster / l2Entries
+	if l1Index >= int64(len(img.l1)) {
+		return readBacking(img.backing, p, off)
+	}
+	l2Offset := img.l1[l1Index] & qcow2OffsetMask
+	if l2Offset == 0 {
+		return readBacking(img.backing, p, off)
+	}
+	l2, err := img.l2Table(l2Offset)
+	if err != nil {
+		return err
+	}
+	entry := l2[cluster%l2Entries]
+	inCluster := off & (img.clusterSize - 1)
+	switch {
+	case entry&qcow2Compressed != 0:
+		data, err := img.decompress(entry)
+		if err != nil {
+			return fmt.Errorf("qcow2 cluster at %d: %w", off-inCluster, err)
+		}
+		copy(p, data[inCluster:])
+		return nil
+	case entry&qcow2ZeroFlag != 0:
+		clear(p)
+		return nil
+	case entry&qcow2OffsetMask == 0:
+		return readBacking(img.backing, p, off)
+	}
+	return readFullAt(img.f, p, int64(entry&qcow2OffsetMask)+inCluster)
+}
+
+// decompress returns the data of the compressed cluster described by the L2
+// entry.
+func (img *qcow2Image) decompress(entry uint64) ([]byte, error) {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	if img.lastData != nil && img.lastEntry == entry {
+		return img.lastData, nil
+	}
+
+	// The host offset takes the low x bits, followed by the number of
+	// additional 512 byte sectors holding the compressed data
+	x := 62 - (img.clusterBits - 8)
+	offset := int64(entry & (1<<x - 1))
+	sectors := int64(entry>>x) & (1<<(img.clusterBits-8) - 1)
+	compressed := make([]byte, (sectors+1)*512-offset%512)
+	n, err := img.f.ReadAt(compressed, offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	compressed = compressed[:n]
+
+	data := make([]byte, img.clusterSize)
+	var r io.Reader
+	if img.zstd {
+		d, err := zstd.NewReader(bytes.NewReader(compressed),
+			zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		defer d.Close()
+		r = d
+	} else {
+		r = flate.NewReader(bytes.NewReader(compressed))
+	}
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("cannot decompress: %w", err)
+	}
+	img.lastEntry, img.lastData = entry, data
+	return data, nil
+}
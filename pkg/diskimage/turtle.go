@@ -0,0 +1,386 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Parser for the subset of RDF Turtle written by AFF4 tools. Collections
+// and relative IRIs are not supported.
+
+package diskimage
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	rdfType = "http://www.w3.org/1999/02/22-rdf-syntax-ns#type"
+	xsdNS   = "http://www.w3.org/2001/XMLSchema#"
+)
+
+// rdfTerm is an IRI, blank node or literal.
+type rdfTerm struct {
+	value    string
+	literal  bool
+	datatype string // Of literals, empty if none
+}
+
+// rdfGraph maps subjects and predicates to objects.
+type rdfGraph map[string]map[string][]rdfTerm
+
+func (g rdfGraph) add(s, p string, o rdfTerm) {
+	if g[s] == nil {
+		g[s] = make(map[string][]rdfTerm)
+	}
+	g[s][p] = append(g[s][p], o)
+}
+
+// value returns the first object of subject s and predicate p.
+func (g rdfGraph) value(s, p string) (rdfTerm, bool) {
+	if os := g[s][p]; len(os) > 0 {
+		return os[0], true
+	}
+	return rdfTerm{}, false
+}
+
+// int returns the first object of s and p as an integer.
+func (g rdfGraph) int(s, p string) (int64, error) {
+	o, ok := g.value(s, p)
+	if !ok {
+		return 0, fmt.Errorf("%s has no %s", s, p)
+	}
+	v, err := strconv.ParseInt(o.value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s has invalid %s: %w", s, p, err)
+	}
+	return v, nil
+}
+
+func (g rdfGraph) hasType(s, typ string) bool {
+	for _, o := range g[s][rdfType] {
+		if o.value == typ {
+			return true
+		}
+	}
+	return false
+}
+
+type turtleToken struct {
+	kind  byte // '<' IRI, '"' literal, 'n' name or a punctuation character
+	value string
+}
+
+type turtleParser struct {
+	data     string
+	pos      int
+	tok      turtleToken
+	prefixes map[string]string
+	graph    rdfGraph
+	blanks   int
+}
+
+// parseTurtle parses a Turtle document into a graph.
+func parseTurtle(data string) (rdfGraph, error) {
+	p := &turtleParser{
+		data:     data,
+		prefixes: make(map[string]string),
+		graph:    make(rdfGraph),
+	}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	for p.tok.kind != 0 {
+		if err := p.statement(); err != nil {
+			line := 1 + strings.Count(data[:p.pos], "\n")
+			return nil, fmt.Errorf("turtle line %d: %w", line, err)
+		}
+	}
+	return p.graph, nil
+}
+
+// next reads the next token, kind 0 at the end of the input.
+func (p *turtleParser) next() error {
+	for p.pos < len(p.data) {
+		c := p.data[p.pos]
+		if c == '#' {
+			for p.pos < len(p.data) && p.data[p.pos] != '\n' {
+				p.pos++
+			}
+		} else if c == ' ' || c == '\t' || c == '\r' || c == '\n' {
+			p.pos++
+		} else {
+			break
+		}
+	}
+	if p.pos >= len(p.data) {
+		p.tok = turtleToken{}
+		return nil
+	}
+	switch c := p.data[p.pos]; c {
+	case '<':
+		end := strings.IndexByte(p.data[p.pos:], '>')
+		if end < 0 {
+			return fmt.Errorf("unterminated IRI")
+		}
+		p.tok = turtleToken{'<', p.data[p.pos+1 : p.pos+end]}
+		p.pos += end + 1
+	case '"', '\'':
+		s, err := p.string(c)
+		if err != nil {
+			return err
+		}
+		p.tok = turtleToken{'"', s}
+	case '.', ';', ',', '[', ']', '(', ')':
+		p.tok = turtleToken{c, ""}
+		p.pos++
+	case '^':
+		if !strings.HasPrefix(p.data[p.pos:], "^^") {
+			return fmt.Errorf("unexpected '^'")
+		}
+		p.tok = turtleToken{'^', ""}
+		p.pos += 2
+	default:
+		start := p.pos
+		for p.pos < len(p.data) &&
+			!strings.ContainsRune(" \t\r\n<>\"';,[]()#^", rune(p.data[p.pos])) {
+			p.pos++
+		}
+		// A trailing dot ends the statement
+		if p.pos-start > 1 && p.data[p.pos-1] == '.' {
+			p.pos--
+		}
+		p.tok = turtleToken{'n', p.data[start:p.pos]}
+	}
+	return nil
+}
+
+// string reads a short or long string literal quoted with q.
+func (p *turtleParser) string(q byte) (string, error) {
+	long := strings.Repeat(string(q), 3)
+	quote := string(q)
+	if strings.HasPrefix(p.data[p.pos:], long) {
+		quote = long
+	}
+	p.pos += len(quote)
+	var b strings.Builder
+	for {
+		if p.pos >= len(p.data) {
+			return "", fmt.Errorf("unterminated string")
+		}
+		if strings.HasPrefix(p.data[p.pos:], quote) {
+			p.pos += len(quote)
+			return b.String(), nil
+		}
+		c := p.data[p.pos]
+		if c != '\\' {
+			b.WriteByte(c)
+			p.pos++
+			continue
+		}
+		if p.pos+1 >= len(p.data) {
+			return "", fmt.Errorf("unterminated string")
+		}
+		e := p.data[p.pos+1]
+		p.pos += 2
+		switch e {
+		case 't':
+			b.WriteByte('\t')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'u', 'U':
+			n := 4
+			if e == 'U' {
+				n = 8
+			}
+			if p.pos+n > len(p.data) {
+				return "", fmt.Errorf("invalid escape")
+			}
+			r, err := strconv.ParseUint(p.data[p.pos:p.pos+n], 16, 32)
+			if err != nil || !utf8.ValidRune(rune(r)) {
+				return "", fmt.Errorf("invalid escape")
+			}
+			b.WriteRune(rune(r))
+			p.pos += n
+		default:
+			b.WriteByte(e)
+		}
+	}
+}
+
+func (p *turtleParser) expect(kind byte) error {
+	if p.tok.kind != kind {
+		return fmt.Errorf("expected '%c'", kind)
+	}
+	return p.next()
+}
+
+func (p *turtleParser) statement() error {
+	if p.tok.kind == 'n' {
+		switch strings.ToLower(p.tok.value) {
+		case "@prefix", "prefix":
+			sparql := p.tok.value[0] != '@'
+			if err := p.next(); err != nil {
+				return err
+			}
+			name := p.tok.value
+			if p.tok.kind != 'n' || !strings.HasSuffix(name, ":") {
+				return fmt.Errorf("expected prefix name")
+			}
+			if err := p.next(); err != nil {
+				return err
+			}
+			if p.tok.kind != '<' {
+				return fmt.Errorf("expected IRI")
+			}
+			p.prefixes[strings.TrimSuffix(name, ":")] = p.tok.value
+			if err := p.next(); err != nil {
+				return err
+			}
+			if sparql {
+				return nil
+			}
+			return p.expect('.')
+		case "@base", "base":
+			return fmt.Errorf("relative IRIs are not supported")
+		}
+	}
+	var subject string
+	if p.tok.kind == '[' {
+		var err error
+		if subject, err = p.blankNode(); err != nil {
+			return err
+		}
+		if p.tok.kind == '.' {
+			return p.next()
+		}
+	} else {
+		o, err := p.term()
+		if err != nil {
+			return err
+		}
+		if o.literal {
+			return fmt.Errorf("literal as subject")
+		}
+		subject = o.value
+	}
+	if err := p.predicateObjects(subject); err != nil {
+		return err
+	}
+	return p.expect('.')
+}
+
+func (p *turtleParser) predicateObjects(subject string) error {
+	for {
+		verb, err := p.term()
+		if err != nil {
+			return err
+		}
+		if verb.literal {
+			return fmt.Errorf("literal as predicate")
+		}
+		for {
+			var o rdfTerm
+			if p.tok.kind == '[' {
+				o.value, err = p.blankNode()
+			} else {
+				o, err = p.term()
+			}
+			if err != nil {
+				return err
+			}
+			p.graph.add(subject, verb.value, o)
+			if p.tok.kind != ',' {
+				break
+			}
+			if err := p.next(); err != nil {
+				return err
+			}
+		}
+		// Any number of semicolons may follow, the last one optionally
+		// ending the list
+		if p.tok.kind != ';' {
+			return nil
+		}
+		for p.tok.kind == ';' {
+			if err := p.next(); err != nil {
+				return err
+			}
+		}
+		if p.tok.kind == '.' || p.tok.kind == ']' {
+			return nil
+		}
+	}
+}
+
+// blankNode reads a blank node property list and returns its name.
+func (p *turtleParser) blankNode() (string, error) {
+	p.blanks++
+	name := fmt.Sprintf("_:b%d", p.blanks)
+	if err := p.expect('['); err != nil {
+		return "", err
+	}
+	if p.tok.kind != ']' {
+		if err := p.predicateObjects(name); err != nil {
+			return "", err
+		}
+	}
+	return name, p.expect(']')
+}
+
+// term reads an IRI, prefixed name, blank node label or literal.
+func (p *turtleParser) term() (rdfTerm, error) {
+	tok := p.tok
+	if err := p.next(); err != nil {
+		return rdfTerm{}, err
+	}
+	switch tok.kind {
+	case '<':
+		return rdfTerm{value: tok.value}, nil
+	case '"':
+		t := rdfTerm{value: tok.value, literal: true}
+		switch {
+		case p.tok.kind == '^':
+			if err := p.next(); err != nil {
+				return rdfTerm{}, err
+			}
+			dt, err := p.term()
+			if err != nil {
+				return rdfTerm{}, err
+			}
+			t.datatype = dt.value
+		case p.tok.kind == 'n' && strings.HasPrefix(p.tok.value, "@"):
+			// Language tags are dropped
+			if err := p.next(); err != nil {
+				return rdfTerm{}, err
+			}
+		}
+		return t, nil
+	case 'n':
+		v := tok.value
+		switch {
+		case v == "a":
+			return rdfTerm{value: rdfType}, nil
+		case v == "true" || v == "false":
+			return rdfTerm{v, true, xsdNS + "boolean"}, nil
+		case v[0] == '-' || v[0] == '+' || v[0] >= '0' && v[0] <= '9':
+			return rdfTerm{v, true, xsdNS + "integer"}, nil
+		case strings.HasPrefix(v, "_:"):
+			return rdfTerm{value: v}, nil
+		}
+		prefix, local, ok := strings.Cut(v, ":")
+		ns, known := p.prefixes[prefix]
+		if !ok || !known {
+			return rdfTerm{}, fmt.Errorf("unknown prefix in %s", v)
+		}
+		return rdfTerm{value: ns + local}, nil
+	case 0:
+		return rdfTerm{}, fmt.Errorf("unexpected end of input")
+	}
+	return rdfTerm{}, fmt.Errorf("unexpected '%c'", tok.kind)
+}
@@ -0,0 +1,89 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Verification of the digests stored in evidence files
+
+package diskimage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"hash"
+	"io"
+)
+
+// Digest is a hash of the virtual disk, stored in an evidence file when it
+// was acquired.
+type Digest struct {
+	Algorithm string // md5, sha1, sha256 or sha512
+	Sum       []byte
+}
+
+// Digester is implemented by images that store digests of their virtual
+// disk.
+type Digester interface {
+	Digests() []Digest
+}
+
+var newHash = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+var digestSize = map[string]int{
+	"md5":    md5.Size,
+	"sha1":   sha1.Size,
+	"sha256": sha256.Size,
+	"sha512": sha512.Size,
+}
+
+// setDigest adds d to ds, replacing a digest with the same algorithm.
+func setDigest(ds []Digest, d Digest) []Digest {
+	for i := range ds {
+		if ds[i].Algorithm == d.Algorithm {
+			ds[i] = d
+			return ds
+		}
+	}
+	return append(ds, d)
+}
+
+// Verification is the result of checking a stored digest.
+type Verification struct {
+	Digest
+	Computed []byte
+}
+
+// OK reports whether the computed digest matches the stored one.
+func (v Verification) OK() bool { return bytes.Equal(v.Sum, v.Computed) }
+
+// Verify reads the whole virtual disk of img and checks it against the
+// digests stored in the image. It returns nil if there are none.
+func Verify(img Image) ([]Verification, error) {
+	d, ok := img.(Digester)
+	if !ok || len(d.Digests()) == 0 {
+		return nil, nil
+	}
+	var hs []hash.Hash
+	var ws []io.Writer
+	for _, digest := range d.Digests() {
+		h := newHash[digest.Algorithm]()
+		hs = append(hs, h)
+		ws = append(ws, h)
+	}
+	r := io.NewSectionReader(img, 0, img.Size())
+	if _, err := io.CopyBuffer(io.MultiWriter(ws...), r,
+		make([]byte, 1<<20)); err != nil {
+		return nil, err
+	}
+	var vs []Verification
+	for i, digest := range d.Digests() {
+		vs = append(vs, Verification{digest, hs[i].Sum(nil)})
+	}
+	return vs, nil
+}
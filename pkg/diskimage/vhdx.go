@@ -0,0 +1,211 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Hyper-V virtual hard disks, version 2 (VHDX)
+
+package diskimage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+
+	"blichmann.eu/code/btrfscue/pkg/uuid"
+)
+
+const vhdxFileMagic = "vhdxfile"
+
+// Locations and sizes of the structures in the VHDX header section
+const (
+	vhdxHeader1      = 64 << 10
+	vhdxHeader2      = 128 << 10
+	vhdxHeaderSize   = 4 << 10
+	vhdxRegionTable1 = 192 << 10
+	vhdxRegionTable2 = 256 << 10
+	vhdxRegionSize   = 64 << 10
+)
+
+// Region and metadata item GUIDs
+const (
+	vhdxBATRegion      = "2dc27766-f623-4200-9d64-115e9bfd4a08"
+	vhdxMetadataRegion = "8b7ca206-4790-4b9a-b8fe-575f050f886e"
+
+	vhdxFileParameters    = "caa16737-fa36-4d43-b3b6-33f0aa44e76b"
+	vhdxVirtualDiskSize   = "2fa54224-cd1b-4876-b211-5dbed83bf4b8"
+	vhdxLogicalSectorSize = "8141bf1d-a96f-4709-ba47-f233a8faab5f"
+)
+
+// Payload block states in the BAT
+const (
+	vhdxBlockNotPresent   = 0
+	vhdxBlockUndefined    = 1
+	vhdxBlockZero         = 2
+	vhdxBlockUnmapped     = 3
+	vhdxBlockFullyPresent = 6
+)
+
+// File parameters flag of differencing disks
+const vhdxHasParent = 1 << 1
+
+// Largest virtual disk size the format allows
+const vhdxMaxDiskSize = 64 << 40
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+type vhdxImage struct {
+	f          *os.File
+	size       int64
+	blockSize  int64
+	chunkRatio int64
+	bat        []uint64
+}
+
+// vhdxChecksumValid verifies the CRC-32C of a header or region table, which
+// is computed with its checksum field set to zero.
+func vhdxChecksumValid(b []byte) bool {
+	check := append([]byte(nil), b...)
+	binary.LittleEndian.PutUint32(check[4:], 0)
+	return crc32.Checksum(check, castagnoli) ==
+		binary.LittleEndian.Uint32(b[4:])
+}
+
+// openVHDX opens a VHDX image. The log is not replayed, so an image that was
+// not closed cleanly is read as of its last flushed metadata. Differencing
+// disks are not supported.
+func openVHDX(f *os.File) (Image, error) {
+	le := binary.LittleEndian
+
+	// The log that the headers point to is not replayed, so either valid
+	// header will do
+	valid := false
+	for _, off := range []int64{vhdxHeader1, vhdxHeader2} {
+		hdr := make([]byte, vhdxHeaderSize)
+		if readFullAt(f, hdr, off) == nil && string(hdr[:4]) == "head" &&
+			vhdxChecksumValid(hdr) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return nil, fmt.Errorf("no valid VHDX header")
+	}
+
+	var batOffset, metaOffset int64
+	var batLength, metaLength uint32
+	found := false
+	for _, off := range []int64{vhdxRegionTable1, vhdxRegionTable2} {
+		rt := make([]byte, vhdxRegionSize)
+		if err := readFullAt(f, rt, off); err != nil {
+			continue
+		}
+		if string(rt[:4]) != "regi" || !vhdxChecksumValid(rt) {
+			continue
+		}
+		count := int(le.Uint32(rt[8:]))
+		if count > (vhdxRegionSize-16)/32 {
+			continue
+		}
+		for i := 0; i < count; i++ {
+			e := rt[16+i*32:]
+			switch uuid.FromMixedEndian(e[:16]).String() {
+			case vhdxBATRegion:
+				batOffset, batLength = int64(le.Uint64(e[16:])),
+					le.Uint32(e[24:])
+			case vhdxMetadataRegion:
+				metaOffset, metaLength = int64(le.Uint64(e[16:])),
+					le.Uint32(e[24:])
+			}
+		}
+		found = true
+		break
+	}
+	if !found || batLength == 0 || metaLength < 32 {
+		return nil, fmt.Errorf("no valid VHDX region table")
+	}
+
+	meta := make([]byte, metaLength)
+	if err := readFullAt(f, meta, metaOffset); err != nil {
+		return nil, fmt.Errorf("cannot read VHDX metadata: %w", err)
+	}
+	if string(meta[:8]) != "metadata" {
+		return nil, fmt.Errorf("invalid VHDX metadata table")
+	}
+	item := func(id string, size int) []byte {
+		count := int(le.Uint16(meta[10:]))
+		for i := 0; i < count && 32+(i+1)*32 <= len(meta); i++ {
+			e := meta[32+i*32:]
+			itemID := uuid.FromMixedEndian(e[:16]).String()
+			off, length := int(le.Uint32(e[16:])), int(le.Uint32(e[20:]))
+			if itemID == id && length >= size && off+size <= len(meta) {
+				return meta[off : off+size]
+			}
+		}
+		return nil
+	}
+	params := item(vhdxFileParameters, 8)
+	diskSize := item(vhdxVirtualDiskSize, 8)
+	logicalSector := item(vhdxLogicalSectorSize, 4)
+	if params == nil || diskSize == nil || logicalSector == nil {
+		return nil, fmt.Errorf("missing VHDX metadata items")
+	}
+	if le.Uint32(params[4:])&vhdxHasParent != 0 {
+		return nil, fmt.Errorf("differencing VHDX images are not supported")
+	}
+	img := &vhdxImage{
+		f:         f,
+		size:      int64(le.Uint64(diskSize)),
+		blockSize: int64(le.Uint32(params)),
+	}
+	if img.size <= 0 || img.size > vhdxMaxDiskSize {
+		return nil, fmt.Errorf("invalid VHDX virtual disk size %d",
+			img.size)
+	}
+	ss := int64(le.Uint32(logicalSector))
+	if img.blockSize < 1<<20 || img.blockSize > 256<<20 ||
+		img.blockSize&(img.blockSize-1) != 0 || (ss != 512 && ss != 4096) {
+		return nil, fmt.Errorf("invalid VHDX block size %d or sector size "+
+			"%d", img.blockSize, ss)
+	}
+	// Each chunk of payload blocks is followed by a sector bitmap entry
+	img.chunkRatio = (1 << 23) * ss / img.blockSize
+	numBlocks := (img.size + img.blockSize - 1) / img.blockSize
+	numEntries := numBlocks + (numBlocks-1)/img.chunkRatio
+	if int64(batLength) < numEntries*8 {
+		return nil, fmt.Errorf("VHDX BAT too small")
+	}
+	bat := make([]byte, numEntries*8)
+	if err := readFullAt(f, bat, batOffset); err != nil {
+		return nil, fmt.Errorf("cannot read VHDX BAT: %w", err)
+	}
+	img.bat = make([]uint64, numEntries)
+	for i := range img.bat {
+		img.bat[i] = le.Uint64(bat[i*8:])
+	}
+	return img, nil
+}
+
+func (img *vhdxImage) Size() int64    { return img.size }
+func (img *vhdxImage) Format() string { return FormatVHDX }
+func (img *vhdxImage) Close() error   { return img.f.Close() }
+
+func (img *vhdxImage) ReadAt(p []byte, off int64) (int, error) {
+	return readVirtual(p, off, img.size, img.blockSize, img.readBlock)
+}
+
+// readBlock reads p, which lies within a single payload block, at off.
+func (img *vhdxImage) readBlock(p []byte, off int64) error {
+	block := off / img.blockSize
+	entry := img.bat[block+block/img.chunkRatio]
+	switch entry & 7 {
+	case vhdxBlockFullyPresent:
+		fileOffset := int64(entry>>20) << 20
+		return readFullAt(img.f, p, fileOffset+off%img.blockSize)
+	case vhdxBlockNotPresent, vhdxBlockUndefined, vhdxBlockZero,
+		vhdxBlockUnmapped:
+		clear(p)
+		return nil
+	}
+	return fmt.Errorf("VHDX block at %d has unsupported state %d",
+		off-off%img.blockSize, entry&7)
+}
@@ -0,0 +1,408 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// VMware virtual disks: descriptor files with flat and sparse extents, and
+// monolithic sparse and stream-optimized images
+
+package diskimage
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const vmdkSparseMagic = "KDMV"
+
+// Sparse extent header flag for compressed grains
+const vmdkCompressed = 1 << 16
+
+// Grain directory offset of stream-optimized images, the actual one is in
+// the footer at the end of the file
+const vmdkGDAtEnd = ^uint64(0)
+
+const sectorSize = 512
+
+// vmdkExtent is an extent of a VMDK, a range of the virtual disk stored in
+// a flat or sparse file or not at all.
+type vmdkExtent struct {
+	start, size int64 // On the virtual disk
+	flat        *os.File
+	offset      int64 // Of the extent data in flat
+	sparse      *vmdkSparse
+}
+
+// vmdkSparse is a hosted sparse extent file.
+type vmdkSparse struct {
+	f          *os.File
+	grainSize  int64 // In bytes
+	gtEntries  int64 // Number of entries per grain table
+	gd         []uint32
+	compressed bool
+
+	mu        sync.Mutex
+	gtCache   map[uint32][]uint32
+	lastGrain int64 // Sector of the last decompressed grain
+	lastData  []byte
+}
+
+type vmdkImage struct {
+	extents []vmdkExtent
+	size    int64
+	files   []*os.File
+	parent  Image
+}
+
+func openVMDK(f *os.File, path string, depth int) (Image, error) {
+	img := &vmdkImage{}
+	var desc []byte
+	hdr := make([]byte, 4)
+	if err := readFullAt(f, hdr, 0); err != nil {
+		return nil, err
+	}
+	if string(hdr) == vmdkSparseMagic {
+		// Monolithic sparse image, possibly with an embedded descriptor
+		s, capacity, embedded, err := openVMDKSparse(f)
+		if err != nil {
+			return nil, err
+		}
+		desc = embedded
+		img.files = append(img.files, f)
+		img.extents = []vmdkExtent{{size: capacity, sparse: s}}
+		img.size = capacity
+	} else {
+		var err error
+		desc, err = io.ReadAll(io.NewSectionReader(f, 0, 1<<20))
+		if err != nil {
+			return nil, err
+		}
+		f.Close()
+	}
+	parent, err := img.parseDescriptor(desc, path, len(img.extents) == 0)
+	if err != nil {
+		img.Close()
+		return nil, err
+	}
+	if parent != "" {
+		if img.parent, err = open(parent, depth+1); err != nil {
+			img.Close()
+			return nil, fmt.Errorf("parent: %w", err)
+		}
+	}
+	return img, nil
+}
+
+var vmdkExtentLine = regexp.MustCompile(
+	`^(RW|RDONLY|NOACCESS)\s+(\d+)\s+(\w+)(?:\s+"([^"]*)"(?:\s+(\d+))?)?`)
+
+// parseDescriptor parses a descriptor. If withExtents is set, its extents
+// are opened relative to the directory of path. Returns the path of the
+// parent disk, if any.
+func (img *vmdkImage) parseDescriptor(desc []byte, path string,
+	withExtents bool) (string, error) {
+	var parent string
+	sc := bufio.NewScanner(bytes.NewReader(bytes.TrimRight(desc, "\x00")))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		m := vmdkExtentLine.FindStringSubmatch(line)
+		if m == nil {
+			k, v, _ := strings.Cut(line, "=")
+			v = strings.Trim(strings.TrimSpace(v), `"`)
+			if strings.TrimSpace(k) == "parentFileNameHint" && v != "" {
+				parent = v
+				if !filepath.IsAbs(parent) {
+					parent = filepath.Join(filepath.Dir(path), parent)
+				}
+			}
+			continue
+		}
+		if !withExtents {
+			continue
+		}
+		sectors, _ := strconv.ParseInt(m[2], 10, 64)
+		e := vmdkExtent{start: img.size, size: sectors * sectorSize}
+		switch m[3] {
+		case "ZERO":
+		case "FLAT", "VMFS", "SPARSE":
+			name := m[4]
+			if !filepath.IsAbs(name) {
+				name = filepath.Join(filepath.Dir(path), name)
+			}
+			f, err := os.Open(name)
+			if err != nil {
+				return "", err
+			}
+			img.files = append(img.files, f)
+			if m[3] == "SPARSE" {
+				if e.sparse, _, _, err = openVMDKSparse(f); err != nil {
+					return "", fmt.Errorf("%s: %w", name, err)
+				}
+			} else {
+				e.flat = f
+				offset, _ := strconv.ParseInt(m[5], 10, 64)
+				e.offset = offset * sectorSize
+			}
+		default:
+			return "", fmt.Errorf("unsupported VMDK extent type %s", m[3])
+		}
+		img.extents = append(img.extents, e)
+		img.size += e.size
+	}
+	if len(img.extents) == 0 {
+		return "", fmt.Errorf("no extents in VMDK descriptor")
+	}
+	return parent, sc.Err()
+}
+
+// openVMDKSparse reads the header and grain directory of a sparse extent.
+// It returns the extent, its capacity and the embedded descriptor, if any.
+func openVMDKSparse(f *os.File) (*vmdkSparse, int64, []byte, error) {
+	le := binary.LittleEndian
+	hdr := make([]byte, sectorSize)
+	if err := readFullAt(f, hdr, 0); err != nil {
+		return nil, 0, nil, err
+	}
+	if string(hdr[:4]) != vmdkSparseMagic {
+		return nil, 0, nil, fmt.Errorf("not a sparse VMDK extent")
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	// Limit for offsets and sizes in sectors, the grain directory and the
+	// descriptor need to be stored in the file
+	fileSectors := uint64(fi.Size() / sectorSize)
+	gdOffset := le.Uint64(hdr[56:])
+	if gdOffset == vmdkGDAtEnd {
+		// Stream-optimized, the footer is in the second to last sector,
+		// followed by the end-of-stream marker
+		if err := readFullAt(f, hdr, fi.Size()-2*sectorSize); err != nil {
+			return nil, 0, nil, fmt.Errorf("cannot read footer: %w", err)
+		}
+		if string(hdr[:4]) != vmdkSparseMagic {
+			return nil, 0, nil, fmt.Errorf("invalid footer")
+		}
+		gdOffset = le.Uint64(hdr[56:])
+	}
+	flags := le.Uint32(hdr[8:])
+	capSectors, grainSectors := le.Uint64(hdr[12:]), le.Uint64(hdr[20:])
+	if capSectors > math.MaxInt64/sectorSize {
+		return nil, 0, nil, fmt.Errorf("invalid capacity of %d sectors",
+			capSectors)
+	}
+	if grainSectors > 1<<30/sectorSize {
+		return nil, 0, nil, fmt.Errorf("invalid grain size of %d sectors",
+			grainSectors)
+	}
+	capacity := int64(capSectors) * sectorSize
+	s := &vmdkSparse{
+		f:          f,
+		grainSize:  int64(grainSectors) * sectorSize,
+		gtEntries:  int64(le.Uint32(hdr[44:])),
+		compressed: flags&vmdkCompressed != 0,
+		gtCache:    make(map[uint32][]uint32),
+		lastGrain:  -1,
+	}
+	if s.grainSize < sectorSize || s.grainSize > 1<<30 ||
+		s.grainSize&(s.grainSize-1) != 0 {
+		return nil, 0, nil, fmt.Errorf("invalid grain size %d", s.grainSize)
+	}
+	if s.gtEntries <= 0 || s.gtEntries > 1<<20 {
+		return nil, 0, nil, fmt.Errorf("invalid grain table size %d",
+			s.gtEntries)
+	}
+	gtCoverage := s.grainSize * s.gtEntries
+	gdSize := 4 * (capacity / gtCoverage)
+	if capacity%gtCoverage != 0 {
+		gdSize += 4
+	}
+	if gdOffset > fileSectors || gdSize > fi.Size() {
+		return nil, 0, nil, fmt.Errorf("grain directory of %d bytes at "+
+			"sector %d is outside of the file", gdSize, gdOffset)
+	}
+	gd := make([]byte, gdSize)
+	if err := readFullAt(f, gd, int64(gdOffset)*sectorSize); err != nil {
+		return nil, 0, nil, fmt.Errorf("cannot read grain directory: %w",
+			err)
+	}
+	s.gd = make([]uint32, len(gd)/4)
+	for i := range s.gd {
+		s.gd[i] = le.Uint32(gd[i*4:])
+	}
+
+	var desc []byte
+	if descOffset := le.Uint64(hdr[28:]); descOffset != 0 {
+		descSectors := le.Uint64(hdr[36:])
+		if descOffset > fileSectors || descSectors > fileSectors {
+			return nil, 0, nil, fmt.Errorf("descriptor of %d sectors at "+
+				"sector %d is outside of the file", descSectors, descOffset)
+		}
+		desc = make([]byte, descSectors*sectorSize)
+		if err := readFullAt(f, desc, int64(descOffset)*
+			sectorSize); err != nil {
+			return nil, 0, nil, fmt.Errorf("cannot read descriptor: %w", err)
+		}
+	}
+	return s, capacity, desc, nil
+}
+
+func (img *vmdkImage) Size() int64    { return img.size }
+func (img *vmdkImage) Format() string { return FormatVMDK }
+
+func (img *vmdkImage) Close() error {
+	var err error
+	for _, f := range img.files {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if img.parent != nil {
+		img.parent.Close()
+	}
+	return err
+}
+
+func (img *vmdkImage) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	if off >= img.size {
+		return 0, io.EOF
+	}
+	var eof error
+	if off+int64(len(p)) > img.size {
+		p, eof = p[:img.size-off], io.EOF
+	}
+	read := 0
+	for read < len(p) {
+		pos := off + int64(read)
+		i := sort.Search(len(img.extents), func(i int) bool {
+			return img.extents[i].start+img.extents[i].size > pos
+		})
+		e := &img.extents[i]
+		n := min(int64(len(p)-read), e.start+e.size-pos)
+		if err := img.readExtent(e, p[read:read+int(n)], pos); err != nil {
+			return read, err
+		}
+		read += int(n)
+	}
+	return read, eof
+}
+
+// readExtent reads p at the virtual offset off from an extent.
+func (img *vmdkImage) readExtent(e *vmdkExtent, p []byte, off int64) error {
+	switch {
+	case e.flat != nil:
+		return readFullAt(e.flat, p, e.offset+off-e.start)
+	case e.sparse != nil:
+		_, err := readVirtual(p, off-e.start, e.size, e.sparse.grainSize,
+			func(p []byte, off int64) error {
+				return img.readGrain(e, p, off)
+			})
+		return err
+	}
+	clear(p)
+	return nil
+}
+
+// readGrain reads p, which lies within a single grain, at the offset off
+// into a sparse extent.
+func (img *vmdkImage) readGrain(e *vmdkExtent, p []byte, off int64) error {
+	s := e.sparse
+	grain := off / s.grainSize
+	gdIndex := grain / s.gtEntries
+	if gdIndex >= int64(len(s.gd)) || s.gd[gdIndex] == 0 {
+		return readBacking(img.parent, p, e.start+off)
+	}
+	gt, err := s.grainTable(s.gd[gdIndex])
+	if err != nil {
+		return err
+	}
+	sector := gt[grain%s.gtEntries]
+	inGrain := off % s.grainSize
+	switch sector {
+	case 0:
+		return readBacking(img.parent, p, e.start+off)
+	case 1:
+		clear(p) // Zeroed grain
+		return nil
+	}
+	if !s.compressed {
+		return readFullAt(s.f, p, int64(sector)*sectorSize+inGrain)
+	}
+	data, err := s.decompress(int64(sector))
+	if err != nil {
+		return fmt.Errorf("grain at %d: %w", e.start+off-inGrain, err)
+	}
+	copy(p, data[inGrain:])
+	return nil
+}
+
+// grainTable returns the grain table at the given sector.
+func (s *vmdkSparse) grainTable(sector uint32) ([]uint32, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if gt, ok := s.gtCache[sector]; ok {
+		return gt, nil
+	}
+	buf := make([]byte, 4*s.gtEntries)
+	if err := readFullAt(s.f, buf, int64(sector)*sectorSize); err != nil {
+		return nil, fmt.Errorf("cannot read grain table: %w", err)
+	}
+	gt := make([]uint32, s.gtEntries)
+	for i := range gt {
+		gt[i] = binary.LittleEndian.Uint32(buf[i*4:])
+	}
+	if len(s.gtCache) >= 256 {
+		for k := range s.gtCache {
+			delete(s.gtCache, k) // Evict an arbitrary table
+			break
+		}
+	}
+	s.gtCache[sector] = gt
+	return gt, nil
+}
+
+// decompress returns the data of the compressed grain at the given sector.
+// It is preceded by its virtual sector number and compressed size.
+func (s *vmdkSparse) decompress(sector int64) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lastGrain == sector {
+		return s.lastData, nil
+	}
+	marker := make([]byte, 12)
+	if err := readFullAt(s.f, marker, sector*sectorSize); err != nil {
+		return nil, err
+	}
+	size := int64(binary.LittleEndian.Uint32(marker[8:]))
+	if size > 2*s.grainSize+sectorSize {
+		return nil, fmt.Errorf("invalid compressed size %d", size)
+	}
+	compressed := make([]byte, size)
+	if err := readFullAt(s.f, compressed, sector*sectorSize+12); err != nil {
+		return nil, err
+	}
+	r, err := zlib.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, s.grainSize)
+	if n, err := io.ReadFull(r, data); err != nil &&
+		err != io.ErrUnexpectedEOF || n == 0 {
+		return nil, fmt.Errorf("cannot decompress: %v", err)
+	}
+	s.lastGrain, s.lastData = sector, data
+	return data, nil
+}
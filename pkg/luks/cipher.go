@@ -0,0 +1,71 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Sector ciphers, as named by dm-crypt
+
+package luks
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+
+	"golang.org/x/crypto/xts"
+)
+
+// sectorCipher decrypts sectors, each with an IV derived from its number.
+type sectorCipher interface {
+	decrypt(dst, src []byte, sector uint64)
+}
+
+func newSectorCipher(spec string, key []byte) (sectorCipher, error) {
+	switch spec {
+	case "aes-xts-plain64", "aes-xts-plain":
+		c, err := xts.NewCipher(aes.NewCipher, key)
+		if err != nil {
+			return nil, err
+		}
+		return &xtsCipher{c, spec == "aes-xts-plain"}, nil
+	case "aes-cbc-essiv:sha256":
+		c, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		salt := sha256.Sum256(key)
+		essiv, err := aes.NewCipher(salt[:])
+		if err != nil {
+			return nil, err
+		}
+		return &essivCipher{c, essiv}, nil
+	}
+	return nil, fmt.Errorf("unsupported cipher %s", spec)
+}
+
+// xtsCipher is AES-XTS with the sector number as the tweak. The plain IV
+// only uses its low 32 bits.
+type xtsCipher struct {
+	c     *xts.Cipher
+	plain bool
+}
+
+func (x *xtsCipher) decrypt(dst, src []byte, sector uint64) {
+	if x.plain {
+		sector &= 0xffffffff
+	}
+	x.c.Decrypt(dst, src, sector)
+}
+
+// essivCipher is AES-CBC with the encrypted sector number as the IV, the
+// default of old LUKS1 volumes.
+type essivCipher struct {
+	c, essiv cipher.Block
+}
+
+func (e *essivCipher) decrypt(dst, src []byte, sector uint64) {
+	iv := make([]byte, aes.BlockSize)
+	binary.LittleEndian.PutUint64(iv, sector)
+	e.essiv.Encrypt(iv, iv)
+	cipher.NewCBCDecrypter(e.c, iv).CryptBlocks(dst, src)
+}
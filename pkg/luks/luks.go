@@ -0,0 +1,415 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Package luks reads LUKS1 and LUKS2 encrypted volumes. The volume key is
+// recovered from a key slot with a passphrase and the payload is decrypted
+// on the fly.
+package luks
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math/bits"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	magic          = "LUKS\xba\xbe"
+	secondaryMagic = "SKUL\xba\xbe" // Of the LUKS2 secondary header
+
+	// Unit of LUKS1 offsets, of IVs and of key slot encryption
+	sectorSize = 512
+
+	// Largest Argon2 memory cost cryptsetup accepts, in KiB
+	argon2MaxMemory = 4 << 20
+)
+
+var (
+	// ErrNotLUKS is returned when there is no LUKS header.
+	ErrNotLUKS = errors.New("no LUKS header")
+	// ErrWrongPassphrase is returned when no key slot can be unlocked.
+	ErrWrongPassphrase = errors.New("no key slot matches the passphrase")
+)
+
+// Header describes an encrypted volume.
+type Header struct {
+	Version int
+	UUID    string
+	Cipher  string // Of the payload, like aes-xts-plain64
+	KeySize int    // Of the volume key, in bytes
+
+	// Location of the payload in the volume. PayloadSize is -1 if the
+	// payload extends to the end of the volume.
+	PayloadOffset int64
+	PayloadSize   int64
+	// Encryption sector size and the IV offset of the payload, in 512 byte
+	// sectors
+	SectorSize int
+	IVOffset   uint64
+
+	slots []keySlot
+}
+
+// KeySlots returns the numbers of the active key slots.
+func (h *Header) KeySlots() []int {
+	var ns []int
+	for _, s := range h.slots {
+		ns = append(ns, s.number)
+	}
+	return ns
+}
+
+type kdf struct {
+	typ        string // pbkdf2, argon2i or argon2id
+	hash       string // PBKDF2 only
+	iterations int
+	memory     int // Argon2 only, in KiB
+	threads    int // Argon2 only
+	salt       []byte
+}
+
+// derive returns a key of the given size derived from the passphrase.
+func (k kdf) derive(passphrase []byte, size int) ([]byte, error) {
+	switch k.typ {
+	case "pbkdf2":
+		h, err := hashFunc(k.hash)
+		if err != nil {
+			return nil, err
+		}
+		return pbkdf2.Key(passphrase, k.salt, k.iterations, size, h), nil
+	case "argon2i", "argon2id":
+		if k.iterations <= 0 || k.memory <= 0 ||
+			k.memory > argon2MaxMemory || k.threads <= 0 || k.threads > 255 {
+			return nil, fmt.Errorf("invalid %s parameters", k.typ)
+		}
+		derive := argon2.IDKey
+		if k.typ == "argon2i" {
+			derive = argon2.Key
+		}
+		return derive(passphrase, k.salt, uint32(k.iterations),
+			uint32(k.memory), uint8(k.threads), uint32(size)), nil
+	}
+	return nil, fmt.Errorf("unsupported key derivation function %s", k.typ)
+}
+
+// digest verifies a candidate volume key.
+type digest struct {
+	hash       string
+	iterations int
+	salt       []byte
+	value      []byte
+}
+
+func (d *digest) matches(key []byte) (bool, error) {
+	h, err := hashFunc(d.hash)
+	if err != nil {
+		return false, err
+	}
+	v := pbkdf2.Key(key, d.salt, d.iterations, len(d.value), h)
+	return subtle.ConstantTimeCompare(v, d.value) == 1, nil
+}
+
+// keySlot holds the volume key, split into stripes with the anti-forensic
+// splitter and encrypted with a key derived from a passphrase.
+type keySlot struct {
+	number  int
+	kdf     kdf
+	stripes int
+	afHash  string
+	offset  int64 // Of the key material
+	cipher  string
+	keySize int // Of the key material cipher
+	digest  *digest
+}
+
+func hashFunc(name string) (func() hash.Hash, error) {
+	switch name {
+	case "sha1":
+		return sha1.New, nil
+	case "sha256":
+		return sha256.New, nil
+	case "sha384":
+		return sha512.New384, nil
+	case "sha512":
+		return sha512.New, nil
+	}
+	return nil, fmt.Errorf("unsupported hash %s", name)
+}
+
+// cstring returns the NUL-terminated string at the start of b.
+func cstring(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// ReadHeader reads the LUKS header at the start of r.
+func ReadHeader(r io.ReaderAt) (*Header, error) {
+	b := make([]byte, len(magic)+2)
+	if _, err := r.ReadAt(b, 0); err != nil {
+		if err == io.EOF {
+			return nil, ErrNotLUKS
+		}
+		return nil, err
+	}
+	if string(b[:len(magic)]) != magic {
+		// The primary LUKS2 header may be damaged
+		if h, err := readLUKS2(r); err == nil {
+			return h, nil
+		}
+		return nil, ErrNotLUKS
+	}
+	switch v := binary.BigEndian.Uint16(b[len(magic):]); v {
+	case 1:
+		return readLUKS1(r)
+	case 2:
+		return readLUKS2(r)
+	default:
+		return nil, fmt.Errorf("unsupported LUKS version %d", v)
+	}
+}
+
+// LUKS1 header layout
+const (
+	luks1HeaderSize   = 592
+	luks1NumKeySlots  = 8
+	luks1KeySlotSize  = 48
+	luks1KeySlotsAt   = 208
+	luks1SlotEnabled  = 0x00ac71f3
+	luks1DigestSize   = 20
+	luks1SaltSize     = 32
+	luks1MaxStripes   = 1 << 16
+	luks1MaxKeyLength = 512
+)
+
+func readLUKS1(r io.ReaderAt) (*Header, error) {
+	be := binary.BigEndian
+	b := make([]byte, luks1HeaderSize)
+	if n, err := r.ReadAt(b, 0); n < len(b) {
+		return nil, fmt.Errorf("short LUKS header: %w", err)
+	}
+	cipherMode := cstring(b[40:72])
+	h := &Header{
+		Version:       1,
+		UUID:          cstring(b[168:208]),
+		Cipher:        cstring(b[8:40]) + "-" + cipherMode,
+		KeySize:       int(be.Uint32(b[108:])),
+		PayloadOffset: int64(be.Uint32(b[104:])) * sectorSize,
+		PayloadSize:   -1,
+		SectorSize:    sectorSize,
+	}
+	if h.KeySize <= 0 || h.KeySize > luks1MaxKeyLength {
+		return nil, fmt.Errorf("invalid LUKS key size %d", h.KeySize)
+	}
+	hash := cstring(b[72:104])
+	d := &digest{
+		hash:       hash,
+		iterations: int(be.Uint32(b[164:])),
+		salt:       b[132 : 132+luks1SaltSize],
+		value:      b[112 : 112+luks1DigestSize],
+	}
+	for i := 0; i < luks1NumKeySlots; i++ {
+		k := b[luks1KeySlotsAt+i*luks1KeySlotSize:]
+		if be.Uint32(k) != luks1SlotEnabled {
+			continue
+		}
+		s := keySlot{
+			number: i,
+			kdf: kdf{
+				typ:        "pbkdf2",
+				hash:       hash,
+				iterations: int(be.Uint32(k[4:])),
+				salt:       k[8 : 8+luks1SaltSize],
+			},
+			offset:  int64(be.Uint32(k[40:])) * sectorSize,
+			stripes: int(be.Uint32(k[44:])),
+			afHash:  hash,
+			cipher:  h.Cipher,
+			keySize: h.KeySize,
+			digest:  d,
+		}
+		if s.stripes <= 0 || s.stripes > luks1MaxStripes {
+			return nil, fmt.Errorf("invalid number of stripes %d in key "+
+				"slot %d", s.stripes, i)
+		}
+		h.slots = append(h.slots, s)
+	}
+	return h, nil
+}
+
+// Unlock recovers the volume key from the first key slot that the
+// passphrase opens. It returns ErrWrongPassphrase if there is none, unless
+// none of the key slots could be tried at all. Then the error of the first
+// one is returned.
+func (h *Header) Unlock(r io.ReaderAt, passphrase []byte) ([]byte, error) {
+	var firstErr error
+	tried := false
+	for _, s := range h.slots {
+		key, err := s.unlock(r, passphrase, h.KeySize)
+		if err != nil {
+			// Try the other slots, this one may be damaged
+			if firstErr == nil {
+				firstErr = fmt.Errorf("key slot %d: %w", s.number, err)
+			}
+			continue
+		}
+		if key != nil {
+			return key, nil
+		}
+		tried = true
+	}
+	if !tried && firstErr != nil {
+		return nil, firstErr
+	}
+	return nil, ErrWrongPassphrase
+}
+
+// unlock returns the volume key of size bytes if the passphrase opens the
+// key slot and nil otherwise.
+func (s *keySlot) unlock(r io.ReaderAt, passphrase []byte, size int) ([]byte,
+	error) {
+	dk, err := s.kdf.derive(passphrase, s.keySize)
+	if err != nil {
+		return nil, err
+	}
+	c, err := newSectorCipher(s.cipher, dk)
+	if err != nil {
+		return nil, err
+	}
+	n := size * s.stripes
+	material := make([]byte, (n+sectorSize-1)/sectorSize*sectorSize)
+	if m, err := r.ReadAt(material, s.offset); m < len(material) {
+		return nil, fmt.Errorf("cannot read key material: %w", err)
+	}
+	for i := 0; i < len(material); i += sectorSize {
+		sector := material[i : i+sectorSize]
+		c.decrypt(sector, sector, uint64(i/sectorSize))
+	}
+	key, err := afMerge(material[:n], size, s.stripes, s.afHash)
+	if err != nil {
+		return nil, err
+	}
+	if ok, err := s.digest.matches(key); !ok {
+		return nil, err
+	}
+	return key, nil
+}
+
+// afMerge recovers a key of size bytes from the stripes of the
+// anti-forensic splitter.
+func afMerge(material []byte, size, stripes int, hashName string) ([]byte,
+	error) {
+	h, err := hashFunc(hashName)
+	if err != nil {
+		return nil, err
+	}
+	d := make([]byte, size)
+	for i := 0; i < stripes; i++ {
+		stripe := material[i*size : (i+1)*size]
+		for j := range d {
+			d[j] ^= stripe[j]
+		}
+		if i < stripes-1 {
+			diffuse(d, h)
+		}
+	}
+	return d, nil
+}
+
+// diffuse replaces each hash-sized block of d with the hash of its index
+// and contents, cut to the block's size.
+func diffuse(d []byte, newHash func() hash.Hash) {
+	size := newHash().Size()
+	for i := 0; i*size < len(d); i++ {
+		block := d[i*size : min((i+1)*size, len(d))]
+		h := newHash()
+		binary.Write(h, binary.BigEndian, uint32(i))
+		h.Write(block)
+		copy(block, h.Sum(nil))
+	}
+}
+
+// Reader reads the decrypted payload of a volume.
+type Reader struct {
+	r          io.ReaderAt
+	offset     int64 // Of the payload in r
+	size       int64
+	sectorSize int64
+	ivOffset   uint64
+	c          sectorCipher
+}
+
+// NewReader returns a reader for the payload of the volume r of the given
+// size, which is decrypted with the volume key.
+func NewReader(r io.ReaderAt, size int64, h *Header, key []byte) (*Reader,
+	error) {
+	c, err := newSectorCipher(h.Cipher, key)
+	if err != nil {
+		return nil, err
+	}
+	payload := h.PayloadSize
+	if payload < 0 {
+		payload = size - h.PayloadOffset
+	}
+	ss := int64(h.SectorSize)
+	payload = payload / ss * ss
+	if payload <= 0 || h.PayloadOffset+payload > size {
+		return nil, fmt.Errorf("LUKS payload at %d does not fit into the "+
+			"volume", h.PayloadOffset)
+	}
+	return &Reader{r, h.PayloadOffset, payload, ss, h.IVOffset, c}, nil
+}
+
+// Size returns the size of the payload in bytes.
+func (r *Reader) Size() int64 { return r.size }
+
+// ReadAt decrypts the sectors that p overlaps. If the underlying read fails,
+// the data of the sectors read in full is returned along with the error.
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	var eof error
+	if off+int64(len(p)) > r.size {
+		p, eof = p[:r.size-off], io.EOF
+	}
+	ss := r.sectorSize
+	start := off / ss * ss
+	end := (off + int64(len(p)) + ss - 1) / ss * ss
+	buf := make([]byte, end-start)
+	n, err := r.r.ReadAt(buf, r.offset+start)
+	if n == len(buf) {
+		err = nil
+	} else if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	n = n / int(ss) * int(ss)
+	// Like dm-crypt, count in 512 byte sectors, then scale to the
+	// encryption sector size
+	shift := bits.TrailingZeros64(uint64(ss / sectorSize))
+	for i := 0; i < n; i += int(ss) {
+		sector := buf[i : i+int(ss)]
+		iv := uint64(start+int64(i))/sectorSize + r.ivOffset
+		r.c.decrypt(sector, sector, iv>>shift)
+	}
+	read := max(0, min(n-int(off-start), len(p)))
+	copy(p, buf[off-start:int(off-start)+read])
+	if err != nil {
+		return read, err
+	}
+	return read, eof
+}
@@ -0,0 +1,241 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// LUKS2 headers: a binary header followed by JSON metadata, stored twice
+
+package luks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+)
+
+const (
+	luks2BinaryHeaderSize = 4096
+	luks2MaxHeaderSize    = 4 << 20
+	luks2MaxStripes       = 1 << 16
+)
+
+// Possible offsets of the secondary header, used if the primary one is
+// damaged
+var luks2SecondaryOffsets = []int64{0x4000, 0x8000, 0x10000, 0x20000,
+	0x40000, 0x80000, 0x100000, 0x200000, 0x400000}
+
+type luks2Metadata struct {
+	Keyslots map[string]struct {
+		Type    string `json:"type"`
+		KeySize int    `json:"key_size"`
+		AF      struct {
+			Type    string `json:"type"`
+			Stripes int    `json:"stripes"`
+			Hash    string `json:"hash"`
+		} `json:"af"`
+		Area struct {
+			Type       string `json:"type"`
+			Offset     string `json:"offset"`
+			Encryption string `json:"encryption"`
+			KeySize    int    `json:"key_size"`
+		} `json:"area"`
+		KDF struct {
+			Type       string `json:"type"`
+			Hash       string `json:"hash"`
+			Iterations int    `json:"iterations"`
+			Time       int    `json:"time"`
+			Memory     int    `json:"memory"`
+			CPUs       int    `json:"cpus"`
+			Salt       []byte `json:"salt"`
+		} `json:"kdf"`
+	} `json:"keyslots"`
+	Segments map[string]struct {
+		Type       string `json:"type"`
+		Offset     string `json:"offset"`
+		Size       string `json:"size"`
+		IVTweak    string `json:"iv_tweak"`
+		Encryption string `json:"encryption"`
+		SectorSize int    `json:"sector_size"`
+		Integrity  any    `json:"integrity"`
+	} `json:"segments"`
+	Digests map[string]struct {
+		Type       string   `json:"type"`
+		Keyslots   []string `json:"keyslots"`
+		Hash       string   `json:"hash"`
+		Iterations int      `json:"iterations"`
+		Salt       []byte   `json:"salt"`
+		Digest     []byte   `json:"digest"`
+	} `json:"digests"`
+}
+
+// readLUKS2Area returns the binary header and JSON area at off if they are
+// intact, along with the header's sequence number.
+func readLUKS2Area(r io.ReaderAt, off int64, magic string) ([]byte, uint64,
+	error) {
+	be := binary.BigEndian
+	bin := make([]byte, luks2BinaryHeaderSize)
+	if n, err := r.ReadAt(bin, off); n < len(bin) {
+		return nil, 0, fmt.Errorf("short LUKS2 header at %d: %w", off, err)
+	}
+	if string(bin[:len(magic)]) != magic || be.Uint16(bin[6:]) != 2 {
+		return nil, 0, ErrNotLUKS
+	}
+	size := be.Uint64(bin[8:])
+	if size < luks2BinaryHeaderSize || size > luks2MaxHeaderSize {
+		return nil, 0, fmt.Errorf("invalid LUKS2 header size %d", size)
+	}
+	hdr := make([]byte, size)
+	if n, err := r.ReadAt(hdr, off); n < len(hdr) {
+		return nil, 0, fmt.Errorf("short LUKS2 header at %d: %w", off, err)
+	}
+	h, err := hashFunc(cstring(hdr[72:104]))
+	if err != nil {
+		return nil, 0, err
+	}
+	// The checksum covers the whole area with the checksum field zeroed
+	csum := append([]byte(nil), hdr[448:448+h().Size()]...)
+	clear(hdr[448:512])
+	d := h()
+	d.Write(hdr)
+	if !bytes.Equal(d.Sum(nil), csum) {
+		return nil, 0, fmt.Errorf("LUKS2 header at %d has a bad checksum",
+			off)
+	}
+	return hdr, be.Uint64(hdr[16:]), nil
+}
+
+func readLUKS2(r io.ReaderAt) (*Header, error) {
+	// Use the intact header with the higher sequence number
+	var hdr []byte
+	var seqID uint64
+	primary, primarySeqID, err := readLUKS2Area(r, 0, magic)
+	if err == nil {
+		hdr, seqID = primary, primarySeqID
+	}
+	for _, off := range luks2SecondaryOffsets {
+		if primary != nil && off != int64(len(primary)) {
+			continue
+		}
+		secondary, id, serr := readLUKS2Area(r, off, secondaryMagic)
+		if serr == nil && (hdr == nil || id > seqID) {
+			hdr, seqID = secondary, id
+		}
+		if err == nil {
+			err = serr
+		}
+	}
+	if hdr == nil {
+		return nil, err
+	}
+
+	var meta luks2Metadata
+	js := hdr[luks2BinaryHeaderSize:]
+	if i := bytes.IndexByte(js, 0); i >= 0 {
+		js = js[:i]
+	}
+	if err := json.Unmarshal(js, &meta); err != nil {
+		return nil, fmt.Errorf("invalid LUKS2 metadata: %w", err)
+	}
+	h := &Header{Version: 2, UUID: cstring(hdr[168:208])}
+
+	if len(meta.Segments) != 1 {
+		return nil, fmt.Errorf("LUKS2 volumes with %d segments are not "+
+			"supported", len(meta.Segments))
+	}
+	for _, seg := range meta.Segments {
+		if seg.Type != "crypt" || seg.Integrity != nil {
+			return nil, fmt.Errorf("unsupported LUKS2 segment type %s",
+				seg.Type)
+		}
+		h.Cipher, h.SectorSize = seg.Encryption, seg.SectorSize
+		if h.PayloadOffset, err = strconv.ParseInt(seg.Offset, 10,
+			64); err != nil {
+			return nil, fmt.Errorf("invalid LUKS2 segment offset: %w", err)
+		}
+		h.PayloadSize = -1
+		if seg.Size != "dynamic" {
+			if h.PayloadSize, err = strconv.ParseInt(seg.Size, 10,
+				64); err != nil {
+				return nil, fmt.Errorf("invalid LUKS2 segment size: %w", err)
+			}
+		}
+		if seg.IVTweak != "" {
+			if h.IVOffset, err = strconv.ParseUint(seg.IVTweak, 10,
+				64); err != nil {
+				return nil, fmt.Errorf("invalid LUKS2 IV tweak: %w", err)
+			}
+		}
+	}
+	if h.SectorSize < sectorSize || h.SectorSize > 4096 ||
+		h.SectorSize&(h.SectorSize-1) != 0 {
+		return nil, fmt.Errorf("invalid LUKS2 sector size %d", h.SectorSize)
+	}
+	if h.IVOffset%uint64(h.SectorSize/sectorSize) != 0 {
+		return nil, fmt.Errorf("LUKS2 IV tweak %d is not aligned to the "+
+			"sector size", h.IVOffset)
+	}
+
+	digests := make(map[string]*digest)
+	for _, d := range meta.Digests {
+		if d.Type != "pbkdf2" {
+			continue
+		}
+		for _, n := range d.Keyslots {
+			digests[n] = &digest{d.Hash, d.Iterations, d.Salt, d.Digest}
+		}
+	}
+	for n, ks := range meta.Keyslots {
+		number, err := strconv.Atoi(n)
+		if err != nil {
+			return nil, fmt.Errorf("invalid LUKS2 key slot %s", n)
+		}
+		if ks.Type != "luks2" || ks.AF.Type != "luks1" ||
+			ks.Area.Type != "raw" || digests[n] == nil {
+			// Reencryption and other special slots do not hold the key
+			continue
+		}
+		if h.KeySize == 0 {
+			h.KeySize = ks.KeySize
+		}
+		s := keySlot{
+			number: number,
+			kdf: kdf{
+				typ:        ks.KDF.Type,
+				hash:       ks.KDF.Hash,
+				iterations: ks.KDF.Iterations,
+				memory:     ks.KDF.Memory,
+				threads:    ks.KDF.CPUs,
+				salt:       ks.KDF.Salt,
+			},
+			stripes: ks.AF.Stripes,
+			afHash:  ks.AF.Hash,
+			cipher:  ks.Area.Encryption,
+			keySize: ks.Area.KeySize,
+			digest:  digests[n],
+		}
+		if s.kdf.typ != "pbkdf2" {
+			s.kdf.iterations = ks.KDF.Time
+		}
+		if s.offset, err = strconv.ParseInt(ks.Area.Offset, 10,
+			64); err != nil {
+			return nil, fmt.Errorf("invalid offset of LUKS2 key slot %s: %w",
+				n, err)
+		}
+		if ks.KeySize != h.KeySize || ks.KeySize <= 0 ||
+			ks.KeySize > luks1MaxKeyLength || s.keySize <= 0 ||
+			s.keySize > luks1MaxKeyLength || s.stripes <= 0 ||
+			s.stripes > luks2MaxStripes {
+			return nil, fmt.Errorf("invalid LUKS2 key slot %s", n)
+		}
+		h.slots = append(h.slots, s)
+	}
+	sort.Slice(h.slots, func(i, j int) bool {
+		return h.slots[i].number < h.slots[j].number
+	})
+	if h.KeySize <= 0 {
+		return nil, fmt.Errorf("LUKS2 volume has no usable key slots")
+	}
+	return h, nil
+}
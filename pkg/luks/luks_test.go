@@ -0,0 +1,318 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Tests for reading LUKS volumes
+
+package luks
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/xts"
+)
+
+const testStripes = 4000
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
+
+// afSplit is the inverse of afMerge.
+func afSplit(key []byte, stripes int, h func() hash.Hash) []byte {
+	material := randomBytes(len(key) * stripes)
+	d := make([]byte, len(key))
+	for i := 0; i < stripes-1; i++ {
+		for j := range d {
+			d[j] ^= material[i*len(key)+j]
+		}
+		diffuse(d, h)
+	}
+	last := material[(stripes-1)*len(key):]
+	for j := range last {
+		last[j] = d[j] ^ key[j]
+	}
+	return material
+}
+
+// encryptSectors encrypts data in place with an IV of the sector number,
+// starting at first.
+func encryptSectors(t *testing.T, spec string, key, data []byte,
+	sectorSize int, first uint64) {
+	for i := 0; i < len(data); i += sectorSize {
+		sector := data[i : i+sectorSize]
+		num := first + uint64(i/sectorSize)
+		switch spec {
+		case "aes-xts-plain64":
+			c, _ := xts.NewCipher(aes.NewCipher, key)
+			c.Encrypt(sector, sector, num)
+		case "aes-cbc-essiv:sha256":
+			c, _ := aes.NewCipher(key)
+			salt := sha256.Sum256(key)
+			essiv, _ := aes.NewCipher(salt[:])
+			iv := make([]byte, aes.BlockSize)
+			binary.LittleEndian.PutUint64(iv, num)
+			essiv.Encrypt(iv, iv)
+			cipher.NewCBCEncrypter(c, iv).CryptBlocks(sector, sector)
+		default:
+			t.Fatalf("unsupported cipher %s", spec)
+		}
+	}
+}
+
+// checkPayload unlocks the volume and compares its payload with expected.
+func checkPayload(t *testing.T, vol []byte, passphrase string,
+	expected []byte) {
+	r := bytes.NewReader(vol)
+	h, err := ReadHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.Unlock(r, []byte("wrong")); err != ErrWrongPassphrase {
+		t.Errorf("expected wrong passphrase, got %v", err)
+	}
+	key, err := h.Unlock(r, []byte(passphrase))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr, err := NewReader(r, int64(len(vol)), h, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pr.Size() != int64(len(expected)) {
+		t.Fatalf("expected size %d, got %d", len(expected), pr.Size())
+	}
+	// Reads that start and end within sectors
+	buf := make([]byte, 1000)
+	for off := 0; off < len(expected); off += len(buf) {
+		n, err := pr.ReadAt(buf, int64(off))
+		if err != nil && !(err == io.EOF && off+n == len(expected)) {
+			t.Fatalf("read at %d: %v", off, err)
+		}
+		if !bytes.Equal(buf[:n], expected[off:off+n]) {
+			t.Fatalf("unexpected data at %d", off)
+		}
+	}
+}
+
+func TestLUKS1(t *testing.T) {
+	const (
+		passphrase     = "secret"
+		cipherSpec     = "aes-cbc-essiv:sha256"
+		keySize        = 32
+		materialSector = 8
+		payloadSector  = 512
+	)
+	be := binary.BigEndian
+	key := randomBytes(keySize)
+	vol := make([]byte, payloadSector*sectorSize+64<<10)
+	copy(vol, magic)
+	be.PutUint16(vol[6:], 1)
+	copy(vol[8:], "aes")
+	copy(vol[40:], "cbc-essiv:sha256")
+	copy(vol[72:], "sha1")
+	be.PutUint32(vol[104:], payloadSector)
+	be.PutUint32(vol[108:], keySize)
+	salt := randomBytes(luks1SaltSize)
+	copy(vol[112:], pbkdf2.Key(key, salt, 10, luks1DigestSize, sha1.New))
+	copy(vol[132:], salt)
+	be.PutUint32(vol[164:], 10)
+	copy(vol[168:], "0b4e5a4d-6a3c-4d43-9d3e-4c0d0f8a1b2c")
+
+	// The key material of slot 0 lies beyond the end of the volume, 1 holds
+	// the key
+	damaged := vol[luks1KeySlotsAt:]
+	be.PutUint32(damaged, luks1SlotEnabled)
+	be.PutUint32(damaged[4:], 100)
+	be.PutUint32(damaged[40:], uint32(len(vol)/sectorSize))
+	be.PutUint32(damaged[44:], testStripes)
+	slot := vol[luks1KeySlotsAt+luks1KeySlotSize:]
+	be.PutUint32(slot, luks1SlotEnabled)
+	be.PutUint32(slot[4:], 100)
+	salt = randomBytes(luks1SaltSize)
+	copy(slot[8:], salt)
+	be.PutUint32(slot[40:], materialSector)
+	be.PutUint32(slot[44:], testStripes)
+	material := afSplit(key, testStripes, sha1.New)
+	material = append(material, make([]byte,
+		-len(material)&(sectorSize-1))...)
+	encryptSectors(t, cipherSpec, pbkdf2.Key([]byte(passphrase), salt, 100,
+		keySize, sha1.New), material, sectorSize, 0)
+	copy(vol[materialSector*sectorSize:], material)
+
+	payload := vol[payloadSector*sectorSize:]
+	expected := randomBytes(len(payload))
+	copy(payload, expected)
+	encryptSectors(t, cipherSpec, key, payload, sectorSize, 0)
+
+	h, err := ReadHeader(bytes.NewReader(vol))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Version != 1 || h.Cipher != cipherSpec || h.KeySize != keySize ||
+		fmt.Sprint(h.KeySlots()) != "[0 1]" {
+		t.Errorf("unexpected header %+v", h)
+	}
+	checkPayload(t, vol, passphrase, expected)
+
+	// Only the damaged slot is left
+	be.PutUint32(slot, 0xdead)
+	r := bytes.NewReader(vol)
+	if h, err = ReadHeader(r); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = h.Unlock(r, []byte(passphrase)); err == nil ||
+		err == ErrWrongPassphrase {
+		t.Errorf("expected an error for the damaged key slot, got %v", err)
+	}
+}
+
+// makeLUKS2 returns a LUKS2 volume with an Argon2id key slot, 4 KiB sectors
+// and a payload of random data. If edit is not nil, it may change the JSON
+// metadata of the key slot.
+func makeLUKS2(t *testing.T, passphrase string,
+	edit func(keyslot map[string]any)) ([]byte, []byte) {
+	const (
+		hdrSize       = 16 << 10
+		cipherSpec    = "aes-xts-plain64"
+		keySize       = 64
+		areaOffset    = 32 << 10
+		payloadOffset = 512 << 10
+		ivTweak       = 56 // In 512 byte sectors
+	)
+	key := randomBytes(keySize)
+	vol := make([]byte, payloadOffset+64<<10)
+	kdfSalt := randomBytes(32)
+	digestSalt := randomBytes(32)
+	material := afSplit(key, testStripes, sha256.New)
+	encryptSectors(t, cipherSpec, argon2.IDKey([]byte(passphrase), kdfSalt,
+		1, 64, 1, keySize), material, sectorSize, 0)
+	copy(vol[areaOffset:], material)
+
+	payload := vol[payloadOffset:]
+	expected := randomBytes(len(payload))
+	copy(payload, expected)
+	encryptSectors(t, cipherSpec, key, payload, 4096, ivTweak/8)
+
+	keyslot := map[string]any{
+		"type":     "luks2",
+		"key_size": keySize,
+		"af": map[string]any{"type": "luks1", "stripes": testStripes,
+			"hash": "sha256"},
+		"area": map[string]any{"type": "raw", "offset": fmt.Sprint(
+			areaOffset), "size": "258048", "encryption": cipherSpec,
+			"key_size": keySize},
+		"kdf": map[string]any{"type": "argon2id", "time": 1,
+			"memory": 64, "cpus": 1, "salt": kdfSalt},
+	}
+	if edit != nil {
+		edit(keyslot)
+	}
+	js, err := json.Marshal(map[string]any{
+		"keyslots": map[string]any{"3": keyslot},
+		"segments": map[string]any{"0": map[string]any{
+			"type": "crypt", "offset": fmt.Sprint(payloadOffset),
+			"size": "dynamic", "iv_tweak": fmt.Sprint(ivTweak),
+			"encryption": cipherSpec, "sector_size": 4096,
+		}},
+		"digests": map[string]any{"0": map[string]any{
+			"type": "pbkdf2", "keyslots": []string{"3"},
+			"segments": []string{"0"}, "hash": "sha256", "iterations": 10,
+			"salt":   digestSalt,
+			"digest": pbkdf2.Key(key, digestSalt, 10, 32, sha256.New),
+		}},
+		"config": map[string]any{"json_size": "12288"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range []string{magic, secondaryMagic} {
+		hdr := vol[i*hdrSize : (i+1)*hdrSize]
+		copy(hdr, m)
+		binary.BigEndian.PutUint16(hdr[6:], 2)
+		binary.BigEndian.PutUint64(hdr[8:], hdrSize)
+		binary.BigEndian.PutUint64(hdr[16:], 5)
+		copy(hdr[72:], "sha256")
+		copy(hdr[168:], "4a1c2d9e-3f0b-4c5d-8e7f-6a5b4c3d2e1f")
+		binary.BigEndian.PutUint64(hdr[256:], uint64(i*hdrSize))
+		copy(hdr[luks2BinaryHeaderSize:], js)
+		sum := sha256.Sum256(hdr)
+		copy(hdr[448:], sum[:])
+	}
+	return vol, expected
+}
+
+func TestLUKS2(t *testing.T) {
+	vol, expected := makeLUKS2(t, "passphrase", nil)
+	h, err := ReadHeader(bytes.NewReader(vol))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Version != 2 || h.SectorSize != 4096 || h.KeySize != 64 ||
+		fmt.Sprint(h.KeySlots()) != "[3]" {
+		t.Errorf("unexpected header %+v", h)
+	}
+	checkPayload(t, vol, "passphrase", expected)
+
+	// The secondary header is used if the primary one is damaged
+	copy(vol, "damaged")
+	checkPayload(t, vol, "passphrase", expected)
+}
+
+func TestLUKS2InvalidKeySlot(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		edit func(keyslot map[string]any)
+	}{
+		{"key size", func(ks map[string]any) {
+			ks["key_size"] = 1 << 50
+		}},
+		{"area key size", func(ks map[string]any) {
+			ks["area"].(map[string]any)["key_size"] = -1
+		}},
+		{"large area key size", func(ks map[string]any) {
+			ks["area"].(map[string]any)["key_size"] = 1 << 50
+		}},
+	} {
+		vol, _ := makeLUKS2(t, "passphrase", tc.edit)
+		if _, err := ReadHeader(bytes.NewReader(vol)); err == nil {
+			t.Errorf("%s: expected an error", tc.name)
+		}
+	}
+
+	// Argon2 memory cost beyond what cryptsetup allows, 1 TiB
+	vol, _ := makeLUKS2(t, "passphrase", func(ks map[string]any) {
+		ks["kdf"].(map[string]any)["memory"] = 1 << 30
+	})
+	r := bytes.NewReader(vol)
+	h, err := ReadHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = h.Unlock(r, []byte("passphrase")); err == nil ||
+		err == ErrWrongPassphrase {
+		t.Errorf("expected an error for the memory cost, got %v", err)
+	}
+}
+
+func TestReadHeaderNotLUKS(t *testing.T) {
+	_, err := ReadHeader(bytes.NewReader(make([]byte, 1<<20)))
+	if !errors.Is(err, ErrNotLUKS) {
+		t.Errorf("expected ErrNotLUKS, got %v", err)
+	}
+}
@@ -0,0 +1,210 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Parser for the LVM2 text format of volume group metadata
+
+package lvm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// section is a named block of values and nested sections.
+type section struct {
+	name     string
+	values   map[string]any // string, int64 or []any
+	sections []*section
+}
+
+func (s *section) sub(name string) *section {
+	for _, c := range s.sections {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func (s *section) str(key string) (string, error) {
+	if v, ok := s.values[key].(string); ok {
+		return v, nil
+	}
+	return "", fmt.Errorf("%s: missing or invalid %s", s.name, key)
+}
+
+func (s *section) int(key string) (int64, error) {
+	if v, ok := s.values[key].(int64); ok {
+		return v, nil
+	}
+	return 0, fmt.Errorf("%s: missing or invalid %s", s.name, key)
+}
+
+func (s *section) list(key string) []any {
+	v, _ := s.values[key].([]any)
+	return v
+}
+
+// hasFlag reports whether the list key contains flag, like the status of
+// volumes.
+func (s *section) hasFlag(key, flag string) bool {
+	for _, v := range s.list(key) {
+		if v == flag {
+			return true
+		}
+	}
+	return false
+}
+
+type configParser struct {
+	data string
+	pos  int
+}
+
+// parseConfig parses metadata text into an unnamed top-level section.
+func parseConfig(data string) (*section, error) {
+	p := &configParser{data: data}
+	s, err := p.section("")
+	if err != nil {
+		line := 1 + strings.Count(data[:p.pos], "\n")
+		return nil, fmt.Errorf("metadata line %d: %w", line, err)
+	}
+	return s, nil
+}
+
+// skip skips white space and comments.
+func (p *configParser) skip() {
+	for p.pos < len(p.data) {
+		switch p.data[p.pos] {
+		case ' ', '\t', '\r', '\n', 0:
+			p.pos++
+		case '#':
+			for p.pos < len(p.data) && p.data[p.pos] != '\n' {
+				p.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+func isIdentChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+		c >= '0' && c <= '9' || strings.IndexByte("_.-+", c) >= 0
+}
+
+func (p *configParser) ident() string {
+	start := p.pos
+	for p.pos < len(p.data) && isIdentChar(p.data[p.pos]) {
+		p.pos++
+	}
+	return p.data[start:p.pos]
+}
+
+// section reads items up to the closing brace, or the end of the input for
+// the top-level section.
+func (p *configParser) section(name string) (*section, error) {
+	s := &section{name: name, values: make(map[string]any)}
+	for {
+		p.skip()
+		if p.pos >= len(p.data) {
+			if name != "" {
+				return nil, fmt.Errorf("unterminated section %s", name)
+			}
+			return s, nil
+		}
+		if p.data[p.pos] == '}' {
+			if name == "" {
+				return nil, fmt.Errorf("unexpected '}'")
+			}
+			p.pos++
+			return s, nil
+		}
+		key := p.ident()
+		if key == "" {
+			return nil, fmt.Errorf("unexpected '%c'", p.data[p.pos])
+		}
+		p.skip()
+		if p.pos >= len(p.data) {
+			return nil, fmt.Errorf("unexpected end of metadata")
+		}
+		switch p.data[p.pos] {
+		case '{':
+			p.pos++
+			sub, err := p.section(key)
+			if err != nil {
+				return nil, err
+			}
+			s.sections = append(s.sections, sub)
+		case '=':
+			p.pos++
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			s.values[key] = v
+		default:
+			return nil, fmt.Errorf("expected '=' or '{' after %s", key)
+		}
+	}
+}
+
+// value reads a string, integer or list of these.
+func (p *configParser) value() (any, error) {
+	p.skip()
+	if p.pos >= len(p.data) {
+		return nil, fmt.Errorf("unexpected end of metadata")
+	}
+	switch c := p.data[p.pos]; {
+	case c == '"':
+		p.pos++
+		var b strings.Builder
+		for {
+			if p.pos >= len(p.data) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			c := p.data[p.pos]
+			p.pos++
+			if c == '"' {
+				return b.String(), nil
+			}
+			if c == '\\' && p.pos < len(p.data) {
+				c = p.data[p.pos]
+				p.pos++
+			}
+			b.WriteByte(c)
+		}
+	case c == '[':
+		p.pos++
+		list := []any{}
+		for {
+			p.skip()
+			if p.pos < len(p.data) && p.data[p.pos] == ']' {
+				p.pos++
+				return list, nil
+			}
+			if len(list) > 0 {
+				if p.pos >= len(p.data) || p.data[p.pos] != ',' {
+					return nil, fmt.Errorf("expected ',' in list")
+				}
+				p.pos++
+			}
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+	}
+	word := p.ident()
+	v, err := strconv.ParseInt(word, 10, 64)
+	if err != nil {
+		// Floating point values only occur in settings of no interest
+		if _, ferr := strconv.ParseFloat(word, 64); ferr == nil {
+			return word, nil
+		}
+		return nil, fmt.Errorf("invalid value %q", word)
+	}
+	return v, nil
+}
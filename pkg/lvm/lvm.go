@@ -0,0 +1,437 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Package lvm reads the metadata of LVM2 physical volumes and maps logical
+// volumes with linear and striped segments onto them.
+package lvm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"sort"
+	"strings"
+)
+
+const (
+	labelMagic = "LABELONE"
+	labelType  = "LVM2 001"
+	mdaMagic   = " LVM2 x[5A%r0N*>"
+
+	// The label is in one of the first labelSectors sectors
+	sectorSize   = 512
+	labelSectors = 4
+
+	mdaHeaderSize = 512
+	initialCRC    = 0xf597a6cf
+)
+
+// ErrNotLVM is returned when there is no LVM2 label.
+var ErrNotLVM = errors.New("no LVM2 label")
+
+// VolumeGroup describes a volume group as recorded in the metadata of its
+// physical volumes.
+type VolumeGroup struct {
+	Name       string
+	UUID       string
+	Seqno      int64
+	ExtentSize uint64 // In bytes
+	PVs        []*PhysicalVolume
+	LVs        []*LogicalVolume
+}
+
+// PhysicalVolume is a physical volume of a volume group.
+type PhysicalVolume struct {
+	Name    string // In the metadata, like pv0
+	UUID    string
+	Device  string // Path when the metadata was written, a hint only
+	PEStart uint64 // Offset of the first extent in bytes
+	PECount uint64
+}
+
+// LogicalVolume is a logical volume made up of segments of extents.
+type LogicalVolume struct {
+	VG       *VolumeGroup
+	Name     string
+	UUID     string
+	Visible  bool // Hidden volumes are parts of others, like RAID images
+	Segments []Segment
+}
+
+// Segment maps a range of extents of a logical volume.
+type Segment struct {
+	StartExtent uint64
+	ExtentCount uint64
+	Type        string // Only striped segments can be read
+	StripeSize  uint64 // In bytes, if there is more than one stripe
+	Stripes     []Stripe
+}
+
+// Stripe is the extent range of a segment on one physical volume.
+type Stripe struct {
+	PV          *PhysicalVolume
+	StartExtent uint64
+}
+
+// LV returns the logical volume with the given name, or nil.
+func (vg *VolumeGroup) LV(name string) *LogicalVolume {
+	for _, lv := range vg.LVs {
+		if lv.Name == name {
+			return lv
+		}
+	}
+	return nil
+}
+
+// Size returns the size of the logical volume in bytes.
+func (lv *LogicalVolume) Size() uint64 {
+	var extents uint64
+	for _, s := range lv.Segments {
+		extents += s.ExtentCount
+	}
+	return extents * lv.VG.ExtentSize
+}
+
+// SegmentTypes returns the distinct types of the segments in order.
+func (lv *LogicalVolume) SegmentTypes() []string {
+	var types []string
+	for _, s := range lv.Segments {
+		t := s.Type
+		if t == "striped" && len(s.Stripes) == 1 {
+			t = "linear"
+		}
+		if len(types) == 0 || types[len(types)-1] != t {
+			types = append(types, t)
+		}
+	}
+	return types
+}
+
+// PVs returns the physical volumes the logical volume is stored on.
+func (lv *LogicalVolume) PVs() []*PhysicalVolume {
+	var pvs []*PhysicalVolume
+	seen := make(map[*PhysicalVolume]bool)
+	for _, s := range lv.Segments {
+		for _, st := range s.Stripes {
+			if !seen[st.PV] {
+				seen[st.PV] = true
+				pvs = append(pvs, st.PV)
+			}
+		}
+	}
+	return pvs
+}
+
+// calcCRC is the CRC32 variant of LVM2, which uses a different initial value
+// and no final inversion.
+func calcCRC(b []byte) uint32 {
+	return ^crc32.Update(^uint32(initialCRC), crc32.IEEETable, b)
+}
+
+// formatUUID inserts the dashes of the metadata form into a label UUID.
+func formatUUID(id string) string {
+	var b strings.Builder
+	for i, n := range []int{6, 4, 4, 4, 4, 4, 6} {
+		if i > 0 {
+			b.WriteByte('-')
+		}
+		if len(id) < n {
+			n = len(id)
+		}
+		b.WriteString(id[:n])
+		id = id[n:]
+	}
+	return b.String()
+}
+
+type diskLocation struct {
+	offset, size uint64
+}
+
+// readLabel returns the UUID of the physical volume in r and the locations of
+// its metadata areas.
+func readLabel(r io.ReaderAt) (string, []diskLocation, error) {
+	le := binary.LittleEndian
+	buf := make([]byte, sectorSize)
+	for sector := 0; sector < labelSectors; sector++ {
+		if n, err := r.ReadAt(buf, int64(sector*sectorSize)); n < len(buf) {
+			if sector == 0 {
+				return "", nil, fmt.Errorf("cannot read LVM2 label: %w", err)
+			}
+			break
+		}
+		if string(buf[:8]) != labelMagic || string(buf[24:32]) != labelType {
+			continue
+		}
+		if le.Uint64(buf[8:]) != uint64(sector) ||
+			le.Uint32(buf[16:]) != calcCRC(buf[20:]) {
+			return "", nil, fmt.Errorf("LVM2 label in sector %d has a bad "+
+				"checksum", sector)
+		}
+		hdr := buf[min(le.Uint32(buf[20:]), sectorSize):]
+		if len(hdr) < 40 {
+			return "", nil, fmt.Errorf("invalid LVM2 physical volume header")
+		}
+		uuid := formatUUID(string(hdr[:32]))
+		// Data areas and then metadata areas, each list terminated by an
+		// empty entry
+		var mdas []diskLocation
+		lists := 0
+		for i := 40; i+16 <= len(hdr) && lists < 2; i += 16 {
+			loc := diskLocation{le.Uint64(hdr[i:]), le.Uint64(hdr[i+8:])}
+			if loc.offset == 0 {
+				lists++
+			} else if lists == 1 {
+				mdas = append(mdas, loc)
+			}
+		}
+		return uuid, mdas, nil
+	}
+	return "", nil, ErrNotLVM
+}
+
+// readMetadata returns the metadata text of the metadata area at loc.
+func readMetadata(r io.ReaderAt, loc diskLocation) (string, error) {
+	le := binary.LittleEndian
+	hdr := make([]byte, mdaHeaderSize)
+	if n, err := r.ReadAt(hdr, int64(loc.offset)); n < len(hdr) {
+		return "", fmt.Errorf("cannot read LVM2 metadata area at %d: %w",
+			loc.offset, err)
+	}
+	if le.Uint32(hdr) != calcCRC(hdr[4:]) || string(hdr[4:20]) != mdaMagic ||
+		le.Uint32(hdr[20:]) != 1 || le.Uint64(hdr[24:]) != loc.offset {
+		return "", fmt.Errorf("invalid LVM2 metadata area at %d", loc.offset)
+	}
+	// The first raw location holds the current metadata in a circular
+	// buffer after the header
+	areaSize := le.Uint64(hdr[32:])
+	if areaSize != loc.size || areaSize <= mdaHeaderSize ||
+		loc.offset > math.MaxInt64-areaSize {
+		return "", fmt.Errorf("invalid size %d of LVM2 metadata area at %d",
+			areaSize, loc.offset)
+	}
+	off, size, crc := le.Uint64(hdr[40:]), le.Uint64(hdr[48:]),
+		le.Uint32(hdr[56:])
+	if size == 0 {
+		return "", fmt.Errorf("LVM2 metadata area at %d is empty", loc.offset)
+	}
+	if off < mdaHeaderSize || off >= areaSize ||
+		size > areaSize-mdaHeaderSize {
+		return "", fmt.Errorf("invalid LVM2 metadata location in area at %d",
+			loc.offset)
+	}
+	// Make sure the area is on the device before allocating for the text
+	if n, _ := r.ReadAt(hdr[:1], int64(loc.offset+areaSize-1)); n < 1 {
+		return "", fmt.Errorf("LVM2 metadata area at %d extends past the "+
+			"end of the device", loc.offset)
+	}
+	text := make([]byte, size)
+	first := min(size, areaSize-off)
+	if n, err := r.ReadAt(text[:first], int64(loc.offset+off)); n < int(
+		first) {
+		return "", fmt.Errorf("cannot read LVM2 metadata: %w", err)
+	}
+	if first < size {
+		if n, err := r.ReadAt(text[first:], int64(loc.offset+
+			mdaHeaderSize)); n < int(size-first) {
+			return "", fmt.Errorf("cannot read LVM2 metadata: %w", err)
+		}
+	}
+	if calcCRC(text) != crc {
+		return "", fmt.Errorf("LVM2 metadata in area at %d has a bad "+
+			"checksum", loc.offset)
+	}
+	return string(text), nil
+}
+
+// ReadVolumeGroup reads the label and metadata of the physical volume in r.
+// It returns the volume group and the physical volume that r holds. Of
+// several intact copies of the metadata, the newest is used.
+func ReadVolumeGroup(r io.ReaderAt) (*VolumeGroup, *PhysicalVolume, error) {
+	uuid, mdas, err := readLabel(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	var vg *VolumeGroup
+	err = fmt.Errorf("LVM2 physical volume %s has no metadata areas", uuid)
+	for _, loc := range mdas {
+		text, terr := readMetadata(r, loc)
+		if terr != nil {
+			err = terr
+			continue
+		}
+		g, perr := parseVolumeGroup(text)
+		if perr != nil {
+			err = perr
+			continue
+		}
+		if vg == nil || g.Seqno > vg.Seqno {
+			vg = g
+		}
+	}
+	if vg == nil {
+		return nil, nil, err
+	}
+	for _, pv := range vg.PVs {
+		if pv.UUID == uuid {
+			return vg, pv, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("physical volume %s is not in the metadata "+
+		"of volume group %s", uuid, vg.Name)
+}
+
+// parseVolumeGroup builds a volume group from metadata text.
+func parseVolumeGroup(text string) (*VolumeGroup, error) {
+	cfg, err := parseConfig(text)
+	if err != nil {
+		return nil, err
+	}
+	// The only section at the top level is the volume group
+	var s *section
+	for _, c := range cfg.sections {
+		if c.sub("physical_volumes") != nil {
+			s = c
+			break
+		}
+	}
+	if s == nil {
+		return nil, fmt.Errorf("no volume group in LVM2 metadata")
+	}
+	vg := &VolumeGroup{Name: s.name}
+	if vg.UUID, err = s.str("id"); err != nil {
+		return nil, err
+	}
+	if vg.Seqno, err = s.int("seqno"); err != nil {
+		return nil, err
+	}
+	extentSize, err := s.int("extent_size")
+	if err != nil {
+		return nil, err
+	}
+	if extentSize <= 0 {
+		return nil, fmt.Errorf("invalid extent size %d", extentSize)
+	}
+	vg.ExtentSize = uint64(extentSize) * sectorSize
+
+	pvs := make(map[string]*PhysicalVolume)
+	for _, p := range s.sub("physical_volumes").sections {
+		pv := &PhysicalVolume{Name: p.name}
+		if pv.UUID, err = p.str("id"); err != nil {
+			return nil, err
+		}
+		pv.Device, _ = p.str("device")
+		start, err := p.int("pe_start")
+		if err != nil {
+			return nil, err
+		}
+		count, err := p.int("pe_count")
+		if err != nil {
+			return nil, err
+		}
+		if start < 0 || count < 0 {
+			return nil, fmt.Errorf("%s: invalid extents", p.name)
+		}
+		pv.PEStart, pv.PECount = uint64(start)*sectorSize, uint64(count)
+		pvs[pv.Name] = pv
+		vg.PVs = append(vg.PVs, pv)
+	}
+
+	if lvs := s.sub("logical_volumes"); lvs != nil {
+		for _, l := range lvs.sections {
+			lv, err := parseLogicalVolume(l, pvs)
+			if err != nil {
+				return nil, err
+			}
+			lv.VG = vg
+			vg.LVs = append(vg.LVs, lv)
+		}
+	}
+	return vg, nil
+}
+
+func parseLogicalVolume(l *section, pvs map[string]*PhysicalVolume) (
+	*LogicalVolume, error) {
+	lv := &LogicalVolume{Name: l.name, Visible: l.hasFlag("status",
+		"VISIBLE")}
+	var err error
+	if lv.UUID, err = l.str("id"); err != nil {
+		return nil, err
+	}
+	for _, g := range l.sections {
+		if !strings.HasPrefix(g.name, "segment") {
+			continue
+		}
+		start, err := g.int("start_extent")
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", l.name, err)
+		}
+		count, err := g.int("extent_count")
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", l.name, err)
+		}
+		if start < 0 || count <= 0 {
+			return nil, fmt.Errorf("%s: invalid %s", l.name, g.name)
+		}
+		seg := Segment{StartExtent: uint64(start),
+			ExtentCount: uint64(count)}
+		if seg.Type, err = g.str("type"); err != nil {
+			return nil, fmt.Errorf("%s: %w", l.name, err)
+		}
+		if seg.Type == "striped" {
+			if err := parseStripes(&seg, g, pvs); err != nil {
+				return nil, fmt.Errorf("%s: %s: %w", l.name, g.name, err)
+			}
+		}
+		lv.Segments = append(lv.Segments, seg)
+	}
+	sort.Slice(lv.Segments, func(i, j int) bool {
+		return lv.Segments[i].StartExtent < lv.Segments[j].StartExtent
+	})
+	var next uint64
+	for _, s := range lv.Segments {
+		if s.StartExtent != next {
+			return nil, fmt.Errorf("%s: segments are not contiguous at "+
+				"extent %d", l.name, next)
+		}
+		next += s.ExtentCount
+	}
+	return lv, nil
+}
+
+// parseStripes reads the list of physical volume names and start extents
+// of a striped segment.
+func parseStripes(seg *Segment, g *section,
+	pvs map[string]*PhysicalVolume) error {
+	list := g.list("stripes")
+	if len(list) == 0 || len(list)%2 != 0 {
+		return fmt.Errorf("invalid stripes")
+	}
+	for i := 0; i < len(list); i += 2 {
+		name, _ := list[i].(string)
+		start, ok := list[i+1].(int64)
+		if pvs[name] == nil || !ok || start < 0 {
+			return fmt.Errorf("invalid stripe %d", i/2)
+		}
+		seg.Stripes = append(seg.Stripes, Stripe{pvs[name], uint64(start)})
+	}
+	n := uint64(len(seg.Stripes))
+	if n > 1 {
+		size, err := g.int("stripe_size")
+		if err != nil {
+			return err
+		}
+		if size <= 0 {
+			return fmt.Errorf("invalid stripe size %d", size)
+		}
+		if seg.ExtentCount%n != 0 {
+			return fmt.Errorf("%d extents do not divide into %d stripes",
+				seg.ExtentCount, n)
+		}
+		seg.StripeSize = uint64(size) * sectorSize
+	}
+	return nil
+}
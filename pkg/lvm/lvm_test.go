@@ -0,0 +1,279 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Tests for mapping LVM2 logical volumes
+
+package lvm
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+const (
+	testExtentSize = 4 << 10
+	testPEStart    = 64 << 10
+	testPECount    = 16
+	testMDAOffset  = 4096
+	testMDASize    = 60 << 10
+)
+
+const testMetadata = `vg0 {
+id = "Vw3D1z-aaaa-bbbb-cccc-dddd-eeee-ffffff"
+seqno = 7
+format = "lvm2" # informational
+status = ["RESIZEABLE", "READ", "WRITE"]
+flags = []
+extent_size = 8		# 4 Kilobytes
+max_lv = 0
+
+physical_volumes {
+
+pv0 {
+id = "AAAAAA-0000-0000-0000-0000-0000-000000"
+device = "/dev/sdb"	# Hint only
+status = ["ALLOCATABLE"]
+dev_size = 256
+pe_start = 128
+pe_count = 16
+}
+
+pv1 {
+id = "BBBBBB-1111-1111-1111-1111-1111-111111"
+device = "/dev/sdc"
+status = ["ALLOCATABLE"]
+dev_size = 256
+pe_start = 128
+pe_count = 16
+}
+}
+
+logical_volumes {
+
+data {
+id = "lv0000-0000-0000-0000-0000-0000-000000"
+status = ["READ", "WRITE", "VISIBLE"]
+flags = []
+segment_count = 2
+
+segment2 {
+start_extent = 2
+extent_count = 2
+type = "striped"
+stripe_count = 1	# linear
+stripes = [
+"pv0", 1
+]
+}
+segment1 {
+start_extent = 0
+extent_count = 2
+type = "striped"
+stripe_count = 1	# linear
+stripes = [
+"pv0", 5
+]
+}
+}
+
+wide {
+id = "lv1111-1111-1111-1111-1111-1111-111111"
+status = ["READ", "WRITE", "VISIBLE"]
+segment_count = 1
+
+segment1 {
+start_extent = 0
+extent_count = 4
+type = "striped"
+stripe_count = 2
+stripe_size = 2
+stripes = [
+"pv0", 8,
+"pv1", 0
+]
+}
+}
+
+pool {
+id = "lv2222-2222-2222-2222-2222-2222-222222"
+status = ["READ", "WRITE"]
+segment_count = 1
+
+segment1 {
+start_extent = 0
+extent_count = 1
+type = "thin-pool"
+}
+}
+}
+}
+# Generated by LVM2
+contents = "Text Format Volume Group"
+version = 1
+description = "Created *after* executing 'vgcreate \"vg0\"'"
+creation_time = 1700000000
+`
+
+// makePV returns a physical volume image with the label in sector 1 and the
+// metadata at textOffset in its metadata area, possibly wrapping around.
+func makePV(uuid string, textOffset int) []byte {
+	le := binary.LittleEndian
+	pv := make([]byte, testPEStart+testPECount*testExtentSize)
+	label := pv[sectorSize : 2*sectorSize]
+	copy(label, labelMagic)
+	le.PutUint64(label[8:], 1)
+	le.PutUint32(label[20:], 32)
+	copy(label[24:], labelType)
+	hdr := label[32:]
+	copy(hdr, strings.ReplaceAll(uuid, "-", ""))
+	le.PutUint64(hdr[32:], uint64(len(pv)))
+	le.PutUint64(hdr[40:], testPEStart)
+	le.PutUint64(hdr[72:], testMDAOffset)
+	le.PutUint64(hdr[80:], testMDASize)
+	le.PutUint32(label[16:], calcCRC(label[20:]))
+
+	text := []byte(testMetadata + "\x00")
+	mda := pv[testMDAOffset : testMDAOffset+testMDASize]
+	first := copy(mda[textOffset:], text)
+	copy(mda[mdaHeaderSize:], text[first:])
+	copy(mda[4:], mdaMagic)
+	le.PutUint32(mda[20:], 1)
+	le.PutUint64(mda[24:], testMDAOffset)
+	le.PutUint64(mda[32:], testMDASize)
+	le.PutUint64(mda[40:], uint64(textOffset))
+	le.PutUint64(mda[48:], uint64(len(text)))
+	le.PutUint32(mda[56:], calcCRC(text))
+	le.PutUint32(mda, calcCRC(mda[4:mdaHeaderSize]))
+	return pv
+}
+
+// checkLV compares the contents of the logical volume with expected.
+func checkLV(t *testing.T, r *Reader, expected []byte) {
+	if r.Size() != int64(len(expected)) {
+		t.Fatalf("expected size %d, got %d", len(expected), r.Size())
+	}
+	// Reads that cross extent and stripe boundaries
+	buf := make([]byte, 700)
+	for off := 0; off < len(expected); off += len(buf) {
+		n, err := r.ReadAt(buf, int64(off))
+		if err != nil && !(err == io.EOF && off+n == len(expected)) {
+			t.Fatalf("read at %d: %v", off, err)
+		}
+		if !bytes.Equal(buf[:n], expected[off:off+n]) {
+			t.Fatalf("unexpected data at %d", off)
+		}
+	}
+}
+
+func TestLogicalVolumes(t *testing.T) {
+	pv0 := makePV("AAAAAA-0000-0000-0000-0000-0000-000000", mdaHeaderSize)
+	pv1 := makePV("BBBBBB-1111-1111-1111-1111-1111-111111", testMDASize-100)
+
+	vg, pv, err := ReadVolumeGroup(bytes.NewReader(pv1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vg.Name != "vg0" || vg.Seqno != 7 || vg.ExtentSize != testExtentSize ||
+		pv.Name != "pv1" || pv.PEStart != testPEStart || len(vg.LVs) != 3 {
+		t.Fatalf("unexpected volume group %+v, physical volume %+v", vg, pv)
+	}
+	pool := vg.LV("pool")
+	if pool.Visible || fmt.Sprint(pool.SegmentTypes()) != "[thin-pool]" {
+		t.Errorf("unexpected logical volume %+v", pool)
+	}
+	if _, err := NewReader(pool, nil); err == nil {
+		t.Errorf("expected an error for a thin pool")
+	}
+	devices := map[string]io.ReaderAt{
+		"AAAAAA-0000-0000-0000-0000-0000-000000": bytes.NewReader(pv0),
+		"BBBBBB-1111-1111-1111-1111-1111-111111": bytes.NewReader(pv1),
+	}
+	extent := func(pv []byte, n int) []byte {
+		return pv[testPEStart+n*testExtentSize:][:testExtentSize]
+	}
+
+	// Linear segments, out of order on disk
+	data := vg.LV("data")
+	if !data.Visible || fmt.Sprint(data.SegmentTypes()) != "[linear]" ||
+		len(data.PVs()) != 1 {
+		t.Errorf("unexpected logical volume %+v", data)
+	}
+	expected := make([]byte, 4*testExtentSize)
+	rand.Read(expected)
+	for i, pe := range []int{5, 6, 1, 2} {
+		copy(extent(pv0, pe), expected[i*testExtentSize:])
+	}
+	r, err := NewReader(data, devices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLV(t, r, expected)
+
+	// Two stripes of 1 KiB each
+	wide := vg.LV("wide")
+	rand.Read(expected)
+	for i := 0; i < len(expected)/1024; i++ {
+		pv, pe := pv0, 8
+		if i%2 == 1 {
+			pv, pe = pv1, 0
+		}
+		copy(pv[testPEStart+pe*testExtentSize+i/2*1024:],
+			expected[i*1024:(i+1)*1024])
+	}
+	r, err = NewReader(wide, devices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLV(t, r, expected)
+
+	// Reads stop where a physical volume is missing
+	delete(devices, "BBBBBB-1111-1111-1111-1111-1111-111111")
+	if r, err = NewReader(wide, devices); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2048)
+	if n, err := r.ReadAt(buf, 0); n != 1024 || err == nil {
+		t.Errorf("expected a partial read, got %d, %v", n, err)
+	}
+}
+
+func TestReadVolumeGroupErrors(t *testing.T) {
+	_, _, err := ReadVolumeGroup(bytes.NewReader(make([]byte, 1<<20)))
+	if !errors.Is(err, ErrNotLVM) {
+		t.Errorf("expected ErrNotLVM, got %v", err)
+	}
+	pv := makePV("AAAAAA-0000-0000-0000-0000-0000-000000", mdaHeaderSize)
+	pv[testMDAOffset+mdaHeaderSize+10] ^= 1
+	if _, _, err := ReadVolumeGroup(bytes.NewReader(pv)); err == nil ||
+		!strings.Contains(err.Error(), "checksum") {
+		t.Errorf("expected a checksum error, got %v", err)
+	}
+
+	// Sizes that do not fit the device
+	le := binary.LittleEndian
+	for _, tc := range []struct {
+		labelSize, areaSize, textSize uint64
+	}{
+		{testMDASize, 1 << 62, 1 << 55},
+		{1 << 62, 1 << 62, 1 << 55},
+	} {
+		pv := makePV("AAAAAA-0000-0000-0000-0000-0000-000000", mdaHeaderSize)
+		label := pv[sectorSize : 2*sectorSize]
+		le.PutUint64(label[32+80:], tc.labelSize)
+		le.PutUint32(label[16:], calcCRC(label[20:]))
+		mda := pv[testMDAOffset:]
+		le.PutUint64(mda[32:], tc.areaSize)
+		le.PutUint64(mda[48:], tc.textSize)
+		le.PutUint32(mda, calcCRC(mda[4:mdaHeaderSize]))
+		if _, _, err := ReadVolumeGroup(bytes.NewReader(pv)); err == nil {
+			t.Errorf("area size %d, text size %d: expected an error",
+				tc.areaSize, tc.textSize)
+		}
+	}
+}
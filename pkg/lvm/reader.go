@@ -0,0 +1,100 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Reading logical volumes from their physical volumes
+
+package lvm
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Reader reads the contents of a logical volume.
+type Reader struct {
+	lv   *LogicalVolume
+	pvs  map[*PhysicalVolume]io.ReaderAt
+	size int64
+}
+
+// NewReader returns a reader for the logical volume. devices maps the UUIDs
+// of physical volumes to their contents. Reads from the parts of the
+// logical volume on physical volumes not in devices fail.
+func NewReader(lv *LogicalVolume, devices map[string]io.ReaderAt) (*Reader,
+	error) {
+	for _, s := range lv.Segments {
+		if s.Type != "striped" {
+			return nil, fmt.Errorf("logical volume %s/%s has a %s segment, "+
+				"only linear and striped ones are supported", lv.VG.Name,
+				lv.Name, s.Type)
+		}
+	}
+	r := &Reader{lv: lv, pvs: make(map[*PhysicalVolume]io.ReaderAt),
+		size: int64(lv.Size())}
+	for _, pv := range lv.PVs() {
+		if d, ok := devices[pv.UUID]; ok {
+			r.pvs[pv] = d
+		}
+	}
+	return r, nil
+}
+
+// Size returns the size of the logical volume.
+func (r *Reader) Size() int64 { return r.size }
+
+// locate returns the physical volume and offset on it that store the byte
+// at off, along with the number of bytes stored contiguously from there.
+func (r *Reader) locate(off uint64) (*PhysicalVolume, uint64, uint64) {
+	es := r.lv.VG.ExtentSize
+	segs := r.lv.Segments
+	i := sort.Search(len(segs), func(i int) bool {
+		return (segs[i].StartExtent+segs[i].ExtentCount)*es > off
+	})
+	s := &segs[i]
+	inner := off - s.StartExtent*es
+	if len(s.Stripes) == 1 {
+		st := s.Stripes[0]
+		return st.PV, st.PV.PEStart + st.StartExtent*es + inner,
+			s.ExtentCount*es - inner
+	}
+	// Chunks of the stripe size go round-robin to the stripes
+	n := uint64(len(s.Stripes))
+	chunk, within := inner/s.StripeSize, inner%s.StripeSize
+	st := s.Stripes[chunk%n]
+	return st.PV, st.PV.PEStart + st.StartExtent*es +
+		chunk/n*s.StripeSize + within, s.StripeSize - within
+}
+
+// ReadAt implements io.ReaderAt.
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	var eof error
+	if off+int64(len(p)) > r.size {
+		p, eof = p[:r.size-off], io.EOF
+	}
+	read := 0
+	for read < len(p) {
+		pv, pvOff, avail := r.locate(uint64(off) + uint64(read))
+		d := r.pvs[pv]
+		if d == nil {
+			return read, fmt.Errorf("physical volume %s (%s) of %s/%s is "+
+				"missing", pv.Name, pv.UUID, r.lv.VG.Name, r.lv.Name)
+		}
+		chunk := p[read:min(len(p), read+int(min(avail, uint64(len(p)))))]
+		n, err := d.ReadAt(chunk, int64(pvOff))
+		read += n
+		if n < len(chunk) {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return read, err
+		}
+	}
+	return read, eof
+}
@@ -0,0 +1,312 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Package partition reads GPT and MBR partition tables of disk images.
+package partition
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+	"unicode/utf16"
+
+	"blichmann.eu/code/btrfscue/pkg/uuid"
+)
+
+// Partitioning schemes
+const (
+	SchemeGPT = "gpt"
+	SchemeMBR = "mbr"
+)
+
+// ErrNoTable is returned if a disk image has no partition table.
+var ErrNoTable = errors.New("no partition table")
+
+// Partition is an entry of a partition table.
+type Partition struct {
+	Number      int    // As numbered by Linux, starting at 1
+	Start, Size uint64 // In bytes
+	Type        string // Partition type in human readable form
+	Name        string // Partition name, GPT only
+}
+
+// Table is the partition table of a disk image.
+type Table struct {
+	Scheme     string
+	SectorSize uint64
+	Partitions []Partition
+}
+
+// Partition returns the partition with the given number.
+func (t *Table) Partition(number int) (Partition, bool) {
+	for _, p := range t.Partitions {
+		if p.Number == number {
+			return p, true
+		}
+	}
+	return Partition{}, false
+}
+
+// Read reads the partition table of a disk image of the given size. A GPT
+// takes precedence over the protective MBR in front of it. If the primary
+// GPT header is damaged, the backup at the end of the disk is used. Returns
+// ErrNoTable if there is neither.
+func Read(r io.ReaderAt, size uint64) (*Table, error) {
+	mbr := make([]byte, 512)
+	if _, err := r.ReadAt(mbr, 0); err != nil {
+		if err == io.EOF {
+			return nil, ErrNoTable
+		}
+		return nil, err
+	}
+	for _, ss := range []uint64{512, 4096} {
+		t, err := readGPT(r, size, ss)
+		if err != nil || t != nil {
+			return t, err
+		}
+	}
+	if isProtectiveMBR(mbr) {
+		return nil, fmt.Errorf("protective MBR, but no valid GPT")
+	}
+	return readMBR(r, size, mbr)
+}
+
+const gptSignature = "EFI PART"
+
+// readGPT reads a GPT for the sector size ss. Returns nil if there is none.
+func readGPT(r io.ReaderAt, size, ss uint64) (*Table, error) {
+	if size < 3*ss {
+		return nil, nil
+	}
+	for _, lba := range []uint64{1, size/ss - 1} {
+		hdr := make([]byte, ss)
+		if _, err := r.ReadAt(hdr, int64(lba*ss)); err != nil {
+			return nil, err
+		}
+		parts, ok, err := parseGPT(r, hdr, size, ss)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return &Table{SchemeGPT, ss, parts}, nil
+		}
+	}
+	return nil, nil
+}
+
+// parseGPT parses the partition entries of the GPT with header hdr. Returns
+// false if the header or the entries are invalid.
+func parseGPT(r io.ReaderAt, hdr []byte, size, ss uint64) ([]Partition,
+	bool, error) {
+	le := binary.LittleEndian
+	if string(hdr[:8]) != gptSignature {
+		return nil, false, nil
+	}
+	hdrSize := le.Uint32(hdr[12:])
+	if hdrSize < 92 || uint64(hdrSize) > ss {
+		return nil, false, nil
+	}
+	check := append([]byte(nil), hdr[:hdrSize]...)
+	le.PutUint32(check[16:], 0)
+	if crc32.ChecksumIEEE(check) != le.Uint32(hdr[16:]) {
+		return nil, false, nil
+	}
+	entriesLBA := le.Uint64(hdr[72:])
+	numEntries := uint64(le.Uint32(hdr[80:]))
+	entrySize := uint64(le.Uint32(hdr[84:]))
+	if entrySize < 128 || numEntries > 1024 ||
+		entriesLBA*ss+numEntries*entrySize > size {
+		return nil, false, nil
+	}
+	entries := make([]byte, numEntries*entrySize)
+	if _, err := r.ReadAt(entries, int64(entriesLBA*ss)); err != nil {
+		return nil, false, err
+	}
+	if crc32.ChecksumIEEE(entries) != le.Uint32(hdr[88:]) {
+		return nil, false, nil
+	}
+	var parts []Partition
+	for i := uint64(0); i < numEntries; i++ {
+		e := entries[i*entrySize : (i+1)*entrySize]
+		typeGUID := uuid.FromMixedEndian(e[0:16])
+		if typeGUID.IsZero() {
+			continue
+		}
+		first, last := le.Uint64(e[32:]), le.Uint64(e[40:])
+		if last < first {
+			continue
+		}
+		parts = append(parts, Partition{
+			Number: int(i) + 1,
+			Start:  first * ss,
+			Size:   (last - first + 1) * ss,
+			Type:   gptTypeString(typeGUID),
+			Name:   gptName(e[56:128]),
+		})
+	}
+	return parts, true, nil
+}
+
+// gptName decodes a UTF-16LE partition name.
+func gptName(b []byte) string {
+	var u []uint16
+	for i := 0; i+1 < len(b); i += 2 {
+		c := binary.LittleEndian.Uint16(b[i:])
+		if c == 0 {
+			break
+		}
+		u = append(u, c)
+	}
+	return string(utf16.Decode(u))
+}
+
+var gptTypes = map[string]string{
+	"c12a7328-f81f-11d2-ba4b-00a0c93ec93b": "EFI system",
+	"21686148-6449-6e6f-744e-656564454649": "BIOS boot",
+	"0fc63daf-8483-4772-8e79-3d69d8477de4": "Linux filesystem",
+	"4f68bce3-e8cd-4db1-96e7-fbcaf984b709": "Linux root (x86-64)",
+	"933ac7e1-2eb4-4f13-b844-0e14e2aef915": "Linux home",
+	"0657fd6d-a4ab-43c4-84e5-0933c84b4f4f": "Linux swap",
+	"e6d6d379-f507-44c2-a23c-238f2a3df928": "Linux LVM",
+	"a19d880f-05fc-4d3b-a006-743f0f84911e": "Linux RAID",
+	"ca7d7ccb-63ed-4c53-861c-1742536059cc": "Linux LUKS",
+	"ebd0a0a2-b9e5-4433-87c0-68b6b72699c7": "Microsoft basic data",
+	"e3c9e316-0b5c-4db8-817d-f92df00215ae": "Microsoft reserved",
+}
+
+func gptTypeString(u uuid.UUID) string {
+	if s, ok := gptTypes[u.String()]; ok {
+		return s
+	}
+	return u.String()
+}
+
+const (
+	mbrEntries   = 446
+	mbrEntrySize = 16
+
+	mbrTypeGPT = 0xee
+)
+
+func isProtectiveMBR(mbr []byte) bool {
+	return mbr[510] == 0x55 && mbr[511] == 0xaa &&
+		mbr[mbrEntries+4] == mbrTypeGPT
+}
+
+func isExtended(t byte) bool { return t == 0x05 || t == 0x0f || t == 0x85 }
+
+var mbrTypes = map[byte]string{
+	0x07: "NTFS/exFAT",
+	0x0b: "FAT32",
+	0x0c: "FAT32 (LBA)",
+	0x82: "Linux swap",
+	0x83: "Linux",
+	0x8e: "Linux LVM",
+	0xef: "EFI system",
+	0xfd: "Linux RAID",
+}
+
+func mbrTypeString(t byte) string {
+	if s, ok := mbrTypes[t]; ok {
+		return s
+	}
+	return fmt.Sprintf("0x%02x", t)
+}
+
+// mbrEntry is a partition entry of an MBR or EBR, in sectors.
+type mbrEntry struct {
+	status, typ  byte
+	start, count uint64
+}
+
+func parseMBREntries(sector []byte) ([4]mbrEntry, bool) {
+	var entries [4]mbrEntry
+	if sector[510] != 0x55 || sector[511] != 0xaa {
+		return entries, false
+	}
+	for i := range entries {
+		e := sector[mbrEntries+i*mbrEntrySize:]
+		entries[i] = mbrEntry{e[0], e[4],
+			uint64(binary.LittleEndian.Uint32(e[8:])),
+			uint64(binary.LittleEndian.Uint32(e[12:]))}
+		if entries[i].status != 0 && entries[i].status != 0x80 {
+			return entries, false // Probably a boot sector, not an MBR
+		}
+	}
+	return entries, true
+}
+
+// readMBR reads the primary partitions of an MBR and the logical partitions
+// in the chain of EBRs of its extended partition, if any.
+func readMBR(r io.ReaderAt, size uint64, mbr []byte) (*Table, error) {
+	const ss = 512
+	primary, ok := parseMBREntries(mbr)
+	if !ok {
+		return nil, ErrNoTable
+	}
+	t := &Table{Scheme: SchemeMBR, SectorSize: ss}
+	var extStart, extSize uint64
+	for i, e := range primary {
+		if e.typ == 0 || e.count == 0 {
+			continue
+		}
+		if (e.start+e.count)*ss > size {
+			return nil, ErrNoTable
+		}
+		if isExtended(e.typ) {
+			if extStart == 0 {
+				extStart, extSize = e.start, e.count
+			}
+			continue
+		}
+		t.Partitions = append(t.Partitions, Partition{Number: i + 1,
+			Start: e.start * ss, Size: e.count * ss,
+			Type: mbrTypeString(e.typ)})
+	}
+	if len(t.Partitions) == 0 && extStart == 0 {
+		return nil, ErrNoTable
+	}
+
+	// Logical partitions are numbered from 5 on
+	number := 5
+	sector := make([]byte, ss)
+	ebr := extStart
+	for seen := 0; ebr != 0 && seen < 128; seen++ {
+		if _, err := r.ReadAt(sector, int64(ebr*ss)); err != nil {
+			return t, err
+		}
+		entries, ok := parseMBREntries(sector)
+		if !ok {
+			return t, fmt.Errorf("invalid extended boot record at sector %d",
+				ebr)
+		}
+		if e := entries[0]; e.typ != 0 && e.count != 0 {
+			t.Partitions = append(t.Partitions, Partition{Number: number,
+				Start: (ebr + e.start) * ss, Size: e.count * ss,
+				Type: mbrTypeString(e.typ)})
+			number++
+		}
+		// The next EBR is relative to the start of the extended partition
+		next := entries[1]
+		if !isExtended(next.typ) || next.start == 0 ||
+			next.start >= extSize {
+			break
+		}
+		ebr = extStart + next.start
+	}
+	return t, nil
+}
+
+// String returns a description of the partition for messages.
+func (p Partition) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "partition %d (%s", p.Number, p.Type)
+	if p.Name != "" {
+		fmt.Fprintf(&b, ", %q", p.Name)
+	}
+	b.WriteString(")")
+	return b.String()
+}
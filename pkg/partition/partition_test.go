@@ -0,0 +1,128 @@
+// Copyright btrfscue authors
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Tests for partition table parsing
+
+package partition
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"reflect"
+	"testing"
+	"unicode/utf16"
+)
+
+const testDiskSize = 1 << 20
+
+func putMBREntry(sector []byte, i int, typ byte, start, count uint32) {
+	e := sector[mbrEntries+i*mbrEntrySize:]
+	e[4] = typ
+	binary.LittleEndian.PutUint32(e[8:], start)
+	binary.LittleEndian.PutUint32(e[12:], count)
+	sector[510], sector[511] = 0x55, 0xaa
+}
+
+// putGPT writes a GPT header at lba with its entries at entriesLBA.
+func putGPT(disk []byte, lba, entriesLBA uint64, entries []byte) {
+	le := binary.LittleEndian
+	copy(disk[entriesLBA*512:], entries)
+	hdr := disk[lba*512 : lba*512+92]
+	copy(hdr, gptSignature)
+	le.PutUint32(hdr[12:], 92)
+	le.PutUint64(hdr[72:], entriesLBA)
+	le.PutUint32(hdr[80:], uint32(len(entries)/128))
+	le.PutUint32(hdr[84:], 128)
+	le.PutUint32(hdr[88:], crc32.ChecksumIEEE(entries))
+	le.PutUint32(hdr[16:], crc32.ChecksumIEEE(hdr))
+}
+
+func makeGPTDisk() []byte {
+	le := binary.LittleEndian
+	disk := make([]byte, testDiskSize)
+	putMBREntry(disk, 0, mbrTypeGPT, 1, testDiskSize/512-1)
+	entries := make([]byte, 4*128)
+	// Linux filesystem, mixed-endian GUID 0fc63daf-8483-4772-...
+	copy(entries[128:], []byte{0xaf, 0x3d, 0xc6, 0x0f, 0x83, 0x84, 0x72,
+		0x47, 0x8e, 0x79, 0x3d, 0x69, 0xd8, 0x47, 0x7d, 0xe4})
+	le.PutUint64(entries[128+32:], 64)
+	le.PutUint64(entries[128+40:], 1023)
+	for i, c := range utf16.Encode([]rune("data")) {
+		le.PutUint16(entries[128+56+2*i:], c)
+	}
+	putGPT(disk, 1, 2, entries)
+	putGPT(disk, testDiskSize/512-1, testDiskSize/512-5, entries)
+	return disk
+}
+
+func TestReadGPT(t *testing.T) {
+	disk := makeGPTDisk()
+	expected := &Table{SchemeGPT, 512, []Partition{
+		{Number: 2, Start: 64 * 512, Size: 960 * 512,
+			Type: "Linux filesystem", Name: "data"},
+	}}
+	tab, err := Read(bytes.NewReader(disk), testDiskSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tab, expected) {
+		t.Errorf("%v vs %v", expected, tab)
+	}
+
+	// Damaged primary header, the backup is used
+	disk[512+24]++
+	if tab, err = Read(bytes.NewReader(disk), testDiskSize); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tab, expected) {
+		t.Errorf("%v vs %v", expected, tab)
+	}
+
+	// Both damaged
+	disk[len(disk)-512+24]++
+	if _, err = Read(bytes.NewReader(disk), testDiskSize); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestReadMBR(t *testing.T) {
+	disk := make([]byte, testDiskSize)
+	putMBREntry(disk, 0, 0x83, 8, 100)
+	putMBREntry(disk, 1, 0x05, 200, 1000)
+	// First logical partition, then a link to the second EBR
+	ebr := disk[200*512:]
+	putMBREntry(ebr, 0, 0x83, 2, 300)
+	putMBREntry(ebr, 1, 0x05, 400, 500)
+	ebr = disk[600*512:]
+	putMBREntry(ebr, 0, 0x8e, 4, 100)
+
+	tab, err := Read(bytes.NewReader(disk), testDiskSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &Table{SchemeMBR, 512, []Partition{
+		{Number: 1, Start: 8 * 512, Size: 100 * 512, Type: "Linux"},
+		{Number: 5, Start: 202 * 512, Size: 300 * 512, Type: "Linux"},
+		{Number: 6, Start: 604 * 512, Size: 100 * 512, Type: "Linux LVM"},
+	}}
+	if !reflect.DeepEqual(tab, expected) {
+		t.Errorf("%v vs %v", expected, tab)
+	}
+	if p, ok := tab.Partition(6); !ok || p.Start != 604*512 {
+		t.Errorf("unexpected partition 6: %v", p)
+	}
+}
+
+func TestReadNoTable(t *testing.T) {
+	disk := make([]byte, testDiskSize)
+	if _, err := Read(bytes.NewReader(disk), testDiskSize); err != ErrNoTable {
+		t.Errorf("expected ErrNoTable, got %v", err)
+	}
+	// Boot sector signature, but no valid entries
+	disk[510], disk[511] = 0x55, 0xaa
+	disk[mbrEntries] = 0x12
+	if _, err := Read(bytes.NewReader(disk), testDiskSize); err != ErrNoTable {
+		t.Errorf("expected ErrNoTable, got %v", err)
+	}
+}
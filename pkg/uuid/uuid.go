@@ -66,3 +66,15 @@ func New(value string) (UUID, error) {
 	err := u.Set(value)
 	return u, err
 }
+
+// FromMixedEndian returns the UUID of a GUID as stored by Microsoft tools,
+// e.g. in GPTs and VHDX images, with its first three fields in little endian
+// byte order.
+func FromMixedEndian(b []byte) UUID {
+	var u UUID
+	copy(u[:], b)
+	u[0], u[1], u[2], u[3] = b[3], b[2], b[1], b[0]
+	u[4], u[5] = b[5], b[4]
+	u[6], u[7] = b[7], b[6]
+	return u
+}
@@ -82,3 +82,11 @@ func TestFlag(t *testing.T) {
 		t.Fatalf("expected string, got: %s", ty)
 	}
 }
+
+func TestFromMixedEndian(t *testing.T) {
+	b := []byte{0x96, 0x18, 0x00, 0x7d, 0x2d, 0x6b, 0xc7, 0x44, 0xbb, 0x8a,
+		0xb5, 0xe8, 0x60, 0x1e, 0x8a, 0x7a}
+	if u := FromMixedEndian(b); u != expected {
+		t.Fatalf("expected %s, got: %s", expected, u)
+	}
+}